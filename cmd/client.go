@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/soarinferret/mcc/internal/config"
+	"github.com/soarinferret/mcc/pkg/meshcentral"
+)
+
+// client is the connection to the server of the active profile, opened by
+// connect
+var client *meshcentral.Client
+
+// connect logs in with the default profile, the process exits when that
+// fails. The client logs to stderr.
+func connect(opts meshcentral.Options) {
+	p := config.GetDefaultProfile()
+	opts.Server = p.Server
+	opts.Username = p.Username
+	opts.Password = p.Password
+	opts.Logger = log.New(os.Stderr, "", 0)
+	if p.Insecure {
+		opts.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	c, err := meshcentral.Connect(context.Background(), opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect to server: %v\n", err)
+		var certErr *tls.CertificateVerificationError
+		if errors.As(err, &certErr) {
+			fmt.Fprintf(os.Stderr, "Set \"insecure\": true in profile %s if the server has a self-signed certificate\n", p.Name)
+		}
+		os.Exit(1)
+	}
+	client = c
+}
+
+// listDevices returns the devices of the server, the process exits when the
+// connection is lost
+func listDevices() []meshcentral.Device {
+	devices, err := client.Devices()
+	if err != nil {
+		pExit("Unable to list devices:", err)
+	}
+	return devices
+}
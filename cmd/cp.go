@@ -0,0 +1,322 @@
+package cmd
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"github.com/soarinferret/mcc/internal/config"
+	"github.com/soarinferret/mcc/pkg/meshcentral"
+)
+
+var cpCmd = &cobra.Command{
+	Use:   "cp [-r] <src> <dst>",
+	Short: "Copy files to or from a node",
+	Long: `Copies files over the MeshCentral files tunnel, no ssh server needed on the node.
+One side must be remote, written as node:path where node is a node id or device
+name. Leave the node out (:path) to use --nodeid or pick the device interactively.
+
+  mcc cp ./app.conf web01:/etc/app/
+  mcc cp -r "node//abc...:C:/Users/admin/logs" ./logs`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		nodeID, _ := cmd.Flags().GetString("nodeid")
+		debug, _ := cmd.Flags().GetBool("debug")
+		recursive, _ := cmd.Flags().GetBool("recursive")
+		retries, _ := cmd.Flags().GetInt("retries")
+		noVerify, _ := cmd.Flags().GetBool("no-verify")
+		limitRate, _ := cmd.Flags().GetString("limit-rate")
+
+		rate, err := config.ParseRate(limitRate)
+		if err != nil {
+			pExit("Invalid arguments:", err)
+		}
+
+		srcNode, srcPath, srcRemote := parseCopyTarget(args[0])
+		dstNode, dstPath, dstRemote := parseCopyTarget(args[1])
+		if srcRemote == dstRemote {
+			pExit("Invalid arguments:", errors.New("exactly one of source and destination must be remote (node:path)"))
+		}
+
+		node := srcNode
+		if dstRemote {
+			node = dstNode
+		}
+
+		connect(meshcentral.Options{Debug: debug})
+		defer client.Close()
+
+		nodeID = resolveNode(node, nodeID)
+
+		c := &copier{nodeID: nodeID, retries: retries, verify: !noVerify, recursive: recursive}
+		if rate > 0 {
+			c.rate = meshcentral.NewRateLimit(rate, false)
+		}
+		c.connect()
+		defer func() { c.files.Close() }()
+
+		if dstRemote {
+			err = c.upload(srcPath, dstPath)
+		} else {
+			err = c.download(srcPath, dstPath)
+		}
+		if err != nil {
+			c.files.Close()
+			client.Close()
+			pExit("Copy failed:", err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cpCmd)
+
+	cpCmd.Flags().StringP("nodeid", "i", "", "Mesh Central Node ID (for :path arguments)")
+	cpCmd.Flags().BoolP("recursive", "r", false, "Copy directories recursively")
+	cpCmd.Flags().Int("retries", 2, "Number of times a failed file is copied again from the start")
+	cpCmd.Flags().Bool("no-verify", false, "Skip the checksum comparison after each file")
+	cpCmd.Flags().String("limit-rate", "", "Limit the bandwidth in each direction, e.g. 512K or 2M (bytes per second)")
+	cpCmd.Flags().BoolP("debug", "", false, "Enable debug logging")
+}
+
+// parseCopyTarget splits node:path, local windows paths like C:\x stay local
+func parseCopyTarget(s string) (node string, path string, remote bool) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return "", s, false
+	}
+	if i == 1 && (len(s) == 2 || s[2] == '\\' || s[2] == '/') {
+		return "", s, false
+	}
+	return s[:i], s[i+1:], true
+}
+
+// resolveNode turns a node id or device name into a node id, falling back to
+// the --nodeid flag and then to the interactive search
+func resolveNode(node string, nodeID string) string {
+	if node == "" {
+		node = nodeID
+	}
+	if node == "" {
+		devices := listDevices()
+		filterAndSortDevices(&devices)
+		return searchDevices(&devices)
+	}
+
+	device, err := client.FindDevice(node)
+	if err != nil {
+		client.Close()
+		pExit("Unable to find node:", err)
+	}
+	return device.Id
+}
+
+type copier struct {
+	nodeID    string
+	files     *meshcentral.FileSession
+	retries   int
+	verify    bool
+	recursive bool
+	noHash    bool
+	rate      *meshcentral.RateLimit
+}
+
+func (c *copier) connect() {
+	files, err := client.OpenFiles(c.nodeID)
+	if err != nil {
+		client.Close()
+		pExit("Unable to open files session:", err)
+	}
+	c.files = files
+}
+
+// retry runs fn until it succeeds, reopening the files session in between
+func (c *copier) retry(name string, fn func() error) error {
+	var err error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			pterm.Warning.Printf("Copying %s failed (%v), retrying\n", name, err)
+			c.files.Close()
+			files, ferr := client.OpenFiles(c.nodeID)
+			if ferr != nil {
+				err = ferr
+				continue
+			}
+			c.files = files
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// checkHash compares a local SHA-384 with the one the agent computes
+func (c *copier) checkHash(dir string, name string, local hash.Hash) error {
+	if !c.verify || c.noHash {
+		return nil
+	}
+
+	remote, err := c.files.Hash(dir, name)
+	if err == meshcentral.ErrHashUnsupported {
+		pterm.Warning.Println("Agent does not support file hashes, skipping verification")
+		c.noHash = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(local.Sum(nil)); sum != remote {
+		return fmt.Errorf("checksum mismatch for %s", name)
+	}
+	return nil
+}
+
+func (c *copier) upload(src string, dst string) error {
+	st, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	// copy into dst when it is an existing directory, otherwise copy to dst
+	dir, name := meshcentral.SplitRemotePath(dst)
+	if entry, err := c.files.Stat(dst); err == nil && entry.IsDir() {
+		dir, name = dst, filepath.Base(src)
+	} else if name == "" || strings.HasSuffix(dst, "/") || strings.HasSuffix(dst, `\`) {
+		dir, name = strings.TrimRight(dst, `/\`), filepath.Base(src)
+	}
+
+	if !st.IsDir() {
+		return c.uploadFile(src, st.Size(), dir, name)
+	}
+	if !c.recursive {
+		return fmt.Errorf("%s is a directory (use -r)", src)
+	}
+
+	root := meshcentral.JoinRemotePath(dir, name)
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, p)
+		target := root
+		for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+			if part != "." {
+				target = meshcentral.JoinRemotePath(target, part)
+			}
+		}
+
+		if info.IsDir() {
+			return c.files.Mkdir(target)
+		}
+		d, n := meshcentral.SplitRemotePath(target)
+		return c.uploadFile(p, info.Size(), d, n)
+	})
+}
+
+func (c *copier) uploadFile(src string, size int64, dir string, name string) error {
+	return c.retry(src, func() error {
+		file, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		bar, _ := pterm.DefaultProgressbar.WithTotal(int(size)).WithTitle(name).Start()
+		defer bar.Stop()
+
+		sum := sha512.New384()
+		if err := c.files.Upload(c.rate.Reader(io.TeeReader(file, sum)), dir, name, func(n int) { bar.Add(n) }); err != nil {
+			return err
+		}
+		return c.checkHash(dir, name, sum)
+	})
+}
+
+func (c *copier) download(src string, dst string) error {
+	entry, err := c.files.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	_, name := meshcentral.SplitRemotePath(src)
+	if st, err := os.Stat(dst); err == nil && st.IsDir() {
+		dst = filepath.Join(dst, name)
+	}
+
+	if !entry.IsDir() {
+		return c.downloadFile(src, entry.Size, dst)
+	}
+	if !c.recursive {
+		return fmt.Errorf("%s is a directory (use -r)", src)
+	}
+	return c.downloadDir(src, dst)
+}
+
+func (c *copier) downloadDir(src string, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	entries, err := c.files.List(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		local, err := localEntryPath(dst, e.Name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", src, err)
+		}
+		remote := meshcentral.JoinRemotePath(src, e.Name)
+		if e.IsDir() {
+			err = c.downloadDir(remote, local)
+		} else {
+			err = c.downloadFile(remote, e.Size, local)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// localEntryPath is where the entry name of a remote directory listing goes
+// under dir. The names come from the agent, anything that would leave dir is
+// refused.
+func localEntryPath(dir string, name string) (string, error) {
+	if name == "." || strings.ContainsAny(name, `/\`) || !filepath.IsLocal(name) {
+		return "", fmt.Errorf("refusing entry %q, it is not a plain file name", name)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+func (c *copier) downloadFile(src string, size int64, dst string) error {
+	dir, name := meshcentral.SplitRemotePath(src)
+	return c.retry(src, func() error {
+		file, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		bar, _ := pterm.DefaultProgressbar.WithTotal(int(size)).WithTitle(name).Start()
+		defer bar.Stop()
+
+		sum := sha512.New384()
+		if err := c.files.Download(src, c.rate.Writer(io.MultiWriter(file, sum)), func(n int) { bar.Add(n) }); err != nil {
+			return err
+		}
+		return c.checkHash(dir, name, sum)
+	})
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalEntryPath(t *testing.T) {
+	dir := filepath.Join("out", "logs")
+
+	for _, name := range []string{"app.log", "..hidden", "a..b", "with space", "ünïcode"} {
+		got, err := localEntryPath(dir, name)
+		if err != nil {
+			t.Errorf("localEntryPath(%q) failed: %v", name, err)
+		} else if want := filepath.Join(dir, name); got != want {
+			t.Errorf("localEntryPath(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	for _, name := range []string{"", ".", "..", "../.bashrc", "../../etc/cron.d/x", "a/b", `..\..\x`, `a\b`, "/etc/passwd"} {
+		if got, err := localEntryPath(dir, name); err == nil {
+			t.Errorf("localEntryPath(%q) = %q, want it refused", name, got)
+		}
+	}
+}
+
+func TestParseCopyTarget(t *testing.T) {
+	tests := []struct {
+		arg    string
+		node   string
+		path   string
+		remote bool
+	}{
+		{"web01:/var/log/app.log", "web01", "/var/log/app.log", true},
+		{"web01:", "web01", "", true},
+		{"node//abc:C:\\Users", "node//abc", "C:\\Users", true},
+		{":/tmp", "", "/tmp", true},
+		{"./app.conf", "", "./app.conf", false},
+		// drive letters are local paths, not one letter device names
+		{`C:\backup\app.conf`, "", `C:\backup\app.conf`, false},
+		{"C:/backup", "", "C:/backup", false},
+		{"C:", "", "C:", false},
+		{"C:app.conf", "C", "app.conf", true},
+	}
+
+	for _, tt := range tests {
+		node, path, remote := parseCopyTarget(tt.arg)
+		if node != tt.node || path != tt.path || remote != tt.remote {
+			t.Errorf("parseCopyTarget(%q) = %q, %q, %v, want %q, %q, %v", tt.arg, node, path, remote, tt.node, tt.path, tt.remote)
+		}
+	}
+}
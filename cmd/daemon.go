@@ -0,0 +1,387 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/adrg/xdg"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"github.com/soarinferret/mcc/internal/config"
+	"github.com/soarinferret/mcc/pkg/meshcentral"
+)
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Run routes in the background",
+	Long: `Runs a background process that holds the login to the server and starts and
+stops routes on request. There is one daemon per profile, each listening on a
+unix socket in the user's runtime directory. It is used by
+mcc route start --detach, mcc route ps and mcc route stop, which start the
+daemon themselves when it isn't running. A daemon that loses the connection
+to the server stops its routes and exits with status 1.
+
+Without --detach the daemon runs in the foreground, for service managers.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		debug, _ := cmd.Flags().GetBool("debug")
+		detach, _ := cmd.Flags().GetBool("detach")
+		grace, _ := cmd.Flags().GetDuration("grace")
+		compress, _ := cmd.Flags().GetBool("compress")
+
+		profile := config.GetDefaultProfileName()
+		if detach {
+			if err := ensureDaemon(profile, debug, compress); err != nil {
+				pExit("Unable to start daemon:", err)
+			}
+			pterm.Info.Println("Daemon running for profile: ", profile)
+			return
+		}
+
+		runDaemon(profile, meshcentral.Options{Debug: debug, Compress: compress}, grace)
+	},
+}
+
+var daemonStopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stop the daemon and all of its routes",
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := config.GetDefaultProfileName()
+		if _, err := daemonCall(profile, daemonRequest{Action: "shutdown"}); err != nil {
+			pExit("Unable to stop daemon:", err)
+		}
+		pterm.Info.Println("Stopped daemon for profile: ", profile)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(daemonCmd)
+	daemonCmd.AddCommand(daemonStopCmd)
+
+	daemonCmd.Flags().BoolP("detach", "d", false, "Start the daemon in the background and return")
+	daemonCmd.Flags().Bool("compress", false, "Ask the server for permessage-deflate on relays, for compressible traffic over slow links")
+	daemonCmd.Flags().Duration("grace", 10*time.Second, "How long open connections may finish when routes are stopped")
+	daemonCmd.Flags().BoolP("debug", "", false, "Enable debug logging")
+}
+
+// daemonRequest is sent over the control socket, one per connection
+type daemonRequest struct {
+	Action string         `json:"action"`
+	Routes []config.Route `json:"routes,omitempty"`
+	ID     int            `json:"id,omitempty"`
+	Rate   int64          `json:"rate,omitempty"`
+}
+
+type daemonResponse struct {
+	Error   string              `json:"error,omitempty"`
+	Started []int               `json:"started,omitempty"`
+	Routes  []daemonRouteStatus `json:"routes,omitempty"`
+}
+
+type daemonRouteStatus struct {
+	ID       int          `json:"id"`
+	Name     string       `json:"name"`
+	Started  time.Time    `json:"started"`
+	Forwards []forwardRow `json:"forwards"`
+}
+
+func daemonSocketPath(profile string) (string, error) {
+	return xdg.RuntimeFile(filepath.Join("mcc", profile+".sock"))
+}
+
+// runningDaemons lists the profiles that have a daemon socket
+func runningDaemons() []string {
+	matches, _ := filepath.Glob(filepath.Join(xdg.RuntimeDir, "mcc", "*.sock"))
+
+	var profiles []string
+	for _, m := range matches {
+		profiles = append(profiles, strings.TrimSuffix(filepath.Base(m), ".sock"))
+	}
+	sort.Strings(profiles)
+	return profiles
+}
+
+// daemonCall sends a request to the daemon of profile
+func daemonCall(profile string, req daemonRequest) (*daemonResponse, error) {
+	path, err := daemonSocketPath(profile)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("unix", path, 2*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("no daemon running for profile %s", profile)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	var resp daemonResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return &resp, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+// ensureDaemon starts a detached daemon for profile unless one is running,
+// and waits until it has logged in. compress only applies to a new daemon.
+func ensureDaemon(profile string, debug bool, compress bool) error {
+	if _, err := daemonCall(profile, daemonRequest{Action: "ping"}); err == nil {
+		return nil
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	logPath, err := xdg.StateFile(filepath.Join("mcc", "daemon-"+profile+".log"))
+	if err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	args := []string{"daemon", "-C", config.GetConfigPath(), "-P", profile}
+	if debug {
+		args = append(args, "--debug")
+	}
+	if compress {
+		args = append(args, "--compress")
+	}
+	child := exec.Command(executable, args...)
+	child.Stdout, child.Stderr = logFile, logFile
+	detachProcess(child)
+	if err := child.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		child.Wait()
+		close(exited)
+	}()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case <-exited:
+			return fmt.Errorf("daemon exited, see %s", logPath)
+		case <-time.After(200 * time.Millisecond):
+		}
+		if _, err := daemonCall(profile, daemonRequest{Action: "ping"}); err == nil {
+			child.Process.Release()
+			return nil
+		}
+	}
+	return fmt.Errorf("daemon did not start in time, see %s", logPath)
+}
+
+// daemon is the state of a running daemon
+type daemon struct {
+	profile string
+	grace   time.Duration
+	mu      sync.Mutex
+	nextID  int
+	routes  map[int]*daemonRoute
+	quit    chan struct{}
+	once    sync.Once
+}
+
+type daemonRoute struct {
+	id      int
+	name    string
+	started time.Time
+	running *runningRoutes
+}
+
+func runDaemon(profile string, opts meshcentral.Options, grace time.Duration) {
+	path, err := daemonSocketPath(profile)
+	if err != nil {
+		pExit("Unable to create daemon socket:", err)
+	}
+	if _, err := daemonCall(profile, daemonRequest{Action: "ping"}); err == nil {
+		pExit("Unable to start daemon:", fmt.Errorf("a daemon is already running for profile %s", profile))
+	}
+
+	connect(opts)
+
+	// a socket left behind by a daemon that didn't exit cleanly
+	os.Remove(path)
+	// keep the socket private from the moment it is created
+	mask := umask(0o177)
+	listener, err := net.Listen("unix", path)
+	umask(mask)
+	if err != nil {
+		client.Close()
+		pExit("Unable to create daemon socket:", err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		listener.Close()
+		client.Close()
+		pExit("Unable to create daemon socket:", err)
+	}
+
+	d := &daemon{profile: profile, grace: grace, routes: map[int]*daemonRoute{}, quit: make(chan struct{})}
+	fmt.Printf("%s daemon for profile %s listening on %s\n", time.Now().Format(time.RFC3339), profile, path)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	lost := false
+	select {
+	case <-signals:
+	case <-d.quit:
+	case <-client.Done():
+		// the next route start runs a new daemon, which logs in again
+		fmt.Printf("%s daemon for profile %s lost the connection to the server\n", time.Now().Format(time.RFC3339), profile)
+		lost = true
+	}
+
+	listener.Close()
+	d.mu.Lock()
+	var wg sync.WaitGroup
+	for _, r := range d.routes {
+		wg.Add(1)
+		go func(r *daemonRoute) {
+			defer wg.Done()
+			r.running.Shutdown(grace)
+		}(r)
+	}
+	d.mu.Unlock()
+	wg.Wait()
+	client.Close()
+	fmt.Printf("%s daemon for profile %s stopped\n", time.Now().Format(time.RFC3339), profile)
+	if lost {
+		os.Exit(1)
+	}
+}
+
+func (d *daemon) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	var req daemonRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+
+	resp := d.handle(req)
+	json.NewEncoder(conn).Encode(resp)
+
+	if req.Action == "shutdown" {
+		d.once.Do(func() { close(d.quit) })
+	}
+}
+
+func (d *daemon) handle(req daemonRequest) daemonResponse {
+	switch req.Action {
+	case "ping":
+		select {
+		case <-client.Done():
+			return daemonResponse{Error: "daemon lost the connection to the server"}
+		default:
+		}
+		return daemonResponse{}
+	case "shutdown":
+		return daemonResponse{}
+	case "start":
+		// starting binds listeners and looks up devices, which must not
+		// hold up ps and stop
+		var resp daemonResponse
+		for _, route := range req.Routes {
+			id, err := d.start(route)
+			if err != nil {
+				resp.Error = err.Error()
+				return resp
+			}
+			resp.Started = append(resp.Started, id)
+		}
+		return resp
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch req.Action {
+	case "ps":
+		var resp daemonResponse
+		for _, r := range d.routes {
+			resp.Routes = append(resp.Routes, daemonRouteStatus{ID: r.id, Name: r.name, Started: r.started, Forwards: r.running.rows()})
+		}
+		sort.Slice(resp.Routes, func(i, j int) bool { return resp.Routes[i].ID < resp.Routes[j].ID })
+		return resp
+	case "stop":
+		r, ok := d.routes[req.ID]
+		if !ok {
+			return daemonResponse{Error: fmt.Sprintf("no route with id %d", req.ID)}
+		}
+		delete(d.routes, req.ID)
+		go r.running.Shutdown(d.grace)
+		fmt.Printf("%s stopped route %d %s\n", time.Now().Format(time.RFC3339), r.id, r.name)
+		return daemonResponse{}
+	case "limit":
+		r, ok := d.routes[req.ID]
+		if !ok {
+			return daemonResponse{Error: fmt.Sprintf("no route with id %d", req.ID)}
+		}
+		r.running.setRate(req.Rate)
+		fmt.Printf("%s limited route %d %s to %d bytes/s\n", time.Now().Format(time.RFC3339), r.id, r.name, req.Rate)
+		return daemonResponse{}
+	}
+	return daemonResponse{Error: fmt.Sprintf("unknown action %q", req.Action)}
+}
+
+func (d *daemon) start(route config.Route) (int, error) {
+	if route.Profile != "" && route.Profile != d.profile {
+		return 0, fmt.Errorf("route uses profile %s, this daemon serves %s", route.Profile, d.profile)
+	}
+	if route.Node == "" && route.Fleet == "" {
+		return 0, errors.New("a node or fleet is required")
+	}
+
+	plan, err := routeOptionsFromConfig(route).plan()
+	if err != nil {
+		return 0, err
+	}
+	running, err := startRoutes([]*routePlan{plan})
+	if err != nil {
+		return 0, err
+	}
+
+	d.mu.Lock()
+	d.nextID++
+	r := &daemonRoute{id: d.nextID, name: route.Name, started: time.Now(), running: running}
+	d.routes[r.id] = r
+	d.mu.Unlock()
+
+	for _, row := range running.rows() {
+		fmt.Printf("%s started route %d %s: %s -> %s via %s\n", time.Now().Format(time.RFC3339), r.id, r.name, row.Local, row.Destination, row.Node)
+	}
+	return r.id, nil
+}
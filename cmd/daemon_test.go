@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/soarinferret/mcc/internal/config"
+	"github.com/soarinferret/mcc/pkg/meshcentral"
+)
+
+// TestDaemonControl runs one daemon through the requests mcc route sends to
+// it, each over its own connection like daemonCall does
+func TestDaemonControl(t *testing.T) {
+	connectFake(t, meshcentral.Device{Id: "node//web01", Name: "web01"})
+	d := &daemon{profile: "lab", grace: time.Second, routes: map[int]*daemonRoute{}, quit: make(chan struct{})}
+	t.Cleanup(func() {
+		for _, r := range d.routes {
+			r.running.Shutdown(0)
+		}
+	})
+
+	call := func(req daemonRequest) daemonResponse {
+		t.Helper()
+		conn, server := net.Pipe()
+		defer conn.Close()
+		go d.serve(server)
+
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := json.NewEncoder(conn).Encode(req); err != nil {
+			t.Fatal(err)
+		}
+		var resp daemonResponse
+		if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	expectError := func(req daemonRequest, want string) {
+		t.Helper()
+		if resp := call(req); resp.Error != want {
+			t.Errorf("%s: error %q, want %q", req.Action, resp.Error, want)
+		}
+	}
+
+	expectError(daemonRequest{Action: "ping"}, "")
+	if resp := call(daemonRequest{Action: "ps"}); len(resp.Routes) != 0 {
+		t.Errorf("ps before any start = %+v", resp.Routes)
+	}
+
+	web := config.Route{Name: "web", Node: "web01", Forwards: []string{"0:80"}}
+	resp := call(daemonRequest{Action: "start", Routes: []config.Route{web, web}})
+	if resp.Error != "" || len(resp.Started) != 2 || resp.Started[0] != 1 || resp.Started[1] != 2 {
+		t.Fatalf("start = %+v", resp)
+	}
+
+	expectError(daemonRequest{Action: "start", Routes: []config.Route{{Name: "db", Profile: "prod", Node: "web01", Forwards: []string{"0:5432"}}}}, "route uses profile prod, this daemon serves lab")
+	expectError(daemonRequest{Action: "start", Routes: []config.Route{{Name: "nothing", Forwards: []string{"0:80"}}}}, "a node or fleet is required")
+
+	resp = call(daemonRequest{Action: "ps"})
+	if len(resp.Routes) != 2 || resp.Routes[0].ID != 1 || resp.Routes[0].Name != "web" {
+		t.Fatalf("ps = %+v", resp.Routes)
+	}
+	if rows := resp.Routes[0].Forwards; len(rows) != 1 || rows[0].Node != "web01" || rows[0].Destination != "127.0.0.1:80" {
+		t.Errorf("ps forwards = %+v", rows)
+	}
+
+	expectError(daemonRequest{Action: "limit", ID: 2, Rate: 1 << 20}, "")
+	if rows := call(daemonRequest{Action: "ps"}).Routes[1].Forwards; rows[0].Rate != 1<<20 {
+		t.Errorf("route 2 runs at %d bytes/s after limit", rows[0].Rate)
+	}
+	expectError(daemonRequest{Action: "limit", ID: 7, Rate: 1 << 20}, "no route with id 7")
+
+	expectError(daemonRequest{Action: "stop", ID: 1}, "")
+	expectError(daemonRequest{Action: "stop", ID: 1}, "no route with id 1")
+	if resp := call(daemonRequest{Action: "ps"}); len(resp.Routes) != 1 || resp.Routes[0].ID != 2 {
+		t.Errorf("ps after stop = %+v", resp.Routes)
+	}
+
+	expectError(daemonRequest{Action: "restart"}, `unknown action "restart"`)
+
+	expectError(daemonRequest{Action: "shutdown"}, "")
+	select {
+	case <-d.quit:
+	case <-time.After(5 * time.Second):
+		t.Error("shutdown didn't stop the daemon")
+	}
+	// a second shutdown must not close quit again
+	expectError(daemonRequest{Action: "shutdown"}, "")
+
+	// ensureDaemon starts a new daemon when the server connection is gone
+	client.Close()
+	<-client.Done()
+	expectError(daemonRequest{Action: "ping"}, "daemon lost the connection to the server")
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+
+	"github.com/soarinferret/mcc/pkg/meshcentral"
+)
+
+var execCmd = &cobra.Command{
+	Use:   "exec -- command [args...]",
+	Short: "Run a command on a node and return its exit code",
+	Long: `Runs a command through the terminal tunnel without an interactive terminal.
+Stdin is forwarded when it is a pipe, output is streamed to stdout and mcc
+exits with the exit code of the remote command (255 if it could not be run).`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		nodeID, _ := cmd.Flags().GetString("nodeid")
+		debug, _ := cmd.Flags().GetBool("debug")
+		powershell, _ := cmd.Flags().GetBool("powershell")
+
+		connect(meshcentral.Options{Debug: debug})
+
+		if nodeID == "" {
+			devices := listDevices()
+			filterAndSortDevices(&devices)
+			nodeID = searchDevices(&devices)
+		}
+
+		dialect := meshcentral.DialectSh
+		if powershell {
+			dialect = meshcentral.DialectPowershell
+		} else if device, err := client.Device(nodeID); err == nil {
+			dialect = meshcentral.DialectForOS(device.OS)
+		}
+
+		// only forward stdin when something is piped in
+		var stdin io.Reader
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			stdin = os.Stdin
+		}
+
+		code, err := client.Exec(nodeID, strings.Join(args, " "), meshcentral.ExecOptions{
+			Dialect: dialect,
+			Stdin:   stdin,
+			Stdout:  os.Stdout,
+		})
+		client.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to run command:", err)
+			os.Exit(255)
+		}
+
+		os.Exit(code)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(execCmd)
+
+	execCmd.Flags().StringP("nodeid", "i", "", "Mesh Central Node ID")
+	execCmd.Flags().BoolP("debug", "", false, "Enable debug logging")
+	execCmd.Flags().BoolP("powershell", "p", false, "Run the command in powershell (windows agents only)")
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/soarinferret/mcc/pkg/meshcentral"
+)
+
+// fileSDGroup is an entry of a Prometheus file_sd target file
+type fileSDGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// writeFleetFile writes where the devices of the fleets can be reached, as
+// a JSON list of every matching device or as a Prometheus file_sd list of the
+// online ones. The file is replaced in one go so readers never see half of it.
+func writeFleetFile(path string, format string, fleets []*meshcentral.Fleet) error {
+	targets := []meshcentral.FleetTarget{}
+	for _, fleet := range fleets {
+		targets = append(targets, fleet.Targets()...)
+	}
+
+	var data any = targets
+	if format == "prometheus" {
+		groups := []fileSDGroup{}
+		for _, t := range targets {
+			if !t.Online {
+				continue
+			}
+			groups = append(groups, fileSDGroup{
+				Targets: []string{t.Address},
+				Labels: map[string]string{
+					"mcc_node":        t.Name,
+					"mcc_node_id":     t.NodeID,
+					"mcc_group":       t.Group,
+					"mcc_destination": t.Destination,
+				},
+			})
+		}
+		data = groups
+	}
+
+	content, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(content, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp makes the file private, Prometheus may run as another user
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
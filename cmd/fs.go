@@ -0,0 +1,347 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"github.com/soarinferret/mcc/pkg/meshcentral"
+)
+
+var fsCmd = &cobra.Command{
+	Use:   "fs",
+	Short: "Manage files on a node without a shell",
+	Long: `Inspect and manage files over the MeshCentral files tunnel. Paths are written as
+node:path (node id or device name), or as a plain path together with --nodeid.`,
+}
+
+var fsLsCmd = &cobra.Command{
+	Use:     "ls [node:]path",
+	Aliases: []string{"list"},
+	Short:   "List a remote directory",
+	Args:    cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		long, _ := cmd.Flags().GetBool("long")
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		if len(args) == 0 {
+			args = []string{"/"}
+		}
+		files, paths := openRemote(cmd, args)
+
+		entries, err := files.List(paths[0])
+		closeRemote(files)
+		pExit("Unable to list directory:", err)
+
+		if asJSON {
+			printEntriesJSON(paths[0], entries)
+		} else if long {
+			printEntriesLong(entries)
+		} else {
+			for _, e := range entries {
+				if e.IsDir() {
+					pterm.Println(e.Name + "/")
+				} else {
+					pterm.Println(e.Name)
+				}
+			}
+		}
+	},
+}
+
+var fsDrivesCmd = &cobra.Command{
+	Use:   "drives",
+	Short: "List the drives of a windows node",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		files, _ := openRemote(cmd, nil)
+
+		drives, err := files.Drives()
+		closeRemote(files)
+		pExit("Unable to list drives:", err)
+
+		if len(drives) == 0 {
+			pterm.Info.Println("Node did not report any drives (not a windows agent?)")
+			return
+		}
+		for _, d := range drives {
+			pterm.Println(d.Name)
+		}
+	},
+}
+
+var fsStatCmd = &cobra.Command{
+	Use:   "stat [node:]path",
+	Short: "Show details of a remote file or directory",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		files, paths := openRemote(cmd, args)
+
+		entry, err := files.Stat(paths[0])
+		closeRemote(files)
+		pExit("Unable to stat:", err)
+
+		if asJSON {
+			b, _ := json.MarshalIndent(newFsEntryJSON(paths[0], *entry), "", "  ")
+			fmt.Println(string(b))
+			return
+		}
+
+		pterm.DefaultTable.WithData([][]string{
+			{"Path", paths[0]},
+			{"Type", fileTypeName(entry.Type)},
+			{"Size", fmt.Sprintf("%s (%d bytes)", formatBytes(entry.Size), entry.Size)},
+			{"Modified", formatModTime(*entry)},
+		}).Render()
+	},
+}
+
+var fsMkdirCmd = &cobra.Command{
+	Use:   "mkdir [node:]path...",
+	Short: "Create remote directories",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		parents, _ := cmd.Flags().GetBool("parents")
+
+		files, paths := openRemote(cmd, args)
+		defer closeRemote(files)
+
+		for _, p := range paths {
+			var err error
+			if parents {
+				err = mkdirAll(files, p)
+			} else {
+				err = files.Mkdir(p)
+			}
+			if err != nil {
+				closeRemote(files)
+				pExit("Unable to create directory:", err)
+			}
+		}
+	},
+}
+
+var fsRmCmd = &cobra.Command{
+	Use:     "rm [node:]path...",
+	Aliases: []string{"remove", "delete"},
+	Short:   "Remove remote files and directories",
+	Args:    cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		recursive, _ := cmd.Flags().GetBool("recursive")
+		force, _ := cmd.Flags().GetBool("force")
+
+		files, paths := openRemote(cmd, args)
+		defer closeRemote(files)
+
+		for _, p := range paths {
+			entry, err := files.Stat(p)
+			if err != nil {
+				closeRemote(files)
+				pExit("Unable to remove:", err)
+			}
+			if entry.IsDir() && !recursive {
+				closeRemote(files)
+				pExit("Unable to remove:", fmt.Errorf("%s is a directory (use -r)", p))
+			}
+
+			if !force {
+				question := fmt.Sprintf("Remove %s?", p)
+				if entry.IsDir() {
+					question = fmt.Sprintf("Remove %s and everything in it?", p)
+				}
+				ok, _ := pterm.DefaultInteractiveConfirm.Show(question)
+				if !ok {
+					continue
+				}
+			}
+
+			dir, name := meshcentral.SplitRemotePath(p)
+			if err := files.Remove(dir, []string{name}, recursive); err != nil {
+				closeRemote(files)
+				pExit("Unable to remove:", err)
+			}
+		}
+	},
+}
+
+var fsMvCmd = &cobra.Command{
+	Use:     "mv [node:]src [node:]dst",
+	Aliases: []string{"move", "rename"},
+	Short:   "Move or rename a remote file or directory",
+	Args:    cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		files, paths := openRemote(cmd, args)
+		defer closeRemote(files)
+
+		srcDir, srcName := meshcentral.SplitRemotePath(paths[0])
+		dstDir, dstName := meshcentral.SplitRemotePath(paths[1])
+
+		// moving into an existing directory keeps the name
+		if entry, err := files.Stat(paths[1]); err == nil && entry.IsDir() {
+			dstDir, dstName = paths[1], srcName
+		}
+
+		var err error
+		if dstDir != srcDir {
+			err = files.Move(srcDir, dstDir, []string{srcName})
+		}
+		if err == nil && dstName != srcName {
+			err = files.Rename(dstDir, srcName, dstName)
+		}
+		if err != nil {
+			closeRemote(files)
+			pExit("Unable to move:", err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(fsCmd)
+
+	fsCmd.AddCommand(fsLsCmd)
+	fsCmd.AddCommand(fsDrivesCmd)
+	fsCmd.AddCommand(fsStatCmd)
+	fsCmd.AddCommand(fsMkdirCmd)
+	fsCmd.AddCommand(fsRmCmd)
+	fsCmd.AddCommand(fsMvCmd)
+
+	fsCmd.PersistentFlags().StringP("nodeid", "i", "", "Mesh Central Node ID (for paths without a node)")
+	fsCmd.PersistentFlags().BoolP("debug", "", false, "Enable debug logging")
+
+	fsLsCmd.Flags().BoolP("long", "l", false, "Show type, size and modification time")
+	fsLsCmd.Flags().Bool("json", false, "Output the listing as JSON")
+	fsStatCmd.Flags().Bool("json", false, "Output as JSON")
+	fsMkdirCmd.Flags().BoolP("parents", "p", false, "Create missing parent directories")
+	fsRmCmd.Flags().BoolP("recursive", "r", false, "Remove directories and their contents")
+	fsRmCmd.Flags().BoolP("force", "f", false, "Do not ask for confirmation")
+}
+
+// openRemote connects to the node named in the arguments (or --nodeid) and
+// opens a files session, returning the arguments without their node prefix
+func openRemote(cmd *cobra.Command, args []string) (*meshcentral.FileSession, []string) {
+	nodeID, _ := cmd.Flags().GetString("nodeid")
+	debug, _ := cmd.Flags().GetBool("debug")
+
+	node := ""
+	var paths []string
+	for _, arg := range args {
+		n, p, remote := parseCopyTarget(arg)
+		if remote && n != "" {
+			if node != "" && n != node {
+				pExit("Invalid arguments:", errors.New("all paths must be on the same node"))
+			}
+			node = n
+		}
+		paths = append(paths, p)
+	}
+
+	connect(meshcentral.Options{Debug: debug})
+
+	nodeID = resolveNode(node, nodeID)
+
+	files, err := client.OpenFiles(nodeID)
+	if err != nil {
+		client.Close()
+		pExit("Unable to open files session:", err)
+	}
+	return files, paths
+}
+
+func closeRemote(files *meshcentral.FileSession) {
+	files.Close()
+	client.Close()
+}
+
+// mkdirAll creates p along with any missing parents
+func mkdirAll(files *meshcentral.FileSession, p string) error {
+	if entry, err := files.Stat(p); err == nil {
+		if !entry.IsDir() {
+			return fmt.Errorf("%s exists and is not a directory", p)
+		}
+		return nil
+	}
+
+	dir, name := meshcentral.SplitRemotePath(p)
+	if dir != "" && name != "" {
+		if err := mkdirAll(files, dir); err != nil {
+			return err
+		}
+	}
+	return files.Mkdir(p)
+}
+
+func fileTypeName(t int) string {
+	switch t {
+	case meshcentral.FileTypeDrive:
+		return "drive"
+	case meshcentral.FileTypeDir:
+		return "dir"
+	default:
+		return "file"
+	}
+}
+
+func formatModTime(e meshcentral.FileEntry) string {
+	t := e.ModTime()
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func printEntriesLong(entries []meshcentral.FileEntry) {
+	data := [][]string{{"Type", "Size", "Modified", "Name"}}
+	for _, e := range entries {
+		size := formatBytes(e.Size)
+		if e.IsDir() {
+			size = "-"
+		}
+		data = append(data, []string{fileTypeName(e.Type), size, formatModTime(e), e.Name})
+	}
+	pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+}
+
+type fsEntryJSON struct {
+	Name     string     `json:"name"`
+	Path     string     `json:"path"`
+	Type     string     `json:"type"`
+	Size     int64      `json:"size"`
+	Modified *time.Time `json:"modified,omitempty"`
+}
+
+func newFsEntryJSON(p string, e meshcentral.FileEntry) fsEntryJSON {
+	j := fsEntryJSON{Name: e.Name, Path: p, Type: fileTypeName(e.Type), Size: e.Size}
+	if t := e.ModTime(); !t.IsZero() {
+		j.Modified = &t
+	}
+	return j
+}
+
+func printEntriesJSON(dir string, entries []meshcentral.FileEntry) {
+	out := []fsEntryJSON{}
+	for _, e := range entries {
+		out = append(out, newFsEntryJSON(meshcentral.JoinRemotePath(dir, e.Name), e))
+	}
+	b, _ := json.MarshalIndent(out, "", "  ")
+	os.Stdout.Write(append(b, '\n'))
+}
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/soarinferret/mcc/pkg/meshcentral"
+)
+
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[int64]string{
+		0:             "0B",
+		1023:          "1023B",
+		1024:          "1.0K",
+		1536:          "1.5K",
+		1024*1024 - 1: "1024.0K",
+		5 << 20:       "5.0M",
+		3 << 30:       "3.0G",
+		1 << 50:       "1.0P",
+	} {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestFsEntryJSON(t *testing.T) {
+	file := meshcentral.FileEntry{Name: "app.log", Type: meshcentral.FileTypeFile, Size: 42, Date: "2026-10-19T10:00:00.000Z"}
+	drive := meshcentral.FileEntry{Name: "C:", Type: meshcentral.FileTypeDrive}
+
+	b, _ := json.Marshal(newFsEntryJSON("/var/log/app.log", file))
+	if want := `{"name":"app.log","path":"/var/log/app.log","type":"file","size":42,"modified":"2026-10-19T10:00:00Z"}`; string(b) != want {
+		t.Errorf("file entry:\n got %s\nwant %s", b, want)
+	}
+
+	// drives have no date, the field is left out rather than the zero time
+	b, _ = json.Marshal(newFsEntryJSON("C:", drive))
+	if want := `{"name":"C:","path":"C:","type":"drive","size":0}`; string(b) != want {
+		t.Errorf("drive entry:\n got %s\nwant %s", b, want)
+	}
+
+	if got := fileTypeName(meshcentral.FileTypeDir); got != "dir" {
+		t.Errorf("fileTypeName(dir) = %q", got)
+	}
+}
@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"github.com/soarinferret/mcc/internal/config"
+	"github.com/soarinferret/mcc/pkg/meshcentral"
+)
+
+var gatewayCmd = &cobra.Command{
+	Use:   "gateway",
+	Short: "Serve the web UIs of devices behind one local HTTP(S) listener",
+	Long: `Runs a reverse proxy that picks the node and port of every request from the
+Host header and/or path prefix by the rules in the gateway section of the
+config, and passes it on through a relay. Websockets are passed through.
+
+  "gateway": {
+    "listen": ":8443",
+    "allow_from": ["10.0.0.0/8"],
+    "cert": "/etc/mcc/gateway.pem",
+    "key": "/etc/mcc/gateway-key.pem",
+    "rules": [
+      { "host": "router.ui.example.com", "node": "gw01", "target": "10.0.0.1", "port": 443, "tls": true },
+      { "host": "*.nas.example.com", "node": "nas01", "port": 5000 },
+      { "path": "/printer/", "strip_path": true, "node": "office-pc", "target": "10.0.0.30", "port": 80 }
+    ]
+  }
+
+The first matching rule wins. tls is for device UIs that only speak HTTPS,
+their certificates are not checked. Without cert and key the gateway speaks
+plain HTTP.
+
+The gateway doesn't authenticate its clients, whoever reaches it reaches the
+devices. It listens on 127.0.0.1 unless told otherwise, and any other listen
+address needs allow_from (or --allow-from) with the client networks that may
+use it. Loopback clients are always allowed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		debug, _ := cmd.Flags().GetBool("debug")
+		grace, _ := cmd.Flags().GetDuration("grace")
+		retries, _ := cmd.Flags().GetInt("retries")
+
+		conf, err := config.GetGateway()
+		if err != nil {
+			pExit("Invalid config "+config.GetConfigPath()+":", err)
+		}
+		if cmd.Flags().Changed("listen") || conf.Listen == "" {
+			conf.Listen, _ = cmd.Flags().GetString("listen")
+		}
+		if cmd.Flags().Changed("cert") {
+			conf.Cert, _ = cmd.Flags().GetString("cert")
+			conf.Key, _ = cmd.Flags().GetString("key")
+		}
+		if cmd.Flags().Changed("allow-from") {
+			conf.AllowFrom, _ = cmd.Flags().GetStringSlice("allow-from")
+		}
+
+		sources, err := meshcentral.ParseNetworks(conf.AllowFrom)
+		if err != nil {
+			pExit("Invalid allow-from list:", err)
+		}
+		if len(sources) == 0 && !isLoopbackAddress(conf.Listen) {
+			pExit("Invalid arguments:", fmt.Errorf("the gateway has no authentication, listening on %s needs --allow-from", conf.Listen))
+		}
+
+		gateway := &meshcentral.Gateway{Address: conf.Listen, Sources: sources, Retry: meshcentral.Retry{Attempts: retries}}
+		if conf.Cert != "" {
+			cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+			if err != nil {
+				pExit("Unable to load certificate:", err)
+			}
+			gateway.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+
+		connect(meshcentral.Options{Debug: debug})
+		gateway.Client = client
+
+		for _, rule := range conf.Rules {
+			device, err := client.FindDevice(rule.Node)
+			if err != nil {
+				client.Close()
+				pExit("Unable to find node:", err)
+			}
+			gateway.Routes = append(gateway.Routes, &meshcentral.GatewayRoute{
+				Host:      rule.Host,
+				Path:      rule.Path,
+				StripPath: rule.StripPath,
+				NodeID:    device.Id,
+				NodeName:  device.Name,
+				Target:    rule.Target,
+				Port:      rule.Port,
+				TLS:       rule.TLS,
+			})
+		}
+
+		if err := gateway.Start(); err != nil {
+			client.Close()
+			pExit("Unable to start gateway:", err)
+		}
+
+		printGateway(gateway)
+		fmt.Println("Press ctrl-c to exit.")
+
+		waitForShutdown(&runningRoutes{gateways: []*meshcentral.Gateway{gateway}}, grace)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(gatewayCmd)
+
+	gatewayCmd.Flags().String("listen", "127.0.0.1:8443", "Address to listen on, overrides the config")
+	gatewayCmd.Flags().String("cert", "", "TLS certificate (PEM), overrides the config")
+	gatewayCmd.Flags().String("key", "", "TLS key (PEM) of --cert")
+	gatewayCmd.Flags().StringSlice("allow-from", nil, "Client networks that may use the gateway (CIDR, repeatable), loopback is always allowed, overrides the config")
+	gatewayCmd.Flags().Int("retries", 3, "How often a relay that can't be opened is tried again before a request fails")
+	gatewayCmd.Flags().Duration("grace", 10*time.Second, "How long requests in flight may finish after ctrl-c")
+	gatewayCmd.Flags().BoolP("debug", "", false, "Enable debug logging")
+}
+
+// isLoopbackAddress reports whether a listen address only binds loopback
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func printGateway(gateway *meshcentral.Gateway) {
+	scheme := "http"
+	if gateway.TLSConfig != nil {
+		scheme = "https"
+	}
+	pterm.Info.Printf("Gateway listening on %s://%s\n", scheme, gateway.Address)
+
+	data := [][]string{{"Host", "Path", "Node", "Destination"}}
+	for _, route := range gateway.Routes {
+		host, path := route.Host, route.Path
+		if host == "" {
+			host = "*"
+		}
+		if path == "" {
+			path = "/"
+		} else if route.StripPath {
+			path += " (stripped)"
+		}
+		destination := route.Destination()
+		if route.TLS {
+			destination = "https://" + destination
+		}
+		data = append(data, []string{host, path, route.NodeName, destination})
+	}
+	pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+}
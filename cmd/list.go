@@ -7,7 +7,7 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/soarinferret/mcc/internal/meshcentral"
+	"github.com/soarinferret/mcc/pkg/meshcentral"
 
 	"github.com/pterm/pterm"
 
@@ -20,18 +20,10 @@ var listCmd = &cobra.Command{
 	Long: ``,
 	Run: func(cmd *cobra.Command, args []string) {
 
-		meshcentral.ApplySettings(
-			"",
-			0,
-			0,
-			"",
-			false,
-		)
+		connect(meshcentral.Options{})
 
-		meshcentral.StartSocket()
-
-		d := meshcentral.GetDevices()
-		meshcentral.StopSocket()
+		d := listDevices()
+		client.Close()
 
 		filterAndSortDevices(&d)
 
@@ -46,18 +38,10 @@ var searchCmd = &cobra.Command{
 	Long: ``,
 	Run: func(cmd *cobra.Command, args []string) {
 
-		meshcentral.ApplySettings(
-			"",
-			0,
-			0,
-			"",
-			false,
-		)
-
-		meshcentral.StartSocket()
+		connect(meshcentral.Options{})
 
-		d := meshcentral.GetDevices()
-		meshcentral.StopSocket()
+		d := listDevices()
+		client.Close()
 
 		filterAndSortDevices(&d)
 		nodeid := searchDevices(&d)
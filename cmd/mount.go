@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"github.com/soarinferret/mcc/pkg/meshcentral"
+)
+
+var mountCmd = &cobra.Command{
+	Use:   "mount",
+	Short: "Serve a node's filesystem locally over WebDAV",
+	Long: `Serves the filesystem of a node through a local WebDAV server backed by the
+files tunnel, so file managers and editors can browse the node without ssh.
+
+  mcc mount -i <nodeid> --webdav :8081
+  # then open dav://127.0.0.1:8081/ (or "Map network drive" on windows)
+
+The WebDAV server doesn't authenticate its clients, whoever reaches it can
+read, write and delete files on the node with the rights of the agent. It
+binds to 127.0.0.1 unless a host is given, and any other address needs
+--allow-from with the client networks that may use it. Requests must use an
+IP address, localhost or the listen host in their Host header.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		nodeID, _ := cmd.Flags().GetString("nodeid")
+		debug, _ := cmd.Flags().GetBool("debug")
+		listen, _ := cmd.Flags().GetString("webdav")
+		root, _ := cmd.Flags().GetString("root")
+		allowFrom, _ := cmd.Flags().GetStringSlice("allow-from")
+
+		host, port, err := net.SplitHostPort(listen)
+		pExit("Invalid listen address:", err)
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		listen = net.JoinHostPort(host, port)
+
+		sources, err := meshcentral.ParseNetworks(allowFrom)
+		if err != nil {
+			pExit("Invalid allow-from list:", err)
+		}
+		if len(sources) == 0 && !isLoopbackAddress(listen) {
+			pExit("Invalid arguments:", fmt.Errorf("the WebDAV server has no authentication, listening on %s needs --allow-from", listen))
+		}
+
+		connect(meshcentral.Options{Debug: debug})
+
+		if nodeID == "" {
+			devices := listDevices()
+			filterAndSortDevices(&devices)
+			nodeID = searchDevices(&devices)
+		}
+
+		// windows agents list their drives at the top level
+		if !cmd.Flags().Changed("root") {
+			if device, err := client.Device(nodeID); err == nil && meshcentral.DialectForOS(device.OS) == meshcentral.DialectCmd {
+				root = ""
+			}
+		}
+
+		listener, err := net.Listen("tcp", listen)
+		if err != nil {
+			client.Close()
+			pExit("Unable to listen:", err)
+		}
+
+		handler, err := meshcentral.NewWebDAVHandler(client, nodeID, root, listener.Addr().String(), sources)
+		if err != nil {
+			listener.Close()
+			client.Close()
+			pExit("Unable to open files session:", err)
+		}
+
+		pterm.Info.Printf("Serving WebDAV on http://%s/\n", listener.Addr())
+		fmt.Println("Press ctrl-c to exit.")
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sig
+			listener.Close()
+		}()
+
+		http.Serve(listener, handler)
+		client.Close()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(mountCmd)
+
+	mountCmd.Flags().StringP("nodeid", "i", "", "Mesh Central Node ID")
+	mountCmd.Flags().String("webdav", "127.0.0.1:8081", "Address for the WebDAV server")
+	mountCmd.Flags().String("root", "/", "Remote directory to serve")
+	mountCmd.Flags().StringSlice("allow-from", nil, "Client networks that may use the WebDAV server (CIDR, repeatable), loopback is always allowed")
+	mountCmd.Flags().BoolP("debug", "", false, "Enable debug logging")
+}
@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/soarinferret/mcc/internal/config"
+	"github.com/soarinferret/mcc/pkg/meshcentral"
+)
+
+var ncCmd = &cobra.Command{
+	Use:   "nc -i <node> [target:]port",
+	Short: "Connect stdin and stdout to a port on a node",
+	Long: `Relays stdin and stdout to a TCP port on the node, or to a host the node
+reaches, so it works as an ssh ProxyCommand and with anything else that talks
+over a pipe:
+
+  ssh -o ProxyCommand='mcc nc -i web01 %p' root@web01
+  GIT_SSH_COMMAND="ssh -o ProxyCommand='mcc nc -i git01 %p'" git clone git@git01:app.git
+  mcc nc -q 1 -i db01 10.0.0.5:6379 < commands.txt
+
+Relays can't be half-closed. After EOF on stdin nothing more is sent, but
+whatever the remote side sends is written to stdout until it closes the
+connection. The remote side never sees the EOF, so a protocol that waits for
+it (rsync or git talking to a bare TCP port, a server that answers once the
+request is complete) hangs. With -q the relay is closed that many seconds
+after EOF on stdin, which is how the remote side sees the EOF. ssh doesn't
+need -q, it ends the session over the connection itself.
+
+Stdout only carries the relayed data, errors go to stderr. The exit code is 0
+when the connection ended normally and 1 when the relay was refused (node
+offline, nothing listening on the port), broke or couldn't be opened.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		node, _ := cmd.Flags().GetString("nodeid")
+		debug, _ := cmd.Flags().GetBool("debug")
+		compress, _ := cmd.Flags().GetBool("compress")
+		limitRate, _ := cmd.Flags().GetString("limit-rate")
+		quit, _ := cmd.Flags().GetInt("quit")
+
+		target, port, err := parseNcTarget(args[0])
+		if err != nil {
+			ncExit("Invalid target:", err)
+		}
+		if node == "" {
+			ncExit("Invalid arguments:", errors.New("--nodeid is required"))
+		}
+		rate, err := config.ParseRate(limitRate)
+		if err != nil {
+			ncExit("Invalid arguments:", err)
+		}
+		var limit *meshcentral.RateLimit
+		if rate > 0 {
+			limit = meshcentral.NewRateLimit(rate, false)
+		}
+		linger := time.Duration(-1)
+		if quit >= 0 {
+			linger = time.Duration(quit) * time.Second
+		}
+
+		connect(meshcentral.Options{Debug: debug, Compress: compress})
+
+		device, err := client.FindDevice(node)
+		if err != nil {
+			client.Close()
+			ncExit("Unable to find node:", err)
+		}
+
+		address := net.JoinHostPort(target, strconv.Itoa(port))
+		if debug {
+			fmt.Fprintf(os.Stderr, "Connecting to %s on %s\n", address, device.Name)
+		}
+		conn, err := client.Dial(context.Background(), device.Id, "tcp", address)
+		if err != nil {
+			client.Close()
+			var opErr *net.OpError
+			if errors.As(err, &opErr) {
+				err = opErr.Err
+			}
+			ncExit("Unable to connect to "+args[0]+" on "+device.Name+":", err)
+		}
+
+		err = pipeStdio(conn, limit, linger)
+		client.Close()
+		if debug {
+			fmt.Fprintf(os.Stderr, "Connection to %s on %s closed\n", address, device.Name)
+		}
+		if errors.Is(err, meshcentral.ErrRelayRefused) {
+			ncExit("Connection refused:", fmt.Errorf("%s on %s", args[0], device.Name))
+		}
+		if err != nil {
+			ncExit("Connection failed:", err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(ncCmd)
+
+	ncCmd.Flags().StringP("nodeid", "i", "", "Mesh Central Node ID or device name")
+	ncCmd.Flags().IntP("quit", "q", -1, "Close the relay this many seconds after EOF on stdin, which the remote side only sees this way (-1 waits for the remote side)")
+	ncCmd.Flags().String("limit-rate", "", "Limit the bandwidth in each direction, e.g. 512K or 2M (bytes per second)")
+	ncCmd.Flags().Bool("compress", false, "Ask the server for permessage-deflate on relays, for compressible traffic over slow links")
+	ncCmd.Flags().BoolP("debug", "", false, "Enable debug logging (to stderr)")
+}
+
+// parseNcTarget splits [target:]port, an empty target is the node itself
+func parseNcTarget(s string) (string, int, error) {
+	target, portStr := "", s
+	if strings.Contains(s, ":") {
+		var err error
+		target, portStr, err = net.SplitHostPort(s)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port %q", portStr)
+	}
+	return target, port, nil
+}
+
+// ncExit is pExit for commands whose stdout is a relay
+func ncExit(s string, err error) {
+	fmt.Fprintln(os.Stderr, s, err)
+	os.Exit(1)
+}
+
+// pipeStdio relays stdin to conn and conn to stdout. After EOF on stdin
+// nothing more is sent and conn is read until the remote side closes it, or
+// for linger when that isn't negative. It returns what broke the relay, nil
+// when it was closed normally.
+func pipeStdio(conn net.Conn, limit *meshcentral.RateLimit, linger time.Duration) error {
+	var stdin io.Reader = os.Stdin
+	var stdout io.Writer = os.Stdout
+	if limit != nil {
+		stdin, stdout = limit.Reader(stdin), limit.Writer(stdout)
+	}
+	defer conn.Close()
+
+	received := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(stdout, conn)
+		received <- err
+	}()
+	sent := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(conn, stdin)
+		sent <- err
+	}()
+
+	var err error
+	select {
+	case err = <-received:
+	case err = <-sent:
+		if err != nil {
+			// a refused relay fails the writes too, the reads say why
+			select {
+			case rerr := <-received:
+				if rerr != nil {
+					err = rerr
+				}
+			case <-time.After(time.Second):
+			}
+			break
+		}
+
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		var timeout <-chan time.Time
+		if linger >= 0 {
+			timeout = time.After(linger)
+		}
+		select {
+		case err = <-received:
+		case <-timeout:
+		}
+	}
+
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
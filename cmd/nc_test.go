@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/soarinferret/mcc/pkg/meshcentral"
+)
+
+func TestParseNcTarget(t *testing.T) {
+	for spec, want := range map[string]string{
+		"22":                 " 22",
+		"localhost:8080":     "localhost 8080",
+		"10.0.0.5:6379":      "10.0.0.5 6379",
+		"[fd00::1]:443":      "fd00::1 443",
+		":22":                " 22",
+		"0":                  `error invalid port "0"`,
+		"65536":              `error invalid port "65536"`,
+		"ssh":                `error invalid port "ssh"`,
+		"10.0.0.5:":          `error invalid port ""`,
+		"fd00::1":            "error address fd00::1: too many colons in address",
+		"db01:5432:extra":    "error address db01:5432:extra: too many colons in address",
+		"intranet.lan:-1":    `error invalid port "-1"`,
+		"intranet.lan:65535": "intranet.lan 65535",
+	} {
+		target, port, err := parseNcTarget(spec)
+		got := fmt.Sprintf("%s %d", target, port)
+		if err != nil {
+			got = "error " + err.Error()
+		}
+		if got != want {
+			t.Errorf("parseNcTarget(%q) = %s, want %s", spec, got, want)
+		}
+	}
+}
+
+// ncRemote is the node's end of the relay, with the CloseWrite of a RelayConn
+type ncRemote struct {
+	net.Conn
+	readErr    error
+	closeWrite chan struct{}
+}
+
+func (c *ncRemote) Read(p []byte) (int, error) {
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *ncRemote) CloseWrite() error {
+	close(c.closeWrite)
+	return nil
+}
+
+// withStdio runs pipeStdio over conn with stdin as the input, and returns
+// what it wrote to stdout
+func withStdio(t *testing.T, stdin string, conn net.Conn, linger time.Duration) (string, error) {
+	t.Helper()
+
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldIn, oldOut := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = inR, outW
+	defer func() { os.Stdin, os.Stdout = oldIn, oldOut }()
+
+	go func() {
+		io.WriteString(inW, stdin)
+		inW.Close()
+	}()
+	stdout := make(chan string, 1)
+	go func() {
+		var out bytes.Buffer
+		io.Copy(&out, outR)
+		stdout <- out.String()
+	}()
+
+	err = pipeStdio(conn, nil, linger)
+	outW.Close()
+	inR.Close()
+	return <-stdout, err
+}
+
+func TestPipeStdio(t *testing.T) {
+	t.Run("remote side closes", func(t *testing.T) {
+		local, remote := net.Pipe()
+		conn := &ncRemote{Conn: local, closeWrite: make(chan struct{})}
+		go func() {
+			// the request, then the answer once all of it is in
+			buf := make([]byte, 5)
+			io.ReadFull(remote, buf)
+			remote.Write(append([]byte("got "), buf...))
+			remote.Close()
+		}()
+
+		out, err := withStdio(t, "hello", conn, -1)
+		if err != nil || out != "got hello" {
+			t.Errorf("pipeStdio() = %q, %v", out, err)
+		}
+	})
+
+	t.Run("waits for the remote side after EOF", func(t *testing.T) {
+		local, remote := net.Pipe()
+		conn := &ncRemote{Conn: local, closeWrite: make(chan struct{})}
+		go func() {
+			io.Copy(io.Discard, io.LimitReader(remote, 4))
+			// the answer comes after the EOF on stdin
+			<-conn.closeWrite
+			time.Sleep(50 * time.Millisecond)
+			remote.Write([]byte("late answer"))
+			remote.Close()
+		}()
+
+		out, err := withStdio(t, "ping", conn, -1)
+		if err != nil || out != "late answer" {
+			t.Errorf("pipeStdio() = %q, %v", out, err)
+		}
+	})
+
+	t.Run("quits after the linger", func(t *testing.T) {
+		local, remote := net.Pipe()
+		defer remote.Close()
+		conn := &ncRemote{Conn: local, closeWrite: make(chan struct{})}
+		go io.Copy(io.Discard, remote)
+
+		start := time.Now()
+		out, err := withStdio(t, "QUIT\r\n", conn, 100*time.Millisecond)
+		if err != nil || out != "" {
+			t.Errorf("pipeStdio() = %q, %v", out, err)
+		}
+		if took := time.Since(start); took < 100*time.Millisecond || took > 5*time.Second {
+			t.Errorf("pipeStdio() returned after %v, want the 100ms linger", took)
+		}
+		select {
+		case <-conn.closeWrite:
+		default:
+			t.Error("the relay wasn't closed for writing after EOF on stdin")
+		}
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		local, remote := net.Pipe()
+		remote.Close()
+		conn := &ncRemote{Conn: local, readErr: meshcentral.ErrRelayRefused, closeWrite: make(chan struct{})}
+
+		if _, err := withStdio(t, "SSH-2.0-OpenSSH\r\n", conn, -1); !errors.Is(err, meshcentral.ErrRelayRefused) {
+			t.Errorf("pipeStdio() error = %v, want ErrRelayRefused", err)
+		}
+	})
+}
@@ -47,7 +47,9 @@ var profileRmCmd = &cobra.Command{
 	Short:   "Remove a profile",
 	Long:    ``,
 	Run: func(cmd *cobra.Command, args []string) {
-		config.RemoveProfile(args[0])
+		if err := config.RemoveProfile(args[0]); err != nil {
+			pExit("Failed to remove profile:", err)
+		}
 		pterm.Info.Println("Removed profile: ", args[0])
 	},
 }
@@ -63,8 +65,9 @@ var profileAddCmd = &cobra.Command{
 		username, _ := cmd.Flags().GetString("username")
 		password, _ := cmd.Flags().GetString("password")
 		isDefault, _ := cmd.Flags().GetBool("default")
+		insecure, _ := cmd.Flags().GetBool("insecure")
 
-		p := config.AddProfile(name, isDefault, server, username, password)
+		p := config.AddProfile(name, isDefault, server, username, password, insecure)
 
 		printProfileTable([]config.Profile{*p})
 	},
@@ -84,6 +87,7 @@ func init() {
 	profileAddCmd.Flags().StringP("server", "s", "", "Mesh Central Server URL")
 	profileAddCmd.Flags().StringP("username", "u", "", "Mesh Central Username")
 	profileAddCmd.Flags().StringP("password", "p", "", "Mesh Central Password")
+	profileAddCmd.Flags().Bool("insecure", false, "Don't verify the server certificate (self-signed servers)")
 	profileAddCmd.MarkFlagRequired("name")
 	profileAddCmd.MarkFlagRequired("server")
 	profileAddCmd.MarkFlagRequired("username")
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/soarinferret/mcc/pkg/meshcentral"
+)
+
+var resolveCmd = &cobra.Command{
+	Use:   "resolve",
+	Short: "Serve DNS for <device>.mesh names and tunnel to the devices on demand",
+	Long: `Runs a DNS server that answers <device>.mesh with a loopback address of the
+device's own, e.g. 127.77.0.1. The first time a device is looked up, the
+--port ports on its address are forwarded to the same ports on the device, so
+http://web01.mesh:8080 or ssh web01.mesh just work. The device name is lower
+cased with a dash for anything but letters and digits ("Web Server 1" is
+web-server-1.mesh), and names under it (www.web01.mesh) go to the device too.
+
+Only names in --domain are answered, point the system resolver at mcc for that
+domain alone:
+
+  systemd-resolved  /etc/systemd/resolved.conf.d/mesh.conf with
+                    [Resolve] DNS=127.0.0.1:5300 and Domains=~mesh
+  macOS             /etc/resolver/mesh with "nameserver 127.0.0.1" and "port 5300"
+
+Loopback addresses other than 127.0.0.1 need an alias on macOS
+(sudo ifconfig lo0 alias 127.77.0.1 and so on).`,
+	Run: func(cmd *cobra.Command, args []string) {
+		debug, _ := cmd.Flags().GetBool("debug")
+		grace, _ := cmd.Flags().GetDuration("grace")
+		listen, _ := cmd.Flags().GetString("listen")
+		domain, _ := cmd.Flags().GetString("domain")
+		network, _ := cmd.Flags().GetString("net")
+		ports, _ := cmd.Flags().GetIntSlice("port")
+		ttl, _ := cmd.Flags().GetDuration("ttl")
+		retries, _ := cmd.Flags().GetInt("retries")
+
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			pExit("Invalid network:", err)
+		}
+		if strings.Trim(domain, ".") == "" {
+			pExit("Invalid domain:", fmt.Errorf("empty"))
+		}
+		for _, port := range ports {
+			if port <= 0 || port > 65535 {
+				pExit("Invalid port:", fmt.Errorf("%d", port))
+			}
+		}
+
+		connect(meshcentral.Options{Debug: debug})
+
+		resolver := &meshcentral.Resolver{
+			Client:  client,
+			Address: listen,
+			Domain:  domain,
+			Network: ipNet,
+			Ports:   ports,
+			TTL:     ttl,
+			Retry:   meshcentral.Retry{Attempts: retries},
+		}
+		if err := resolver.Start(); err != nil {
+			client.Close()
+			pExit("Unable to start resolver:", err)
+		}
+
+		var portList []string
+		for _, port := range ports {
+			portList = append(portList, strconv.Itoa(port))
+		}
+		fmt.Printf("Answering *.%s on %s, devices get addresses in %s with ports %s.\n", strings.Trim(domain, "."), listen, ipNet, strings.Join(portList, ", "))
+		fmt.Println("Press ctrl-c to exit.")
+
+		waitForShutdown(&runningRoutes{resolvers: []*meshcentral.Resolver{resolver}}, grace)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(resolveCmd)
+
+	resolveCmd.Flags().String("listen", "127.0.0.1:5300", "Address of the DNS server (UDP)")
+	resolveCmd.Flags().String("domain", "mesh", "Domain the device names are in")
+	resolveCmd.Flags().String("net", "127.77.0.0/16", "Network the device addresses are taken from")
+	resolveCmd.Flags().IntSliceP("port", "p", []int{22, 80, 443, 3389, 5900, 8080, 8443}, "Ports forwarded on every device address (repeatable)")
+	resolveCmd.Flags().Duration("ttl", time.Minute, "TTL of the answers")
+	resolveCmd.Flags().Int("retries", 3, "How often a relay that can't be opened is tried again before a connection is dropped")
+	resolveCmd.Flags().Duration("grace", 10*time.Second, "How long open connections may finish after ctrl-c")
+	resolveCmd.Flags().BoolP("debug", "", false, "Enable debug logging")
+}
@@ -2,90 +2,912 @@ package cmd
 
 import (
 	"errors"
-	"regexp"
 	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/pterm/pterm"
 	"github.com/spf13/cobra"
 	//"github.com/spf13/viper"
 
-	"github.com/soarinferret/mcc/internal/meshcentral"
+	"github.com/soarinferret/mcc/internal/config"
+	"github.com/soarinferret/mcc/pkg/meshcentral"
 )
 
 var routeCmd = &cobra.Command{
 	Use:     "route",
 	Aliases: []string{"r"},
 	Short:   "Forward TCP traffic to specified Node",
-	Long: ``,
+	Long: `Forwards local TCP ports to nodes. -L can be repeated, all forwards share one
+login to the server. The host part of a forward selects where traffic goes:
+
+  -L 8080:80             port 80 on the --nodeid node
+  -L 8080:10.0.0.5:80    10.0.0.5:80 as reached from the --nodeid node
+  -L 5432:@db01:5432     port 5432 on the device named db01
+  -L 5432:db01:5432      the same without --nodeid, with it this is refused
+                         when db01 is a device, as the host could mean either
+  -L 8080:10.0.0.5@gw:80 10.0.0.5:80 as reached from the device gw
+  -L 8080:[fd00::5]:80   IPv6 targets go in brackets
+  -L 8000-8010:80-90     one forward per port of the ranges
+  -L /tmp/db.sock:5432   a unix socket (mode 0600) instead of a TCP port
+
+Like ssh, forwards listen on 127.0.0.1 unless --gateway-ports is given or a
+bind address is put in front, e.g. -L 0.0.0.0:8080:127.0.0.1:80 or
+-L '*:8080:db01:5432'.
+
+-D [bind:]port starts a SOCKS5 proxy (on 127.0.0.1 unless a bind address or
+--gateway-ports is given) that reaches any host:port the --nodeid node can reach.
+
+--http-proxy [bind:]port starts an HTTP proxy (CONNECT and plain http:// URLs)
+through the --nodeid node. --allow and --deny limit the destination networks
+of both proxies. Host names are resolved by the node and can't be checked, so
+they are refused as soon as --allow or --deny is given, use IP addresses then.
+
+-U [bind_address:]port:[host:]hostport forwards UDP the same way, every local client
+address gets its own relay which is closed after --udp-idle-timeout.
+
+--max-conns, --idle-timeout, --max-lifetime and --allow-from limit the TCP
+connections of every forward and proxy of the route, --access-log records
+each of them (client, start and end, bytes both ways and why it was closed)
+as a line of JSON.
+
+--limit-rate caps the bandwidth of every forward and proxy in each direction
+(shared by its connections, or per connection with --limit-per-conn). For
+routes in the daemon it can be changed with mcc route limit.
+
+When a relay can't be opened it is tried again --retries times with backoff,
+for -U that is the relay of every new UDP flow.
+--failover lists nodes (e.g. a second gateway at the site) that take over the
+forwards and proxies of the --nodeid node while it is offline, as reported by
+the server.
+
+--fleet forwards to every device that matches a selector instead of a single
+node, e.g. --fleet 'group=edge,os=*linux*' -L 9100. Selectors are comma
+separated key=value (or key!=value) terms with the keys id, name, group, os,
+ip and tag, values may use * and ?. Every device gets its own local port,
+counting up from the local port of -L (or chosen by the system when there is
+none), or with --fleet-net its own loopback address on the same port, e.g.
+--fleet-net 127.77.0.0/16 (other loopback addresses than 127.0.0.1 need an
+alias on macOS). Devices are added and removed as they come online and go
+offline. --fleet-file keeps the mapping in a file, as JSON or as a Prometheus
+file_sd target list (--fleet-format prometheus).`,
 	Run: func(cmd *cobra.Command, args []string) {
 
-		bindAddress, _ := cmd.Flags().GetString("bind-address")
-		nodeID, _ := cmd.Flags().GetString("nodeid")
 		debug, _ := cmd.Flags().GetBool("debug")
+		grace, _ := cmd.Flags().GetDuration("grace")
+		compress, _ := cmd.Flags().GetBool("compress")
+
+		opts := routeOptionsFromFlags(cmd)
+		if len(opts.forwards) == 0 && len(opts.udp) == 0 && opts.dynamic == "" && opts.httpProxy == "" {
+			opts.forwards = []string{""}
+		}
+		if _, err := opts.plan(); err != nil {
+			pExit("Invalid arguments:", err)
+		}
+
+		route, err := routeFromFlags(cmd, "")
+		if err != nil {
+			pExit("Invalid arguments:", err)
+		}
+
+		runRoutes([]config.Route{route}, meshcentral.Options{Debug: debug, Compress: compress}, grace)
+	},
+}
+
+// routeOptions holds everything a route is started with, from flags or from
+// a named route in the config
+type routeOptions struct {
+	name         string
+	nodeID       string
+	forwards     []string
+	udp          []string
+	dynamic      string
+	socksAuth    string
+	httpProxy    string
+	allow        []string
+	deny         []string
+	udpIdle      time.Duration
+	gatewayPorts bool
+	maxConns     int
+	idleTimeout  time.Duration
+	maxLifetime  time.Duration
+	allowFrom    []string
+	accessLog    string
+	limitRate    string
+	limitPerConn bool
+	failover     []string
+	retries      int
+	retryBackoff time.Duration
+	fleet        string
+	fleetNet     string
+	fleetFile    string
+	fleetFormat  string
+}
+
+func routeOptionsFromFlags(cmd *cobra.Command) routeOptions {
+	var opts routeOptions
+	opts.forwards, _ = cmd.Flags().GetStringArray("bind-address")
+	opts.nodeID, _ = cmd.Flags().GetString("nodeid")
+	opts.dynamic, _ = cmd.Flags().GetString("dynamic")
+	opts.socksAuth, _ = cmd.Flags().GetString("socks-auth")
+	opts.httpProxy, _ = cmd.Flags().GetString("http-proxy")
+	opts.allow, _ = cmd.Flags().GetStringSlice("allow")
+	opts.deny, _ = cmd.Flags().GetStringSlice("deny")
+	opts.udp, _ = cmd.Flags().GetStringArray("udp")
+	opts.udpIdle, _ = cmd.Flags().GetDuration("udp-idle-timeout")
+	opts.gatewayPorts, _ = cmd.Flags().GetBool("gateway-ports")
+	opts.maxConns, _ = cmd.Flags().GetInt("max-conns")
+	opts.idleTimeout, _ = cmd.Flags().GetDuration("idle-timeout")
+	opts.maxLifetime, _ = cmd.Flags().GetDuration("max-lifetime")
+	opts.allowFrom, _ = cmd.Flags().GetStringSlice("allow-from")
+	opts.accessLog, _ = cmd.Flags().GetString("access-log")
+	opts.limitRate, _ = cmd.Flags().GetString("limit-rate")
+	opts.limitPerConn, _ = cmd.Flags().GetBool("limit-per-conn")
+	opts.failover, _ = cmd.Flags().GetStringSlice("failover")
+	opts.retries, _ = cmd.Flags().GetInt("retries")
+	opts.retryBackoff, _ = cmd.Flags().GetDuration("retry-backoff")
+	opts.fleet, _ = cmd.Flags().GetString("fleet")
+	opts.fleetNet, _ = cmd.Flags().GetString("fleet-net")
+	opts.fleetFile, _ = cmd.Flags().GetString("fleet-file")
+	opts.fleetFormat, _ = cmd.Flags().GetString("fleet-format")
+	return opts
+}
+
+// routePlan is a parsed route, ready to be started once logged in
+type routePlan struct {
+	name     string
+	nodeID   string
+	specs    []bindSpec
+	udpSpecs []bindSpec
+	udpIdle  time.Duration
+	gateway  bool
+	socks    *meshcentral.SocksProxy
+	proxy    *meshcentral.HttpProxy
+	limits   meshcentral.Limits
+
+	// accessLog is opened when the route is started, "-" is stdout
+	accessLog string
+	// every forward gets its own limiter with this rate
+	rate    int64
+	perConn bool
+	// failover nodes for the forwards to the route's node
+	failover []string
+	retry    meshcentral.Retry
+	// one fleet per forward when the route follows a selector
+	fleets      []*meshcentral.Fleet
+	fleetFile   string
+	fleetFormat string
+}
+
+// plan parses the options without touching the network, so mistakes are
+// reported before logging in
+func (opts routeOptions) plan() (*routePlan, error) {
+	plan := &routePlan{name: opts.name, nodeID: opts.nodeID, udpIdle: opts.udpIdle, gateway: opts.gatewayPorts, accessLog: opts.accessLog}
+
+	if opts.maxConns < 0 || opts.idleTimeout < 0 || opts.maxLifetime < 0 {
+		return nil, errors.New("max conns, idle timeout and max lifetime must not be negative")
+	}
+	plan.limits = meshcentral.Limits{MaxConns: opts.maxConns, IdleTimeout: opts.idleTimeout, MaxLifetime: opts.maxLifetime}
+	var err error
+	if plan.rate, err = config.ParseRate(opts.limitRate); err != nil {
+		return nil, fmt.Errorf("limit rate: %w", err)
+	}
+	plan.perConn = opts.limitPerConn
+
+	if opts.retries < 0 || opts.retryBackoff < 0 {
+		return nil, errors.New("retries and retry backoff must not be negative")
+	}
+	plan.retry = meshcentral.Retry{Attempts: opts.retries, Backoff: opts.retryBackoff}
+	plan.failover = opts.failover
+
+	policy := &meshcentral.NetworkPolicy{}
+	if plan.limits.Sources, err = meshcentral.ParseNetworks(opts.allowFrom); err != nil {
+		return nil, fmt.Errorf("allow-from: %w", err)
+	}
+	if policy.Allow, err = meshcentral.ParseNetworks(opts.allow); err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	if policy.Deny, err = meshcentral.ParseNetworks(opts.deny); err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
 
-		localport, target, remoteport, err := parseBindAddress(bindAddress)
+	if opts.dynamic != "" {
+		address, err := parseDynamicAddress(opts.dynamic, opts.gatewayPorts)
 		if err != nil {
-			fmt.Println("Error parsing bind address: ", err)
-			return
+			return nil, fmt.Errorf("dynamic address %q: %w", opts.dynamic, err)
+		}
+		plan.socks = &meshcentral.SocksProxy{Address: address, Policy: policy, Limits: plan.limits}
+		if opts.socksAuth != "" {
+			user, pass, ok := strings.Cut(opts.socksAuth, ":")
+			if !ok {
+				return nil, errors.New("SOCKS credentials must be user:password")
+			}
+			plan.socks.Username, plan.socks.Password = user, pass
 		}
+	}
 
-		meshcentral.ApplySettings(
-			nodeID,
-			remoteport,
-			localport,
-			target,
-			debug,
-		)
+	if opts.httpProxy != "" {
+		address, err := parseDynamicAddress(opts.httpProxy, opts.gatewayPorts)
+		if err != nil {
+			return nil, fmt.Errorf("HTTP proxy address %q: %w", opts.httpProxy, err)
+		}
+		plan.proxy = &meshcentral.HttpProxy{Address: address, Policy: policy, Limits: plan.limits}
+	}
 
-		meshcentral.StartSocket()
+	for _, bindAddress := range opts.forwards {
+		spec, err := parseBindAddress(bindAddress)
+		if err != nil {
+			return nil, fmt.Errorf("forward %q: %w", bindAddress, err)
+		}
+		plan.specs = append(plan.specs, spec...)
+	}
 
-		if nodeID == "" {
-			devices := meshcentral.GetDevices()
-			filterAndSortDevices(&devices)
-			nodeID = searchDevices(&devices)
+	if opts.fleet != "" {
+		if err := opts.planFleets(plan); err != nil {
+			return nil, err
+		}
+	}
 
-			meshcentral.ApplySettings(
-				nodeID,
-				remoteport,
-				localport,
-				target,
-				debug,
-			)
+	for _, udpAddress := range opts.udp {
+		spec, err := parseBindAddress(udpAddress)
+		if err != nil {
+			return nil, fmt.Errorf("UDP forward %q: %w", udpAddress, err)
+		}
+		if spec[0].socketPath != "" {
+			return nil, fmt.Errorf("UDP forward %q: unix sockets are only supported for TCP forwards", udpAddress)
 		}
+		plan.udpSpecs = append(plan.udpSpecs, spec...)
+	}
 
-		ready := make(chan struct{})
-		meshcentral.StartRouter(ready)
-	},
+	return plan, nil
+}
+
+// planFleets turns the forwards of a --fleet route into fleets
+func (opts routeOptions) planFleets(plan *routePlan) error {
+	if opts.nodeID != "" || len(opts.failover) > 0 || len(opts.udp) > 0 || opts.dynamic != "" || opts.httpProxy != "" {
+		return errors.New("--fleet only works with -L, not with a node, failover, -U, -D or --http-proxy")
+	}
+	selector, err := meshcentral.ParseSelector(opts.fleet)
+	if err != nil {
+		return err
+	}
+
+	var network *net.IPNet
+	if opts.fleetNet != "" {
+		if _, network, err = net.ParseCIDR(opts.fleetNet); err != nil {
+			return fmt.Errorf("fleet network: %w", err)
+		}
+	}
+	switch opts.fleetFormat {
+	case "", "json", "prometheus":
+	default:
+		return fmt.Errorf("unknown fleet format %q, expected json or prometheus", opts.fleetFormat)
+	}
+	plan.fleetFile, plan.fleetFormat = opts.fleetFile, opts.fleetFormat
+
+	for _, spec := range plan.specs {
+		if spec.socketPath != "" || strings.Contains(spec.host, "@") {
+			return errors.New("fleet forwards go to a port (or host:port) on every device")
+		}
+		target := spec.host
+		if target == "127.0.0.1" {
+			target = ""
+		}
+		plan.fleets = append(plan.fleets, &meshcentral.Fleet{
+			Selector:     selector,
+			BindAddress:  bindHost(spec, opts.gatewayPorts),
+			Network:      network,
+			LocalPort:    spec.localPort,
+			RemoteTarget: target,
+			RemotePort:   spec.remotePort,
+		})
+	}
+	plan.specs = nil
+	return nil
+}
+
+// runningRoutes is everything started by startRoutes
+type runningRoutes struct {
+	forwards    []*meshcentral.Forward
+	udpForwards []*meshcentral.Forward
+	socks       []*meshcentral.SocksProxy
+	proxies     []*meshcentral.HttpProxy
+	fleets      []*meshcentral.Fleet
+	resolvers   []*meshcentral.Resolver
+	gateways    []*meshcentral.Gateway
+	accessLogs  []io.Closer
+}
+
+// startRoutes resolves the nodes of every plan and starts its listeners over
+// the shared control connection. If anything can't be started, whatever was
+// already started is closed again.
+func startRoutes(plans []*routePlan) (*runningRoutes, error) {
+	running := &runningRoutes{}
+
+	for _, plan := range plans {
+		if err := running.start(plan); err != nil {
+			running.Close()
+			return nil, err
+		}
+	}
+	return running, nil
+}
+
+func (running *runningRoutes) start(plan *routePlan) error {
+	var failover []meshcentral.Device
+	for _, node := range plan.failover {
+		device, err := client.FindDevice(node)
+		if err != nil {
+			return fmt.Errorf("unable to find failover node: %w", err)
+		}
+		failover = append(failover, *device)
+	}
+
+	forwards, err := resolveForwards(plan.specs, plan.nodeID, plan.gateway, failover)
+	if err != nil {
+		return err
+	}
+	udpForwards, err := resolveForwards(plan.udpSpecs, plan.nodeID, plan.gateway, failover)
+	if err != nil {
+		return err
+	}
+
+	if plan.accessLog != "" {
+		var accessLog io.Writer = os.Stdout
+		if plan.accessLog != "-" {
+			file, err := os.OpenFile(plan.accessLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+			if err != nil {
+				return fmt.Errorf("unable to open access log: %w", err)
+			}
+			running.accessLogs = append(running.accessLogs, file)
+			accessLog = file
+		}
+		plan.limits.AccessLog = accessLog
+		if plan.socks != nil {
+			plan.socks.Limits.AccessLog = accessLog
+		}
+		if plan.proxy != nil {
+			plan.proxy.Limits.AccessLog = accessLog
+		}
+	}
+	// a limiter even without a rate, so the daemon can set one later
+	for _, fwd := range forwards {
+		fwd.Limits = plan.limits
+		fwd.Limits.Rate = meshcentral.NewRateLimit(plan.rate, plan.perConn)
+		fwd.Retry = plan.retry
+	}
+	for _, fwd := range udpForwards {
+		fwd.Limits.Rate = meshcentral.NewRateLimit(plan.rate, plan.perConn)
+		fwd.Retry = plan.retry
+	}
+	if plan.socks != nil {
+		plan.socks.Limits.Rate = meshcentral.NewRateLimit(plan.rate, plan.perConn)
+	}
+	if plan.proxy != nil {
+		plan.proxy.Limits.Rate = meshcentral.NewRateLimit(plan.rate, plan.perConn)
+	}
+
+	if plan.socks != nil || plan.proxy != nil {
+		if plan.nodeID == "" {
+			plan.nodeID = resolveNode("", "")
+		}
+		device, err := client.FindDevice(plan.nodeID)
+		if err != nil {
+			return fmt.Errorf("unable to find node: %w", err)
+		}
+
+		if plan.socks != nil {
+			plan.socks.Client = client
+			plan.socks.NodeID, plan.socks.NodeName = device.Id, device.Name
+			plan.socks.Failover, plan.socks.Retry = failover, plan.retry
+
+			if err := plan.socks.Start(); err != nil {
+				return err
+			}
+			running.socks = append(running.socks, plan.socks)
+		}
+
+		if plan.proxy != nil {
+			plan.proxy.Client = client
+			plan.proxy.NodeID, plan.proxy.NodeName = device.Id, device.Name
+			plan.proxy.Failover, plan.proxy.Retry = failover, plan.retry
+
+			if err := plan.proxy.Start(); err != nil {
+				return err
+			}
+			running.proxies = append(running.proxies, plan.proxy)
+		}
+	}
+
+	if err := client.StartForwards(forwards); err != nil {
+		return err
+	}
+	running.forwards = append(running.forwards, forwards...)
+
+	for _, fleet := range plan.fleets {
+		fleet.Client = client
+		fleet.Limits = plan.limits
+		fleet.Limits.Rate = meshcentral.NewRateLimit(plan.rate, plan.perConn)
+		fleet.Retry = plan.retry
+		if plan.fleetFile != "" {
+			fleets, path, format := plan.fleets, plan.fleetFile, plan.fleetFormat
+			fleet.OnChange = func() {
+				if err := writeFleetFile(path, format, fleets); err != nil {
+					// stdout may carry the access log
+					fmt.Fprintln(os.Stderr, "Unable to write fleet file:", err)
+				}
+			}
+		}
+		fleet.Start()
+		running.fleets = append(running.fleets, fleet)
+	}
+
+	if err := client.StartUdpForwards(udpForwards, plan.udpIdle); err != nil {
+		return err
+	}
+	running.udpForwards = append(running.udpForwards, udpForwards...)
+
+	return nil
+}
+
+// Close stops every listener and connection of the routes
+func (running *runningRoutes) Close() {
+	for _, socks := range running.socks {
+		socks.Close()
+	}
+	for _, proxy := range running.proxies {
+		proxy.Close()
+	}
+	for _, fwd := range running.forwards {
+		fwd.Close()
+	}
+	for _, fwd := range running.udpForwards {
+		fwd.Close()
+	}
+	for _, fleet := range running.fleets {
+		fleet.Close()
+	}
+	for _, resolver := range running.resolvers {
+		resolver.Close()
+	}
+	for _, gateway := range running.gateways {
+		gateway.Close()
+	}
+	for _, accessLog := range running.accessLogs {
+		accessLog.Close()
+	}
+}
+
+// Shutdown stops accepting on every listener and waits up to grace for the
+// open connections to finish
+func (running *runningRoutes) Shutdown(grace time.Duration) {
+	var wg sync.WaitGroup
+	shutdown := func(r interface{ Shutdown(time.Duration) }) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Shutdown(grace)
+		}()
+	}
+	for _, socks := range running.socks {
+		shutdown(socks)
+	}
+	for _, proxy := range running.proxies {
+		shutdown(proxy)
+	}
+	for _, fwd := range running.forwards {
+		shutdown(fwd)
+	}
+	for _, fwd := range running.udpForwards {
+		shutdown(fwd)
+	}
+	for _, fleet := range running.fleets {
+		shutdown(fleet)
+	}
+	for _, resolver := range running.resolvers {
+		shutdown(resolver)
+	}
+	for _, gateway := range running.gateways {
+		shutdown(gateway)
+	}
+	wg.Wait()
+
+	for _, accessLog := range running.accessLogs {
+		accessLog.Close()
+	}
+}
+
+// waitForShutdown blocks until SIGINT or SIGTERM, then drains the routes and
+// logs out. A second signal exits straight away.
+func waitForShutdown(running *runningRoutes, grace time.Duration) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	active := int64(0)
+	for _, row := range running.rows() {
+		active += row.Stats.Active
+	}
+	if active > 0 {
+		fmt.Printf("Waiting up to %v for %d connection(s) to finish, press ctrl-c again to quit now.\n", grace, active)
+	}
+	go func() {
+		<-signals
+		os.Exit(1)
+	}()
+
+	running.Shutdown(grace)
+	client.Close()
+}
+
+// forwardRow describes one listener of a running route
+type forwardRow struct {
+	Local       string                 `json:"local"`
+	Node        string                 `json:"node"`
+	Destination string                 `json:"destination"`
+	Stats       meshcentral.RelayStats `json:"stats"`
+	Rate        int64                  `json:"rate,omitempty"`
+}
+
+// setRate changes the rate limit of every forward and proxy
+func (running *runningRoutes) setRate(rate int64) {
+	for _, socks := range running.socks {
+		socks.Limits.Rate.SetRate(rate)
+	}
+	for _, proxy := range running.proxies {
+		proxy.Limits.Rate.SetRate(rate)
+	}
+	for _, fwd := range running.forwards {
+		fwd.Limits.Rate.SetRate(rate)
+	}
+	for _, fwd := range running.udpForwards {
+		fwd.Limits.Rate.SetRate(rate)
+	}
+	for _, fleet := range running.fleets {
+		fleet.Limits.Rate.SetRate(rate)
+	}
+}
+
+func (running *runningRoutes) rows() []forwardRow {
+	var rows []forwardRow
+	for _, socks := range running.socks {
+		rows = append(rows, forwardRow{socks.Address, socks.NodeName, "SOCKS5 (any host)", socks.Stats(), socks.Limits.Rate.Rate()})
+	}
+	for _, proxy := range running.proxies {
+		rows = append(rows, forwardRow{proxy.Address, proxy.NodeName, "HTTP proxy (any host)", proxy.Stats(), proxy.Limits.Rate.Rate()})
+	}
+	row := func(fwd *meshcentral.Forward, suffix string) forwardRow {
+		target := fwd.RemoteTarget
+		if target == "" {
+			target = "127.0.0.1"
+		}
+		local := net.JoinHostPort(displayBind(fwd.BindAddress), strconv.Itoa(fwd.LocalPort)) + suffix
+		if fwd.SocketPath != "" {
+			local = fwd.SocketPath
+		}
+		node := fwd.NodeName
+		if len(fwd.Failover) > 0 {
+			var names []string
+			for _, f := range fwd.Failover {
+				names = append(names, f.Name)
+			}
+			node += " (failover " + strings.Join(names, ", ") + ")"
+		}
+		return forwardRow{local, node, fmt.Sprintf("%s:%d%s", target, fwd.RemotePort, suffix), fwd.Stats(), fwd.Limits.Rate.Rate()}
+	}
+	for _, fwd := range running.forwards {
+		rows = append(rows, row(fwd, ""))
+	}
+	for _, fwd := range running.udpForwards {
+		rows = append(rows, row(fwd, "/udp"))
+	}
+	for _, fleet := range running.fleets {
+		forwards := fleet.Forwards()
+		if len(forwards) == 0 {
+			rows = append(rows, forwardRow{"-", "fleet " + fleet.Selector.String() + " (none online)", fleet.Destination(), meshcentral.RelayStats{}, fleet.Limits.Rate.Rate()})
+		}
+		for _, fwd := range forwards {
+			rows = append(rows, row(fwd, ""))
+		}
+	}
+	for _, resolver := range running.resolvers {
+		for _, name := range resolver.Names() {
+			for _, fwd := range name.Forwards {
+				r := row(fwd, "")
+				r.Local = name.Name + ":" + strconv.Itoa(fwd.LocalPort)
+				rows = append(rows, r)
+			}
+		}
+	}
+	return rows
 }
 
 func init() {
 	rootCmd.AddCommand(routeCmd)
 
 	routeCmd.Flags().StringP("nodeid", "i", "", "Mesh Central Node ID")
-	routeCmd.Flags().StringP("bind-address", "L", "", "localport:[target:]remoteport")
+	routeCmd.Flags().StringArrayP("bind-address", "L", nil, "[bind_address:]port:host:hostport (or port:hostport), repeatable")
+	routeCmd.Flags().BoolP("gateway-ports", "g", false, "Listen on all interfaces instead of loopback")
+	routeCmd.Flags().StringP("dynamic", "D", "", "[bind:]port for a SOCKS5 proxy through the node")
+	routeCmd.Flags().String("socks-auth", "", "user:password required by the SOCKS5 proxy")
+	routeCmd.Flags().StringArrayP("udp", "U", nil, "[bind_address:]port:[host:]hostport for UDP, repeatable")
+	routeCmd.Flags().Duration("udp-idle-timeout", time.Minute, "Close UDP flows after this long without traffic")
+	routeCmd.Flags().String("http-proxy", "", "[bind:]port for an HTTP proxy through the node")
+	routeCmd.Flags().StringSlice("allow", nil, "Destination networks the proxies may reach (CIDR, repeatable, host names are refused)")
+	routeCmd.Flags().StringSlice("deny", nil, "Destination networks the proxies may not reach (CIDR, repeatable, host names are refused)")
+	routeCmd.Flags().Int("max-conns", 0, "Refuse connections beyond this many per forward (0 for no limit)")
+	routeCmd.Flags().Duration("idle-timeout", 0, "Close TCP connections after this long without traffic")
+	routeCmd.Flags().Duration("max-lifetime", 0, "Close TCP connections after this long")
+	routeCmd.Flags().StringSlice("allow-from", nil, "Client networks that may connect to the forwards (CIDR, repeatable), loopback is always allowed")
+	routeCmd.Flags().String("access-log", "", "Append a JSON line per connection to this file (- for stdout)")
+	routeCmd.Flags().StringSlice("failover", nil, "Nodes to use when the --nodeid node is offline, in order (repeatable)")
+	routeCmd.Flags().Int("retries", 3, "How often a relay that can't be opened is tried again before a connection is dropped")
+	routeCmd.Flags().Duration("retry-backoff", 500*time.Millisecond, "Wait before the first retry, doubled after each")
+	routeCmd.Flags().String("fleet", "", "Forward to every device matching this selector, e.g. 'group=edge'")
+	routeCmd.Flags().String("fleet-net", "", "Give every fleet device its own address in this network, e.g. 127.77.0.0/16")
+	routeCmd.Flags().String("fleet-file", "", "Keep the fleet's local addresses in this file")
+	routeCmd.Flags().String("fleet-format", "json", "Format of --fleet-file: json or prometheus (file_sd)")
+	routeCmd.Flags().String("limit-rate", "", "Limit the bandwidth in each direction, e.g. 512K or 2M (bytes per second)")
+	routeCmd.Flags().Bool("limit-per-conn", false, "Apply --limit-rate to every connection (or UDP flow) instead of every forward")
+	routeCmd.Flags().Bool("compress", false, "Ask the server for permessage-deflate on relays, for compressible traffic over slow links")
+	routeCmd.Flags().Duration("grace", 10*time.Second, "How long open connections may finish after ctrl-c")
 	routeCmd.Flags().BoolP("debug", "", false, "Enable debug logging")
 }
 
-// parseBindAddress parses a bind address string in the format:
-// "localport:target:remoteport" or "localport:remoteport" or just "remoteport"
-func parseBindAddress(s string) (localPort int, target string, remotePort int, err error) {
-	// Define regex pattern to match both formats
-	pattern := `^(?:(\d+)(?::([\w\.\-]+))?:)?(\d+)$`
-	re := regexp.MustCompile(pattern)
+// parseDynamicAddress turns [bind:]port into a listen address, defaulting to
+// loopback so the proxy is not open to the network by accident
+func parseDynamicAddress(s string, gatewayPorts bool) (string, error) {
+	host, port := "127.0.0.1", s
+	if gatewayPorts {
+		host = ""
+	}
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		host, port = strings.Trim(s[:i], "[]"), s[i+1:]
+		if host == "" || host == "*" {
+			host = ""
+		}
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", errors.New("invalid port " + port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// bindSpec is a parsed -L argument, host is resolved to a node and/or target
+// once the device list is available. An empty bind means the default address.
+type bindSpec struct {
+	socketPath string
+	bind       string
+	bindSet    bool
+	localPort  int
+	host       string
+	remotePort int
+}
 
-	matches := re.FindStringSubmatch(s)
-	if matches == nil {
-		return 0, "", 0, errors.New("invalid bind address format")
+// parseBindAddress parses a forward in the format ssh uses for -L,
+// "[bind_address:]port:host:hostport", as well as "port:hostport" and just
+// "hostport". IPv6 addresses are written in brackets and port ranges such as
+// 8000-8010:80-90 expand to one forward per port. A local part that is a path,
+// "/run/db.sock:[host:]hostport", listens on a unix socket instead.
+func parseBindAddress(s string) ([]bindSpec, error) {
+	parts, err := splitForward(s)
+	if err != nil {
+		return nil, err
 	}
 
-	localPort, _ = strconv.Atoi(matches[1]) // First capture group (local port)
-	target = matches[2]
-	remotePort, _ = strconv.Atoi(matches[3]) // Third capture group (remote port)
+	var spec bindSpec
+	var localPorts, remotePorts []int
+
+	if isSocketPath(parts[0]) {
+		spec.socketPath = parts[0]
+		switch len(parts) {
+		case 3:
+			spec.host = parts[1]
+			if spec.host == "" {
+				return nil, errors.New("invalid bind address format: empty host")
+			}
+		case 2:
+		default:
+			return nil, errors.New("invalid bind address format: expected path:[host:]hostport")
+		}
+		port, err := strconv.ParseUint(parts[len(parts)-1], 10, 16)
+		if err != nil || port == 0 {
+			return nil, errors.New("invalid port " + parts[len(parts)-1])
+		}
+		spec.remotePort = int(port)
+		return []bindSpec{spec}, nil
+	}
 
-	// If target is "127.0.0.1", set to nothing
-	if target == "127.0.0.1" {
-		target = ""
+	switch len(parts) {
+	case 4:
+		spec.bind, spec.bindSet = parts[0], true
+		parts = parts[1:]
+		fallthrough
+	case 3:
+		spec.host = parts[1]
+		if spec.host == "" {
+			return nil, errors.New("invalid bind address format: empty host")
+		}
+		parts = []string{parts[0], parts[2]}
+		fallthrough
+	case 2:
+		if localPorts, err = parsePortRange(parts[0]); err != nil {
+			return nil, err
+		}
+		parts = parts[1:]
+		fallthrough
+	case 1:
+		if remotePorts, err = parsePortRange(parts[0]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("invalid bind address format")
 	}
 
-	return localPort, target, remotePort, nil
+	if localPorts == nil {
+		if len(remotePorts) > 1 {
+			return nil, errors.New("invalid bind address format: a port range needs a local range")
+		}
+		localPorts = []int{0}
+	}
+	if len(remotePorts) == 1 && len(localPorts) > 1 {
+		return nil, errors.New("invalid bind address format: a local port range needs a remote range")
+	}
+	if len(localPorts) != len(remotePorts) {
+		return nil, errors.New("invalid bind address format: port ranges differ in length")
+	}
+
+	specs := make([]bindSpec, len(localPorts))
+	for i := range localPorts {
+		specs[i] = spec
+		specs[i].localPort, specs[i].remotePort = localPorts[i], remotePorts[i]
+	}
+	return specs, nil
+}
+
+func isSocketPath(s string) bool {
+	return strings.HasPrefix(s, "/") || strings.HasPrefix(s, "./") || strings.HasPrefix(s, "../")
+}
+
+// splitForward splits on the colons outside of [] and strips the brackets
+func splitForward(s string) ([]string, error) {
+	var parts []string
+	var part strings.Builder
+	bracketed := false
+	for _, r := range s {
+		switch {
+		case r == '[' && !bracketed:
+			bracketed = true
+		case r == ']' && bracketed:
+			bracketed = false
+		case r == ':' && !bracketed:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteRune(r)
+		}
+	}
+	if bracketed {
+		return nil, errors.New("invalid bind address format: unterminated [")
+	}
+	return append(parts, part.String()), nil
+}
+
+// parsePortRange parses "port" or "first-last"
+func parsePortRange(s string) ([]int, error) {
+	first, last, isRange := strings.Cut(s, "-")
+	start, err := strconv.ParseUint(first, 10, 16)
+	if err != nil {
+		return nil, errors.New("invalid port " + s)
+	}
+	end := start
+	if isRange {
+		end, err = strconv.ParseUint(last, 10, 16)
+		if err != nil || end < start || start == 0 {
+			return nil, errors.New("invalid port range " + s)
+		}
+	}
+	var ports []int
+	for port := start; port <= end; port++ {
+		ports = append(ports, int(port))
+	}
+	return ports, nil
+}
+
+// bindHost picks the local address a forward listens on. Like ssh, forwards
+// only listen on loopback unless --gateway-ports is set or the forward names
+// its own bind address ("*" or an empty one meaning all interfaces).
+func bindHost(spec bindSpec, gatewayPorts bool) string {
+	if !spec.bindSet {
+		if gatewayPorts {
+			return ""
+		}
+		return "127.0.0.1"
+	}
+	switch spec.bind {
+	case "", "*":
+		return ""
+	case "localhost":
+		return "127.0.0.1"
+	}
+	return spec.bind
+}
+
+// resolveForwards works out the node and target of every forward. A host is
+// either target@node, the name or id of a device when there is no default
+// node, or a target reached through the default node (which is searched for
+// interactively when not given). A host that names a device while there is a
+// default node is refused as ambiguous.
+func resolveForwards(specs []bindSpec, defaultNode string, gatewayPorts bool, failover []meshcentral.Device) ([]*meshcentral.Forward, error) {
+	var forwards []*meshcentral.Forward
+	for _, spec := range specs {
+		fwd := &meshcentral.Forward{
+			SocketPath:  spec.socketPath,
+			BindAddress: bindHost(spec, gatewayPorts),
+			LocalPort:   spec.localPort,
+			RemotePort:  spec.remotePort,
+		}
+
+		node := ""
+		target := spec.host
+		if i := strings.Index(spec.host, "@"); i >= 0 {
+			target, node = spec.host[:i], spec.host[i+1:]
+		} else if spec.host != "" {
+			device, err := client.FindDevice(spec.host)
+			switch {
+			case err == nil && defaultNode != "":
+				// with a node given the host could mean either
+				return nil, fmt.Errorf("%s is the name of a device, write @%s for the device or %s@<node> for the host %s as reached from a node", spec.host, spec.host, spec.host, spec.host)
+			case err == nil:
+				node, target = device.Id, ""
+			case !errors.Is(err, meshcentral.ErrDeviceNotFound):
+				return nil, fmt.Errorf("unable to find node: %w", err)
+			}
+		}
+
+		// If target is "127.0.0.1", set to nothing
+		if target == "127.0.0.1" {
+			target = ""
+		}
+		fwd.RemoteTarget = target
+
+		if node == "" {
+			if defaultNode == "" {
+				defaultNode = resolveNode("", "")
+			}
+			node = defaultNode
+			fwd.Failover = failover
+		}
+		device, err := client.FindDevice(node)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find node: %w", err)
+		}
+		fwd.NodeID = device.Id
+		fwd.NodeName = device.Name
+
+		forwards = append(forwards, fwd)
+	}
+	return forwards, nil
+}
+
+func (running *runningRoutes) print() {
+	data := [][]string{{"Local", "Node", "Destination"}}
+	for _, row := range running.rows() {
+		data = append(data, []string{row.Local, row.Node, row.Destination})
+	}
+	pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+}
+
+func displayBind(host string) string {
+	if host == "" {
+		return "*"
+	}
+	return host
 }
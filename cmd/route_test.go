@@ -0,0 +1,281 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/soarinferret/mcc/pkg/meshcentral"
+)
+
+func TestRouteOptionsPlanErrors(t *testing.T) {
+	tests := map[string]struct {
+		opts routeOptions
+		want string
+	}{
+		"negative max conns":  {routeOptions{maxConns: -1}, "max conns, idle timeout and max lifetime must not be negative"},
+		"bad rate":            {routeOptions{limitRate: "fast"}, `limit rate: invalid rate "fast"`},
+		"negative retries":    {routeOptions{retries: -1}, "retries and retry backoff must not be negative"},
+		"bad allow-from":      {routeOptions{allowFrom: []string{"office"}}, `allow-from: invalid network "office"`},
+		"bad deny":            {routeOptions{deny: []string{"10.0.0.0/33"}}, "deny: "},
+		"bad dynamic port":    {routeOptions{dynamic: "socks"}, `dynamic address "socks": `},
+		"socks auth":          {routeOptions{dynamic: "1080", socksAuth: "bob"}, "SOCKS credentials must be user:password"},
+		"bad proxy port":      {routeOptions{httpProxy: "127.0.0.1:x"}, `HTTP proxy address "127.0.0.1:x": `},
+		"bad forward":         {routeOptions{forwards: []string{"8080:localhost:http"}}, `forward "8080:localhost:http": invalid port http`},
+		"unix udp":            {routeOptions{udp: []string{"/tmp/dns.sock:53"}}, `UDP forward "/tmp/dns.sock:53": unix sockets are only supported for TCP forwards`},
+		"fleet format":        {routeOptions{fleet: "group=edge", forwards: []string{"9100"}, fleetFormat: "yaml"}, `unknown fleet format "yaml", expected json or prometheus`},
+		"fleet network":       {routeOptions{fleet: "group=edge", forwards: []string{"9100"}, fleetNet: "127.77.0.0"}, "fleet network: "},
+		"fleet to one device": {routeOptions{fleet: "group=edge", forwards: []string{"9100:db01@localhost:9100"}}, "fleet forwards go to a port (or host:port) on every device"},
+	}
+
+	for name, tt := range tests {
+		_, err := tt.opts.plan()
+		if err == nil {
+			t.Errorf("%s: plan() succeeded, want %q", name, tt.want)
+			continue
+		}
+		// callers print it after "Invalid arguments:"
+		if !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("%s: plan() = %q, want %q", name, err, tt.want)
+		}
+	}
+}
+
+func TestResolveForwards(t *testing.T) {
+	connectFake(t,
+		meshcentral.Device{Id: "node//web01", Name: "web01"},
+		meshcentral.Device{Id: "node//db01", Name: "db01"},
+		meshcentral.Device{Id: "node//gw", Name: "gw"},
+	)
+	failover := []meshcentral.Device{{Id: "node//gw", Name: "gw"}}
+
+	// each forward picks its own node
+	var specs []bindSpec
+	for _, arg := range []string{"5432:db01:5432", "8080:10.0.0.5@gw:80", "8081:@web01:80", "8443:127.0.0.1@node//web01:443", "9000-9001:[fd00::1]@gw:9000-9001"} {
+		s, err := parseBindAddress(arg)
+		if err != nil {
+			t.Fatalf("parseBindAddress(%q): %v", arg, err)
+		}
+		specs = append(specs, s...)
+	}
+	forwards, err := resolveForwards(specs, "", false, failover)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, fwd := range forwards {
+		got = append(got, fmt.Sprintf("%s:%d>%s/%s:%d failover=%d", fwd.BindAddress, fwd.LocalPort, fwd.NodeName, fwd.RemoteTarget, fwd.RemotePort, len(fwd.Failover)))
+	}
+	want := []string{
+		"127.0.0.1:5432>db01/:5432 failover=0",
+		"127.0.0.1:8080>gw/10.0.0.5:80 failover=0",
+		"127.0.0.1:8081>web01/:80 failover=0",
+		"127.0.0.1:8443>web01/:443 failover=0",
+		"127.0.0.1:9000>gw/fd00::1:9000 failover=0",
+		"127.0.0.1:9001>gw/fd00::1:9001 failover=0",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// with a default node, hosts are reached through it and fail over
+	specs, _ = parseBindAddress("0.0.0.0:2222:10.0.0.9:22")
+	forwards, err = resolveForwards(specs, "web01", false, failover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fwd := forwards[0]; fwd.NodeID != "node//web01" || fwd.RemoteTarget != "10.0.0.9" || fwd.BindAddress != "0.0.0.0" || len(fwd.Failover) != 1 {
+		t.Errorf("forward through the default node = %+v", fwd)
+	}
+
+	for spec, want := range map[string]string{
+		"5432:db01:5432":    "db01 is the name of a device, write @db01 for the device or db01@<node> for the host db01 as reached from a node",
+		"5432:db@db02:5432": "unable to find node: no device found matching db02",
+	} {
+		specs, _ := parseBindAddress(spec)
+		if _, err := resolveForwards(specs, "web01", false, nil); err == nil || err.Error() != want {
+			t.Errorf("%s: resolveForwards() = %v, want %q", spec, err, want)
+		}
+	}
+}
+
+func TestParseBindAddress(t *testing.T) {
+	// each spec prints as bind>local>host>remote, with a bind of "-" when the
+	// forward didn't name one
+	format := func(specs []bindSpec) string {
+		var out []string
+		for _, s := range specs {
+			bind := "-"
+			if s.bindSet {
+				bind = "[" + s.bind + "]"
+			}
+			out = append(out, fmt.Sprintf("%s>%d>%s>%d", bind, s.localPort, s.host, s.remotePort))
+		}
+		return strings.Join(out, " ")
+	}
+
+	for _, tt := range []struct{ arg, want string }{
+		{"80", "->0>>80"},
+		{"8080:80", "->8080>>80"},
+		{"8080:10.0.0.5:80", "->8080>10.0.0.5>80"},
+		{"0.0.0.0:8080:10.0.0.5:80", "[0.0.0.0]>8080>10.0.0.5>80"},
+		{":8080:10.0.0.5:80", "[]>8080>10.0.0.5>80"},
+		{"*:8080:10.0.0.5:80", "[*]>8080>10.0.0.5>80"},
+		{"[::1]:8080:[fd00::5]:80", "[::1]>8080>fd00::5>80"},
+		{"8080:[fd00::5]@gw:80", "->8080>fd00::5@gw>80"},
+		{"9000-9002:db01:5432-5434", "->9000>db01>5432 ->9001>db01>5433 ->9002>db01>5434"},
+		{"[::]:53-54:dns:53-54", "[::]>53>dns>53 [::]>54>dns>54"},
+		{"7000-7000:7000-7000", "->7000>>7000"},
+	} {
+		specs, err := parseBindAddress(tt.arg)
+		if err != nil {
+			t.Errorf("parseBindAddress(%q): %v", tt.arg, err)
+		} else if got := format(specs); got != tt.want {
+			t.Errorf("parseBindAddress(%q) = %s, want %s", tt.arg, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct{ arg, err string }{
+		{"", "invalid port "},
+		{"a:b:c:d:e", "invalid bind address format"},
+		{"8080::80", "invalid bind address format: empty host"},
+		{"8080:host:http", "invalid port http"},
+		{"70000:80", "invalid port 70000"},
+		{"[::1:8080:80", "invalid bind address format: unterminated ["},
+		{"9000-9002:80", "invalid bind address format: a local port range needs a remote range"},
+		{"5432-5434", "invalid bind address format: a port range needs a local range"},
+		{"9000-9001:db01:5432-5434", "invalid bind address format: port ranges differ in length"},
+		{"9002-9000:db01:5432-5434", "invalid port range 9002-9000"},
+		{"0-10:0-10", "invalid port range 0-10"},
+		{"1-x:1-2", "invalid port range 1-x"},
+	} {
+		if specs, err := parseBindAddress(tt.arg); err == nil || err.Error() != tt.err {
+			t.Errorf("parseBindAddress(%q) = %s, %v, want %q", tt.arg, format(specs), err, tt.err)
+		}
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	// ranges print as first..last/count
+	for s, want := range map[string]string{
+		"22":          "22..22/1",
+		"0":           "0..0/1",
+		"65535":       "65535..65535/1",
+		"65530-65535": "65530..65535/6",
+		"1-1024":      "1..1024/1024",
+		"-5":          "error invalid port -5",
+		"5-":          "error invalid port range 5-",
+		"0-1":         "error invalid port range 0-1",
+		"65535-65536": "error invalid port range 65535-65536",
+		"1-2-3":       "error invalid port range 1-2-3",
+		" 22":         "error invalid port  22",
+		"+22":         "error invalid port +22",
+	} {
+		ports, err := parsePortRange(s)
+		var got string
+		if err != nil {
+			got = "error " + err.Error()
+		} else {
+			got = fmt.Sprintf("%d..%d/%d", ports[0], ports[len(ports)-1], len(ports))
+			for i, port := range ports {
+				if port != ports[0]+i {
+					got += " with gaps"
+					break
+				}
+			}
+		}
+		if got != want {
+			t.Errorf("parsePortRange(%q) = %s, want %s", s, got, want)
+		}
+	}
+}
+
+func TestSplitForward(t *testing.T) {
+	for arg, want := range map[string][]string{
+		"8080:80":                 {"8080", "80"},
+		"[::1]:8080:[fd00::5]:80": {"::1", "8080", "fd00::5", "80"},
+		"[fe80::1%eth0]:22":       {"fe80::1%eth0", "22"},
+		"8080:[fd00::5]@[gw]:80":  {"8080", "fd00::5@gw", "80"},
+		"::80":                    {"", "", "80"},
+		"no colons":               {"no colons"},
+		"a]b:c":                   {"a]b", "c"},
+		"[nested[brackets]]:1":    {"nested[brackets]", "1"},
+	} {
+		got, err := splitForward(arg)
+		if err != nil || strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("splitForward(%q) = %q, %v, want %q", arg, got, err, want)
+		}
+	}
+}
+
+func TestBindHostAndDynamicAddress(t *testing.T) {
+	spec := func(bind string) bindSpec { return bindSpec{bind: bind, bindSet: true} }
+	for _, tt := range []struct {
+		spec    bindSpec
+		gateway bool
+		want    string
+	}{
+		{bindSpec{}, false, "127.0.0.1"},
+		{bindSpec{}, true, ""},
+		{spec(""), false, ""},
+		{spec("*"), false, ""},
+		{spec("localhost"), true, "127.0.0.1"},
+		{spec("192.168.1.5"), false, "192.168.1.5"},
+		{spec("::1"), true, "::1"},
+	} {
+		if got := bindHost(tt.spec, tt.gateway); got != tt.want {
+			t.Errorf("bindHost(%+v, %v) = %q, want %q", tt.spec, tt.gateway, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		arg     string
+		gateway bool
+		want    string
+	}{
+		{"1080", false, "127.0.0.1:1080"},
+		{"1080", true, ":1080"},
+		{"0.0.0.0:1080", false, "0.0.0.0:1080"},
+		{"*:1080", false, ":1080"},
+		{":1080", false, ":1080"},
+		{"[::1]:1080", false, "[::1]:1080"},
+		{"1080x", false, "error invalid port 1080x"},
+		{"localhost:", false, "error invalid port "},
+	} {
+		got, err := parseDynamicAddress(tt.arg, tt.gateway)
+		if err != nil {
+			got = "error " + err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("parseDynamicAddress(%q, %v) = %q, want %q", tt.arg, tt.gateway, got, tt.want)
+		}
+	}
+}
+
+func TestParseSocketForward(t *testing.T) {
+	for arg, want := range map[string]bindSpec{
+		"/run/user/1000/db.sock:db01:5432": {socketPath: "/run/user/1000/db.sock", host: "db01", remotePort: 5432},
+		"./db.sock:5432":                   {socketPath: "./db.sock", remotePort: 5432},
+		"../db.sock:[fd00::5]:5432":        {socketPath: "../db.sock", host: "fd00::5", remotePort: 5432},
+		"[/tmp/a:b.sock]:10.0.0.5@gw:5432": {socketPath: "/tmp/a:b.sock", host: "10.0.0.5@gw", remotePort: 5432},
+	} {
+		specs, err := parseBindAddress(arg)
+		if err != nil || len(specs) != 1 || specs[0] != want {
+			t.Errorf("parseBindAddress(%q) = %+v, %v, want %+v", arg, specs, err, want)
+		}
+	}
+
+	for arg, want := range map[string]string{
+		"/run/db.sock":           "invalid bind address format: expected path:[host:]hostport",
+		"/run/db.sock:0":         "invalid port 0",
+		"/run/db.sock::5432":     "invalid bind address format: empty host",
+		"/run/db.sock:a:b:5432":  "invalid bind address format: expected path:[host:]hostport",
+		"/run/db.sock:5432-5433": "invalid port 5432-5433",
+		"db.sock:5432":           "invalid port db.sock",
+	} {
+		if _, err := parseBindAddress(arg); err == nil || err.Error() != want {
+			t.Errorf("parseBindAddress(%q) error = %v, want %q", arg, err, want)
+		}
+	}
+}
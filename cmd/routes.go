@@ -0,0 +1,440 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"github.com/soarinferret/mcc/internal/config"
+	"github.com/soarinferret/mcc/pkg/meshcentral"
+)
+
+var routeAddCmd = &cobra.Command{
+	Use:   "add <name>",
+	Short: "Save a named route in the config",
+	Long: `Saves the forwards given with the usual route flags under a name, so they
+can be started with mcc route up. The active profile (-P) is stored with the
+route. Adding a route with an existing name replaces it.
+
+  mcc route add db -i db01 -L 5432:5432 -L 6379:6379`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		route, err := routeFromFlags(cmd, args[0])
+		if err != nil {
+			pExit("Invalid arguments:", err)
+		}
+
+		if err := config.AddRoute(route); err != nil {
+			pExit("Failed to save route:", err)
+		}
+		printRouteTable([]config.Route{route}, nil)
+	},
+}
+
+var routeListCmd = &cobra.Command{
+	Use:     "ls",
+	Aliases: []string{"list"},
+	Short:   "List the named routes in the config",
+	Run: func(cmd *cobra.Command, args []string) {
+		printRouteTable(config.GetRoutes(), config.CheckRoutes())
+	},
+}
+
+var routeRmCmd = &cobra.Command{
+	Use:     "rm <name>...",
+	Aliases: []string{"remove", "delete"},
+	Short:   "Remove named routes from the config",
+	Args:    cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, name := range args {
+			if err := config.RemoveRoute(name); err != nil {
+				pExit("Failed to remove route:", err)
+			}
+			pterm.Info.Println("Removed route: ", name)
+		}
+	},
+}
+
+var routeUpCmd = &cobra.Command{
+	Use:   "up <name>...",
+	Short: "Start one or more named routes",
+	Long: `Starts the named routes from the config with a single login. Routes that are
+started together must use the same profile.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		debug, _ := cmd.Flags().GetBool("debug")
+		grace, _ := cmd.Flags().GetDuration("grace")
+		compress, _ := cmd.Flags().GetBool("compress")
+
+		routes := namedRoutes(args)
+
+		runRoutes(routes, meshcentral.Options{Debug: debug, Compress: compress}, grace)
+	},
+}
+
+var routeStartCmd = &cobra.Command{
+	Use:   "start [name...]",
+	Short: "Start named routes and/or the route given by flags",
+	Long: `Starts the named routes from the config, plus a route given with the usual
+route flags. With --detach the routes are handed to the daemon for the profile
+(which is started if needed) and mcc returns straight away.
+
+  mcc route start db --detach
+  mcc route start -i web01 -L 8080:80 --detach`,
+	Run: func(cmd *cobra.Command, args []string) {
+		debug, _ := cmd.Flags().GetBool("debug")
+		detach, _ := cmd.Flags().GetBool("detach")
+		grace, _ := cmd.Flags().GetDuration("grace")
+		compress, _ := cmd.Flags().GetBool("compress")
+
+		routes := namedRoutes(args)
+
+		opts := routeOptionsFromFlags(cmd)
+		if len(opts.forwards) > 0 || len(opts.udp) > 0 || opts.dynamic != "" || opts.httpProxy != "" {
+			if detach && opts.nodeID == "" && opts.fleet == "" {
+				pExit("Invalid arguments:", fmt.Errorf("a node (-i) is required with --detach"))
+			}
+			route, err := routeFromFlags(cmd, "")
+			if err != nil {
+				pExit("Invalid arguments:", err)
+			}
+			routes = append(routes, route)
+		}
+		if len(routes) == 0 {
+			pExit("Invalid arguments:", fmt.Errorf("no route given"))
+		}
+
+		if !detach {
+			runRoutes(routes, meshcentral.Options{Debug: debug, Compress: compress}, grace)
+			return
+		}
+
+		profile, err := routesProfile(routes)
+		if err != nil {
+			pExit("Unable to start routes:", err)
+		}
+		if err := ensureDaemon(profile, debug, compress); err != nil {
+			pExit("Unable to start daemon:", err)
+		}
+		resp, err := daemonCall(profile, daemonRequest{Action: "start", Routes: routes})
+		if resp != nil {
+			for _, id := range resp.Started {
+				pterm.Info.Printf("Started route %d\n", id)
+			}
+		}
+		if err != nil {
+			pExit("Unable to start route:", err)
+		}
+	},
+}
+
+var routePsCmd = &cobra.Command{
+	Use:   "ps",
+	Short: "Show the routes running in daemons",
+	Run: func(cmd *cobra.Command, args []string) {
+		data := [][]string{{"ID", "Profile", "Name", "Local", "Node", "Destination", "Conns", "In", "Out", "Limit", "Uptime"}}
+		for _, profile := range runningDaemons() {
+			resp, err := daemonCall(profile, daemonRequest{Action: "ps"})
+			if err != nil {
+				continue
+			}
+			for _, r := range resp.Routes {
+				for _, f := range r.Forwards {
+					data = append(data, []string{
+						fmt.Sprint(r.ID),
+						profile,
+						r.Name,
+						f.Local,
+						f.Node,
+						f.Destination,
+						fmt.Sprintf("%d/%d", f.Stats.Active, f.Stats.Total),
+						formatBytes(f.Stats.BytesIn),
+						formatBytes(f.Stats.BytesOut),
+						formatRate(f.Rate),
+						time.Since(r.Started).Round(time.Second).String(),
+					})
+				}
+			}
+		}
+		pterm.DefaultTable.WithHasHeader().WithData(data).Render()
+	},
+}
+
+var routeStopCmd = &cobra.Command{
+	Use:   "stop <id>...",
+	Short: "Stop routes running in the daemon of the profile",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := config.GetDefaultProfileName()
+		for _, arg := range args {
+			id, err := strconv.Atoi(arg)
+			if err != nil {
+				pExit("Invalid arguments:", fmt.Errorf("invalid route id %q", arg))
+			}
+			if _, err := daemonCall(profile, daemonRequest{Action: "stop", ID: id}); err != nil {
+				pExit("Unable to stop route:", err)
+			}
+			pterm.Info.Printf("Stopped route %d\n", id)
+		}
+	},
+}
+
+var routeLimitCmd = &cobra.Command{
+	Use:   "limit <id> <rate>",
+	Short: "Change the rate limit of a route running in the daemon",
+	Long: `Sets the bandwidth limit of every forward and proxy of a route in the
+daemon of the profile, e.g. 512K or 2M bytes per second. 0 removes the limit.
+Open connections pick up the new rate straight away.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			pExit("Invalid arguments:", fmt.Errorf("invalid route id %q", args[0]))
+		}
+		rate, err := config.ParseRate(args[1])
+		if err != nil {
+			pExit("Invalid arguments:", err)
+		}
+
+		profile := config.GetDefaultProfileName()
+		if _, err := daemonCall(profile, daemonRequest{Action: "limit", ID: id, Rate: rate}); err != nil {
+			pExit("Unable to change limit:", err)
+		}
+		pterm.Info.Printf("Route %d limited to %s\n", id, formatRate(rate))
+	},
+}
+
+func init() {
+	routeCmd.AddCommand(routeAddCmd)
+	routeCmd.AddCommand(routeListCmd)
+	routeCmd.AddCommand(routeRmCmd)
+	routeCmd.AddCommand(routeUpCmd)
+	routeCmd.AddCommand(routeStartCmd)
+	routeCmd.AddCommand(routePsCmd)
+	routeCmd.AddCommand(routeStopCmd)
+	routeCmd.AddCommand(routeLimitCmd)
+
+	// add and start take the same flags as route itself
+	routeAddCmd.Flags().AddFlagSet(routeCmd.Flags())
+	routeAddCmd.Flags().MarkHidden("debug")
+	routeStartCmd.Flags().AddFlagSet(routeCmd.Flags())
+	routeStartCmd.Flags().Bool("detach", false, "Run the routes in the background daemon")
+
+	routeUpCmd.Flags().Bool("compress", false, "Ask the server for permessage-deflate on relays, for compressible traffic over slow links")
+	routeUpCmd.Flags().Duration("grace", 10*time.Second, "How long open connections may finish after ctrl-c")
+	routeUpCmd.Flags().BoolP("debug", "", false, "Enable debug logging")
+}
+
+// routeFromFlags builds a config route from the route flags, checking that
+// it can be started
+func routeFromFlags(cmd *cobra.Command, name string) (config.Route, error) {
+	opts := routeOptionsFromFlags(cmd)
+	if name != "" && opts.nodeID == "" && opts.fleet == "" {
+		return config.Route{}, fmt.Errorf("a node (-i) or --fleet is required")
+	}
+	if _, err := opts.plan(); err != nil {
+		return config.Route{}, err
+	}
+
+	profile, _ := cmd.Flags().GetString("profile")
+	route := config.Route{
+		Name:         name,
+		Profile:      profile,
+		Node:         opts.nodeID,
+		Forwards:     opts.forwards,
+		Udp:          opts.udp,
+		Dynamic:      opts.dynamic,
+		SocksAuth:    opts.socksAuth,
+		HttpProxy:    opts.httpProxy,
+		Allow:        opts.allow,
+		Deny:         opts.deny,
+		GatewayPorts: opts.gatewayPorts,
+	}
+	if cmd.Flags().Changed("udp-idle-timeout") {
+		route.UdpIdleTimeout = opts.udpIdle.String()
+	}
+	route.MaxConns = opts.maxConns
+	if opts.idleTimeout > 0 {
+		route.IdleTimeout = opts.idleTimeout.String()
+	}
+	if opts.maxLifetime > 0 {
+		route.MaxLifetime = opts.maxLifetime.String()
+	}
+	route.AllowFrom = opts.allowFrom
+	route.AccessLog = opts.accessLog
+	route.LimitRate = opts.limitRate
+	route.LimitPerConn = opts.limitPerConn
+	route.Failover = opts.failover
+	if cmd.Flags().Changed("retries") {
+		route.Retries = &opts.retries
+	}
+	if cmd.Flags().Changed("retry-backoff") {
+		route.RetryBackoff = opts.retryBackoff.String()
+	}
+	route.Fleet = opts.fleet
+	route.FleetNet = opts.fleetNet
+	route.FleetFile = opts.fleetFile
+	if opts.fleetFile != "" {
+		route.FleetFormat = opts.fleetFormat
+	}
+	return route, nil
+}
+
+// namedRoutes looks up routes in the config, the process exits when one is
+// missing or can't be started
+func namedRoutes(names []string) []config.Route {
+	var routes []config.Route
+	for _, name := range names {
+		route, err := config.GetRoute(name)
+		if err == nil {
+			err = config.CheckRoute(*route)
+		}
+		if err != nil {
+			pExit("Unable to start route:", err)
+		}
+		routes = append(routes, *route)
+	}
+	return routes
+}
+
+// routesProfile is the profile shared by routes, routes without one use the
+// active profile
+func routesProfile(routes []config.Route) (string, error) {
+	profile := ""
+	for _, r := range routes {
+		p := r.Profile
+		if p == "" {
+			p = config.GetDefaultProfileName()
+		}
+		if profile != "" && p != profile {
+			return "", fmt.Errorf("routes use profiles %s and %s, start them separately", profile, p)
+		}
+		profile = p
+	}
+	return profile, nil
+}
+
+// runRoutes starts routes in the foreground with a single login
+func runRoutes(routes []config.Route, opts meshcentral.Options, grace time.Duration) {
+	profile, err := routesProfile(routes)
+	if err != nil {
+		pExit("Unable to start routes:", err)
+	}
+
+	var plans []*routePlan
+	for _, route := range routes {
+		plan, err := routeOptionsFromConfig(route).plan()
+		if err != nil {
+			pExit("Invalid route "+route.Name+":", err)
+		}
+		plans = append(plans, plan)
+	}
+
+	if err := config.SetDefaultProfile(profile, false); err != nil {
+		pExit("Unable to start route:", err)
+	}
+
+	connect(opts)
+
+	running, err := startRoutes(plans)
+	if err != nil {
+		client.Close()
+		pExit("Unable to start route:", err)
+	}
+
+	running.print()
+	fmt.Println("Press ctrl-c to exit.")
+
+	waitForShutdown(running, grace)
+}
+
+func routeOptionsFromConfig(route config.Route) routeOptions {
+	opts := routeOptions{
+		name:         route.Name,
+		nodeID:       route.Node,
+		forwards:     route.Forwards,
+		udp:          route.Udp,
+		dynamic:      route.Dynamic,
+		socksAuth:    route.SocksAuth,
+		httpProxy:    route.HttpProxy,
+		allow:        route.Allow,
+		deny:         route.Deny,
+		udpIdle:      time.Minute,
+		gatewayPorts: route.GatewayPorts,
+		maxConns:     route.MaxConns,
+		allowFrom:    route.AllowFrom,
+		accessLog:    route.AccessLog,
+		limitRate:    route.LimitRate,
+		limitPerConn: route.LimitPerConn,
+		failover:     route.Failover,
+		fleet:        route.Fleet,
+		fleetNet:     route.FleetNet,
+		fleetFile:    route.FleetFile,
+		fleetFormat:  route.FleetFormat,
+		retries:      3,
+		retryBackoff: 500 * time.Millisecond,
+	}
+	if route.Retries != nil {
+		opts.retries = *route.Retries
+	}
+	// durations are checked by config.CheckRoute
+	if route.UdpIdleTimeout != "" {
+		opts.udpIdle, _ = time.ParseDuration(route.UdpIdleTimeout)
+	}
+	if route.IdleTimeout != "" {
+		opts.idleTimeout, _ = time.ParseDuration(route.IdleTimeout)
+	}
+	if route.MaxLifetime != "" {
+		opts.maxLifetime, _ = time.ParseDuration(route.MaxLifetime)
+	}
+	if route.RetryBackoff != "" {
+		opts.retryBackoff, _ = time.ParseDuration(route.RetryBackoff)
+	}
+	return opts
+}
+
+func formatRate(rate int64) string {
+	if rate <= 0 {
+		return "none"
+	}
+	return formatBytes(rate) + "/s"
+}
+
+// printRouteTable lists routes, with errs (from config.CheckRoutes) the
+// invalid ones are marked
+func printRouteTable(routes []config.Route, errs []error) {
+	data := [][]string{{"Name", "Profile", "Node", "Forwards", "Status"}}
+
+	for i, r := range routes {
+		var forwards []string
+		forwards = append(forwards, r.Forwards...)
+		for _, u := range r.Udp {
+			forwards = append(forwards, u+"/udp")
+		}
+		if r.Dynamic != "" {
+			forwards = append(forwards, "socks "+r.Dynamic)
+		}
+		if r.HttpProxy != "" {
+			forwards = append(forwards, "http "+r.HttpProxy)
+		}
+
+		profile := r.Profile
+		if profile == "" {
+			profile = "(default)"
+		}
+		node := r.Node
+		if r.Fleet != "" {
+			node = "fleet " + r.Fleet
+		}
+		status := "ok"
+		if i < len(errs) && errs[i] != nil {
+			status = "invalid: " + errs[i].Error()
+		}
+		data = append(data, []string{r.Name, profile, node, strings.Join(forwards, ", "), status})
+	}
+	pterm.DefaultTable.WithHasHeader().WithBoxed().WithData(data).Render()
+}
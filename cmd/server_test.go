@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/soarinferret/mcc/pkg/meshcentral"
+)
+
+// connectFake logs the package client in to a stand-in server that knows
+// devices, all of them online in one group
+func connectFake(t *testing.T, devices ...meshcentral.Device) {
+	t.Helper()
+
+	nodes := []map[string]interface{}{}
+	for _, d := range devices {
+		nodes = append(nodes, map[string]interface{}{"_id": d.Id, "rname": d.Name, "osdesc": d.OS, "conn": 1})
+	}
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/control.ashx" {
+			http.NotFound(w, r)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.WriteJSON(map[string]interface{}{"action": "serverinfo"})
+		for {
+			var command map[string]interface{}
+			if err := conn.ReadJSON(&command); err != nil {
+				return
+			}
+			switch command["action"] {
+			case "authcookie":
+				conn.WriteJSON(map[string]interface{}{"action": "authcookie", "cookie": "a", "rcookie": "r"})
+			case "meshes":
+				conn.WriteJSON(map[string]interface{}{"action": "meshes", "meshes": []interface{}{map[string]interface{}{"_id": "mesh//servers", "name": "servers"}}})
+			case "nodes":
+				conn.WriteJSON(map[string]interface{}{"action": "nodes", "nodes": map[string]interface{}{"mesh//servers": nodes}})
+			}
+		}
+	}))
+
+	c, err := meshcentral.Connect(context.Background(), meshcentral.Options{
+		Server:    strings.TrimPrefix(server.URL, "https://"),
+		TLSConfig: server.Client().Transport.(*http.Transport).TLSClientConfig,
+	})
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+
+	client = c
+	t.Cleanup(func() {
+		c.Close()
+		server.Close()
+		client = nil
+	})
+}
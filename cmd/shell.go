@@ -1,62 +1,58 @@
-
 package cmd
 
 import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"unicode/utf8"
+
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 	//"github.com/spf13/viper"
 
-	"github.com/soarinferret/mcc/internal/meshcentral"
+	"github.com/soarinferret/mcc/pkg/meshcentral"
 )
 
+const exitKey = 0x1D // Ctrl-]
 
 var shellCmd = &cobra.Command{
-	Use:     "shell",
-	Short:   "Opens a root shell directly to the node",
-	Long:    ``,
+	Use:   "shell",
+	Short: "Opens a root shell directly to the node",
+	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
 
 		nodeID, _ := cmd.Flags().GetString("nodeid")
 		debug, _ := cmd.Flags().GetBool("debug")
 		powershell, _ := cmd.Flags().GetBool("powershell")
 
-
-		meshcentral.ApplySettings(
-			nodeID,
-			0,
-			0,
-			"",
-			debug,
-		)
-
-		meshcentral.StartSocket()
+		connect(meshcentral.Options{Debug: debug})
 
 		if nodeID == "" {
-			devices := meshcentral.GetDevices()
+			devices := listDevices()
 			filterAndSortDevices(&devices)
 			nodeID = searchDevices(&devices)
-
-			meshcentral.ApplySettings(
-				nodeID,
-				0,
-				0,
-				"",
-				debug,
-			)
 		}
 
-		//ready := make(chan struct{})
-
 		// open shell
-		protocol := 1
-		if powershell {
-			protocol = 6
+		cols, rows, _ := term.GetSize(int(os.Stdout.Fd()))
+		shell, err := client.OpenShell(nodeID, meshcentral.ShellOptions{PowerShell: powershell, Cols: cols, Rows: rows})
+		if err != nil {
+			client.Close()
+			pExit("Unable to open shell:", err)
+		}
+		runShell(shell)
+		if debug {
+			fmt.Println("Websocket closed")
 		}
-		meshcentral.StartShell(protocol)
 
-		meshcentral.StopSocket()
+		client.Close()
 
 	},
 }
+
 func init() {
 	rootCmd.AddCommand(shellCmd)
 
@@ -64,3 +60,73 @@ func init() {
 	shellCmd.Flags().BoolP("debug", "", false, "Enable debug logging")
 	shellCmd.Flags().BoolP("powershell", "p", false, "Use powershell instead of cmd.exe (windows agents only")
 }
+
+// runShell connects the local terminal to the shell until either side closes
+// it or ctrl-] is pressed
+func runShell(shell *meshcentral.ShellSession) {
+	defer shell.Close()
+
+	// Set raw terminal mode
+	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		fmt.Println("Failed to set raw mode:", err)
+		return
+	}
+	defer term.Restore(int(os.Stdin.Fd()), oldState)
+
+	// Handle terminal resize signals
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+
+	go func() {
+		for range winch {
+			cols, rows, _ := term.GetSize(int(os.Stdout.Fd()))
+			if err := shell.Resize(cols, rows); err != nil {
+				fmt.Println("Error sending options message:", err)
+			}
+		}
+	}()
+
+	// read from the shell until it is closed
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := io.Copy(os.Stdout, shell); err != nil {
+			fmt.Println("Error reading message:", err)
+		}
+	}()
+
+	// Read from stdin → shell (with UTF-8 rune support)
+	input := make(chan struct{})
+	go func() {
+		defer close(input)
+		reader := bufio.NewReader(os.Stdin)
+		for {
+			r, size, err := reader.ReadRune()
+			if err != nil {
+				fmt.Println("stdin read error:", err)
+				return
+			}
+
+			// Check for exit key (Ctrl-])
+			if r == rune(exitKey) && size == 1 {
+				fmt.Fprintln(os.Stderr, "\n[exit] Detected Ctrl-]")
+				return
+			}
+
+			buf := make([]byte, utf8.RuneLen(r))
+			utf8.EncodeRune(buf, r)
+
+			if _, err := shell.Write(buf); err != nil {
+				fmt.Println("WebSocket write error:", err)
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-input:
+	}
+}
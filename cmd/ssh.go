@@ -1,16 +1,20 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 
 	"github.com/spf13/cobra"
 
 	//"github.com/spf13/viper"
 
-	"github.com/soarinferret/mcc/internal/meshcentral"
+	"github.com/soarinferret/mcc/internal/config"
+	"github.com/soarinferret/mcc/pkg/meshcentral"
 )
 
 var sshCmd = &cobra.Command{
@@ -36,48 +40,59 @@ var sshCmd = &cobra.Command{
 		nodeID, _ := cmd.Flags().GetString("nodeid")
 		debug, _ := cmd.Flags().GetBool("debug")
 		proxyMode, _ := cmd.Flags().GetBool("proxy")
+		compress, _ := cmd.Flags().GetBool("compress")
+		limitRate, _ := cmd.Flags().GetString("limit-rate")
 
-		// generate random local port num
-		localport := 0
-
-		meshcentral.ApplySettings(
-			nodeID,
-			remoteport,
-			localport,
-			target,
-			debug,
-		)
+		rate, err := config.ParseRate(limitRate)
+		if err != nil {
+			pExit("Invalid arguments:", err)
+		}
+		var limit *meshcentral.RateLimit
+		if rate > 0 {
+			limit = meshcentral.NewRateLimit(rate, false)
+		}
 
-		meshcentral.StartSocket()
+		connect(meshcentral.Options{Debug: debug, Compress: compress})
 
 		if nodeID == "" {
-			devices := meshcentral.GetDevices()
+			devices := listDevices()
 			filterAndSortDevices(&devices)
 			nodeID = searchDevices(&devices)
-
-			meshcentral.ApplySettings(
-				nodeID,
-				remoteport,
-				localport,
-				target,
-				debug,
-			)
 		}
 
-		ready := make(chan struct{})
-
 		if proxyMode {
-			// Proxy mode: pipe stdin/stdout directly through WebSocket
-			go meshcentral.StartProxyRouter(ready)
-			<-ready
-			select {} // Keep running until connection dies
+			// Proxy mode: pipe stdin/stdout directly through the relay
+			if debug {
+				fmt.Fprintf(os.Stderr, "Proxy connecting to port %d on %s\n", remoteport, nodeID)
+			}
+			conn, err := client.Dial(context.Background(), nodeID, "tcp", net.JoinHostPort(target, strconv.Itoa(remoteport)))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to connect to server: %v\n", err)
+				os.Exit(1)
+			}
+			// ssh closes stdin once it is done
+			err = pipeStdio(conn, limit, 0)
+			client.Close()
+			if err != nil {
+				ncExit("Connection failed:", err)
+			}
 		} else {
 			// Interactive mode: start proxy and launch SSH client
-			go meshcentral.StartRouter(ready)
-			<-ready
+			fwd := &meshcentral.Forward{
+				NodeID:       nodeID,
+				BindAddress:  "127.0.0.1",
+				RemoteTarget: target,
+				RemotePort:   remoteport,
+				Limits:       meshcentral.Limits{Rate: limit},
+			}
+			if err := client.StartForwards([]*meshcentral.Forward{fwd}); err != nil {
+				fmt.Printf("Unable to bind to local TCP port: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Redirecting local port %d to remote port %d.\n", fwd.LocalPort, remoteport)
 
 			// start ssh client
-			sshPort := meshcentral.GetLocalPort()
+			sshPort := fwd.LocalPort
 			fmt.Printf("SSH into %s:%d via 127.0.0.1:%d\n", target, remoteport, sshPort)
 			sshCmd := exec.Command("ssh", "-o", "ServerAliveInterval=60",
 				"-o", "ServerAliveCountMax=3",
@@ -92,6 +107,8 @@ var sshCmd = &cobra.Command{
 			if err != nil {
 				fmt.Printf("Unable to start SSH client: %v\n", err)
 			}
+			fwd.Close()
+			client.Close()
 		}
 	},
 }
@@ -103,4 +120,6 @@ func init() {
 	sshCmd.Flags().IntP("port", "p", 22, "Define the remote ssh port")
 	sshCmd.Flags().BoolP("debug", "", false, "Enable debug logging")
 	sshCmd.Flags().BoolP("proxy", "", false, "Proxy mode for SSH ProxyCommand")
+	sshCmd.Flags().String("limit-rate", "", "Limit the bandwidth in each direction, e.g. 512K or 2M (bytes per second)")
+	sshCmd.Flags().Bool("compress", false, "Ask the server for permessage-deflate on relays, for compressible traffic over slow links")
 }
@@ -0,0 +1,395 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+
+	"github.com/adrg/xdg"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/soarinferret/mcc/internal/config"
+	"github.com/soarinferret/mcc/pkg/meshcentral"
+)
+
+// sshConfigHeader starts the files written by ssh-config, other files are
+// not overwritten
+const sshConfigHeader = "# Generated by mcc ssh-config"
+
+// sshConfigResync is how often --watch lists the devices even without events
+const sshConfigResync = time.Minute
+
+var sshConfigCmd = &cobra.Command{
+	Use:   "ssh-config",
+	Short: "Generate OpenSSH Host entries for the devices",
+	Long: `Prints a Host entry for every device (or every device matching --selector)
+that connects through mcc nc, so plain ssh, scp, rsync and VS Code Remote reach
+the devices by name:
+
+  Host web01
+      User root
+      Port 22
+      ProxyCommand /usr/local/bin/mcc nc -P default -i 'node//abc...' %p
+
+Aliases are the device names in lower case with a dash for anything other
+than letters and digits, devices with the same alias get -2, -3, ... in the
+order of their node ids. The ssh section of the config overrides the user and
+port of single devices (node id or device name), and sets the user of the
+others unless --user is given:
+
+  "ssh": {
+    "user": "admin",
+    "devices": [
+      { "node": "web01", "user": "deploy" },
+      { "node": "nas01", "port": 2222 }
+    ]
+  }
+
+--write puts the entries in ~/.ssh/config.d/mcc (or --file) instead and adds
+an Include for it to the top of ~/.ssh/config when it isn't there yet. With
+--watch mcc keeps running and rewrites the file as devices are added,
+renamed or removed.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		debug, _ := cmd.Flags().GetBool("debug")
+		selectorFlag, _ := cmd.Flags().GetString("selector")
+		user, _ := cmd.Flags().GetString("user")
+		port, _ := cmd.Flags().GetInt("port")
+		prefix, _ := cmd.Flags().GetString("prefix")
+		write, _ := cmd.Flags().GetBool("write")
+		watch, _ := cmd.Flags().GetBool("watch")
+		file, _ := cmd.Flags().GetString("file")
+
+		selector, err := meshcentral.ParseSelector(selectorFlag)
+		if err != nil {
+			pExit("Invalid selector:", err)
+		}
+		if port <= 0 || port > 65535 {
+			pExit("Invalid port:", fmt.Errorf("%d", port))
+		}
+		if watch && !write {
+			pExit("Invalid arguments:", errors.New("--watch needs --write"))
+		}
+		conf, err := config.GetSSH()
+		if err != nil {
+			pExit("Invalid config "+config.GetConfigPath()+":", err)
+		}
+		if !cmd.Flags().Changed("user") && conf.User != "" {
+			user = conf.User
+		}
+
+		g := &sshConfig{
+			command:   mccCommand(),
+			profile:   config.GetDefaultProfileName(),
+			selector:  selector,
+			user:      user,
+			port:      port,
+			prefix:    prefix,
+			overrides: conf.Devices,
+		}
+
+		connect(meshcentral.Options{Debug: debug})
+
+		if !write {
+			fmt.Print(g.render(listDevices()))
+			client.Close()
+			return
+		}
+
+		path := file
+		if path == "" {
+			path = filepath.Join(xdg.Home, ".ssh", "config.d", "mcc")
+		}
+		hosts, err := g.write(path, listDevices())
+		if err != nil {
+			client.Close()
+			pExit("Unable to write ssh config:", err)
+		}
+		pterm.Info.Printf("Wrote %d hosts to %s\n", hosts, path)
+
+		added, err := ensureSSHInclude(path)
+		if err != nil {
+			client.Close()
+			pExit("Unable to add the Include to ~/.ssh/config:", err)
+		}
+		if added {
+			pterm.Info.Println("Added an Include for it to ~/.ssh/config")
+		}
+
+		if !watch {
+			client.Close()
+			return
+		}
+		fmt.Println("Watching for device changes, press ctrl-c to exit.")
+		g.watch(path)
+		client.Close()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(sshConfigCmd)
+
+	sshConfigCmd.Flags().String("selector", "", "Only devices matching this selector, e.g. 'group=servers,os=*linux*'")
+	sshConfigCmd.Flags().StringP("user", "u", "root", "Login of the hosts, overrides the user of the ssh section in the config")
+	sshConfigCmd.Flags().IntP("port", "p", 22, "Remote ssh port of the hosts")
+	sshConfigCmd.Flags().String("prefix", "", "Put this in front of every alias, e.g. mesh-")
+	sshConfigCmd.Flags().BoolP("write", "w", false, "Write the entries to --file and include it from ~/.ssh/config")
+	sshConfigCmd.Flags().String("file", "", "File for --write (default ~/.ssh/config.d/mcc)")
+	sshConfigCmd.Flags().Bool("watch", false, "Keep the --write file up to date as devices change")
+	sshConfigCmd.Flags().BoolP("debug", "", false, "Enable debug logging")
+}
+
+type sshConfig struct {
+	command   string
+	profile   string
+	selector  meshcentral.Selector
+	user      string
+	port      int
+	prefix    string
+	overrides []config.SSHDevice
+
+	// written is what write put in the file last
+	written string
+}
+
+// sshHost is the Host entry of one device
+type sshHost struct {
+	alias  string
+	device meshcentral.Device
+	user   string
+	port   int
+}
+
+// hosts picks the devices, gives them unique aliases and applies the
+// overrides
+func (g *sshConfig) hosts(devices []meshcentral.Device) []sshHost {
+	var matched []meshcentral.Device
+	for _, device := range devices {
+		// the id ends up in the ProxyCommand, which can't be quoted across lines
+		if g.selector.Matches(device) && strings.IndexFunc(device.Id, unicode.IsControl) < 0 {
+			matched = append(matched, device)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := meshcentral.DeviceLabel(matched[i].Name), meshcentral.DeviceLabel(matched[j].Name)
+		if a != b {
+			return a < b
+		}
+		return matched[i].Id < matched[j].Id
+	})
+
+	var hosts []sshHost
+	seen := map[string]int{}
+	for _, device := range matched {
+		label := meshcentral.DeviceLabel(device.Name)
+		if label == "" {
+			label = "device"
+		}
+		seen[label]++
+		if seen[label] > 1 {
+			label += "-" + strconv.Itoa(seen[label])
+		}
+
+		host := sshHost{alias: g.prefix + label, device: device, user: g.user, port: g.port}
+		for _, o := range g.overrides {
+			if o.Node != device.Id && !strings.EqualFold(o.Node, device.Name) {
+				continue
+			}
+			if o.User != "" {
+				host.user = o.User
+			}
+			if o.Port != 0 {
+				host.port = o.Port
+			}
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// render returns the Host entries of the devices
+func (g *sshConfig) render(devices []meshcentral.Device) string {
+	var b strings.Builder
+	for _, host := range g.hosts(devices) {
+		d := host.device
+		fmt.Fprintf(&b, "# %s (%s)\n", sshComment(d.Name), d.Id)
+		fmt.Fprintf(&b, "Host %s\n", host.alias)
+		if host.user != "" {
+			fmt.Fprintf(&b, "    User %s\n", host.user)
+		}
+		fmt.Fprintf(&b, "    Port %d\n", host.port)
+		fmt.Fprintf(&b, "    ProxyCommand %s nc -P %s -i %s %%p\n", g.command, proxyQuote(g.profile), proxyQuote(d.Id))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// write replaces path with the entries of the devices and returns how many
+// there are. Files that ssh-config didn't write are left alone.
+func (g *sshConfig) write(path string, devices []meshcentral.Device) (int, error) {
+	if existing, err := os.ReadFile(path); err == nil && len(existing) > 0 && !bytes.HasPrefix(existing, []byte(sshConfigHeader)) {
+		return 0, fmt.Errorf("%s exists and was not written by mcc ssh-config", path)
+	}
+
+	rendered := g.render(devices)
+	content := fmt.Sprintf("%s for profile %s, changes are overwritten\n\n", sshConfigHeader, g.profile) + rendered
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+	g.written = rendered
+	return len(g.hosts(devices)), nil
+}
+
+// watch rewrites path whenever the devices change, until ctrl-c or the
+// connection to the server is gone
+func (g *sshConfig) watch(path string) {
+	changes, stop := client.WatchNodes()
+	defer stop()
+	resync := time.NewTicker(sshConfigResync)
+	defer resync.Stop()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-changes:
+		case <-resync.C:
+		case <-signals:
+			return
+		case <-client.Done():
+			pExit("Lost the connection to the server:", meshcentral.ErrClosed)
+		}
+
+		devices, err := client.Devices()
+		if err != nil {
+			pExit("Lost the connection to the server:", err)
+		}
+		// only the entries matter, not the devices going on and offline
+		if g.render(devices) == g.written {
+			continue
+		}
+		hosts, err := g.write(path, devices)
+		if err != nil {
+			fmt.Println("Unable to write ssh config:", err)
+			continue
+		}
+		fmt.Printf("%s wrote %d hosts to %s\n", time.Now().Format(time.RFC3339), hosts, path)
+	}
+}
+
+// ensureSSHInclude adds an Include for path to the top of ~/.ssh/config,
+// unless it is there already. It reports whether it added one.
+func ensureSSHInclude(path string) (bool, error) {
+	sshDir := filepath.Join(xdg.Home, ".ssh")
+	configPath := filepath.Join(sshDir, "config")
+
+	// relative includes in the user config are relative to ~/.ssh
+	include := path
+	if rel, err := filepath.Rel(sshDir, path); err == nil && !strings.HasPrefix(rel, "..") {
+		include = filepath.ToSlash(rel)
+	}
+
+	existing, err := os.ReadFile(configPath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	for _, line := range strings.Split(string(existing), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "Include") {
+			continue
+		}
+		for _, f := range fields[1:] {
+			f = strings.Trim(f, `"`)
+			if f == include || f == path || f == "~/.ssh/"+include {
+				return false, nil
+			}
+		}
+	}
+
+	// Host and Match blocks would swallow an Include at the end
+	line := "Include " + include
+	if strings.ContainsAny(include, " \t") {
+		line = `Include "` + include + `"`
+	}
+	content := line + "\n"
+	if len(existing) > 0 {
+		content += "\n" + string(existing)
+	}
+	if err := os.MkdirAll(sshDir, 0o700); err != nil {
+		return false, err
+	}
+	mode := os.FileMode(0o600)
+	if st, err := os.Stat(configPath); err == nil {
+		mode = st.Mode().Perm()
+	}
+	return true, os.WriteFile(configPath, []byte(content), mode)
+}
+
+// mccCommand is how ssh runs this mcc, with the config file if it isn't the
+// default one
+func mccCommand() string {
+	exe, err := os.Executable()
+	if err != nil {
+		exe = "mcc"
+	}
+	command := proxyQuote(exe)
+	if used := viper.ConfigFileUsed(); used != "" && used != config.DefaultConfigPath {
+		if abs, err := filepath.Abs(used); err == nil {
+			used = abs
+		}
+		command += " -C " + proxyQuote(used)
+	}
+	return command
+}
+
+// sshComment replaces the control characters in a name the server sent, so
+// it can't end the comment line and add options of its own
+func sshComment(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// proxyQuote quotes s for a ProxyCommand, which ssh hands to the shell after
+// expanding % tokens
+func proxyQuote(s string) string {
+	s = strings.ReplaceAll(s, "%", "%%")
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-.,/:@+=") == "" {
+		return s
+	}
+	if runtime.GOOS == "windows" {
+		return `"` + s + `"`
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
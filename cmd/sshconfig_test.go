@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/soarinferret/mcc/pkg/meshcentral"
+)
+
+func TestSSHConfigRender(t *testing.T) {
+	tests := []struct {
+		name    string
+		device  meshcentral.Device
+		want    string
+		without string
+	}{
+		{
+			name:   "plain",
+			device: meshcentral.Device{Id: "node//abc", Name: "Web 01", Group: "servers"},
+			want:   "# Web 01 (node//abc)\nHost web-01\n    User root\n    Port 22\n    ProxyCommand mcc nc -P default -i node//abc %p\n\n",
+		},
+		{
+			name:    "newline in name",
+			device:  meshcentral.Device{Id: "node//abc", Name: "web01\nHost *\n    ProxyCommand evil"},
+			want:    "# web01 Host *     ProxyCommand evil (node//abc)\n",
+			without: "\nHost *",
+		},
+		{
+			name:    "carriage return in name",
+			device:  meshcentral.Device{Id: "node//abc", Name: "web01\r\nMatch all"},
+			want:    "# web01  Match all (node//abc)\n",
+			without: "\nMatch",
+		},
+		{
+			name:    "newline in id",
+			device:  meshcentral.Device{Id: "node//abc\nHost *", Name: "web01"},
+			want:    "",
+			without: "Host",
+		},
+		{
+			name:    "group is not written",
+			device:  meshcentral.Device{Id: "node//abc", Name: "web01", Group: "edge\nHost *"},
+			want:    "# web01 (node//abc)\n",
+			without: "edge",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &sshConfig{command: "mcc", profile: "default", user: "root", port: 22}
+			got := g.render([]meshcentral.Device{tt.device})
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("render() = %q, want it to contain %q", got, tt.want)
+			}
+			if tt.without != "" && strings.Contains(got, tt.without) {
+				t.Errorf("render() = %q, must not contain %q", got, tt.without)
+			}
+		})
+	}
+}
+
+func TestProxyQuote(t *testing.T) {
+	tests := []struct {
+		value   string
+		unix    string
+		windows string
+	}{
+		{"mcc", "mcc", "mcc"},
+		{"/usr/local/bin/mcc", "/usr/local/bin/mcc", "/usr/local/bin/mcc"},
+		{"node//abc@def+x=", "node//abc@def+x=", "node//abc@def+x="},
+		{"", "''", `""`},
+		{"/opt/my tools/mcc", "'/opt/my tools/mcc'", `"/opt/my tools/mcc"`},
+		{"C:\\Program Files\\mcc.exe", "'C:\\Program Files\\mcc.exe'", `"C:\Program Files\mcc.exe"`},
+		{"bob's", `'bob'\''s'`, `"bob's"`},
+		{"a;rm -rf ~", "'a;rm -rf ~'", `"a;rm -rf ~"`},
+		{"$(id)", "'$(id)'", `"$(id)"`},
+		{"100%", "'100%%'", `"100%%"`},
+		{"%h", "'%%h'", `"%%h"`},
+	}
+
+	for _, tt := range tests {
+		want := tt.unix
+		if runtime.GOOS == "windows" {
+			want = tt.windows
+		}
+		if got := proxyQuote(tt.value); got != want {
+			t.Errorf("proxyQuote(%q) = %s, want %s", tt.value, got, want)
+		}
+	}
+}
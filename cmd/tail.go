@@ -0,0 +1,233 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+
+	"github.com/soarinferret/mcc/pkg/meshcentral"
+)
+
+// files larger than this are followed with tail on the node when possible
+const tailPollLimit = 4 * 1024 * 1024
+
+var tailCmd = &cobra.Command{
+	Use:   "tail [-f] [-n N] [node:]path...",
+	Short: "Print (and follow) the end of remote files",
+	Long: `Prints the last lines of files on one or more nodes. With several files or
+nodes every line is prefixed with the device name and/or the file.
+
+The files tunnel can only fetch whole files, so following polls the file size
+and downloads it again when it grows. With --via terminal (or automatically for
+large files on non-windows nodes) tail runs on the node instead.
+
+  mcc tail -f -i <nodeid> /var/log/app.log
+  mcc tail -f -n 50 -i web01 -i web02 /var/log/nginx/error.log`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		nodes, _ := cmd.Flags().GetStringArray("nodeid")
+		debug, _ := cmd.Flags().GetBool("debug")
+		follow, _ := cmd.Flags().GetBool("follow")
+		lines, _ := cmd.Flags().GetInt("lines")
+		interval, _ := cmd.Flags().GetDuration("interval")
+		via, _ := cmd.Flags().GetString("via")
+
+		if via != "auto" && via != "files" && via != "terminal" {
+			pExit("Invalid arguments:", fmt.Errorf("unknown --via %q (auto, files or terminal)", via))
+		}
+
+		connect(meshcentral.Options{Debug: debug})
+		defer client.Close()
+
+		targets := tailTargets(args, nodes)
+
+		// only prefix lines when more than one stream is interleaved
+		nodeSet, pathSet := map[string]bool{}, map[string]bool{}
+		for _, t := range targets {
+			nodeSet[t.device.Id] = true
+			pathSet[t.path] = true
+		}
+
+		var out sync.Mutex
+		var wg sync.WaitGroup
+		failed := false
+		for _, t := range targets {
+			var parts []string
+			if len(nodeSet) > 1 {
+				parts = append(parts, t.device.Name)
+			}
+			if len(pathSet) > 1 {
+				parts = append(parts, t.path)
+			}
+			prefix := ""
+			if len(parts) > 0 {
+				prefix = strings.Join(parts, ":") + " | "
+			}
+
+			wg.Add(1)
+			go func(t tailTarget, w *lineWriter) {
+				defer wg.Done()
+				opts := meshcentral.TailOptions{Lines: lines, Follow: follow, Interval: interval}
+				if err := runTail(t, via, opts, w); err != nil {
+					out.Lock()
+					failed = true
+					pterm.Error.Printf("%s%s: %v\n", w.prefix, t.path, err)
+					out.Unlock()
+				}
+				w.Flush()
+			}(t, &lineWriter{prefix: prefix, out: os.Stdout, mu: &out})
+		}
+		wg.Wait()
+
+		if failed {
+			client.Close()
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(tailCmd)
+
+	tailCmd.Flags().StringArrayP("nodeid", "i", nil, "Mesh Central Node ID or device name (repeatable)")
+	tailCmd.Flags().BoolP("follow", "f", false, "Keep printing lines as they are appended")
+	tailCmd.Flags().IntP("lines", "n", 10, "Number of lines to print first")
+	tailCmd.Flags().Duration("interval", 2*time.Second, "How often followed files are polled over the files tunnel")
+	tailCmd.Flags().String("via", "auto", "Tunnel to read the file with: auto, files or terminal")
+	tailCmd.Flags().BoolP("debug", "", false, "Enable debug logging")
+}
+
+type tailTarget struct {
+	device *meshcentral.Device
+	path   string
+}
+
+// tailTargets pairs every path with its node, paths without a node: prefix
+// are read from every --nodeid (or an interactively selected node)
+func tailTargets(args []string, nodes []string) []tailTarget {
+	devices := map[string]*meshcentral.Device{}
+	resolve := func(node string) *meshcentral.Device {
+		if d, ok := devices[node]; ok {
+			return d
+		}
+		d, err := client.FindDevice(node)
+		if err != nil {
+			client.Close()
+			pExit("Unable to find node:", err)
+		}
+		devices[node] = d
+		return d
+	}
+
+	var targets []tailTarget
+	for _, arg := range args {
+		node, path, remote := parseCopyTarget(arg)
+		if remote && node != "" {
+			targets = append(targets, tailTarget{resolve(node), path})
+			continue
+		}
+
+		if len(nodes) == 0 {
+			nodes = []string{resolveNode("", "")}
+		}
+		for _, n := range nodes {
+			targets = append(targets, tailTarget{resolve(n), path})
+		}
+	}
+	return targets
+}
+
+func runTail(t tailTarget, via string, opts meshcentral.TailOptions, w io.Writer) error {
+	windows := meshcentral.DialectForOS(t.device.OS) == meshcentral.DialectCmd
+
+	if via != "terminal" {
+		files, err := client.OpenFiles(t.device.Id)
+		if err != nil && via == "files" {
+			return err
+		}
+		if err == nil {
+			defer files.Close()
+
+			entry, err := files.Stat(t.path)
+			if err != nil {
+				return err
+			}
+			if via == "files" || windows || entry.Size <= tailPollLimit {
+				return meshcentral.TailFile(files, t.path, opts, w, nil)
+			}
+			files.Close()
+		}
+	}
+
+	// fall back to running tail on the node itself
+	var command string
+	dialect := meshcentral.DialectSh
+	if windows {
+		dialect = meshcentral.DialectPowershell
+		command = fmt.Sprintf("Get-Content -Tail %d '%s'", opts.Lines, strings.ReplaceAll(t.path, "'", "''"))
+		if opts.Follow {
+			command += " -Wait"
+		}
+	} else {
+		command = fmt.Sprintf("tail -n %d '%s'", opts.Lines, strings.ReplaceAll(t.path, "'", `'\''`))
+		if opts.Follow {
+			command = fmt.Sprintf("tail -n %d -F '%s'", opts.Lines, strings.ReplaceAll(t.path, "'", `'\''`))
+		}
+	}
+
+	code, err := client.Exec(t.device.Id, command, meshcentral.ExecOptions{Dialect: dialect, Stdout: w})
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("tail exited with code %d", code)
+	}
+	return nil
+}
+
+// lineWriter writes whole lines with a prefix, sharing a lock with the other
+// writers so lines from different streams never mix
+type lineWriter struct {
+	prefix  string
+	out     io.Writer
+	mu      *sync.Mutex
+	partial []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.partial = append(l.partial, p...)
+
+	i := bytes.LastIndexByte(l.partial, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(l.partial[:i+1], []byte("\n")) {
+		if len(line) > 0 {
+			buf.WriteString(l.prefix)
+			buf.Write(line)
+		}
+	}
+	l.partial = append(l.partial[:0], l.partial[i+1:]...)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.out.Write(buf.Bytes())
+	return len(p), err
+}
+
+// Flush writes out a trailing line without a newline
+func (l *lineWriter) Flush() {
+	if len(l.partial) > 0 {
+		l.Write([]byte("\n"))
+	}
+}
@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestLineWriter(t *testing.T) {
+	var out bytes.Buffer
+	var mu sync.Mutex
+	web := &lineWriter{prefix: "web01: ", out: &out, mu: &mu}
+	db := &lineWriter{prefix: "db01: ", out: &out, mu: &mu}
+
+	// lines only go out once complete, so the streams interleave by line
+	web.Write([]byte("GET / 200\nGET /fav"))
+	db.Write([]byte("checkpoint "))
+	db.Write([]byte("starting\n"))
+	web.Write([]byte("icon.ico 404\n\n"))
+	db.Write([]byte("no newline at the end"))
+	web.Flush()
+	db.Flush()
+
+	want := "web01: GET / 200\n" +
+		"db01: checkpoint starting\n" +
+		"web01: GET /favicon.ico 404\n" +
+		"web01: \n" +
+		"db01: no newline at the end\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package cmd
+
+import "syscall"
+
+func umask(mask int) int {
+	return syscall.Umask(mask)
+}
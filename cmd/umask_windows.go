@@ -0,0 +1,6 @@
+package cmd
+
+// windows has no umask, the socket is restricted by the Chmod that follows
+func umask(mask int) int {
+	return 0
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Gateway is the gateway section of the config, used by mcc gateway. Cert
+// and Key serve HTTPS, without them the gateway speaks plain HTTP. AllowFrom
+// are the client networks that may use the gateway besides loopback.
+type Gateway struct {
+	Listen    string        `json:"listen,omitempty"`
+	Cert      string        `json:"cert,omitempty"`
+	Key       string        `json:"key,omitempty"`
+	AllowFrom []string      `json:"allow_from,omitempty" mapstructure:"allow_from"`
+	Rules     []GatewayRule `json:"rules,omitempty"`
+}
+
+// GatewayRule sends requests for Host (exact or *.example.com) and/or under
+// the Path prefix to Port on Node, or to Target:Port as seen from the node.
+// The first rule that matches wins. StripPath removes the prefix before the
+// request is passed on, TLS is for device UIs that only speak HTTPS (their
+// certificate is not checked).
+type GatewayRule struct {
+	Host      string `json:"host,omitempty"`
+	Path      string `json:"path,omitempty"`
+	StripPath bool   `json:"strip_path,omitempty" mapstructure:"strip_path"`
+	Node      string `json:"node"`
+	Target    string `json:"target,omitempty"`
+	Port      int    `json:"port"`
+	TLS       bool   `json:"tls,omitempty"`
+}
+
+// GetGateway returns the checked gateway section
+func GetGateway() (*Gateway, error) {
+	var gateway Gateway
+	if err := viper.UnmarshalKey("gateway", &gateway); err != nil {
+		return nil, &GatewayError{err}
+	}
+	if err := validateGateway(gateway); err != nil {
+		return nil, &GatewayError{err}
+	}
+	return &gateway, nil
+}
+
+func validateGateway(g Gateway) error {
+	if (g.Cert == "") != (g.Key == "") {
+		return fmt.Errorf("cert and key go together")
+	}
+	for _, cidr := range g.AllowFrom {
+		if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+			return fmt.Errorf("invalid allow_from network %q", cidr)
+		}
+	}
+	if len(g.Rules) == 0 {
+		return fmt.Errorf("no rules")
+	}
+	for i, r := range g.Rules {
+		if r.Host == "" && r.Path == "" {
+			return fmt.Errorf("rule %d has neither host nor path", i+1)
+		}
+		if r.Path != "" && !strings.HasPrefix(r.Path, "/") {
+			return fmt.Errorf("rule %d: path %q must start with /", i+1, r.Path)
+		}
+		if r.Node == "" {
+			return fmt.Errorf("rule %d has no node", i+1)
+		}
+		if r.Port <= 0 || r.Port > 65535 {
+			return fmt.Errorf("rule %d: invalid port %d", i+1, r.Port)
+		}
+	}
+	return nil
+}
+
+// GatewayError is returned by GetGateway when the gateway section is invalid
+type GatewayError struct {
+	Err error
+}
+
+func (e *GatewayError) Error() string {
+	return "invalid gateway section: " + e.Err.Error()
+}
+
+func (e *GatewayError) Unwrap() error {
+	return e.Err
+}
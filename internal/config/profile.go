@@ -1,6 +1,10 @@
 package config
 
-import "github.com/spf13/viper"
+import (
+	"strings"
+
+	"github.com/spf13/viper"
+)
 
 // Profile is a struct that holds the profile information
 type Profile struct {
@@ -8,6 +12,9 @@ type Profile struct {
 	Server   string
 	Username string
 	Password string
+	// Insecure skips the check of the server certificate, for servers with a
+	// self-signed one
+	Insecure bool
 }
 
 func GetProfiles() []Profile {
@@ -18,12 +25,16 @@ func GetProfiles() []Profile {
 	return profiles
 }
 
+// activeProfile overrides default_profile for this run without it being
+// written back to the config file
+var activeProfile string
+
 func GetDefaultProfile() Profile {
 	// get profiles from config
 	var profiles []Profile
 	viper.UnmarshalKey("profiles", &profiles)
 
-	defaultProfile := viper.GetString("default_profile")
+	defaultProfile := GetDefaultProfileName()
 
 	for _, p := range profiles {
 		if p.Name == defaultProfile {
@@ -35,6 +46,9 @@ func GetDefaultProfile() Profile {
 }
 
 func GetDefaultProfileName() string {
+	if activeProfile != "" {
+		return activeProfile
+	}
 	return viper.GetString("default_profile")
 }
 
@@ -46,17 +60,20 @@ func SetDefaultProfile(name string, commit bool) error {
 	// make sure profile exists
 	for _, p := range profiles {
 		if p.Name == name {
-			viper.Set("default_profile", name)
-			if commit {
-				viper.WriteConfig()
+			if !commit {
+				activeProfile = name
+				return nil
 			}
+			activeProfile = ""
+			viper.Set("default_profile", name)
+			viper.WriteConfig()
 			return nil
 		}
 	}
 	return &ProfileNotFoundError{name}
 }
 
-func AddProfile(name string, isDefault bool, server string, username string, password string) *Profile {
+func AddProfile(name string, isDefault bool, server string, username string, password string, insecure bool) *Profile {
 	// get profiles from config
 	var profiles []Profile
 	viper.UnmarshalKey("profiles", &profiles)
@@ -67,6 +84,7 @@ func AddProfile(name string, isDefault bool, server string, username string, pas
 		Server:   server,
 		Username: username,
 		Password: password,
+		Insecure: insecure,
 	})
 
 	// if default, set all other profiles to non default
@@ -80,7 +98,18 @@ func AddProfile(name string, isDefault bool, server string, username string, pas
 	return &profiles[len(profiles)-1]
 }
 
-func RemoveProfile(name string) {
+// RemoveProfile removes a profile, it fails while routes still use it
+func RemoveProfile(name string) error {
+	var routes []string
+	for _, r := range GetRoutes() {
+		if r.Profile == name {
+			routes = append(routes, r.Name)
+		}
+	}
+	if len(routes) > 0 {
+		return &ProfileInUseError{name, routes}
+	}
+
 	// get profiles from config
 	var profiles []Profile
 	viper.UnmarshalKey("profiles", &profiles)
@@ -93,7 +122,7 @@ func RemoveProfile(name string) {
 	}
 
 	viper.Set("profiles", profiles)
-	viper.WriteConfig()
+	return viper.WriteConfig()
 }
 
 // profile not found error definition
@@ -104,3 +133,13 @@ type ProfileNotFoundError struct {
 func (e *ProfileNotFoundError) Error() string {
 	return "Profile not found: " + e.Name
 }
+
+// ProfileInUseError is returned by RemoveProfile for a profile that routes use
+type ProfileInUseError struct {
+	Name   string
+	Routes []string
+}
+
+func (e *ProfileInUseError) Error() string {
+	return "Profile " + e.Name + " is used by the routes " + strings.Join(e.Routes, ", ") + ", remove them first"
+}
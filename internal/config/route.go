@@ -0,0 +1,284 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Route is a named set of forwards to a node that can be started with
+// mcc route up. Forwards and Udp use the same syntax as route -L and -U.
+// With Fleet the forwards go to every device matching the selector instead.
+type Route struct {
+	Name           string   `json:"name"`
+	Profile        string   `json:"profile,omitempty"`
+	Node           string   `json:"node"`
+	Forwards       []string `json:"forwards,omitempty"`
+	Udp            []string `json:"udp,omitempty"`
+	Dynamic        string   `json:"dynamic,omitempty" mapstructure:"dynamic"`
+	SocksAuth      string   `json:"socks_auth,omitempty" mapstructure:"socks_auth"`
+	HttpProxy      string   `json:"http_proxy,omitempty" mapstructure:"http_proxy"`
+	Allow          []string `json:"allow,omitempty"`
+	Deny           []string `json:"deny,omitempty"`
+	GatewayPorts   bool     `json:"gateway_ports,omitempty" mapstructure:"gateway_ports"`
+	UdpIdleTimeout string   `json:"udp_idle_timeout,omitempty" mapstructure:"udp_idle_timeout"`
+	MaxConns       int      `json:"max_conns,omitempty" mapstructure:"max_conns"`
+	IdleTimeout    string   `json:"idle_timeout,omitempty" mapstructure:"idle_timeout"`
+	MaxLifetime    string   `json:"max_lifetime,omitempty" mapstructure:"max_lifetime"`
+	AllowFrom      []string `json:"allow_from,omitempty" mapstructure:"allow_from"`
+	AccessLog      string   `json:"access_log,omitempty" mapstructure:"access_log"`
+	LimitRate      string   `json:"limit_rate,omitempty" mapstructure:"limit_rate"`
+	LimitPerConn   bool     `json:"limit_per_conn,omitempty" mapstructure:"limit_per_conn"`
+	Failover       []string `json:"failover,omitempty"`
+	Retries        *int     `json:"retries,omitempty"`
+	RetryBackoff   string   `json:"retry_backoff,omitempty" mapstructure:"retry_backoff"`
+	Fleet          string   `json:"fleet,omitempty"`
+	FleetNet       string   `json:"fleet_net,omitempty" mapstructure:"fleet_net"`
+	FleetFile      string   `json:"fleet_file,omitempty" mapstructure:"fleet_file"`
+	FleetFormat    string   `json:"fleet_format,omitempty" mapstructure:"fleet_format"`
+}
+
+func GetRoutes() []Route {
+	var routes []Route
+	viper.UnmarshalKey("routes", &routes)
+
+	return routes
+}
+
+func GetRoute(name string) (*Route, error) {
+	for _, r := range GetRoutes() {
+		if r.Name == name {
+			return &r, nil
+		}
+	}
+	return nil, &RouteNotFoundError{name}
+}
+
+// AddRoute stores a new route, or replaces the route with the same name
+func AddRoute(route Route) error {
+	if route.Name == "" {
+		return fmt.Errorf("route has no name")
+	}
+	if err := validateRoute(route, profileNames()); err != nil {
+		return &RouteError{route.Name, err}
+	}
+
+	routes := GetRoutes()
+	replaced := false
+	for i, r := range routes {
+		if r.Name == route.Name {
+			routes[i] = route
+			replaced = true
+		}
+	}
+	if !replaced {
+		routes = append(routes, route)
+	}
+
+	viper.Set("routes", routes)
+	return viper.WriteConfig()
+}
+
+func RemoveRoute(name string) error {
+	routes := GetRoutes()
+
+	for i, r := range routes {
+		if r.Name == name {
+			routes = append(routes[:i], routes[i+1:]...)
+			viper.Set("routes", routes)
+			return viper.WriteConfig()
+		}
+	}
+	return &RouteNotFoundError{name}
+}
+
+// CheckRoute returns a *RouteError when the route can't be started
+func CheckRoute(r Route) error {
+	if err := validateRoute(r, profileNames()); err != nil {
+		return &RouteError{r.Name, err}
+	}
+	return nil
+}
+
+// CheckRoutes returns why each route of the config can't be started, nil for
+// the routes that are fine
+func CheckRoutes() []error {
+	return validateRoutes(GetRoutes(), profileNames())
+}
+
+// validateRoutes checks every route, only the first of several routes with
+// the same name can be started
+func validateRoutes(routes []Route, profiles map[string]bool) []error {
+	errs := make([]error, len(routes))
+	names := map[string]bool{}
+	for i, r := range routes {
+		switch {
+		case r.Name == "":
+			errs[i] = fmt.Errorf("no name")
+		case names[r.Name]:
+			errs[i] = fmt.Errorf("defined more than once")
+		default:
+			errs[i] = validateRoute(r, profiles)
+		}
+		names[r.Name] = true
+	}
+	return errs
+}
+
+func profileNames() map[string]bool {
+	profiles := map[string]bool{}
+	for _, p := range GetProfiles() {
+		profiles[p.Name] = true
+	}
+	return profiles
+}
+
+func validateRoute(r Route, profiles map[string]bool) error {
+	if r.Profile != "" && !profiles[r.Profile] {
+		return &ProfileNotFoundError{r.Profile}
+	}
+	if r.Node == "" && r.Fleet == "" {
+		return fmt.Errorf("no node")
+	}
+	if len(r.Forwards) == 0 && len(r.Udp) == 0 && r.Dynamic == "" && r.HttpProxy == "" {
+		return fmt.Errorf("nothing to forward")
+	}
+
+	for _, f := range append(append([]string{}, r.Forwards...), r.Udp...) {
+		if err := validateForward(f); err != nil {
+			return err
+		}
+	}
+	for _, address := range []string{r.Dynamic, r.HttpProxy} {
+		if address == "" {
+			continue
+		}
+		if err := validatePorts(address[strings.LastIndex(address, ":")+1:]); err != nil {
+			return fmt.Errorf("invalid proxy address %q", address)
+		}
+	}
+	if r.SocksAuth != "" && !strings.Contains(r.SocksAuth, ":") {
+		return fmt.Errorf("socks_auth must be user:password")
+	}
+	durations := []struct{ key, value string }{
+		{"udp_idle_timeout", r.UdpIdleTimeout},
+		{"idle_timeout", r.IdleTimeout},
+		{"max_lifetime", r.MaxLifetime},
+		{"retry_backoff", r.RetryBackoff},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d.value); err != nil || v < 0 {
+			return fmt.Errorf("invalid %s %q", d.key, d.value)
+		}
+	}
+	if r.FleetNet != "" {
+		if _, _, err := net.ParseCIDR(r.FleetNet); err != nil {
+			return fmt.Errorf("invalid fleet_net %q", r.FleetNet)
+		}
+	}
+	switch r.FleetFormat {
+	case "", "json", "prometheus":
+	default:
+		return fmt.Errorf("invalid fleet_format %q", r.FleetFormat)
+	}
+	if r.MaxConns < 0 {
+		return fmt.Errorf("invalid max_conns %d", r.MaxConns)
+	}
+	if r.Retries != nil && *r.Retries < 0 {
+		return fmt.Errorf("invalid retries %d", *r.Retries)
+	}
+	if _, err := ParseRate(r.LimitRate); err != nil {
+		return fmt.Errorf("invalid limit_rate: %w", err)
+	}
+	for _, cidr := range r.AllowFrom {
+		if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+			return fmt.Errorf("invalid allow_from network %q", cidr)
+		}
+	}
+	return nil
+}
+
+// ParseRate reads a rate in bytes per second like curl's --limit-rate: a
+// number with an optional K, M or G suffix (powers of 1024). An empty string
+// is no limit.
+func ParseRate(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	number, multiplier := s, 1.0
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		number = s[:len(s)-1]
+	}
+
+	// also refuses NaN and rates beyond int64, like Inf
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || !(value >= 0) || value*multiplier >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return int64(value * multiplier), nil
+}
+
+// validateForward catches the obvious mistakes in a forward, the full syntax
+// is checked again when the route is started
+func validateForward(f string) error {
+	if strings.Count(f, "[") != strings.Count(f, "]") {
+		return fmt.Errorf("invalid forward %q", f)
+	}
+	if err := validatePorts(f[strings.LastIndex(f, ":")+1:]); err != nil {
+		return fmt.Errorf("invalid forward %q: %w", f, err)
+	}
+	return nil
+}
+
+func validatePorts(s string) error {
+	first, last, isRange := strings.Cut(s, "-")
+	if _, err := strconv.ParseUint(first, 10, 16); err != nil {
+		return fmt.Errorf("invalid port %q", s)
+	}
+	if isRange {
+		if _, err := strconv.ParseUint(last, 10, 16); err != nil {
+			return fmt.Errorf("invalid port %q", s)
+		}
+	}
+	return nil
+}
+
+// RouteError is returned by CheckRoute and AddRoute for an invalid route
+type RouteError struct {
+	Name string
+	Err  error
+}
+
+func (e *RouteError) Error() string {
+	return "invalid route " + e.Name + ": " + e.Err.Error()
+}
+
+func (e *RouteError) Unwrap() error {
+	return e.Err
+}
+
+// route not found error definition
+type RouteNotFoundError struct {
+	Name string
+}
+
+func (e *RouteNotFoundError) Error() string {
+	return "Route not found: " + e.Name
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateRoutes(t *testing.T) {
+	profiles := map[string]bool{"work": true}
+	negative := -1
+	route := func(change func(r *Route)) Route {
+		r := Route{Name: "db", Node: "db01", Forwards: []string{"5432:localhost:5432"}}
+		if change != nil {
+			change(&r)
+		}
+		return r
+	}
+
+	tests := []struct {
+		name   string
+		routes []Route
+		want   []string
+	}{
+		{"valid", []Route{route(nil)}, []string{""}},
+		{"known profile", []Route{route(func(r *Route) { r.Profile = "work" })}, []string{""}},
+		{"unknown profile", []Route{route(func(r *Route) { r.Profile = "home" })}, []string{"home"}},
+		{"no name", []Route{route(func(r *Route) { r.Name = "" })}, []string{"no name"}},
+		{"no node", []Route{route(func(r *Route) { r.Node = "" })}, []string{"no node"}},
+		{"fleet instead of node", []Route{route(func(r *Route) { r.Node, r.Fleet = "", "group=edge" })}, []string{""}},
+		{"nothing to forward", []Route{route(func(r *Route) { r.Forwards = nil })}, []string{"nothing to forward"}},
+		{"socks only", []Route{route(func(r *Route) { r.Forwards, r.Dynamic = nil, "1080" })}, []string{""}},
+		{"bad forward port", []Route{route(func(r *Route) { r.Forwards = []string{"5432:localhost:http"} })}, []string{"invalid forward"}},
+		{"unbalanced brackets", []Route{route(func(r *Route) { r.Forwards = []string{"5432:[::1:5432"} })}, []string{"invalid forward"}},
+		{"port range", []Route{route(func(r *Route) { r.Udp = []string{"5000-5010"} })}, []string{""}},
+		{"bad proxy address", []Route{route(func(r *Route) { r.HttpProxy = "127.0.0.1:proxy" })}, []string{"invalid proxy address"}},
+		{"socks_auth without password", []Route{route(func(r *Route) { r.SocksAuth = "bob" })}, []string{"socks_auth"}},
+		{"bad duration", []Route{route(func(r *Route) { r.IdleTimeout = "soon" })}, []string{"idle_timeout"}},
+		{"negative duration", []Route{route(func(r *Route) { r.RetryBackoff = "-1s" })}, []string{"retry_backoff"}},
+		{"bad fleet_net", []Route{route(func(r *Route) { r.FleetNet = "127.77.0.0" })}, []string{"fleet_net"}},
+		{"bad fleet_format", []Route{route(func(r *Route) { r.FleetFormat = "yaml" })}, []string{"fleet_format"}},
+		{"negative max_conns", []Route{route(func(r *Route) { r.MaxConns = -1 })}, []string{"max_conns"}},
+		{"negative retries", []Route{route(func(r *Route) { r.Retries = &negative })}, []string{"retries"}},
+		{"bad limit_rate", []Route{route(func(r *Route) { r.LimitRate = "fast" })}, []string{"limit_rate"}},
+		{"bad allow_from", []Route{route(func(r *Route) { r.AllowFrom = []string{"office"} })}, []string{"allow_from"}},
+		{"allow_from address", []Route{route(func(r *Route) { r.AllowFrom = []string{"10.0.0.1", "192.168.0.0/16"} })}, []string{""}},
+		{
+			"duplicate names",
+			[]Route{route(nil), route(func(r *Route) { r.Node = "db02" }), route(func(r *Route) { r.Name = "web" })},
+			[]string{"", "defined more than once", ""},
+		},
+		{
+			"one invalid route of several",
+			[]Route{route(func(r *Route) { r.Node = "" }), route(func(r *Route) { r.Name = "web" })},
+			[]string{"no node", ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := validateRoutes(tt.routes, profiles)
+			if len(errs) != len(tt.want) {
+				t.Fatalf("validateRoutes returned %d errors, want %d", len(errs), len(tt.want))
+			}
+			for i, err := range errs {
+				switch {
+				case tt.want[i] == "" && err != nil:
+					t.Errorf("route %d: unexpected error %v", i, err)
+				case tt.want[i] != "" && (err == nil || !strings.Contains(err.Error(), tt.want[i])):
+					t.Errorf("route %d: error %v, want one containing %q", i, err, tt.want[i])
+				}
+			}
+		})
+	}
+
+	t.Run("unknown profile error", func(t *testing.T) {
+		errs := validateRoutes([]Route{route(func(r *Route) { r.Profile = "home" })}, profiles)
+		var notFound *ProfileNotFoundError
+		if !errors.As(errs[0], &notFound) || notFound.Name != "home" {
+			t.Errorf("error = %v, want a ProfileNotFoundError for home", errs[0])
+		}
+	})
+}
+
+func TestParseRate(t *testing.T) {
+	for s, want := range map[string]int64{
+		"":      0,
+		"0":     0,
+		"512":   512,
+		"512K":  512 << 10,
+		"512k":  512 << 10,
+		"2M":    2 << 20,
+		"1.5M":  3 << 19,
+		"1G":    1 << 30,
+		"0.5K":  512,
+		"100.9": 100,
+	} {
+		if got, err := ParseRate(s); err != nil || got != want {
+			t.Errorf("ParseRate(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+
+	for _, s := range []string{"fast", "-1", "-2M", "K", "2MB", "1 M", "NaN", "Inf", "+InfK", "1e30G", "9223372036854775807"} {
+		if got, err := ParseRate(s); err == nil {
+			t.Errorf("ParseRate(%q) = %d, want an error", s, got)
+		}
+	}
+}
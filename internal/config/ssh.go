@@ -0,0 +1,59 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// SSH is the ssh section of the config, used by mcc ssh-config. User is the
+// login of every host unless --user or a device entry says otherwise.
+type SSH struct {
+	User    string      `json:"user,omitempty"`
+	Devices []SSHDevice `json:"devices,omitempty"`
+}
+
+// SSHDevice overrides the login and/or the ssh port of the device Node (node
+// id or device name)
+type SSHDevice struct {
+	Node string `json:"node"`
+	User string `json:"user,omitempty"`
+	Port int    `json:"port,omitempty"`
+}
+
+// GetSSH returns the checked ssh section, which may be empty
+func GetSSH() (*SSH, error) {
+	var ssh SSH
+	if err := viper.UnmarshalKey("ssh", &ssh); err != nil {
+		return nil, &SSHError{err}
+	}
+	if err := validateSSH(ssh); err != nil {
+		return nil, &SSHError{err}
+	}
+	return &ssh, nil
+}
+
+func validateSSH(s SSH) error {
+	for i, d := range s.Devices {
+		if d.Node == "" {
+			return fmt.Errorf("device %d has no node", i+1)
+		}
+		if d.Port < 0 || d.Port > 65535 {
+			return fmt.Errorf("device %s: invalid port %d", d.Node, d.Port)
+		}
+	}
+	return nil
+}
+
+// SSHError is returned by GetSSH when the ssh section is invalid
+type SSHError struct {
+	Err error
+}
+
+func (e *SSHError) Error() string {
+	return "invalid ssh section: " + e.Err.Error()
+}
+
+func (e *SSHError) Unwrap() error {
+	return e.Err
+}
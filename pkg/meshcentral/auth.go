@@ -0,0 +1,229 @@
+package meshcentral
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrAuthFailed is wrapped by the errors of Connect when the server turned the
+// login down
+var ErrAuthFailed = errors.New("authentication failed")
+
+// Connect opens the control connection and returns once the server has
+// authenticated it
+func Connect(ctx context.Context, opts Options) (*Client, error) {
+	c := &Client{
+		opts:          opts,
+		serverURL:     "wss://" + opts.Server + "/meshrelay.ashx",
+		debug:         opts.Debug,
+		authenticated: make(chan struct{}),
+		done:          make(chan struct{}),
+		groups:        map[string]Group{},
+		nodeConn:      map[string]int{},
+		nodeWatchers:  map[chan struct{}]struct{}{},
+		eventWatchers: map[chan Event]struct{}{},
+	}
+
+	// Start by requesting a login token, this is needed because of 2FA and check that we have correct credentials from the start
+	if _, err := url.Parse(c.serverURL); err != nil {
+		return nil, fmt.Errorf("invalid server %q: %w", opts.Server, err)
+	}
+
+	auth := base64.StdEncoding.EncodeToString([]byte(opts.Username)) + "," +
+		base64.StdEncoding.EncodeToString([]byte(opts.Password))
+	if xtoken := c.xtoken(); xtoken != "" {
+		auth += "," + base64.StdEncoding.EncodeToString([]byte(xtoken))
+	}
+	headers := http.Header{}
+	headers.Add("x-meshauth", auth)
+
+	dialer := websocket.Dialer{TLSClientConfig: c.opts.TLSConfig}
+	conn, _, err := dialer.DialContext(ctx, "wss://"+opts.Server+"/control.ashx", headers)
+	if err != nil {
+		return nil, err
+	}
+
+	c.debugf("Connected to server.")
+
+	c.conn = conn
+	go c.onServerWebSocket()
+
+	// Wait for authentication before returning
+	select {
+	case <-c.authenticated:
+		return c, nil
+	case <-c.done:
+		if c.loginErr != nil {
+			return nil, c.loginErr
+		}
+		return nil, errors.New("server closed the connection before the login")
+	case <-ctx.Done():
+		c.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// xtoken is the second factor sent with the login
+func (c *Client) xtoken() string {
+	if c.opts.EmailToken {
+		return "**email**"
+	} else if c.opts.SMSToken {
+		return "**sms**"
+	}
+	return c.opts.Token
+}
+
+// Close closes the control connection, waiting briefly for the server to
+// acknowledge the close. Relays that are open stay open until they are
+// closed. It is safe to call more than once.
+func (c *Client) Close() error {
+	c.writeLock.Lock()
+	if c.stopped {
+		c.writeLock.Unlock()
+		return nil
+	}
+	c.stopped = true
+	c.cookieLock.Lock()
+	if c.renewCookieTimer != nil {
+		c.renewCookieTimer.Stop()
+	}
+	c.cookieLock.Unlock()
+
+	// send close message
+	c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(1000, "all done"))
+	c.writeLock.Unlock()
+
+	select {
+	case <-c.done:
+	case <-time.After(2 * time.Second):
+	}
+	return c.conn.Close()
+}
+
+// Done is closed once the control connection is gone
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// sendControl writes a message to the control connection, gorilla websocket
+// connections only allow one writer at a time
+func (c *Client) sendControl(message []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, message)
+}
+
+func (c *Client) onServerWebSocket() {
+	defer close(c.done)
+
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			// check if the error is a close message
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+				c.debugf("Server closed connection")
+				return
+			}
+			if !c.isStopped() {
+				c.logf("Server connection error: %v", err)
+			}
+			return
+		}
+
+		var command map[string]interface{}
+		if err := json.Unmarshal(message, &command); err != nil {
+			c.logf("Error parsing command: %v", err)
+			continue
+		}
+
+		switch command["action"] {
+		case "close":
+			c.handleCloseCommand(command)
+		case "serverinfo":
+			c.sendControl([]byte(`{"action":"authcookie"}`))
+		case "authcookie":
+			c.handleAuthCookieCommand(command)
+		case "serverAuth":
+			c.handleServerAuthCommand(command)
+		case "userinfo":
+			c.handleUserInfoCommand(command)
+		// devices.go
+		case "nodes":
+			c.handleNodesCommand(command)
+		case "meshes":
+			c.handleMeshesCommand(command)
+		// events.go
+		case "event":
+			c.handleEventCommand(command)
+		}
+
+	}
+}
+
+func (c *Client) isStopped() bool {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.stopped
+}
+
+func (c *Client) handleCloseCommand(command map[string]interface{}) {
+	if command["cause"] == "noauth" {
+		var reason string
+		switch command["msg"] {
+		case "tokenrequired":
+			if command["email2fasent"] == true {
+				reason = "login token sent by email"
+			} else {
+				reason = "login token required"
+			}
+		case "badtlscert":
+			reason = "invalid TLS certificate detected"
+		case "badargs":
+			reason = "invalid protocol arguments"
+		default:
+			reason = "invalid username/password"
+		}
+		// Connect returns it once the server closes the connection
+		c.loginErr = fmt.Errorf("%w: %s", ErrAuthFailed, reason)
+	} else {
+		c.debugf("Server disconnected: %v", command["msg"])
+	}
+}
+
+func (c *Client) handleAuthCookieCommand(command map[string]interface{}) {
+	c.cookieLock.Lock()
+	defer c.cookieLock.Unlock()
+
+	first := c.aCookie == ""
+	c.aCookie, _ = command["cookie"].(string)
+	c.rCookie, _ = command["rcookie"].(string)
+	if first {
+		c.renewCookieTimer = time.AfterFunc(10*time.Minute, func() {
+			c.sendControl([]byte(`{"action":"authcookie"}`))
+		})
+		close(c.authenticated)
+	} else {
+		// keep renewing for long running routes
+		c.renewCookieTimer.Reset(10 * time.Minute)
+	}
+}
+
+func (c *Client) handleServerAuthCommand(command map[string]interface{}) {
+	auth := fmt.Sprintf(`{"action":"userAuth","username":"%s","password":"%s"`,
+		base64.StdEncoding.EncodeToString([]byte(c.opts.Username)),
+		base64.StdEncoding.EncodeToString([]byte(c.opts.Password)))
+	if xtoken := c.xtoken(); xtoken != "" {
+		auth += fmt.Sprintf(`,"token":"%s"`, xtoken)
+	}
+	auth += "}"
+
+	c.sendControl([]byte(auth))
+}
@@ -0,0 +1,333 @@
+package meshcentral_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/soarinferret/mcc/pkg/meshcentral"
+)
+
+// control plays the control connection of a MeshCentral server. It sends
+// serverinfo and hands every command of the client to answer.
+func control(t *testing.T, answer func(conn *websocket.Conn, command map[string]interface{})) meshcentral.Options {
+	t.Helper()
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.WriteJSON(map[string]interface{}{"action": "serverinfo"})
+		for {
+			var command map[string]interface{}
+			if err := conn.ReadJSON(&command); err != nil {
+				return
+			}
+			answer(conn, command)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return meshcentral.Options{
+		Server:    strings.TrimPrefix(server.URL, "https://"),
+		TLSConfig: server.Client().Transport.(*http.Transport).TLSClientConfig,
+	}
+}
+
+// loggedIn answers like a server that took the login
+func loggedIn(conn *websocket.Conn, command map[string]interface{}) {
+	if command["action"] == "authcookie" {
+		conn.WriteJSON(map[string]interface{}{"action": "authcookie", "cookie": "a", "rcookie": "r"})
+	}
+}
+
+func TestConnectSendsCredentials(t *testing.T) {
+	header := make(chan string, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header <- r.Header.Get("x-meshauth")
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteJSON(map[string]interface{}{"action": "close", "cause": "noauth", "msg": "badargs"})
+	}))
+	defer server.Close()
+
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	for _, tt := range []struct {
+		opts meshcentral.Options
+		want string
+	}{
+		{meshcentral.Options{Username: "admin", Password: "p,a:ss"}, encode("admin") + "," + encode("p,a:ss")},
+		{meshcentral.Options{Username: "admin", Password: "secret", Token: "123456"}, encode("admin") + "," + encode("secret") + "," + encode("123456")},
+		{meshcentral.Options{Username: "admin", Password: "secret", EmailToken: true}, encode("admin") + "," + encode("secret") + "," + encode("**email**")},
+		{meshcentral.Options{Username: "admin", Password: "secret", SMSToken: true}, encode("admin") + "," + encode("secret") + "," + encode("**sms**")},
+	} {
+		opts := tt.opts
+		opts.Server = strings.TrimPrefix(server.URL, "https://")
+		opts.TLSConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+		meshcentral.Connect(context.Background(), opts)
+		if got := <-header; got != tt.want {
+			t.Errorf("x-meshauth = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	for _, tt := range []struct {
+		close map[string]interface{}
+		want  string
+	}{
+		{map[string]interface{}{"msg": "tokenrequired"}, "authentication failed: login token required"},
+		{map[string]interface{}{"msg": "tokenrequired", "email2fasent": true}, "authentication failed: login token sent by email"},
+		{map[string]interface{}{"msg": "badtlscert"}, "authentication failed: invalid TLS certificate detected"},
+		{map[string]interface{}{"msg": "badargs"}, "authentication failed: invalid protocol arguments"},
+		{map[string]interface{}{}, "authentication failed: invalid username/password"},
+	} {
+		message := map[string]interface{}{"action": "close", "cause": "noauth"}
+		for k, v := range tt.close {
+			message[k] = v
+		}
+		// the server refuses before the serverinfo is answered
+		opts := refuseWith(t, message)
+
+		_, err := meshcentral.Connect(context.Background(), opts)
+		if !errors.Is(err, meshcentral.ErrAuthFailed) || err.Error() != tt.want {
+			t.Errorf("Connect() error = %v, want %q", err, tt.want)
+		}
+	}
+}
+
+// refuseWith plays a server that closes the login with message
+func refuseWith(t *testing.T, message map[string]interface{}) meshcentral.Options {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteJSON(message)
+	}))
+	t.Cleanup(server.Close)
+	return meshcentral.Options{
+		Server:    strings.TrimPrefix(server.URL, "https://"),
+		TLSConfig: server.Client().Transport.(*http.Transport).TLSClientConfig,
+	}
+}
+
+func TestConnectGivesUp(t *testing.T) {
+	// a server that never hands out a cookie
+	opts := control(t, func(conn *websocket.Conn, command map[string]interface{}) {})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := meshcentral.Connect(ctx, opts); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Connect() error = %v, want the context's", err)
+	}
+
+	// and one that isn't there
+	opts.Server = "127.0.0.1:1"
+	if _, err := meshcentral.Connect(context.Background(), opts); err == nil {
+		t.Error("Connect() to a closed port succeeded")
+	}
+}
+
+func TestClientDevices(t *testing.T) {
+	opts := control(t, func(conn *websocket.Conn, command map[string]interface{}) {
+		switch command["action"] {
+		case "authcookie":
+			conn.WriteJSON(map[string]interface{}{"action": "userinfo", "userinfo": map[string]interface{}{"_id": "user//admin", "name": "admin", "email": "admin@example.com"}})
+			loggedIn(conn, command)
+		case "meshes":
+			conn.WriteJSON(map[string]interface{}{"action": "meshes", "meshes": []interface{}{
+				map[string]interface{}{"_id": "mesh//servers", "name": "servers", "desc": "production"},
+			}})
+		case "nodes":
+			conn.WriteJSON(map[string]interface{}{"action": "nodes", "nodes": map[string]interface{}{
+				"mesh//servers": []interface{}{
+					map[string]interface{}{"_id": "node//web01", "rname": "web01", "osdesc": "Ubuntu 22.04", "ip": "10.0.0.5", "conn": 1, "pwr": 1, "tags": []interface{}{"web", "prod"}},
+					map[string]interface{}{"_id": "node//db01", "rname": "db", "conn": 0},
+					map[string]interface{}{"_id": "node//db02", "rname": "DB", "conn": 1},
+				},
+			}})
+		}
+	})
+	opts.Username = "admin"
+
+	client, err := meshcentral.Connect(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	devices, err := client.Devices()
+	if err != nil || len(devices) != 3 {
+		t.Fatalf("Devices() = %v, %v", devices, err)
+	}
+	web, err := client.FindDevice("WEB01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if web.Id != "node//web01" || web.Group != "servers" || web.IP != "10.0.0.5" || web.OS != "Ubuntu 22.04" || strings.Join(web.Tags, ",") != "web,prod" {
+		t.Errorf("FindDevice(WEB01) = %+v", web)
+	}
+	if user := client.User(); user.ID != "user//admin" || user.Email != "admin@example.com" {
+		t.Errorf("User() = %+v", user)
+	}
+	if groups, err := client.Groups(); err != nil || len(groups) != 1 || groups[0].Description != "production" {
+		t.Errorf("Groups() = %v, %v", groups, err)
+	}
+
+	// the listing tells which nodes are online
+	if !client.NodeOnline("node//web01") || client.NodeOnline("node//db01") {
+		t.Error("NodeOnline() doesn't follow the listing")
+	}
+
+	if _, err := client.FindDevice("db"); err == nil || !strings.Contains(err.Error(), "use the node id") {
+		t.Errorf("FindDevice() of a shared name = %v", err)
+	}
+	if d, err := client.FindDevice("node//db02"); err != nil || d.Name != "DB" {
+		t.Errorf("FindDevice() by id = %v, %v", d, err)
+	}
+	if _, err := client.Device("node//gone"); !errors.Is(err, meshcentral.ErrDeviceNotFound) {
+		t.Errorf("Device() of an unknown node = %v", err)
+	}
+
+	// once closed the client says so instead of waiting
+	if err := client.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Errorf("second Close() = %v", err)
+	}
+	if _, err := client.Devices(); !errors.Is(err, meshcentral.ErrClosed) {
+		t.Errorf("Devices() after Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestClientEvents(t *testing.T) {
+	push := make(chan map[string]interface{})
+	opts := control(t, func(conn *websocket.Conn, command map[string]interface{}) {
+		loggedIn(conn, command)
+		if command["action"] == "authcookie" {
+			go func() {
+				for event := range push {
+					conn.WriteJSON(map[string]interface{}{"action": "event", "event": event})
+				}
+			}()
+		}
+	})
+	client, err := meshcentral.Connect(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer close(push)
+
+	events, stop := client.Events()
+	defer stop()
+	changes, stopWatching := client.WatchNodes()
+	defer stopWatching()
+
+	expect := func(want string) meshcentral.Event {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event.Action != want {
+				t.Errorf("event %q, want %q", event.Action, want)
+			}
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s event", want)
+		}
+		return meshcentral.Event{}
+	}
+
+	push <- map[string]interface{}{"action": "nodeconnect", "nodeid": "node//web01", "conn": 0}
+	if event := expect("nodeconnect"); event.NodeID != "node//web01" || event.Conn != 0 {
+		t.Errorf("event = %+v", event)
+	}
+	<-changes
+	if client.NodeOnline("node//web01") {
+		t.Error("node//web01 still online after it disconnected")
+	}
+
+	push <- map[string]interface{}{"action": "nodeconnect", "nodeid": "node//web01", "conn": 1}
+	expect("nodeconnect")
+	<-changes
+	if !client.NodeOnline("node//web01") {
+		t.Error("node//web01 offline after it connected")
+	}
+
+	// events that don't change a node reach Events only
+	push <- map[string]interface{}{"action": "login", "msg": "admin logged in"}
+	if event := expect("login"); event.Data["msg"] != "admin logged in" {
+		t.Errorf("event data = %v", event.Data)
+	}
+	select {
+	case <-changes:
+		t.Error("a login changed the nodes")
+	default:
+	}
+}
+
+func TestClientLogger(t *testing.T) {
+	opts := control(t, func(conn *websocket.Conn, command map[string]interface{}) {
+		if command["action"] == "authcookie" {
+			conn.WriteMessage(websocket.TextMessage, []byte("not json"))
+		}
+		loggedIn(conn, command)
+	})
+
+	for _, tt := range []struct {
+		debug      bool
+		want, skip string
+	}{
+		{false, "Error parsing command", "Connected to server."},
+		{true, "Connected to server.", ""},
+	} {
+		var out bytes.Buffer
+		opts.Logger = log.New(&out, "mesh: ", 0)
+		opts.Debug = tt.debug
+
+		client, err := meshcentral.Connect(context.Background(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the junk arrives before the cookie, Connect returns after it was logged
+		client.Close()
+
+		logged := out.String()
+		if !strings.Contains(logged, "mesh: "+tt.want) {
+			t.Errorf("debug %v: log %q doesn't have %q", tt.debug, logged, tt.want)
+		}
+		if tt.skip != "" && strings.Contains(logged, tt.skip) {
+			t.Errorf("debug %v: log %q has %q", tt.debug, logged, tt.skip)
+		}
+	}
+
+	// without a logger nothing is written, or panics
+	opts.Logger, opts.Debug = nil, true
+	client, err := meshcentral.Connect(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+}
@@ -0,0 +1,95 @@
+package meshcentral
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Options are the login and connection settings of a Client
+type Options struct {
+	// Server is host[:port] of the MeshCentral server
+	Server   string
+	Username string
+	Password string
+	// Token is the second factor of accounts that have one. EmailToken and
+	// SMSToken ask the server to send one instead.
+	Token      string
+	EmailToken bool
+	SMSToken   bool
+	// TLSConfig is used for every connection to the server. When it is nil
+	// the server certificate is verified against the system roots.
+	TLSConfig *tls.Config
+	// Compress asks the server for permessage-deflate on relays. It helps
+	// with compressible traffic over slow links and costs CPU otherwise.
+	Compress bool
+	// Logger gets connection errors and the state of forwards and proxies.
+	// Nothing is logged when it is nil.
+	Logger *log.Logger
+	// Debug adds protocol details to the log
+	Debug bool
+}
+
+// Client is a logged in control connection to a MeshCentral server. Relays,
+// shells and file sessions are opened through it. A Client is safe for use by
+// several goroutines.
+type Client struct {
+	opts      Options
+	serverURL string
+	debug     bool
+
+	conn          *websocket.Conn
+	writeLock     sync.Mutex
+	authenticated chan struct{}
+	done          chan struct{}
+	stopped       bool
+	loginErr      error
+
+	cookieLock       sync.Mutex
+	aCookie          string
+	rCookie          string
+	renewCookieTimer *time.Timer
+
+	mu            sync.Mutex
+	user          *User
+	groups        map[string]Group
+	deviceWaiters []chan []Device
+	groupWaiters  []chan []Group
+	nodeConn      map[string]int
+	nodeWatchers  map[chan struct{}]struct{}
+	eventWatchers map[chan Event]struct{}
+}
+
+// discardLogger stands in for a nil Options.Logger
+var discardLogger = log.New(io.Discard, "", 0)
+
+// logger is Options.Logger, or one that discards everything
+func (c *Client) logger() *log.Logger {
+	if c.opts.Logger != nil {
+		return c.opts.Logger
+	}
+	return discardLogger
+}
+
+// logf writes a message to Options.Logger
+func (c *Client) logf(format string, v ...any) {
+	c.logger().Printf(format, v...)
+}
+
+// debugf is logf for the protocol details logged with Options.Debug
+func (c *Client) debugf(format string, v ...any) {
+	if c.debug {
+		c.logf(format, v...)
+	}
+}
+
+// cookies returns the current auth cookie for relays and the one for agents
+func (c *Client) cookies() (string, string) {
+	c.cookieLock.Lock()
+	defer c.cookieLock.Unlock()
+	return c.aCookie, c.rCookie
+}
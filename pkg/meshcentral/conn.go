@@ -0,0 +1,326 @@
+package meshcentral
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrRelayRefused is returned by the reads of a relay connection that the
+// server closed before the node took it, e.g. because nothing listens on the
+// port or the node is offline
+var ErrRelayRefused = errors.New("relay refused")
+
+// RelayAddr is the address a relay connection goes to, Address as seen from
+// the node with NodeID
+type RelayAddr struct {
+	NodeID  string
+	Address string
+}
+
+func (a *RelayAddr) Network() string { return "tcp" }
+func (a *RelayAddr) String() string  { return a.Address }
+
+// RelayConn is a relay to a TCP port on a node as a net.Conn. Deadlines only
+// affect the call they interrupt, reads can go on after a timeout. The relay
+// has no half-close: CloseWrite stops the writes, while reads go on until the
+// node side closes or Close is called.
+type RelayConn struct {
+	ws     *websocket.Conn
+	writer *relayWriter
+	remote *RelayAddr
+
+	incoming chan []byte
+	readMu   sync.Mutex
+	pending  []byte
+	readErr  error
+
+	readDeadline *deadline
+
+	mu          sync.Mutex
+	writeClosed bool
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+// Dial connects to address ("host:port") as seen from the node. An empty
+// host, localhost or 127.0.0.1 is the node itself. Only "tcp" networks are
+// supported.
+//
+// The connection is a *RelayConn. The relay has no half-close: CloseWrite
+// stops the writes while the reads go on until the node side closes.
+func (c *Client) Dial(ctx context.Context, nodeID string, network string, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	conn, err := c.dialNode(ctx, nodeID, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: &RelayAddr{NodeID: nodeID, Address: address}, Err: err}
+	}
+	return conn, nil
+}
+
+func (c *Client) dialNode(ctx context.Context, nodeID string, address string) (*RelayConn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, errors.New("invalid port " + portStr)
+	}
+	if host == "localhost" || host == "127.0.0.1" {
+		host = ""
+	}
+
+	select {
+	case <-c.done:
+		return nil, ErrClosed
+	default:
+	}
+
+	ws, err := c.dialProtocolRelay(ctx, nodeID, "tcp", host, port)
+	if err != nil {
+		return nil, err
+	}
+	fwd := Forward{RemoteTarget: host, RemotePort: port}
+	return newRelayConn(ws, &RelayAddr{NodeID: nodeID, Address: fwd.destination()}), nil
+}
+
+// DialContext returns a dial function for nodeID with the signature of
+// net.Dialer.DialContext, for clients that take one
+func (c *Client) DialContext(nodeID string) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		return c.Dial(ctx, nodeID, network, address)
+	}
+}
+
+// Transport returns an http.RoundTripper that connects to the hosts of the
+// requests as seen from nodeID. Idle connections are kept like by
+// http.DefaultTransport.
+func (c *Client) Transport(nodeID string) *http.Transport {
+	return &http.Transport{
+		DialContext:           c.DialContext(nodeID),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+func newRelayConn(ws *websocket.Conn, remote *RelayAddr) *RelayConn {
+	c := &RelayConn{
+		ws:           ws,
+		writer:       &relayWriter{conn: ws},
+		remote:       remote,
+		incoming:     make(chan []byte, relayQueue),
+		readDeadline: newDeadline(),
+		closed:       make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+// readLoop moves the messages of the relay to incoming, so a read that times
+// out doesn't leave the websocket in the middle of a message
+func (c *RelayConn) readLoop() {
+	defer close(c.incoming)
+
+	connected := false
+	for {
+		messageType, message, err := c.ws.NextReader()
+		if err != nil {
+			switch {
+			case errors.Is(err, net.ErrClosed):
+				c.readErr = net.ErrClosed
+			case !connected:
+				c.readErr = fmt.Errorf("%w: %v", ErrRelayRefused, err)
+			case websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived):
+				c.readErr = io.EOF
+			default:
+				c.readErr = err
+			}
+			return
+		}
+		if messageType != websocket.BinaryMessage {
+			// the server sends "c" once the node took the relay
+			data, _ := io.ReadAll(message)
+			if string(data) == "c" || string(data) == "cr" {
+				connected = true
+			}
+			continue
+		}
+		connected = true
+
+		for {
+			buf := make([]byte, relayBufferSize)
+			n, err := io.ReadFull(message, buf)
+			if n > 0 {
+				select {
+				case c.incoming <- buf[:n]:
+				case <-c.closed:
+					c.readErr = net.ErrClosed
+					return
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				c.readErr = err
+				return
+			}
+		}
+	}
+}
+
+func (c *RelayConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(c.pending) == 0 {
+		select {
+		case data, ok := <-c.incoming:
+			if !ok {
+				return 0, c.readErr
+			}
+			c.pending = data
+		case <-c.closed:
+			return 0, net.ErrClosed
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *RelayConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	writeClosed := c.writeClosed
+	c.mu.Unlock()
+	if writeClosed {
+		return 0, net.ErrClosed
+	}
+
+	written := 0
+	for written < len(p) {
+		n := min(len(p)-written, relayFrameSize)
+		if err := c.writer.WriteMessage(websocket.BinaryMessage, p[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite makes further writes fail. The relay can't pass a half-close on
+// to the node, so the node side stays open until it closes or Close is called.
+func (c *RelayConn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeClosed = true
+	return nil
+}
+
+// Close tells the relay the local side is done and closes the connection
+func (c *RelayConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.writer.close()
+		err = c.ws.Close()
+	})
+	return err
+}
+
+// LocalAddr is the local end of the websocket to the server
+func (c *RelayConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+// RemoteAddr is where the relay goes to as seen from the node
+func (c *RelayConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *RelayConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *RelayConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline limits the writes, a write that times out breaks the
+// connection
+func (c *RelayConn) SetWriteDeadline(t time.Time) error {
+	// interrupts a write in progress, which holds the writer
+	c.ws.NetConn().SetWriteDeadline(t)
+
+	c.writer.mu.Lock()
+	defer c.writer.mu.Unlock()
+	return c.ws.SetWriteDeadline(t)
+}
+
+// deadline is a channel that is closed once a time passes, the time can be
+// moved any time
+type deadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{expired: make(chan struct{})}
+}
+
+// set moves the deadline, the zero time means none
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// the timer fired, wait for it to close expired
+		<-d.expired
+	}
+	d.timer = nil
+
+	select {
+	case <-d.expired:
+		d.expired = make(chan struct{})
+	default:
+	}
+	if t.IsZero() {
+		return
+	}
+	if wait := time.Until(t); wait > 0 {
+		expired := d.expired
+		d.timer = time.AfterFunc(wait, func() { close(expired) })
+		return
+	}
+	close(d.expired)
+}
+
+// wait returns the channel that is closed when the deadline passes
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.expired
+}
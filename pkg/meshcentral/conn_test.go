@@ -0,0 +1,211 @@
+package meshcentral
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// openRelayConn dials address through the fake node and closes the connection
+// when the test ends
+func openRelayConn(t *testing.T, client *Client, address string) *RelayConn {
+	t.Helper()
+	conn, err := client.Dial(context.Background(), "node//web01", "tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.(*RelayConn)
+}
+
+func TestDial(t *testing.T) {
+	client := startFakeServer(t, relayTarget)
+
+	for address, want := range map[string]string{
+		"10.0.0.5:22":    "10.0.0.5:22 via node//web01\n",
+		"localhost:8080": ":8080 via node//web01\n",
+		"127.0.0.1:8080": ":8080 via node//web01\n",
+		"[fd00::1]:443":  "fd00::1:443 via node//web01\n",
+	} {
+		conn := openRelayConn(t, client, address)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if greeting, _ := bufio.NewReader(conn).ReadString('\n'); greeting != want {
+			t.Errorf("Dial(%q) reached %q, want %q", address, greeting, want)
+		}
+	}
+
+	// the node itself is 127.0.0.1 in the remote address
+	if got := openRelayConn(t, client, "localhost:8080").RemoteAddr().String(); got != "127.0.0.1:8080" {
+		t.Errorf("RemoteAddr() = %q", got)
+	}
+
+	_, err := client.Dial(context.Background(), "node//web01", "udp", "10.0.0.5:53")
+	var unknown net.UnknownNetworkError
+	if !errors.As(err, &unknown) {
+		t.Errorf("Dial(udp) error = %v, want an UnknownNetworkError", err)
+	}
+
+	for _, address := range []string{"10.0.0.5:0", "10.0.0.5:ssh", "10.0.0.5:65536", "10.0.0.5"} {
+		var opErr *net.OpError
+		if _, err := client.Dial(context.Background(), "node//web01", "tcp", address); !errors.As(err, &opErr) || opErr.Op != "dial" {
+			t.Errorf("Dial(%q) error = %v, want a dial OpError", address, err)
+		}
+	}
+}
+
+func TestRelayConnReadDeadline(t *testing.T) {
+	release := make(chan struct{})
+	client := startFakeServer(t, func(conn *websocket.Conn, r *http.Request) {
+		conn.WriteMessage(websocket.TextMessage, []byte("c"))
+		<-release
+		conn.WriteMessage(websocket.BinaryMessage, []byte("late"))
+		conn.ReadMessage()
+	})
+	conn := openRelayConn(t, client, "10.0.0.5:22")
+	buf := make([]byte, 16)
+
+	conn.SetDeadline(time.Now().Add(-time.Second))
+	if _, err := conn.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read() past the deadline = %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	_, err := conn.Read(buf)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Read() = %v, want a timeout", err)
+	}
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Errorf("Read() gave up after %v", waited)
+	}
+
+	// a timed out read doesn't break the connection
+	conn.SetReadDeadline(time.Time{})
+	close(release)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "late" {
+		t.Errorf("Read() after the timeout = %q, %v", buf[:n], err)
+	}
+}
+
+func TestRelayConnCloseWrite(t *testing.T) {
+	client := startFakeServer(t, relayTarget)
+	conn := openRelayConn(t, client, "10.0.0.5:22")
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, "one\n")
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(conn, "two\n"); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write() after CloseWrite = %v, want net.ErrClosed", err)
+	}
+
+	// the reads go on
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n')
+	if echo, err := reader.ReadString('\n'); echo != "one\n" {
+		t.Errorf("echo after CloseWrite = %q, %v", echo, err)
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+	if err := conn.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("second Close() = %v, want net.ErrClosed", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Read() after Close = %v, want net.ErrClosed", err)
+	}
+}
+
+func TestRelayConnEnds(t *testing.T) {
+	tests := []struct {
+		name  string
+		agent func(conn *websocket.Conn)
+		data  string
+		err   error
+	}{
+		{"node closes", func(conn *websocket.Conn) {
+			conn.WriteMessage(websocket.TextMessage, []byte("c"))
+			conn.WriteMessage(websocket.BinaryMessage, []byte("bye"))
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		}, "bye", io.EOF},
+		{"connected on cr", func(conn *websocket.Conn) {
+			conn.WriteMessage(websocket.TextMessage, []byte("cr"))
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+		}, "", io.EOF},
+		{"data without c", func(conn *websocket.Conn) {
+			conn.WriteMessage(websocket.BinaryMessage, []byte("SSH-2.0"))
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		}, "SSH-2.0", io.EOF},
+		{"refused", func(conn *websocket.Conn) {}, "", ErrRelayRefused},
+		{"refused with a close", func(conn *websocket.Conn) {
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		}, "", ErrRelayRefused},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := startFakeServer(t, func(conn *websocket.Conn, r *http.Request) { tt.agent(conn) })
+			conn := openRelayConn(t, client, "10.0.0.5:22")
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			var got strings.Builder
+			buf := make([]byte, 4)
+			for {
+				n, err := conn.Read(buf)
+				got.Write(buf[:n])
+				if err != nil {
+					if !errors.Is(err, tt.err) {
+						t.Errorf("Read() = %v, want %v", err, tt.err)
+					}
+					break
+				}
+			}
+			if got.String() != tt.data {
+				t.Errorf("read %q, want %q", got.String(), tt.data)
+			}
+		})
+	}
+}
+
+func TestRelayConnWriteFrames(t *testing.T) {
+	sizes := make(chan []int, 1)
+	client := startFakeServer(t, func(conn *websocket.Conn, r *http.Request) {
+		conn.WriteMessage(websocket.TextMessage, []byte("c"))
+		var got []int
+		for total := 0; total < 2*relayFrameSize+100; {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				break
+			}
+			got = append(got, len(message))
+			total += len(message)
+		}
+		sizes <- got
+		conn.ReadMessage()
+	})
+	conn := openRelayConn(t, client, "10.0.0.5:22")
+
+	data := make([]byte, 2*relayFrameSize+100)
+	if n, err := conn.Write(data); n != len(data) || err != nil {
+		t.Fatalf("Write() = %d, %v", n, err)
+	}
+	select {
+	case got := <-sizes:
+		if len(got) != 3 || got[0] != relayFrameSize || got[1] != relayFrameSize || got[2] != 100 {
+			t.Errorf("relay got messages of %v bytes", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the messages didn't arrive")
+	}
+}
@@ -0,0 +1,225 @@
+package meshcentral
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Device is a node as listed by the server. Conn is its connection state
+// (bit 1 is set while the agent is connected), Pwr its power state. Mesh is
+// the id of its device group, Group the group's name.
+type Device struct {
+	Id    string
+	Name  string
+	OS    string
+	IP    string
+	Icon  int
+	Conn  int
+	Pwr   int
+	Mesh  string
+	Group string
+	Tags  []string
+}
+
+// Group is a device group (a mesh in MeshCentral's own terms)
+type Group struct {
+	ID          string
+	Name        string
+	Description string
+}
+
+// User is the account a client is logged in as
+type User struct {
+	ID    string
+	Name  string
+	Email string
+}
+
+func (c *Client) handleNodesCommand(command map[string]interface{}) {
+	c.debugf("Received nodes command")
+	c.mu.Lock()
+	groups := c.groups
+	c.mu.Unlock()
+
+	var devices []Device
+	nodeGroups, _ := command["nodes"].(map[string]interface{})
+	for meshID, nodeGroup := range nodeGroups {
+		nodes, _ := nodeGroup.([]interface{})
+		for _, node := range nodes {
+			nodeMap, ok := node.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			device := Device{
+				Mesh:  meshID,
+				Group: groups[meshID].Name,
+			}
+			device.Id, _ = nodeMap["_id"].(string)
+			device.Name, _ = nodeMap["rname"].(string)
+			device.OS, _ = nodeMap["osdesc"].(string)
+			device.IP, _ = nodeMap["ip"].(string)
+			icon, _ := nodeMap["icon"].(float64)
+			conn, _ := nodeMap["conn"].(float64)
+			pwr, _ := nodeMap["pwr"].(float64)
+			device.Icon, device.Conn, device.Pwr = int(icon), int(conn), int(pwr)
+			if tags, ok := nodeMap["tags"].([]interface{}); ok {
+				for _, tag := range tags {
+					if t, ok := tag.(string); ok {
+						device.Tags = append(device.Tags, t)
+					}
+				}
+			}
+			devices = append(devices, device)
+			c.setNodeConn(device.Id, device.Conn)
+		}
+	}
+
+	c.mu.Lock()
+	waiters := c.deviceWaiters
+	c.deviceWaiters = nil
+	c.mu.Unlock()
+	for _, waiter := range waiters {
+		waiter <- devices
+	}
+}
+
+// handleMeshesCommand keeps the device groups, the server answers meshes
+// before the nodes asked for after it
+func (c *Client) handleMeshesCommand(command map[string]interface{}) {
+	meshes, _ := command["meshes"].([]interface{})
+	groups := map[string]Group{}
+	var list []Group
+	for _, mesh := range meshes {
+		meshMap, ok := mesh.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var group Group
+		group.ID, _ = meshMap["_id"].(string)
+		group.Name, _ = meshMap["name"].(string)
+		group.Description, _ = meshMap["desc"].(string)
+		groups[group.ID] = group
+		list = append(list, group)
+	}
+
+	c.mu.Lock()
+	c.groups = groups
+	waiters := c.groupWaiters
+	c.groupWaiters = nil
+	c.mu.Unlock()
+	for _, waiter := range waiters {
+		waiter <- list
+	}
+}
+
+// handleUserInfoCommand keeps the account, the server sends it after the login
+func (c *Client) handleUserInfoCommand(command map[string]interface{}) {
+	info, ok := command["userinfo"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	var user User
+	user.ID, _ = info["_id"].(string)
+	user.Name, _ = info["name"].(string)
+	user.Email, _ = info["email"].(string)
+
+	c.mu.Lock()
+	c.user = &user
+	c.mu.Unlock()
+}
+
+// User returns the account the client is logged in as. Until the server has
+// sent the details only Name is set.
+func (c *Client) User() User {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.user == nil {
+		return User{Name: c.opts.Username}
+	}
+	return *c.user
+}
+
+// ErrClosed is returned by requests to the server after the control
+// connection is gone
+var ErrClosed = errors.New("connection to the server closed")
+
+// Devices asks the server for every device the account can see
+func (c *Client) Devices() ([]Device, error) {
+	waiter := make(chan []Device, 1)
+	c.mu.Lock()
+	c.deviceWaiters = append(c.deviceWaiters, waiter)
+	c.mu.Unlock()
+
+	c.sendControl([]byte(`{"action":"meshes"}`))
+	c.sendControl([]byte(`{"action":"nodes"}`))
+
+	select {
+	case devices := <-waiter:
+		return devices, nil
+	case <-c.done:
+		return nil, ErrClosed
+	}
+}
+
+// Groups asks the server for the device groups the account can see
+func (c *Client) Groups() ([]Group, error) {
+	waiter := make(chan []Group, 1)
+	c.mu.Lock()
+	c.groupWaiters = append(c.groupWaiters, waiter)
+	c.mu.Unlock()
+
+	c.sendControl([]byte(`{"action":"meshes"}`))
+
+	select {
+	case groups := <-waiter:
+		return groups, nil
+	case <-c.done:
+		return nil, ErrClosed
+	}
+}
+
+// ErrDeviceNotFound is returned by Device and FindDevice when nothing matches
+var ErrDeviceNotFound = errors.New("no device found matching")
+
+// Device returns the device with the given node id
+func (c *Client) Device(nodeID string) (*Device, error) {
+	devices, err := c.Devices()
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		if device.Id == nodeID {
+			return &device, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %s", ErrDeviceNotFound, nodeID)
+}
+
+// FindDevice looks up a device by node id or, failing that, by its name
+func (c *Client) FindDevice(nameOrID string) (*Device, error) {
+	devices, err := c.Devices()
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		if device.Id == nameOrID {
+			return &device, nil
+		}
+	}
+
+	var found *Device
+	for _, device := range devices {
+		if strings.EqualFold(device.Name, nameOrID) {
+			if found != nil {
+				return nil, fmt.Errorf("more than one device is named %s, use the node id", nameOrID)
+			}
+			d := device
+			found = &d
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w %s", ErrDeviceNotFound, nameOrID)
+	}
+	return found, nil
+}
@@ -0,0 +1,35 @@
+// Package meshcentral is a client for MeshCentral servers. It logs in over the
+// control connection and opens relays through the server to the agents of the
+// devices: TCP connections, terminals, commands and file sessions.
+//
+// Connect logs in and returns a Client, everything else hangs off it:
+//
+//	client, err := meshcentral.Connect(ctx, meshcentral.Options{
+//		Server:   "mesh.example.com",
+//		Username: "admin",
+//		Password: os.Getenv("MESH_PASSWORD"),
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer client.Close()
+//
+//	conn, err := client.Dial(ctx, nodeID, "tcp", "127.0.0.1:22")
+//
+// Client.Dial returns a net.Conn, so anything that takes a dialer works over
+// a relay; Client.Transport is an http.Transport for the web UI of a device.
+// Forward, SocksProxy, HttpProxy, Fleet, Resolver and Gateway are the
+// listeners mcc itself is built from, each takes the Client to relay through.
+//
+// The package doesn't write to stdout or stderr. Errors that can't be
+// returned, like a relay a forward couldn't open, go to Options.Logger.
+//
+// # Versioning
+//
+// Version is the version of the package API. Until it reaches 1.0.0 the API
+// may still change between minor versions. What is written to
+// Options.Logger is not part of the API.
+package meshcentral
+
+// Version is the version of the package API
+const Version = "0.1.0"
@@ -0,0 +1,115 @@
+package meshcentral
+
+// connAgent is the bit of a node's conn state that is set while its agent is
+// connected to the server, which relays need
+const connAgent = 1
+
+// eventQueue is how many events wait for a slow reader of Events before
+// newer ones are dropped
+const eventQueue = 64
+
+// Event is something the server reported. Node events carry the NodeID, e.g.
+// "nodeconnect" (with the node's new Conn state), "addnode", "changenode" and
+// "removenode". Data is the event as the server sent it.
+type Event struct {
+	Action string
+	NodeID string
+	Conn   int
+	Data   map[string]interface{}
+}
+
+func (c *Client) setNodeConn(nodeID string, conn int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nodeConn[nodeID] = conn
+}
+
+// Events returns a channel that receives the events of the server. Events
+// that arrive while the channel is full are dropped. stop ends the
+// subscription.
+func (c *Client) Events() (events <-chan Event, stop func()) {
+	ch := make(chan Event, eventQueue)
+	c.mu.Lock()
+	c.eventWatchers[ch] = struct{}{}
+	c.mu.Unlock()
+
+	return ch, func() {
+		c.mu.Lock()
+		delete(c.eventWatchers, ch)
+		c.mu.Unlock()
+	}
+}
+
+// WatchNodes returns a channel that receives when nodes change. Changes that
+// happen while nobody reads are merged into one. stop ends the watch.
+func (c *Client) WatchNodes() (changes <-chan struct{}, stop func()) {
+	ch := make(chan struct{}, 1)
+	c.mu.Lock()
+	c.nodeWatchers[ch] = struct{}{}
+	c.mu.Unlock()
+
+	return ch, func() {
+		c.mu.Lock()
+		delete(c.nodeWatchers, ch)
+		c.mu.Unlock()
+	}
+}
+
+func (c *Client) notifyNodeWatchers() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for ch := range c.nodeWatchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// NodeOnline reports whether the agent of the node is connected. Nodes the
+// server hasn't told us about count as online, so they are still tried.
+func (c *Client) NodeOnline(nodeID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn, ok := c.nodeConn[nodeID]
+	return !ok || conn&connAgent != 0
+}
+
+// handleEventCommand keeps track of nodes going on and offline and tells the
+// watchers
+func (c *Client) handleEventCommand(command map[string]interface{}) {
+	data, ok := command["event"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	event := Event{Data: data}
+	event.Action, _ = data["action"].(string)
+	event.NodeID, _ = data["nodeid"].(string)
+	if conn, ok := data["conn"].(float64); ok {
+		event.Conn = int(conn)
+	}
+
+	c.mu.Lock()
+	for ch := range c.eventWatchers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+	c.mu.Unlock()
+
+	if event.NodeID == "" {
+		return
+	}
+	switch event.Action {
+	case "nodeconnect":
+		c.debugf("Node %s conn state %d", event.NodeID, event.Conn)
+		c.setNodeConn(event.NodeID, event.Conn)
+	case "removenode":
+		c.setNodeConn(event.NodeID, 0)
+	case "addnode", "changenode":
+	default:
+		return
+	}
+	c.notifyNodeWatchers()
+}
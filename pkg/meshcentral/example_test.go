@@ -0,0 +1,184 @@
+package meshcentral_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/soarinferret/mcc/pkg/meshcentral"
+)
+
+func ExampleConnect() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	client, err := meshcentral.Connect(ctx, meshcentral.Options{
+		Server:   "mesh.example.com",
+		Username: "admin",
+		Password: os.Getenv("MESH_PASSWORD"),
+		Logger:   log.New(os.Stderr, "mesh: ", log.LstdFlags),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	fmt.Println("logged in as", client.User().Name)
+}
+
+func ExampleClient_Devices() {
+	client, err := meshcentral.Connect(context.Background(), meshcentral.Options{Server: "mesh.example.com", Username: "admin", Password: "secret"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	devices, err := client.Devices()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, device := range devices {
+		fmt.Println(device.Name, device.Group, device.Id)
+	}
+}
+
+func ExampleClient_Dial() {
+	client, err := meshcentral.Connect(context.Background(), meshcentral.Options{Server: "mesh.example.com", Username: "admin", Password: "secret"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	// port 6379 on the node itself, "10.0.0.5:6379" would be a host the node reaches
+	conn, err := client.Dial(context.Background(), "node//abc", "tcp", "127.0.0.1:6379")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprint(conn, "PING\r\n")
+	reply := make([]byte, 64)
+	n, _ := conn.Read(reply)
+	fmt.Printf("%q\n", reply[:n])
+}
+
+func ExampleClient_Transport() {
+	client, err := meshcentral.Connect(context.Background(), meshcentral.Options{Server: "mesh.example.com", Username: "admin", Password: "secret"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	// the host in the URL is resolved on the node
+	httpClient := &http.Client{Transport: client.Transport("node//abc")}
+	resp, err := httpClient.Get("http://127.0.0.1:8080/health")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	fmt.Println(resp.Status)
+}
+
+func ExampleClient_StartForwards() {
+	client, err := meshcentral.Connect(context.Background(), meshcentral.Options{Server: "mesh.example.com", Username: "admin", Password: "secret"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	// LocalPort 0 picks a free port
+	fwd := &meshcentral.Forward{NodeID: "node//abc", BindAddress: "127.0.0.1", RemotePort: 5432}
+	if err := client.StartForwards([]*meshcentral.Forward{fwd}); err != nil {
+		log.Fatal(err)
+	}
+	defer fwd.Close()
+
+	fmt.Println("postgres on 127.0.0.1:", fwd.LocalPort)
+	<-client.Done()
+}
+
+func ExampleClient_Events() {
+	client, err := meshcentral.Connect(context.Background(), meshcentral.Options{Server: "mesh.example.com", Username: "admin", Password: "secret"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	events, stop := client.Events()
+	defer stop()
+	for {
+		select {
+		case event := <-events:
+			if event.Action == "nodeconnect" {
+				fmt.Println(event.NodeID, "online:", client.NodeOnline(event.NodeID))
+			}
+		case <-client.Done():
+			return
+		}
+	}
+}
+
+func ExampleClient_Exec() {
+	client, err := meshcentral.Connect(context.Background(), meshcentral.Options{Server: "mesh.example.com", Username: "admin", Password: "secret"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	device, err := client.FindDevice("web01")
+	if err != nil {
+		log.Fatal(err)
+	}
+	code, err := client.Exec(device.Id, "uptime", meshcentral.ExecOptions{
+		Dialect: meshcentral.DialectForOS(device.OS),
+		Stdout:  os.Stdout,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(code)
+}
+
+func ExampleClient_OpenShell() {
+	client, err := meshcentral.Connect(context.Background(), meshcentral.Options{Server: "mesh.example.com", Username: "admin", Password: "secret"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	shell, err := client.OpenShell("node//abc", meshcentral.ShellOptions{Cols: 120, Rows: 40})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shell.Close()
+
+	go io.Copy(os.Stdout, shell)
+	fmt.Fprint(shell, "uname -a\nexit\n")
+	time.Sleep(2 * time.Second)
+}
+
+func ExampleClient_OpenFiles() {
+	client, err := meshcentral.Connect(context.Background(), meshcentral.Options{Server: "mesh.example.com", Username: "admin", Password: "secret"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	files, err := client.OpenFiles("node//abc")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer files.Close()
+
+	entries, err := files.List("/var/log")
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, entry := range entries {
+		fmt.Println(entry.Name, entry.Size)
+	}
+}
@@ -0,0 +1,223 @@
+package meshcentral
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ExecDialect selects how a command is wrapped for the remote shell
+type ExecDialect int
+
+const (
+	DialectSh ExecDialect = iota
+	DialectCmd
+	DialectPowershell
+)
+
+// DialectForOS picks the shell dialect the agent will start for a device
+func DialectForOS(os string) ExecDialect {
+	if strings.Contains(strings.ToLower(os), "windows") {
+		return DialectCmd
+	}
+	return DialectSh
+}
+
+// ErrSessionClosed is returned when the terminal closes before the command
+// reported its exit code (for example when the command itself calls exit)
+var ErrSessionClosed = errors.New("session closed before command completed")
+
+// ExecOptions are the shell and the streams of Client.Exec. When Stdin is nil
+// the remote side sees EOF straight away. Stdout may be nil to drop the
+// output.
+type ExecOptions struct {
+	Dialect ExecDialect
+	Stdin   io.Reader
+	Stdout  io.Writer
+}
+
+// Exec runs command on the node over the terminal tunnel and returns its exit
+// code. Output between the generated begin and end sentinels is streamed to
+// opts.Stdout, opts.Stdin is fed to the command once it has started. Input
+// travels through the remote terminal so it is line oriented.
+func (c *Client) Exec(nodeID string, command string, opts ExecOptions) (int, error) {
+	dialect, stdin, stdout := opts.Dialect, opts.Stdin, opts.Stdout
+	if stdout == nil {
+		stdout = io.Discard
+	}
+
+	protocol := 1
+	if dialect == DialectPowershell {
+		protocol = 6
+	}
+
+	wsConn, err := c.openTunnel(nodeID, 1)
+	if err != nil {
+		return -1, err
+	}
+	defer wsConn.Close()
+
+	id, err := randomHex()
+	if err != nil {
+		return -1, err
+	}
+	marker := "MCC" + strings.ToUpper(id)
+	begin := []byte(marker + "BEGIN")
+	end := []byte(marker + "END ")
+
+	// gorilla websocket connections only allow one concurrent writer
+	var wmu sync.Mutex
+	write := func(messageType int, data []byte) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		return wsConn.WriteMessage(messageType, data)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// keep the session alive for long running commands
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				epoch := time.Now().UnixNano() / int64(time.Millisecond)
+				if err := write(websocket.TextMessage, []byte(fmt.Sprintf(`{"ctrlChannel":102938,"type":"rtt","time":%d}`, epoch))); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	started := false
+	var pending []byte
+
+	for {
+		msgType, msg, err := wsConn.ReadMessage()
+		if err != nil {
+			c.debugf("Exec session read error: %v", err)
+			return -1, ErrSessionClosed
+		}
+
+		if msgType != websocket.BinaryMessage {
+			if string(msg) == "c" {
+				c.debugf("Received 'c' message")
+				// a wide terminal keeps the remote side from wrapping output
+				write(websocket.TextMessage, []byte(fmt.Sprintf(`{"protocol":%d,"cols":1000,"rows":50,"xterm":true,"type":"options"}`, protocol)))
+				write(websocket.TextMessage, []byte(strconv.Itoa(protocol)))
+				if err := write(websocket.BinaryMessage, []byte(wrapCommand(command, marker, dialect))); err != nil {
+					return -1, err
+				}
+			}
+			continue
+		}
+
+		pending = append(pending, msg...)
+
+		if !started {
+			i := bytes.Index(pending, begin)
+			if i < 0 {
+				continue
+			}
+			nl := bytes.IndexByte(pending[i:], '\n')
+			if nl < 0 {
+				continue
+			}
+			pending = pending[i+nl+1:]
+			started = true
+
+			go c.feedStdin(stdin, dialect, write, stop)
+		}
+
+		if i := bytes.Index(pending, end); i >= 0 {
+			nl := bytes.IndexByte(pending[i:], '\n')
+			if nl < 0 {
+				// wait for the rest of the exit code
+				continue
+			}
+			stdout.Write(pending[:i])
+
+			code, err := strconv.Atoi(strings.TrimSpace(string(pending[i+len(end) : i+nl])))
+			if err != nil {
+				return -1, fmt.Errorf("unable to parse exit code: %w", err)
+			}
+
+			write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return code, nil
+		}
+
+		// hold back anything that could be the start of the end sentinel
+		if keep := len(end) - 1; len(pending) > keep {
+			stdout.Write(pending[:len(pending)-keep])
+			pending = append(pending[:0], pending[len(pending)-keep:]...)
+		}
+	}
+}
+
+// wrapCommand surrounds command with the sentinels. The sentinels are split up
+// in the typed line so the terminal echo never matches the printed marker.
+func wrapCommand(command string, marker string, dialect ExecDialect) string {
+	head, tail := marker[:3], marker[3:]
+	switch dialect {
+	case DialectCmd:
+		return fmt.Sprintf(`echo %s^%sBEGIN & %s & call echo %s^%sEND %%^errorlevel%%`+"\r",
+			head, tail, command, head, tail)
+	case DialectPowershell:
+		return fmt.Sprintf(`echo ("%s"+"%sBEGIN"); %s; $mccrc = if ($?) {0} elseif ($LASTEXITCODE) {$LASTEXITCODE} else {1}; echo ("%s"+"%sEND " + $mccrc)`+"\r",
+			head, tail, command, head, tail)
+	default:
+		return fmt.Sprintf(`stty -echo -onlcr 2>/dev/null; echo "%s""%sBEGIN"; %s; echo "%s""%sEND" $?`+"\r",
+			head, tail, command, head, tail)
+	}
+}
+
+// feedStdin copies stdin into the remote terminal and signals end of input
+// with the dialect's EOF character
+func (c *Client) feedStdin(stdin io.Reader, dialect ExecDialect, write func(int, []byte) error, stop chan struct{}) {
+	eof := []byte{0x04}
+	if dialect != DialectSh {
+		eof = []byte{0x1a, '\r'}
+	}
+
+	last := byte('\n')
+	if stdin != nil {
+		buf := make([]byte, 4096)
+		for {
+			n, err := stdin.Read(buf)
+			if n > 0 {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if write(websocket.BinaryMessage, buf[:n]) != nil {
+					return
+				}
+				last = buf[n-1]
+			}
+			if err != nil {
+				if err != io.EOF {
+					c.debugf("stdin read error: %v", err)
+				}
+				break
+			}
+		}
+	}
+
+	// a partial line needs a second EOF before the reader sees it
+	if last != '\n' && dialect == DialectSh {
+		write(websocket.BinaryMessage, eof)
+	}
+	write(websocket.BinaryMessage, eof)
+}
@@ -0,0 +1,231 @@
+package meshcentral
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// markerPattern finds the sentinel marker in a wrapped command of any dialect
+var markerPattern = regexp.MustCompile(`MCC[\^"+]{1,3}([0-9A-F]{10})BEGIN`)
+
+// acceptCommand starts a terminal session like the agent does and returns
+// the command typed into it and its sentinel marker
+func acceptCommand(t *testing.T, conn *websocket.Conn) ([]byte, string, bool) {
+	conn.WriteMessage(websocket.TextMessage, []byte("c"))
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			return nil, "", false
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+		match := markerPattern.FindSubmatch(message)
+		if match == nil {
+			t.Errorf("no sentinel in command %q", message)
+			return nil, "", false
+		}
+		return message, "MCC" + string(match[1]), true
+	}
+}
+
+// fakeTerminal plays a terminal that runs the typed command. The output is
+// script with {begin} and {end} replaced by the sentinels, sent in messages
+// of chunk bytes (all at once for 0). With hangup the terminal closes after
+// the output.
+func fakeTerminal(t *testing.T, script string, chunk int, hangup bool) func(*websocket.Conn, *http.Request) {
+	return func(conn *websocket.Conn, r *http.Request) {
+		command, marker, ok := acceptCommand(t, conn)
+		if !ok {
+			return
+		}
+
+		// the terminal echoes what was typed first
+		output := string(command) + "\r\n" + strings.NewReplacer("{begin}", marker+"BEGIN", "{end}", marker+"END ").Replace(script)
+		for len(output) > 0 {
+			n := len(output)
+			if chunk > 0 {
+				n = min(n, chunk)
+			}
+			if conn.WriteMessage(websocket.BinaryMessage, []byte(output[:n])) != nil {
+				return
+			}
+			output = output[n:]
+		}
+		for !hangup {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestExecOutputAndExitCode(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		out    string
+		code   int
+	}{
+		{"exit code", "{begin}\r\nhello\nworld\n{end}3\r\n", "hello\nworld\n", 3},
+		{"no output", "{begin}\n{end}0\n", "", 0},
+		{"no newline before end", "{begin}\nprompt> {end}1\n", "prompt> ", 1},
+		{"output before begin", "Last login: today\n{begin}\nok\n{end}0\n", "ok\n", 0},
+		{"marker lookalikes", "{begin}\nMCC END 5\nMCCEND\n{end}0\n", "MCC END 5\nMCCEND\n", 0},
+		{"windows line ends", "{begin}\r\nC:\\> dir\r\n{end}0\r\n", "C:\\> dir\r\n", 0},
+		{"large code", "{begin}\n{end}255\n", "", 255},
+	}
+
+	for _, tt := range tests {
+		// split up, the sentinels and exit code arrive across messages
+		for _, chunk := range []int{0, 1, 7} {
+			client := startFakeServer(t, fakeTerminal(t, tt.script, chunk, false))
+
+			var out bytes.Buffer
+			code, err := client.Exec("node//web01", "uptime", ExecOptions{Stdout: &out})
+			if err != nil {
+				t.Errorf("%s in %d byte messages: %v", tt.name, chunk, err)
+				continue
+			}
+			if code != tt.code || out.String() != tt.out {
+				t.Errorf("%s in %d byte messages: got %d %q, want %d %q", tt.name, chunk, code, out.String(), tt.code, tt.out)
+			}
+		}
+	}
+}
+
+func TestExecSessionEnds(t *testing.T) {
+	t.Run("closed before the end sentinel", func(t *testing.T) {
+		client := startFakeServer(t, fakeTerminal(t, "{begin}\npartial", 0, true))
+		if _, err := client.Exec("node//web01", "exit 3", ExecOptions{}); !errors.Is(err, ErrSessionClosed) {
+			t.Errorf("Exec() error = %v, want ErrSessionClosed", err)
+		}
+	})
+
+	t.Run("garbled exit code", func(t *testing.T) {
+		client := startFakeServer(t, fakeTerminal(t, "{begin}\n{end}zero\n", 0, false))
+		if _, err := client.Exec("node//web01", "true", ExecOptions{}); err == nil || !strings.Contains(err.Error(), "exit code") {
+			t.Errorf("Exec() error = %v, want an exit code error", err)
+		}
+	})
+}
+
+func TestExecStdin(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect ExecDialect
+		stdin   string
+		want    string
+	}{
+		{"sh lines", DialectSh, "one\ntwo\n", "one\ntwo\n\x04"},
+		{"sh partial line", DialectSh, "one\ntwo", "one\ntwo\x04\x04"},
+		{"sh no input", DialectSh, "", "\x04"},
+		{"cmd", DialectCmd, "one\r\n", "one\r\n\x1a\r"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			typed := make(chan []byte, 1)
+			// the command only ends once all of the input has arrived
+			client := startFakeServer(t, func(conn *websocket.Conn, r *http.Request) {
+				_, marker, ok := acceptCommand(t, conn)
+				if !ok {
+					return
+				}
+				conn.WriteMessage(websocket.BinaryMessage, []byte(marker+"BEGIN\n"))
+				var input []byte
+				for len(input) < len(tt.want) {
+					_, message, err := conn.ReadMessage()
+					if err != nil {
+						break
+					}
+					input = append(input, message...)
+				}
+				typed <- input
+				conn.WriteMessage(websocket.BinaryMessage, []byte(marker+"END 0\n"))
+			})
+
+			_, err := client.Exec("node//web01", "cat", ExecOptions{Dialect: tt.dialect, Stdin: strings.NewReader(tt.stdin)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := <-typed; string(got) != tt.want {
+				t.Errorf("typed %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWrapCommandInSh(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh")
+	}
+
+	marker := "MCC0123456789"
+	for command, want := range map[string]string{
+		"echo hi":             "MCC0123456789BEGIN\nhi\nMCC0123456789END 0\n",
+		"echo hi; false":      "MCC0123456789BEGIN\nhi\nMCC0123456789END 1\n",
+		"(exit 42)":           "MCC0123456789BEGIN\nMCC0123456789END 42\n",
+		`printf '%s' "a b"`:   "MCC0123456789BEGIN\na bMCC0123456789END 0\n",
+		"echo $((6 * 7)) >&2": "MCC0123456789BEGIN\n42\nMCC0123456789END 0\n",
+	} {
+		wrapped := wrapCommand(command, marker, DialectSh)
+		if strings.Contains(wrapped, marker) {
+			t.Errorf("wrapped %q contains the marker, the echo of the typed line would match", command)
+		}
+		out, err := exec.Command(sh, "-c", strings.TrimSuffix(wrapped, "\r")).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%q: %v", command, err)
+		}
+		if string(out) != want {
+			t.Errorf("%q printed %q, want %q", command, out, want)
+		}
+	}
+}
+
+func TestWrapCommandDialects(t *testing.T) {
+	marker := "MCC0123456789"
+	tests := []struct {
+		dialect ExecDialect
+		want    string
+	}{
+		{DialectSh, `stty -echo -onlcr 2>/dev/null; echo "MCC""0123456789BEGIN"; dir; echo "MCC""0123456789END" $?` + "\r"},
+		{DialectCmd, `echo MCC^0123456789BEGIN & dir & call echo MCC^0123456789END %^errorlevel%` + "\r"},
+		{DialectPowershell, `echo ("MCC"+"0123456789BEGIN"); dir; $mccrc = if ($?) {0} elseif ($LASTEXITCODE) {$LASTEXITCODE} else {1}; echo ("MCC"+"0123456789END " + $mccrc)` + "\r"},
+	}
+
+	for _, tt := range tests {
+		got := wrapCommand("dir", marker, tt.dialect)
+		if got != tt.want {
+			t.Errorf("dialect %d:\n got %q\nwant %q", tt.dialect, got, tt.want)
+		}
+		if strings.Contains(got, marker) {
+			t.Errorf("dialect %d: %q contains the marker", tt.dialect, got)
+		}
+		if m := markerPattern.FindStringSubmatch(got); m == nil || m[1] != "0123456789" {
+			t.Errorf("dialect %d: the fake terminal can't find the marker in %q", tt.dialect, got)
+		}
+	}
+}
+
+func TestDialectForOS(t *testing.T) {
+	for os, want := range map[string]ExecDialect{
+		"Microsoft Windows 11 Pro": DialectCmd,
+		"windows server 2022":      DialectCmd,
+		"Ubuntu 22.04.3 LTS":       DialectSh,
+		"macOS Sonoma":             DialectSh,
+		"":                         DialectSh,
+	} {
+		if got := DialectForOS(os); got != want {
+			t.Errorf("DialectForOS(%q) = %d, want %d", os, got, want)
+		}
+	}
+}
@@ -0,0 +1,573 @@
+package meshcentral
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// file types reported by the agent in directory listings
+const (
+	FileTypeDrive = 1
+	FileTypeDir   = 2
+	FileTypeFile  = 3
+)
+
+// size of the download blocks sent by the agent and of our upload chunks
+const filesBlockSize = 16384
+
+// number of upload chunks allowed in flight before waiting for an ack
+const filesUploadWindow = 8
+
+// how long Hash waits for the agent, older agents never answer
+const filesHashTimeout = 15 * time.Second
+
+var (
+	ErrFilesClosed     = errors.New("files session closed")
+	ErrHashUnsupported = errors.New("agent did not return a file hash")
+)
+
+// FileEntry is a single entry of a remote directory listing
+type FileEntry struct {
+	Name string `json:"n"`
+	Type int    `json:"t"`
+	Size int64  `json:"s"`
+	Date string `json:"d"`
+}
+
+func (e FileEntry) IsDir() bool {
+	return e.Type == FileTypeDir || e.Type == FileTypeDrive
+}
+
+// ModTime parses the modification time sent by the agent, drives have none
+func (e FileEntry) ModTime() time.Time {
+	t, _ := time.Parse(time.RFC3339, e.Date)
+	return t
+}
+
+// filesReply holds every field the agent uses in its files protocol answers
+type filesReply struct {
+	Action string      `json:"action"`
+	Sub    string      `json:"sub"`
+	ID     int         `json:"id"`
+	ReqID  int         `json:"reqid"`
+	Path   string      `json:"path"`
+	Dir    []FileEntry `json:"dir"`
+	Hash   *string     `json:"hash"`
+}
+
+// filesFrame is either a parsed json reply or a raw download block
+type filesFrame struct {
+	reply *filesReply
+	block []byte
+}
+
+// FileSession is an open files tunnel (relay protocol 5) to a node. Requests
+// are serialized, so a session can be shared between goroutines.
+type FileSession struct {
+	client *Client
+	conn   *websocket.Conn
+	wmu    sync.Mutex
+	mu     sync.Mutex
+	reqID  int
+	frames chan filesFrame
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+// OpenFiles opens a files tunnel to the node and waits for the agent to
+// accept it
+func (c *Client) OpenFiles(nodeID string) (*FileSession, error) {
+	wsConn, err := c.openTunnel(nodeID, 5)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &FileSession{
+		client: c,
+		conn:   wsConn,
+		frames: make(chan filesFrame, 16),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	ready := make(chan struct{})
+	go f.read(ready)
+
+	select {
+	case <-ready:
+	case <-time.After(30 * time.Second):
+		f.Close()
+		return nil, errors.New("agent did not accept the files session")
+	}
+
+	go f.keepAlive()
+
+	return f, nil
+}
+
+// Close ends the files session
+func (f *FileSession) Close() {
+	f.once.Do(func() {
+		close(f.stop)
+		f.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		f.conn.Close()
+	})
+}
+
+// Done is closed once the tunnel to the agent is gone
+func (f *FileSession) Done() <-chan struct{} {
+	return f.done
+}
+
+func (f *FileSession) write(messageType int, data []byte) error {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+	return f.conn.WriteMessage(messageType, data)
+}
+
+func (f *FileSession) send(command interface{}) error {
+	b, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+	return f.write(websocket.TextMessage, b)
+}
+
+func (f *FileSession) nextID() int {
+	f.reqID++
+	return f.reqID
+}
+
+func (f *FileSession) keepAlive() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			if f.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)) != nil {
+				return
+			}
+		}
+	}
+}
+
+func (f *FileSession) read(ready chan struct{}) {
+	defer close(f.done)
+	defer close(f.frames)
+	joined := false
+	for {
+		msgType, msg, err := f.conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+				f.client.debugf("Files session read error: %v", err)
+			}
+			return
+		}
+
+		// the relay signals that the agent joined with a single 'c'
+		if msgType == websocket.TextMessage && string(msg) == "c" && !joined {
+			joined = true
+			if err := f.write(websocket.TextMessage, []byte("5")); err != nil {
+				return
+			}
+			close(ready)
+			continue
+		}
+
+		var frame filesFrame
+		if len(msg) > 0 && msg[0] == '{' {
+			var reply filesReply
+			if err := json.Unmarshal(msg, &reply); err != nil {
+				// control channel messages do not match, skip them
+				continue
+			}
+			frame.reply = &reply
+		} else if msgType == websocket.BinaryMessage {
+			frame.block = msg
+		} else {
+			continue
+		}
+
+		select {
+		case f.frames <- frame:
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// next waits for the next frame from the agent, a zero timeout waits forever
+func (f *FileSession) next(timeout time.Duration) (filesFrame, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case frame, ok := <-f.frames:
+		if !ok {
+			return filesFrame{}, ErrFilesClosed
+		}
+		return frame, nil
+	case <-expired:
+		return filesFrame{}, errTimeout
+	}
+}
+
+var errTimeout = errors.New("timed out waiting for agent")
+
+// List returns the entries of a remote directory. On windows agents an empty
+// path lists the drives.
+func (f *FileSession) List(dir string) ([]FileEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := f.nextID()
+	if err := f.send(map[string]interface{}{"action": "ls", "reqid": id, "path": dir}); err != nil {
+		return nil, err
+	}
+
+	for {
+		frame, err := f.next(time.Minute)
+		if err != nil {
+			return nil, err
+		}
+		if frame.reply != nil && frame.reply.Action == "" && frame.reply.ReqID == id {
+			return frame.reply.Dir, nil
+		}
+	}
+}
+
+// Download streams a remote file into w, progress is called with the size of
+// every block received
+func (f *FileSession) Download(remotePath string, w io.Writer, progress func(int)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := f.nextID()
+	if err := f.send(map[string]interface{}{"action": "download", "sub": "start", "id": id, "path": remotePath}); err != nil {
+		return err
+	}
+
+	for {
+		frame, err := f.next(time.Minute)
+		if err != nil {
+			return err
+		}
+		if frame.reply == nil || frame.reply.Action != "download" || frame.reply.ID != id {
+			continue
+		}
+		if frame.reply.Sub == "cancel" {
+			return fmt.Errorf("unable to open %s for reading", remotePath)
+		}
+		if frame.reply.Sub == "start" {
+			break
+		}
+	}
+
+	if err := f.send(map[string]interface{}{"action": "download", "sub": "startack", "id": id, "ack": filesUploadWindow}); err != nil {
+		return err
+	}
+
+	for {
+		frame, err := f.next(time.Minute)
+		if err != nil {
+			return err
+		}
+		if frame.reply != nil {
+			if frame.reply.Action == "download" && frame.reply.ID == id && frame.reply.Sub == "cancel" {
+				return fmt.Errorf("agent cancelled download of %s", remotePath)
+			}
+			continue
+		}
+		if len(frame.block) < 4 {
+			continue
+		}
+
+		data := frame.block[4:]
+		if _, err := w.Write(data); err != nil {
+			f.send(map[string]interface{}{"action": "download", "sub": "stop", "id": id})
+			return err
+		}
+		if progress != nil {
+			progress(len(data))
+		}
+
+		// the last block is flagged in the header
+		if frame.block[3]&1 == 1 {
+			return nil
+		}
+		if err := f.send(map[string]interface{}{"action": "download", "sub": "ack", "id": id}); err != nil {
+			return err
+		}
+	}
+}
+
+// Upload writes the content of r to name inside the remote directory dir,
+// replacing any existing file
+func (f *FileSession) Upload(r io.Reader, dir string, name string, progress func(int)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := f.nextID()
+	if err := f.send(map[string]interface{}{"action": "upload", "reqid": id, "path": dir, "name": name}); err != nil {
+		return err
+	}
+
+	if err := f.waitUpload(id, "uploadstart"); err != nil {
+		return err
+	}
+
+	inflight := 0
+	buf := make([]byte, filesBlockSize+1)
+	for {
+		// leave room for a zero byte so chunks are never mistaken for json
+		n, rerr := r.Read(buf[1:])
+		if n > 0 {
+			chunk := buf[1 : n+1]
+			if chunk[0] == 0 || chunk[0] == '{' {
+				chunk = buf[:n+1]
+				chunk[0] = 0
+			}
+			if err := f.write(websocket.BinaryMessage, chunk); err != nil {
+				return err
+			}
+			if progress != nil {
+				progress(n)
+			}
+			inflight++
+
+			for inflight >= filesUploadWindow {
+				if err := f.waitUpload(id, "uploadack"); err != nil {
+					return err
+				}
+				inflight--
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			f.send(map[string]interface{}{"action": "uploadcancel", "reqid": id})
+			return rerr
+		}
+	}
+
+	for ; inflight > 0; inflight-- {
+		if err := f.waitUpload(id, "uploadack"); err != nil {
+			return err
+		}
+	}
+
+	if err := f.send(map[string]interface{}{"action": "uploaddone", "reqid": id}); err != nil {
+		return err
+	}
+	return f.waitUpload(id, "uploaddone")
+}
+
+func (f *FileSession) waitUpload(id int, action string) error {
+	for {
+		frame, err := f.next(time.Minute)
+		if err != nil {
+			return err
+		}
+		if frame.reply == nil {
+			continue
+		}
+		if frame.reply.Action == "uploaderror" {
+			return errors.New("agent was unable to write the file")
+		}
+		if frame.reply.Action == action && frame.reply.ReqID == id {
+			return nil
+		}
+	}
+}
+
+// Hash asks the agent for the SHA-384 of a remote file, older agents do not
+// answer and ErrHashUnsupported is returned
+func (f *FileSession) Hash(dir string, name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := f.nextID()
+	if err := f.send(map[string]interface{}{"action": "uploadhash", "reqid": id, "path": dir, "name": name, "tag": id}); err != nil {
+		return "", err
+	}
+
+	deadline := time.Now().Add(filesHashTimeout)
+	for {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return "", ErrHashUnsupported
+		}
+		frame, err := f.next(wait)
+		if err == errTimeout {
+			return "", ErrHashUnsupported
+		}
+		if err != nil {
+			return "", err
+		}
+		if frame.reply == nil || frame.reply.Action != "uploadhash" || frame.reply.ReqID != id {
+			continue
+		}
+		if frame.reply.Hash == nil {
+			return "", fmt.Errorf("unable to hash %s", JoinRemotePath(dir, name))
+		}
+		return strings.ToLower(*frame.reply.Hash), nil
+	}
+}
+
+// The agent does not answer mkdir, rm and rename. It handles commands in
+// order though, so listing the parent afterwards tells us if they worked.
+
+// Mkdir creates a remote directory
+func (f *FileSession) Mkdir(dir string) error {
+	if err := f.command(map[string]interface{}{"action": "mkdir", "path": dir}); err != nil {
+		return err
+	}
+
+	entry, err := f.Stat(dir)
+	if err != nil || !entry.IsDir() {
+		return fmt.Errorf("unable to create directory %s", dir)
+	}
+	return nil
+}
+
+// Remove deletes names from the remote directory dir, non empty directories
+// are only removed when recursive is set
+func (f *FileSession) Remove(dir string, names []string, recursive bool) error {
+	if err := f.command(map[string]interface{}{"action": "rm", "path": dir, "delfiles": names, "rec": recursive}); err != nil {
+		return err
+	}
+
+	entries, err := f.List(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		for _, name := range names {
+			if e.Name == name {
+				return fmt.Errorf("unable to remove %s", JoinRemotePath(dir, name))
+			}
+		}
+	}
+	return nil
+}
+
+// Rename renames oldName to newName inside the remote directory dir
+func (f *FileSession) Rename(dir string, oldName string, newName string) error {
+	if err := f.command(map[string]interface{}{"action": "rename", "path": dir, "oldname": oldName, "newname": newName}); err != nil {
+		return err
+	}
+
+	if _, err := f.Stat(JoinRemotePath(dir, newName)); err != nil {
+		return fmt.Errorf("unable to rename %s to %s", JoinRemotePath(dir, oldName), newName)
+	}
+	return nil
+}
+
+// Move moves names from the remote directory srcDir into dstDir
+func (f *FileSession) Move(srcDir string, dstDir string, names []string) error {
+	if err := f.command(map[string]interface{}{"action": "move", "scpath": srcDir, "dspath": dstDir, "names": names}); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if _, err := f.Stat(JoinRemotePath(dstDir, name)); err != nil {
+			return fmt.Errorf("unable to move %s to %s", JoinRemotePath(srcDir, name), dstDir)
+		}
+	}
+	return nil
+}
+
+// Drives lists the drives of a windows agent
+func (f *FileSession) Drives() ([]FileEntry, error) {
+	entries, err := f.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	var drives []FileEntry
+	for _, e := range entries {
+		if e.Type == FileTypeDrive {
+			drives = append(drives, e)
+		}
+	}
+	return drives, nil
+}
+
+// command sends a request the agent does not reply to
+func (f *FileSession) command(command map[string]interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	command["reqid"] = f.nextID()
+	return f.send(command)
+}
+
+// Stat looks up a single remote path by listing its parent directory
+func (f *FileSession) Stat(remotePath string) (*FileEntry, error) {
+	dir, name := SplitRemotePath(remotePath)
+	if name == "" {
+		// the root (or a bare drive) always exists
+		return &FileEntry{Name: remotePath, Type: FileTypeDir}, nil
+	}
+
+	entries, err := f.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Name == name || (isWindowsPath(remotePath) && strings.EqualFold(e.Name, name)) {
+			return &e, nil
+		}
+	}
+	return nil, &os.PathError{Op: "stat", Path: remotePath, Err: os.ErrNotExist}
+}
+
+// isWindowsPath reports whether a remote path uses drive letters or backslashes
+func isWindowsPath(p string) bool {
+	return strings.Contains(p, `\`) || (len(p) >= 2 && p[1] == ':')
+}
+
+// JoinRemotePath joins a remote directory and a name with the separator the
+// directory already uses
+func JoinRemotePath(dir string, name string) string {
+	if dir == "" {
+		return name
+	}
+	if strings.Contains(dir, `\`) {
+		return strings.TrimRight(dir, `\`) + `\` + name
+	}
+	return path.Join(dir, name)
+}
+
+// SplitRemotePath splits a remote path into its directory and final element
+func SplitRemotePath(p string) (string, string) {
+	p = strings.TrimRight(p, `/\`)
+	i := strings.LastIndexAny(p, `/\`)
+	if i < 0 {
+		// a bare name or drive letter, the drive list is its parent
+		return "", p
+	}
+
+	dir := p[:i]
+	if dir == "" || (len(dir) == 2 && dir[1] == ':') {
+		dir = p[:i+1]
+	}
+	return dir, p[i+1:]
+}
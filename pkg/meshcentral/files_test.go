@@ -0,0 +1,491 @@
+package meshcentral
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeFiles is the filesystem of an agent on the other end of a files
+// tunnel. It sends downloads in blocks of block bytes.
+type fakeFiles struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+	block int
+	// drives are listed for the empty path, like a windows agent does
+	drives []string
+	// noHash plays an agent that doesn't know uploadhash
+	noHash bool
+}
+
+func newFakeFiles(files map[string]string) *fakeFiles {
+	f := &fakeFiles{files: map[string][]byte{}, dirs: map[string]bool{"/": true}, block: 16384}
+	for name, content := range files {
+		f.files[name] = []byte(content)
+		for dir := path.Dir(name); !f.dirs[dir]; dir = path.Dir(dir) {
+			f.dirs[dir] = true
+		}
+	}
+	return f
+}
+
+func (f *fakeFiles) content(name string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.files[name]
+	return string(data), ok
+}
+
+func (f *fakeFiles) write(name string, data string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files[name] = []byte(data)
+}
+
+func (f *fakeFiles) list(dir string) []FileEntry {
+	entries := []FileEntry{}
+	if dir == "" {
+		for _, drive := range f.drives {
+			entries = append(entries, FileEntry{Name: drive, Type: FileTypeDrive})
+		}
+		return entries
+	}
+	for name := range f.dirs {
+		if name != "/" && path.Dir(name) == dir {
+			entries = append(entries, FileEntry{Name: path.Base(name), Type: FileTypeDir, Date: "2026-10-19T10:00:00.000Z"})
+		}
+	}
+	for name, data := range f.files {
+		if path.Dir(name) == dir {
+			entries = append(entries, FileEntry{Name: path.Base(name), Type: FileTypeFile, Size: int64(len(data)), Date: "2026-10-19T10:00:00.000Z"})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// remove deletes name, and everything below it with recursive
+func (f *fakeFiles) remove(name string, recursive bool) {
+	if _, ok := f.files[name]; ok {
+		delete(f.files, name)
+		return
+	}
+	if !f.dirs[name] || (len(f.list(name)) > 0 && !recursive) {
+		return
+	}
+	for other := range f.files {
+		if strings.HasPrefix(other, name+"/") {
+			delete(f.files, other)
+		}
+	}
+	for other := range f.dirs {
+		if other == name || strings.HasPrefix(other, name+"/") {
+			delete(f.dirs, other)
+		}
+	}
+}
+
+// rename moves name and everything below it to newName
+func (f *fakeFiles) rename(name string, newName string) {
+	if data, ok := f.files[name]; ok {
+		delete(f.files, name)
+		f.files[newName] = data
+		return
+	}
+	for other, data := range f.files {
+		if rest, ok := strings.CutPrefix(other, name+"/"); ok {
+			delete(f.files, other)
+			f.files[newName+"/"+rest] = data
+		}
+	}
+	for other := range f.dirs {
+		if other == name {
+			delete(f.dirs, other)
+			f.dirs[newName] = true
+		} else if rest, ok := strings.CutPrefix(other, name+"/"); ok {
+			delete(f.dirs, other)
+			f.dirs[newName+"/"+rest] = true
+		}
+	}
+}
+
+// serve speaks the agent side of the files protocol
+func (f *fakeFiles) serve(conn *websocket.Conn, r *http.Request) {
+	conn.WriteMessage(websocket.TextMessage, []byte("c"))
+	if _, message, err := conn.ReadMessage(); err != nil || string(message) != "5" {
+		return
+	}
+	reply := func(v map[string]any) {
+		data, _ := json.Marshal(v)
+		conn.WriteMessage(websocket.TextMessage, data)
+	}
+
+	var download []byte
+	var downloadID any
+	sendBlock := func() {
+		n := min(len(download), f.block)
+		header := []byte{0, 0, 0, 0}
+		if n == len(download) {
+			header[3] = 1
+		}
+		conn.WriteMessage(websocket.BinaryMessage, append(header, download[:n]...))
+		download = download[n:]
+	}
+
+	var upload string
+	var uploadID any
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType == websocket.BinaryMessage {
+			if len(message) > 0 && message[0] == 0 {
+				message = message[1:]
+			}
+			f.mu.Lock()
+			f.files[upload] = append(f.files[upload], message...)
+			f.mu.Unlock()
+			reply(map[string]any{"action": "uploadack", "reqid": uploadID})
+			continue
+		}
+
+		var cmd struct {
+			Action, Sub, Path, Name, Scpath, Dspath, Oldname, Newname string
+			ID, Reqid                                                 any
+			Delfiles, Names                                           []string
+			Rec                                                       bool
+		}
+		if json.Unmarshal(message, &cmd) != nil {
+			continue
+		}
+
+		f.mu.Lock()
+		switch cmd.Action {
+		case "ls":
+			reply(map[string]any{"reqid": cmd.Reqid, "path": cmd.Path, "dir": f.list(cmd.Path)})
+		case "download":
+			switch cmd.Sub {
+			case "start":
+				data, ok := f.files[cmd.Path]
+				if !ok {
+					reply(map[string]any{"action": "download", "sub": "cancel", "id": cmd.ID})
+					break
+				}
+				download, downloadID = append([]byte(nil), data...), cmd.ID
+				reply(map[string]any{"action": "download", "sub": "start", "id": downloadID})
+			case "startack", "ack":
+				sendBlock()
+			}
+		case "upload":
+			if !f.dirs[cmd.Path] {
+				reply(map[string]any{"action": "uploaderror", "reqid": cmd.Reqid})
+				break
+			}
+			upload, uploadID = path.Join(cmd.Path, cmd.Name), cmd.Reqid
+			f.files[upload] = nil
+			reply(map[string]any{"action": "uploadstart", "reqid": uploadID})
+		case "uploaddone":
+			reply(map[string]any{"action": "uploaddone", "reqid": cmd.Reqid})
+		case "uploadhash":
+			if f.noHash {
+				break
+			}
+			data, ok := f.files[path.Join(cmd.Path, cmd.Name)]
+			if !ok {
+				reply(map[string]any{"action": "uploadhash", "reqid": cmd.Reqid, "hash": nil})
+				break
+			}
+			sum := sha512.Sum384(data)
+			reply(map[string]any{"action": "uploadhash", "reqid": cmd.Reqid, "hash": strings.ToUpper(hex.EncodeToString(sum[:]))})
+		case "mkdir":
+			if _, ok := f.files[cmd.Path]; !ok && f.dirs[path.Dir(cmd.Path)] {
+				f.dirs[cmd.Path] = true
+			}
+		case "rm":
+			for _, name := range cmd.Delfiles {
+				f.remove(path.Join(cmd.Path, name), cmd.Rec)
+			}
+		case "rename":
+			f.rename(path.Join(cmd.Path, cmd.Oldname), path.Join(cmd.Path, cmd.Newname))
+		case "move":
+			if f.dirs[cmd.Dspath] {
+				for _, name := range cmd.Names {
+					f.rename(path.Join(cmd.Scpath, name), path.Join(cmd.Dspath, name))
+				}
+			}
+		}
+		f.mu.Unlock()
+	}
+}
+
+// openFakeFiles opens a files session to fs
+func openFakeFiles(t *testing.T, fs *fakeFiles) *FileSession {
+	t.Helper()
+	client := startFakeServer(t, fs.serve)
+	files, err := client.OpenFiles("node//web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(files.Close)
+	return files
+}
+
+func TestFilesDownload(t *testing.T) {
+	fs := newFakeFiles(map[string]string{
+		"/var/log/app.log": "line one\nline two\nline three\n",
+		"/var/log/empty":   "",
+	})
+	fs.block = 5
+	files := openFakeFiles(t, fs)
+
+	for _, name := range []string{"/var/log/app.log", "/var/log/empty"} {
+		var buf bytes.Buffer
+		progress := 0
+		if err := files.Download(name, &buf, func(n int) { progress += n }); err != nil {
+			t.Fatalf("Download(%s): %v", name, err)
+		}
+		want, _ := fs.content(name)
+		if buf.String() != want || progress != len(want) {
+			t.Errorf("Download(%s) = %q with progress %d, want %q", name, buf.String(), progress, want)
+		}
+	}
+
+	if err := files.Download("/var/log/missing", &bytes.Buffer{}, nil); err == nil {
+		t.Error("Download of a missing file succeeded")
+	}
+	// the session is still usable after a refused download
+	if _, err := files.List("/var/log"); err != nil {
+		t.Errorf("List after a refused download: %v", err)
+	}
+}
+
+func TestFilesUpload(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"text", "hello\n"},
+		{"empty", ""},
+		// chunks starting like json or with a zero byte get a zero byte
+		// prefix, which the agent strips
+		{"json", `{"action":"ls"}`},
+		{"zero byte", "\x00\x00binary"},
+		{"many chunks", strings.Repeat("0123456789abcdef", 20*filesBlockSize/16+3)},
+	}
+
+	fs := newFakeFiles(map[string]string{"/srv/keep": ""})
+	files := openFakeFiles(t, fs)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			progress := 0
+			if err := files.Upload(strings.NewReader(tt.data), "/srv", "upload", func(n int) { progress += n }); err != nil {
+				t.Fatal(err)
+			}
+			got, _ := fs.content("/srv/upload")
+			if got != tt.data {
+				t.Errorf("agent got %d bytes, want %d", len(got), len(tt.data))
+			}
+			if progress != len(tt.data) {
+				t.Errorf("progress = %d, want %d", progress, len(tt.data))
+			}
+		})
+	}
+
+	t.Run("agent refuses", func(t *testing.T) {
+		if err := files.Upload(strings.NewReader("x"), "/nonexistent", "upload", nil); err == nil {
+			t.Error("Upload into a missing directory succeeded")
+		}
+	})
+}
+
+func TestFilesHash(t *testing.T) {
+	fs := newFakeFiles(map[string]string{"/etc/motd": "welcome\n"})
+	files := openFakeFiles(t, fs)
+
+	sum := sha512.Sum384([]byte("welcome\n"))
+	got, err := files.Hash("/etc", "motd")
+	if err != nil || got != hex.EncodeToString(sum[:]) {
+		t.Errorf("Hash() = %q, %v, want the lower case SHA-384", got, err)
+	}
+	if _, err := files.Hash("/etc", "missing"); err == nil || errors.Is(err, ErrHashUnsupported) {
+		t.Errorf("Hash of a missing file: %v, want an error other than ErrHashUnsupported", err)
+	}
+}
+
+func TestFilesStat(t *testing.T) {
+	fs := newFakeFiles(map[string]string{"/etc/hosts": "127.0.0.1 localhost\n"})
+	files := openFakeFiles(t, fs)
+
+	entry, err := files.Stat("/etc/hosts")
+	if err != nil || entry.IsDir() || entry.Size != 20 {
+		t.Errorf("Stat(/etc/hosts) = %+v, %v", entry, err)
+	}
+	if entry, err := files.Stat("/etc/"); err != nil || !entry.IsDir() {
+		t.Errorf("Stat(/etc/) = %+v, %v, want a directory", entry, err)
+	}
+	if entry, err := files.Stat("/"); err != nil || !entry.IsDir() {
+		t.Errorf("Stat(/) = %+v, %v, want a directory", entry, err)
+	}
+	if _, err := files.Stat("/etc/shadow"); !os.IsNotExist(err) {
+		t.Errorf("Stat(/etc/shadow) error = %v, want not exist", err)
+	}
+}
+
+func TestSplitRemotePath(t *testing.T) {
+	tests := []struct {
+		path, dir, name string
+	}{
+		{"/var/log/syslog", "/var/log", "syslog"},
+		{"/var/log/", "/var", "log"},
+		{"/etc", "/", "etc"},
+		{"/", "", ""},
+		{"notes.txt", "", "notes.txt"},
+		{"logs/app.log", "logs", "app.log"},
+		{`C:\Users\admin\file.txt`, `C:\Users\admin`, "file.txt"},
+		{`C:\Users\`, `C:\`, "Users"},
+		{`C:\Windows`, `C:\`, "Windows"},
+		{`C:\`, "", "C:"},
+		{"C:", "", "C:"},
+		{"C:/Users/admin", "C:/Users", "admin"},
+		{"C:/temp", "C:/", "temp"},
+	}
+
+	for _, tt := range tests {
+		dir, name := SplitRemotePath(tt.path)
+		if dir != tt.dir || name != tt.name {
+			t.Errorf("SplitRemotePath(%q) = %q, %q, want %q, %q", tt.path, dir, name, tt.dir, tt.name)
+		}
+	}
+}
+
+func TestJoinRemotePath(t *testing.T) {
+	tests := []struct {
+		dir, name, want string
+	}{
+		{"/var/log", "syslog", "/var/log/syslog"},
+		{"/var/log/", "syslog", "/var/log/syslog"},
+		{"/", "etc", "/etc"},
+		{"", "C:", "C:"},
+		{`C:\`, "Users", `C:\Users`},
+		{`C:\Users\admin`, "file.txt", `C:\Users\admin\file.txt`},
+		{`C:\Users\admin\`, "file.txt", `C:\Users\admin\file.txt`},
+		{"C:/Users", "admin", "C:/Users/admin"},
+	}
+
+	for _, tt := range tests {
+		if got := JoinRemotePath(tt.dir, tt.name); got != tt.want {
+			t.Errorf("JoinRemotePath(%q, %q) = %q, want %q", tt.dir, tt.name, got, tt.want)
+		}
+	}
+
+	// joining and splitting again gives back the parts
+	for _, p := range []string{"/var/log/syslog", `C:\Users\admin\file.txt`, "C:/Users/admin"} {
+		dir, name := SplitRemotePath(p)
+		if got := JoinRemotePath(dir, name); got != p {
+			t.Errorf("JoinRemotePath(SplitRemotePath(%q)) = %q", p, got)
+		}
+	}
+}
+
+// The agent doesn't answer mkdir, rm, rename or move, the session checks
+// the outcome with a listing. One session runs through them in turn, as
+// mcc fs does.
+func TestFilesManage(t *testing.T) {
+	fs := newFakeFiles(map[string]string{
+		"/srv/app/config.yml":  "port: 80\n",
+		"/srv/app/logs/a.log":  "a\n",
+		"/srv/app/logs/b.log":  "b\n",
+		"/srv/app/release.txt": "1.0\n",
+	})
+	files := openFakeFiles(t, fs)
+
+	names := func(dir string) string {
+		t.Helper()
+		entries, err := files.List(dir)
+		if err != nil {
+			t.Fatalf("List(%s): %v", dir, err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		return strings.Join(names, " ")
+	}
+
+	if err := files.Mkdir("/srv/backup"); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if err := files.Mkdir("/srv/missing/parent"); err == nil {
+		t.Error("Mkdir below a missing parent succeeded")
+	}
+	if err := files.Mkdir("/srv/app/config.yml"); err == nil {
+		t.Error("Mkdir over a file succeeded")
+	}
+
+	if err := files.Rename("/srv/app", "config.yml", "config.yml.orig"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if err := files.Rename("/srv/app", "absent", "present"); err == nil {
+		t.Error("Rename of a missing file succeeded")
+	}
+
+	if err := files.Move("/srv/app", "/srv/backup", []string{"config.yml.orig", "release.txt"}); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if err := files.Move("/srv/app", "/srv/nowhere", []string{"logs"}); err == nil {
+		t.Error("Move into a missing directory succeeded")
+	}
+	if got := names("/srv/backup"); got != "config.yml.orig release.txt" {
+		t.Errorf("/srv/backup holds %q after Move", got)
+	}
+	if got, _ := fs.content("/srv/backup/config.yml.orig"); got != "port: 80\n" {
+		t.Errorf("moved file holds %q", got)
+	}
+
+	// non empty directories need recursive
+	if err := files.Remove("/srv/app", []string{"logs"}, false); err == nil {
+		t.Error("Remove of a non empty directory without recursive succeeded")
+	}
+	if err := files.Remove("/srv/app", []string{"logs"}, true); err != nil {
+		t.Errorf("recursive Remove: %v", err)
+	}
+	if err := files.Remove("/srv/backup", []string{"config.yml.orig", "release.txt"}, false); err != nil {
+		t.Errorf("Remove of two files: %v", err)
+	}
+	if got := names("/srv"); got != "app backup" {
+		t.Errorf("/srv holds %q at the end", got)
+	}
+	if got := names("/srv/app") + names("/srv/backup"); got != "" {
+		t.Errorf("left behind: %q", got)
+	}
+}
+
+func TestFilesDrives(t *testing.T) {
+	fs := newFakeFiles(nil)
+	fs.drives = []string{"C:", "D:"}
+	files := openFakeFiles(t, fs)
+
+	drives, err := files.Drives()
+	if err != nil || len(drives) != 2 || drives[0].Name != "C:" || !drives[1].IsDir() {
+		t.Errorf("Drives() = %+v, %v", drives, err)
+	}
+
+	// a linux agent has nothing at the top
+	fs.drives = nil
+	if drives, err := files.Drives(); err != nil || len(drives) != 0 {
+		t.Errorf("Drives() without drives = %+v, %v", drives, err)
+	}
+}
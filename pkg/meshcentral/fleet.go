@@ -0,0 +1,330 @@
+package meshcentral
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// fleetSettle is how long a fleet waits after a node event before it looks at
+// the devices again, a group coming online sends many events at once
+const fleetSettle = time.Second
+
+// fleetResync is how often a fleet looks at the devices without an event, in
+// case one was missed
+const fleetResync = time.Minute
+
+// Fleet keeps a forward to RemotePort (or RemoteTarget:RemotePort) on every
+// online device that matches Selector. Each device gets its own port on
+// BindAddress, counting up from LocalPort or chosen by the system when it is
+// 0. When Network is set each device gets its own address in it instead, all
+// listening on LocalPort. A device that goes offline and comes back gets the
+// same address again where possible. OnChange is called whenever the
+// devices or their addresses change. The devices are followed and relayed
+// through Client.
+type Fleet struct {
+	Client       *Client
+	Selector     Selector
+	BindAddress  string
+	Network      *net.IPNet
+	LocalPort    int
+	RemoteTarget string
+	RemotePort   int
+	Limits       Limits
+	Retry        Retry
+	OnChange     func()
+
+	mu       sync.Mutex
+	matched  []Device
+	forwards map[string]*Forward
+	assigned map[string]fleetAddress
+	closed   bool
+	quit     chan struct{}
+}
+
+type fleetAddress struct {
+	host string
+	port int
+}
+
+// FleetTarget is a device of a fleet and where it can be reached locally.
+// Address is empty while the device is offline.
+type FleetTarget struct {
+	NodeID      string `json:"node_id"`
+	Name        string `json:"name"`
+	Group       string `json:"group,omitempty"`
+	Address     string `json:"address,omitempty"`
+	Destination string `json:"destination"`
+	Online      bool   `json:"online"`
+}
+
+// Start forwards to the devices that are online now and keeps following them
+// until the fleet is closed
+func (f *Fleet) Start() {
+	f.forwards = map[string]*Forward{}
+	f.assigned = map[string]fleetAddress{}
+	f.quit = make(chan struct{})
+
+	// watch first, so nothing that happens during the first sync is missed
+	changes, stop := f.Client.WatchNodes()
+
+	f.sync()
+	go f.watch(changes, stop)
+}
+
+func (f *Fleet) watch(changes <-chan struct{}, stop func()) {
+	defer stop()
+	resync := time.NewTicker(fleetResync)
+	defer resync.Stop()
+
+	for {
+		select {
+		case <-f.quit:
+			return
+		case <-resync.C:
+		case <-changes:
+			select {
+			case <-f.quit:
+				return
+			case <-time.After(fleetSettle):
+			}
+		}
+		f.sync()
+	}
+}
+
+// sync starts forwards to the matching devices that came online and closes
+// the ones to devices that went offline or no longer match
+func (f *Fleet) sync() {
+	devices, err := f.Client.Devices()
+	if err != nil {
+		return
+	}
+
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+
+	var matched []Device
+	online := map[string]bool{}
+	for _, device := range devices {
+		if f.Selector.Matches(device) {
+			matched = append(matched, device)
+			online[device.Id] = f.Client.NodeOnline(device.Id)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Name < matched[j].Name })
+
+	changed := f.matched == nil || !sameDevices(f.matched, matched)
+	f.matched = matched
+
+	for id, fwd := range f.forwards {
+		if !online[id] {
+			fwd.Close()
+			delete(f.forwards, id)
+			f.Client.logf("Fleet %s: %s is gone from %s", f.Selector, fwd.NodeName, fwd.localAddress())
+			changed = true
+		}
+	}
+	for _, device := range matched {
+		if !online[device.Id] || f.forwards[device.Id] != nil {
+			continue
+		}
+		fwd, err := f.start(device)
+		if err != nil {
+			f.Client.logf("Fleet %s: unable to forward to %s: %v", f.Selector, device.Name, err)
+			continue
+		}
+		f.forwards[device.Id] = fwd
+		f.Client.logf("Fleet %s: %s is on %s", f.Selector, device.Name, fwd.localAddress())
+		changed = true
+	}
+
+	onChange := f.OnChange
+	f.mu.Unlock()
+
+	if changed && onChange != nil {
+		onChange()
+	}
+}
+
+func sameDevices(a, b []Device) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Id != b[i].Id || a[i].Name != b[i].Name {
+			return false
+		}
+	}
+	return true
+}
+
+// start forwards to a device, on the address it had before if it is free
+func (f *Fleet) start(device Device) (*Forward, error) {
+	fwd := &Forward{
+		NodeID:       device.Id,
+		NodeName:     device.Name,
+		RemoteTarget: f.RemoteTarget,
+		RemotePort:   f.RemotePort,
+		Limits:       f.Limits,
+		Retry:        f.Retry,
+	}
+
+	if previous, ok := f.assigned[device.Id]; ok {
+		fwd.BindAddress, fwd.LocalPort = previous.host, previous.port
+		if f.Client.StartForwards([]*Forward{fwd}) == nil {
+			return fwd, nil
+		}
+	}
+
+	taken := map[fleetAddress]bool{}
+	for id, address := range f.assigned {
+		if id != device.Id {
+			taken[address] = true
+		}
+	}
+
+	var lastErr error
+	for i := 0; i < 1024; i++ {
+		address, ok := f.candidate(i)
+		if !ok {
+			break
+		}
+		if taken[address] {
+			continue
+		}
+
+		fwd.BindAddress, fwd.LocalPort = address.host, address.port
+		if lastErr = f.Client.StartForwards([]*Forward{fwd}); lastErr == nil {
+			// remember the port the system chose
+			f.assigned[device.Id] = fleetAddress{fwd.BindAddress, fwd.LocalPort}
+			return fwd, nil
+		}
+		if address.port == 0 {
+			return nil, lastErr
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no free local addresses left")
+	}
+	return nil, lastErr
+}
+
+// candidate is the i-th local address the fleet hands out
+func (f *Fleet) candidate(i int) (fleetAddress, bool) {
+	if f.Network == nil {
+		if f.LocalPort == 0 {
+			return fleetAddress{f.BindAddress, 0}, i == 0
+		}
+		port := f.LocalPort + i
+		return fleetAddress{f.BindAddress, port}, port <= 65535
+	}
+
+	ip, ok := networkAddress(f.Network, i)
+	port := f.LocalPort
+	if port == 0 {
+		port = f.RemotePort
+	}
+	return fleetAddress{ip.String(), port}, ok
+}
+
+// networkAddress is the i-th address of the network after the network
+// address itself, false once it runs out
+func networkAddress(network *net.IPNet, i int) (net.IP, bool) {
+	ip := make(net.IP, len(network.IP))
+	copy(ip, network.IP)
+	carry := i + 1
+	for b := len(ip) - 1; b >= 0 && carry > 0; b-- {
+		sum := int(ip[b]) + carry
+		ip[b] = byte(sum)
+		carry = sum >> 8
+	}
+	return ip, carry == 0 && network.Contains(ip)
+}
+
+func (fwd *Forward) localAddress() string {
+	return net.JoinHostPort(fwd.BindAddress, strconv.Itoa(fwd.LocalPort))
+}
+
+// Targets lists the matching devices by name
+func (f *Fleet) Targets() []FleetTarget {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var targets []FleetTarget
+	for _, device := range f.matched {
+		target := FleetTarget{NodeID: device.Id, Name: device.Name, Group: device.Group, Destination: f.Destination()}
+		if fwd := f.forwards[device.Id]; fwd != nil {
+			target.Address = fwd.localAddress()
+			target.Online = true
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// Destination is where the forwards connect to as seen from each device
+func (f *Fleet) Destination() string {
+	fwd := Forward{RemoteTarget: f.RemoteTarget, RemotePort: f.RemotePort}
+	return fwd.destination()
+}
+
+// Forwards returns the running forwards by device name
+func (f *Fleet) Forwards() []*Forward {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var forwards []*Forward
+	for _, device := range f.matched {
+		if fwd := f.forwards[device.Id]; fwd != nil {
+			forwards = append(forwards, fwd)
+		}
+	}
+	return forwards
+}
+
+// stop keeps the fleet from starting more forwards and returns the running
+// ones
+func (f *Fleet) stop() []*Forward {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.closed && f.quit != nil {
+		close(f.quit)
+	}
+	f.closed = true
+
+	var forwards []*Forward
+	for _, fwd := range f.forwards {
+		forwards = append(forwards, fwd)
+	}
+	return forwards
+}
+
+// Close stops following the devices and closes every forward
+func (f *Fleet) Close() error {
+	for _, fwd := range f.stop() {
+		fwd.Close()
+	}
+	return nil
+}
+
+// Shutdown stops following the devices and waits up to grace for the open
+// connections of every forward to finish
+func (f *Fleet) Shutdown(grace time.Duration) {
+	var wg sync.WaitGroup
+	for _, fwd := range f.stop() {
+		wg.Add(1)
+		go func(fwd *Forward) {
+			defer wg.Done()
+			fwd.Shutdown(grace)
+		}(fwd)
+	}
+	wg.Wait()
+}
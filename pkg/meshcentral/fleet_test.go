@@ -0,0 +1,37 @@
+package meshcentral
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNetworkAddress(t *testing.T) {
+	tests := []struct {
+		network string
+		i       int
+		want    string
+		wantOK  bool
+	}{
+		{"127.77.0.0/16", 0, "127.77.0.1", true},
+		{"127.77.0.0/16", 254, "127.77.0.255", true},
+		{"127.77.0.0/16", 255, "127.77.1.0", true},
+		{"127.77.0.0/16", 65534, "127.77.255.255", true},
+		{"127.77.0.0/16", 65535, "127.78.0.0", false},
+		{"10.0.0.0/30", 2, "10.0.0.3", true},
+		{"10.0.0.0/30", 3, "10.0.0.4", false},
+		{"255.255.255.254/31", 1, "0.0.0.0", false},
+		{"fd00::/120", 0, "fd00::1", true},
+		{"fd00::/120", 255, "fd00::100", false},
+	}
+
+	for _, tt := range tests {
+		_, network, err := net.ParseCIDR(tt.network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := networkAddress(network, tt.i)
+		if ok != tt.wantOK || (ok && got.String() != tt.want) {
+			t.Errorf("networkAddress(%s, %d) = %s, %v, want %s, %v", tt.network, tt.i, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package meshcentral
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GatewayRoute sends the requests for Host (exact or *.example.com) and/or
+// under the Path prefix to Port on the node, or to Target:Port as seen from
+// the node
+type GatewayRoute struct {
+	Host      string
+	Path      string
+	StripPath bool
+	NodeID    string
+	NodeName  string
+	Target    string
+	Port      int
+	TLS       bool
+
+	proxy *httputil.ReverseProxy
+}
+
+// Gateway is a local HTTP(S) server that reverse proxies every request to the
+// first route that matches it, through a relay to the route's node. Websocket
+// upgrades are passed through. TLSConfig serves HTTPS when it is set. The
+// relays are opened with Client.
+type Gateway struct {
+	Client    *Client
+	Address   string
+	Routes    []*GatewayRoute
+	TLSConfig *tls.Config
+	Retry     Retry
+	// Sources are the client networks allowed to use the gateway. Loopback
+	// clients are always allowed, an empty list allows everyone.
+	Sources []*net.IPNet
+
+	server *http.Server
+}
+
+// Start binds the listener and serves it in the background
+func (g *Gateway) Start() error {
+	for _, route := range g.Routes {
+		route.proxy = g.reverseProxy(route)
+	}
+
+	listener, err := net.Listen("tcp", g.Address)
+	if err != nil {
+		return fmt.Errorf("unable to bind gateway to %s: %w", g.Address, err)
+	}
+	g.Address = listener.Addr().String()
+	if g.TLSConfig != nil {
+		listener = tls.NewListener(listener, g.TLSConfig)
+	}
+	g.server = &http.Server{Handler: g, ReadHeaderTimeout: 30 * time.Second, ErrorLog: g.Client.logger()}
+	go g.server.Serve(listener)
+	return nil
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !g.permits(req) {
+		g.Client.debugf("Gateway refused %s", req.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	for _, route := range g.Routes {
+		if route.matches(req) {
+			g.Client.debugf("Gateway %s %s%s via %s", req.Method, req.Host, req.URL.Path, route.NodeName)
+			route.proxy.ServeHTTP(w, req)
+			return
+		}
+	}
+	http.Error(w, "no gateway rule for "+req.Host+req.URL.Path, http.StatusNotFound)
+}
+
+// permits checks the client of req against Sources
+func (g *Gateway) permits(req *http.Request) bool {
+	if len(g.Sources) == 0 {
+		return true
+	}
+	addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	limits := Limits{Sources: g.Sources}
+	return limits.permitsSource(addr)
+}
+
+func (r *GatewayRoute) matches(req *http.Request) bool {
+	if r.Host != "" {
+		host := strings.ToLower(req.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		pattern := strings.ToLower(r.Host)
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			if !strings.HasSuffix(host, suffix) {
+				return false
+			}
+		} else if host != pattern {
+			return false
+		}
+	}
+	if prefix := strings.TrimSuffix(r.Path, "/"); prefix != "" {
+		if req.URL.Path != prefix && !strings.HasPrefix(req.URL.Path, prefix+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// Destination is where the route's requests go as seen from the node
+func (r *GatewayRoute) Destination() string {
+	fwd := Forward{RemoteTarget: r.Target, RemotePort: r.Port}
+	return fwd.destination()
+}
+
+// reverseProxy builds the proxy of a route. Every route has its own
+// transport, so idle connections are only reused for the same node.
+func (g *Gateway) reverseProxy(route *GatewayRoute) *httputil.ReverseProxy {
+	fwd := &Forward{NodeID: route.NodeID, NodeName: route.NodeName, RemoteTarget: route.Target, RemotePort: route.Port, Retry: g.Retry, client: g.Client}
+	scheme := "http"
+	if route.TLS {
+		scheme = "https"
+	}
+	prefix := strings.TrimSuffix(route.Path, "/")
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = scheme
+			pr.Out.URL.Host = route.Destination()
+			pr.Out.Host = ""
+			if route.StripPath && prefix != "" {
+				pr.Out.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(pr.In.URL.Path, prefix), "/")
+				pr.Out.URL.RawPath = ""
+			}
+			pr.SetXForwarded()
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return fwd.dialConn()
+			},
+			TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+			MaxIdleConnsPerHost: 8,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			g.Client.logf("Gateway %s%s via %s failed: %v", req.Host, req.URL.Path, route.NodeName, err)
+			http.Error(w, "unable to reach "+route.NodeName+" port "+strconv.Itoa(route.Port), http.StatusBadGateway)
+		},
+	}
+}
+
+// dialConn opens a relay like a connection to the forward would
+func (fwd *Forward) dialConn() (net.Conn, error) {
+	wsConn, node, err := fwd.dial()
+	if err != nil {
+		return nil, err
+	}
+	return newRelayConn(wsConn, &RelayAddr{NodeID: node.Id, Address: fwd.destination()}), nil
+}
+
+// Close stops the gateway and every connection
+func (g *Gateway) Close() error {
+	if g.server == nil {
+		return nil
+	}
+	return g.server.Close()
+}
+
+// Shutdown stops accepting and waits up to grace for the requests in flight
+func (g *Gateway) Shutdown(grace time.Duration) {
+	if g.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if g.server.Shutdown(ctx) != nil {
+		g.server.Close()
+	}
+}
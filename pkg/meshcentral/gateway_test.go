@@ -0,0 +1,75 @@
+package meshcentral
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGatewayRouteMatches(t *testing.T) {
+	tests := []struct {
+		name  string
+		route GatewayRoute
+		url   string
+		want  bool
+	}{
+		{"host", GatewayRoute{Host: "router.example.com"}, "http://router.example.com/", true},
+		{"host with port", GatewayRoute{Host: "router.example.com"}, "http://router.example.com:8443/admin", true},
+		{"host case", GatewayRoute{Host: "Router.Example.com"}, "http://ROUTER.example.COM/", true},
+		{"other host", GatewayRoute{Host: "router.example.com"}, "http://nas.example.com/", false},
+		{"wildcard", GatewayRoute{Host: "*.nas.example.com"}, "http://a.nas.example.com/", true},
+		{"wildcard deeper", GatewayRoute{Host: "*.nas.example.com"}, "http://a.b.nas.example.com/", true},
+		{"wildcard not the domain itself", GatewayRoute{Host: "*.nas.example.com"}, "http://nas.example.com/", false},
+		{"wildcard not a suffix of a label", GatewayRoute{Host: "*.nas.example.com"}, "http://evilnas.example.com/", false},
+		{"path", GatewayRoute{Path: "/printer/"}, "http://localhost/printer/status", true},
+		{"path exact", GatewayRoute{Path: "/printer/"}, "http://localhost/printer", true},
+		{"path without slash", GatewayRoute{Path: "/printer"}, "http://localhost/printer/", true},
+		{"path prefix of a segment", GatewayRoute{Path: "/printer/"}, "http://localhost/printers", false},
+		{"other path", GatewayRoute{Path: "/printer/"}, "http://localhost/", false},
+		{"root path", GatewayRoute{Path: "/"}, "http://localhost/anything", true},
+		{"host and path", GatewayRoute{Host: "ui.example.com", Path: "/nas"}, "http://ui.example.com/nas/", true},
+		{"host and other path", GatewayRoute{Host: "ui.example.com", Path: "/nas"}, "http://ui.example.com/router", false},
+		{"path and other host", GatewayRoute{Host: "ui.example.com", Path: "/nas"}, "http://other.example.com/nas", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			if got := tt.route.matches(req); got != tt.want {
+				t.Errorf("%+v matches %s = %v, want %v", tt.route, tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGatewayPermits(t *testing.T) {
+	office, err := ParseNetworks([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		sources []*net.IPNet
+		remote  string
+		want    bool
+	}{
+		{"no sources", nil, "203.0.113.9:40000", true},
+		{"allowed", office, "10.1.2.3:40000", true},
+		{"not allowed", office, "203.0.113.9:40000", false},
+		{"loopback", office, "127.0.0.1:40000", true},
+		{"ipv6 loopback", office, "[::1]:40000", true},
+		{"bad address", office, "somewhere", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &Gateway{Sources: tt.sources}
+			req := httptest.NewRequest("GET", "http://router.example.com/", nil)
+			req.RemoteAddr = tt.remote
+			if got := g.permits(req); got != tt.want {
+				t.Errorf("permits from %s = %v, want %v", tt.remote, got, tt.want)
+			}
+		})
+	}
+}
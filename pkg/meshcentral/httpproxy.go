@@ -0,0 +1,243 @@
+package meshcentral
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// NetworkPolicy decides which destinations a proxy may relay to. Deny wins over
+// Allow, and an empty Allow list permits everything not denied. Host names are
+// resolved by the node, so they can't be checked locally and are refused once
+// either list is set.
+type NetworkPolicy struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// ParseNetworks parses a list of CIDRs or single addresses
+func ParseNetworks(values []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network %q", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Permits reports whether host may be relayed to
+func (p *NetworkPolicy) Permits(host string) bool {
+	if p == nil {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return len(p.Allow) == 0 && len(p.Deny) == 0
+	}
+	for _, network := range p.Deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for _, network := range p.Allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// HttpProxy is a local HTTP proxy that relays CONNECT tunnels and plain
+// absolute-URI requests through the node, with relays opened by Client. Like
+// SocksProxy it uses the Failover nodes and Retry.
+type HttpProxy struct {
+	Client   *Client
+	NodeID   string
+	NodeName string
+	Failover []Device
+	Retry    Retry
+	Address  string
+	Policy   *NetworkPolicy
+	Limits   Limits
+
+	relay
+}
+
+// Start binds the proxy listener and serves it in the background
+func (p *HttpProxy) Start() error {
+	listener, err := net.Listen("tcp", p.Address)
+	if err != nil {
+		return fmt.Errorf("unable to bind HTTP proxy to %s: %w", p.Address, err)
+	}
+	p.Address = listener.Addr().String()
+	p.addListener(listener)
+
+	go func() {
+		var delay time.Duration
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if p.acceptFailed(p.Client, err, &delay) {
+					return
+				}
+				continue
+			}
+			delay = 0
+			go p.serve(conn)
+		}
+	}()
+	return nil
+}
+
+func (p *HttpProxy) serve(raw net.Conn) {
+	conn, err := p.open(raw, &p.Limits)
+	if err != nil {
+		p.Client.debugf("Refused %s: %v", raw.RemoteAddr(), err)
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		p.Client.debugf("HTTP proxy request failed: %v", err)
+		conn.finish("bad request: " + err.Error())
+		return
+	}
+
+	host, port, err := proxyDestination(req)
+	if err != nil {
+		httpProxyError(conn, http.StatusBadRequest, err.Error())
+		conn.finish("bad request: " + err.Error())
+		return
+	}
+	conn.target(p.NodeName, net.JoinHostPort(host, strconv.Itoa(port)))
+
+	if !p.Policy.Permits(host) {
+		p.Client.debugf("HTTP proxy refused %s", net.JoinHostPort(host, strconv.Itoa(port)))
+		httpProxyError(conn, http.StatusForbidden, "destination not allowed")
+		conn.finish("destination not allowed")
+		return
+	}
+
+	p.Client.debugf("HTTP proxy %s %s via %s", req.Method, net.JoinHostPort(host, strconv.Itoa(port)), p.NodeName)
+
+	nodes := func() []Device { return p.Client.failoverNodes(p.NodeID, p.NodeName, p.Failover) }
+	wsConn, node, err := p.Client.retryDial(p.Retry, nodes, "tcp", host, port, p.closing())
+	if err != nil {
+		p.Client.logf("Unable to connect to server: %v", err)
+		httpProxyError(conn, http.StatusBadGateway, "unable to reach destination")
+		conn.finish("relay failed: " + err.Error())
+		return
+	}
+	if node.Id != p.NodeID {
+		conn.target(node.Name, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+
+	if req.Method == http.MethodConnect {
+		if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+			wsConn.Close()
+			conn.finish("client error: " + err.Error())
+			return
+		}
+	} else {
+		// every request gets its own relay, so the connection can't be reused
+		// for a request to another host
+		removeHopHeaders(req.Header)
+		req.Header.Set("Connection", "close")
+		req.Close = true
+
+		var buf bytes.Buffer
+		if err := req.Write(&buf); err != nil {
+			wsConn.Close()
+			conn.finish("client error: " + err.Error())
+			return
+		}
+		if err := wsConn.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
+			wsConn.Close()
+			conn.finish("client error: " + err.Error())
+			return
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	p.Client.onWebSocket(wsConn, &bufferedConn{Conn: conn, reader: reader}, conn)
+}
+
+// proxyDestination works out host and port from a CONNECT authority or an
+// absolute http:// request URI
+func proxyDestination(req *http.Request) (string, int, error) {
+	authority := req.Host
+	defaultPort := "80"
+	if req.Method != http.MethodConnect {
+		if !req.URL.IsAbs() {
+			return "", 0, errors.New("request URI must be absolute")
+		}
+		if req.URL.Scheme != "http" {
+			return "", 0, fmt.Errorf("unsupported scheme %q, use CONNECT", req.URL.Scheme)
+		}
+		authority = req.URL.Host
+	}
+
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		if req.Method == http.MethodConnect {
+			return "", 0, errors.New("CONNECT requires host:port")
+		}
+		host, port = strings.Trim(authority, "[]"), defaultPort
+	}
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || number == 0 || host == "" {
+		return "", 0, fmt.Errorf("invalid destination %q", authority)
+	}
+	return host, int(number), nil
+}
+
+// removeHopHeaders drops headers that only apply to the client-proxy hop
+func removeHopHeaders(header http.Header) {
+	for _, field := range strings.Split(header.Get("Connection"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			header.Del(field)
+		}
+	}
+	for _, name := range []string{"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authorization", "Te", "Trailer", "Upgrade"} {
+		header.Del(name)
+	}
+}
+
+func httpProxyError(conn net.Conn, code int, message string) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s\n",
+		code, http.StatusText(code), len(message)+1, message)
+}
@@ -0,0 +1,185 @@
+package meshcentral
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestNetworkPolicyPermits(t *testing.T) {
+	networks := func(values ...string) []*net.IPNet {
+		n, err := ParseNetworks(values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	tests := []struct {
+		name   string
+		policy *NetworkPolicy
+		host   string
+		want   bool
+	}{
+		{"no policy", nil, "10.0.0.1", true},
+		{"no policy host name", nil, "intranet", true},
+		{"empty lists host name", &NetworkPolicy{}, "intranet", true},
+		{"allowed", &NetworkPolicy{Allow: networks("10.0.0.0/8")}, "10.1.2.3", true},
+		{"not allowed", &NetworkPolicy{Allow: networks("10.0.0.0/8")}, "192.168.1.1", false},
+		{"denied", &NetworkPolicy{Deny: networks("169.254.169.254")}, "169.254.169.254", false},
+		{"not denied", &NetworkPolicy{Deny: networks("169.254.169.254")}, "10.0.0.1", true},
+		{"deny wins", &NetworkPolicy{Allow: networks("10.0.0.0/8"), Deny: networks("10.0.0.0/24")}, "10.0.0.5", false},
+		{"ipv6", &NetworkPolicy{Allow: networks("fd00::/8")}, "fd12::1", true},
+		{"host name with allow", &NetworkPolicy{Allow: networks("10.0.0.0/8")}, "intranet", false},
+		{"host name with deny", &NetworkPolicy{Deny: networks("169.254.169.254")}, "metadata.internal", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Permits(tt.host); got != tt.want {
+				t.Errorf("Permits(%q) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyDestination(t *testing.T) {
+	for request, want := range map[string]string{
+		"CONNECT 10.0.0.5:22 HTTP/1.1\r\nHost: 10.0.0.5:22\r\n\r\n":                          "10.0.0.5 22",
+		"CONNECT [fd00::1]:443 HTTP/1.1\r\nHost: [fd00::1]:443\r\n\r\n":                      "fd00::1 443",
+		"CONNECT intranet HTTP/1.1\r\nHost: intranet\r\n\r\n":                                "error CONNECT requires host:port",
+		"CONNECT intranet:0 HTTP/1.1\r\nHost: intranet:0\r\n\r\n":                            `error invalid destination "intranet:0"`,
+		"GET http://10.0.0.5/status HTTP/1.1\r\nHost: 10.0.0.5\r\n\r\n":                      "10.0.0.5 80",
+		"GET http://10.0.0.5:8080/ HTTP/1.1\r\nHost: 10.0.0.5:8080\r\n\r\n":                  "10.0.0.5 8080",
+		"GET http://[fd00::1]/ HTTP/1.1\r\nHost: [fd00::1]\r\n\r\n":                          "fd00::1 80",
+		"GET /status HTTP/1.1\r\nHost: 10.0.0.5\r\n\r\n":                                     "error request URI must be absolute",
+		"GET https://10.0.0.5/ HTTP/1.1\r\nHost: 10.0.0.5\r\n\r\n":                           `error unsupported scheme "https", use CONNECT`,
+		"GET http://10.0.0.5:99999/ HTTP/1.1\r\nHost: 10.0.0.5\r\n\r\n":                      `error invalid destination "10.0.0.5:99999"`,
+		"POST http://intranet:9000/api HTTP/1.1\r\nHost: other\r\nContent-Length: 0\r\n\r\n": "intranet 9000",
+	} {
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(request)))
+		if err != nil {
+			t.Fatalf("%q: %v", request, err)
+		}
+		host, port, err := proxyDestination(req)
+		got := fmt.Sprintf("%s %d", host, port)
+		if err != nil {
+			got = "error " + err.Error()
+		}
+		if got != want {
+			t.Errorf("%s %s: got %s, want %s", req.Method, req.RequestURI, got, want)
+		}
+	}
+}
+
+// relayHttpServer plays a web server behind the node. It answers with the
+// relay's target and the headers that reached it.
+func relayHttpServer(conn *websocket.Conn, r *http.Request) {
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		return
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(message)))
+	if err != nil {
+		return
+	}
+	query := r.URL.Query()
+	body := fmt.Sprintf("%s %s:%s\nconnection=%s keep-alive=%s proxy-authorization=%s x-private=%s\n",
+		req.URL, query.Get("tcpaddr"), query.Get("tcpport"),
+		req.Header.Get("Connection"), req.Header.Get("Keep-Alive"), req.Header.Get("Proxy-Authorization"), req.Header.Get("X-Private"))
+	conn.WriteMessage(websocket.BinaryMessage, []byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)))
+}
+
+func TestHttpProxy(t *testing.T) {
+	tunnel := startFakeServer(t, relayTarget)
+	web := startFakeServer(t, relayHttpServer)
+	policy := &NetworkPolicy{Deny: mustParseNetworks(t, "169.254.0.0/16")}
+
+	start := func(client *Client) *HttpProxy {
+		p := &HttpProxy{Client: client, NodeID: "node//gw", NodeName: "gw", Address: "127.0.0.1:0", Policy: policy}
+		if err := p.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { p.Close() })
+		return p
+	}
+
+	t.Run("CONNECT", func(t *testing.T) {
+		p := start(tunnel)
+		conn, err := net.Dial("tcp", p.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		fmt.Fprintf(conn, "CONNECT 10.0.0.5:22 HTTP/1.1\r\nHost: 10.0.0.5:22\r\n\r\nSSH-2.0-test\n")
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT answered %v, %v", resp, err)
+		}
+		// what was sent behind the request isn't lost
+		if greeting, _ := reader.ReadString('\n'); greeting != "10.0.0.5:22 via node//gw\n" {
+			t.Errorf("relay opened for %q", greeting)
+		}
+		if echo, _ := reader.ReadString('\n'); echo != "SSH-2.0-test\n" {
+			t.Errorf("echo = %q", echo)
+		}
+	})
+
+	t.Run("plain request", func(t *testing.T) {
+		p := start(web)
+		proxyURL, _ := url.Parse("http://" + p.Address)
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+		req, _ := http.NewRequest("GET", "http://10.0.0.5:8080/status?full=1", nil)
+		req.Header.Set("Connection", "X-Private")
+		req.Header.Set("X-Private", "hop")
+		req.Header.Set("Keep-Alive", "timeout=5")
+		req.Header.Set("Proxy-Authorization", "Basic Ym9iOnNlY3JldA==")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+
+		// the web server gets the request in origin form
+		want := "/status?full=1 10.0.0.5:8080\nconnection=close keep-alive= proxy-authorization= x-private=\n"
+		if string(body) != want {
+			t.Errorf("web server saw\n%s\nwant\n%s", body, want)
+		}
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		p := start(tunnel)
+		for request, want := range map[string]int{
+			"CONNECT 169.254.169.254:80 HTTP/1.1\r\nHost: 169.254.169.254:80\r\n\r\n":  http.StatusForbidden,
+			"CONNECT metadata.internal:80 HTTP/1.1\r\nHost: metadata.internal\r\n\r\n": http.StatusForbidden,
+			"CONNECT intranet HTTP/1.1\r\nHost: intranet\r\n\r\n":                      http.StatusBadRequest,
+			"GET /status HTTP/1.1\r\nHost: 10.0.0.5\r\n\r\n":                           http.StatusBadRequest,
+		} {
+			conn, err := net.Dial("tcp", p.Address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			io.WriteString(conn, request)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil || resp.StatusCode != want {
+				t.Errorf("%q answered %v, %v, want %d", request, resp, err, want)
+			}
+			conn.Close()
+		}
+	})
+}
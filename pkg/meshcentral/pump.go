@@ -0,0 +1,251 @@
+package meshcentral
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// relayBufferSize is how much is read from either side at once
+	relayBufferSize = 32 * 1024
+	// relayFrameSize is the largest message sent to the relay. Reads that
+	// queue up while the relay is busy are sent together up to this size.
+	relayFrameSize = 64 * 1024
+	// relayQueue is how many reads may wait for the other side
+	relayQueue = 16
+)
+
+var relayBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, relayBufferSize)
+		return &buf
+	},
+}
+
+// relayWriteBuffers lets idle relays give back their websocket write buffer
+var relayWriteBuffers = &sync.Pool{}
+
+var localWriters = sync.Pool{
+	New: func() any {
+		return bufio.NewWriterSize(nil, relayFrameSize)
+	},
+}
+
+// relayChunk is a pooled buffer holding n bytes
+type relayChunk struct {
+	buf *[]byte
+	n   int
+}
+
+func (c relayChunk) bytes() []byte {
+	return (*c.buf)[:c.n]
+}
+
+// relayWriter serializes the writes to a relay websocket, which allows only
+// one writer at a time
+type relayWriter struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+// WriteMessage sends a single message
+func (w *relayWriter) WriteMessage(messageType int, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.conn.WriteMessage(messageType, data)
+}
+
+// writeChunks sends chunks as one binary message
+func (w *relayWriter) writeChunks(chunks []relayChunk) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	message, err := w.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		if _, err := message.Write(c.bytes()); err != nil {
+			message.Close()
+			return err
+		}
+	}
+	return message.Close()
+}
+
+// close tells the relay the local side is done
+func (w *relayWriter) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	w.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// pump moves data between the relay and local until either side is done and
+// returns why, within rate when it isn't nil. The caller closes both
+// afterwards, which stops the direction that is still running.
+func pump(wsConn *websocket.Conn, local io.ReadWriter, rate *RateLimit) string {
+	writer := &relayWriter{conn: wsConn}
+	done := make(chan string, 2)
+	up, down := rate.buckets()
+
+	go func() { done <- pumpToLocal(wsConn, local, down) }()
+	go func() { done <- pumpToRelay(local, writer, up) }()
+
+	reason := <-done
+	if reason == "client closed" {
+		writer.close()
+	}
+	return reason
+}
+
+// pumpToRelay copies local to the relay. Reads are queued so the next one can
+// happen while the relay is busy, everything queued goes out as one message.
+func pumpToRelay(local io.Reader, writer *relayWriter, limit *bucket) string {
+	chunks := make(chan relayChunk, relayQueue)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	var readErr error
+	go func() {
+		defer close(chunks)
+		for {
+			buf := relayBuffers.Get().(*[]byte)
+			n, err := local.Read(*buf)
+			if n > 0 {
+				select {
+				case chunks <- relayChunk{buf, n}:
+				case <-stop:
+					relayBuffers.Put(buf)
+					return
+				}
+			} else {
+				relayBuffers.Put(buf)
+			}
+			if err != nil {
+				readErr = err
+				return
+			}
+		}
+	}()
+
+	batch := make([]relayChunk, 0, relayFrameSize/relayBufferSize)
+	for c := range chunks {
+		batch = append(batch[:0], c)
+		size := c.n
+	coalesce:
+		for size+relayBufferSize <= relayFrameSize {
+			select {
+			case more, ok := <-chunks:
+				if !ok {
+					break coalesce
+				}
+				batch = append(batch, more)
+				size += more.n
+			default:
+				break coalesce
+			}
+		}
+
+		limit.wait(size)
+		err := writer.writeChunks(batch)
+		for _, b := range batch {
+			relayBuffers.Put(b.buf)
+		}
+		if err != nil {
+			go drain(chunks)
+			return "relay error: " + err.Error()
+		}
+	}
+
+	// chunks is closed after readErr is set
+	if readErr == io.EOF || errors.Is(readErr, net.ErrClosed) {
+		return "client closed"
+	}
+	return "client error: " + readErr.Error()
+}
+
+// pumpToLocal copies relay messages to local. Messages that arrive while
+// local is busy are written together.
+func pumpToLocal(wsConn *websocket.Conn, local io.Writer, limit *bucket) string {
+	chunks := make(chan relayChunk, relayQueue)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	var readErr error
+	go func() {
+		defer close(chunks)
+		for {
+			messageType, message, err := wsConn.NextReader()
+			if err != nil {
+				readErr = err
+				return
+			}
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			for {
+				buf := relayBuffers.Get().(*[]byte)
+				n, err := io.ReadFull(message, *buf)
+				if n > 0 {
+					select {
+					case chunks <- relayChunk{buf, n}:
+					case <-stop:
+						relayBuffers.Put(buf)
+						return
+					}
+				} else {
+					relayBuffers.Put(buf)
+				}
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					break
+				}
+				if err != nil {
+					readErr = err
+					return
+				}
+			}
+		}
+	}()
+
+	out := localWriters.Get().(*bufio.Writer)
+	out.Reset(local)
+	defer func() {
+		out.Reset(nil)
+		localWriters.Put(out)
+	}()
+
+	for c := range chunks {
+		limit.wait(c.n)
+		_, err := out.Write(c.bytes())
+		relayBuffers.Put(c.buf)
+		if err == nil && len(chunks) == 0 {
+			err = out.Flush()
+		}
+		if err != nil {
+			go drain(chunks)
+			return "client error: " + err.Error()
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return "client error: " + err.Error()
+	}
+
+	if websocket.IsCloseError(readErr, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) || errors.Is(readErr, net.ErrClosed) {
+		return "remote closed"
+	}
+	return "relay error: " + readErr.Error()
+}
+
+// drain returns the buffers still queued once nobody writes them
+func drain(chunks chan relayChunk) {
+	for c := range chunks {
+		relayBuffers.Put(c.buf)
+	}
+}
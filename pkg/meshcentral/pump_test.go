@@ -0,0 +1,551 @@
+package meshcentral
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startStandInRelay serves an echoing meshrelay.ashx and returns a client
+// pointed at it, like a node that sends back whatever it gets
+func startStandInRelay(b *testing.B, compress bool) *Client {
+	b.Helper()
+
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, message, err := conn.NextReader()
+			if err != nil {
+				return
+			}
+			writer, err := conn.NextWriter(messageType)
+			if err != nil {
+				return
+			}
+			io.Copy(writer, message)
+			if writer.Close() != nil {
+				return
+			}
+		}
+	}))
+	b.Cleanup(server.Close)
+
+	return &Client{
+		opts:      Options{Compress: compress, TLSConfig: server.Client().Transport.(*http.Transport).TLSClientConfig},
+		serverURL: "wss://" + strings.TrimPrefix(server.URL, "https://") + "/meshrelay.ashx",
+		done:      make(chan struct{}),
+		nodeConn:  map[string]int{},
+	}
+}
+
+// startBenchForward starts a forward to the stand-in relay and connects to it
+func startBenchForward(b *testing.B, compress bool) net.Conn {
+	b.Helper()
+	client := startStandInRelay(b, compress)
+
+	fwd := &Forward{NodeID: "node//bench", BindAddress: "127.0.0.1", RemotePort: 80}
+	if err := client.StartForwards([]*Forward{fwd}); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { fwd.Close() })
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(fwd.LocalPort)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// benchPayload is text-like so deflate has something to do
+func benchPayload(size int) []byte {
+	line := []byte("203.0.113.7 - - [19/Oct/2026:10:00:00 +0000] \"GET /api/v1/devices HTTP/1.1\" 200 5120\n")
+	return bytes.Repeat(line, size/len(line)+1)[:size]
+}
+
+func benchmarkThroughput(b *testing.B, size int, compress bool) {
+	conn := startBenchForward(b, compress)
+	payload := benchPayload(size)
+
+	received := make(chan error, 1)
+	go func() {
+		want := int64(b.N) * int64(size)
+		buf := make([]byte, len(payload))
+		var got int64
+		for got < want {
+			n, err := conn.Read(buf)
+			if err != nil {
+				received <- err
+				return
+			}
+			data, offset := buf[:n], int(got%int64(size))
+			for len(data) > 0 {
+				k := min(len(data), size-offset)
+				if !bytes.Equal(data[:k], payload[offset:offset+k]) {
+					received <- fmt.Errorf("data after byte %d differs", got)
+					return
+				}
+				data, offset = data[k:], 0
+			}
+			got += int64(n)
+		}
+		received <- nil
+	}()
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := <-received; err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkRelayThroughput streams through a forward and back, the bytes are
+// counted once
+func BenchmarkRelayThroughput(b *testing.B) {
+	for _, size := range []int{4 << 10, 64 << 10, 1 << 20} {
+		for _, compress := range []bool{false, true} {
+			name := strconv.Itoa(size>>10) + "K"
+			if compress {
+				name += "/deflate"
+			}
+			b.Run(name, func(b *testing.B) {
+				benchmarkThroughput(b, size, compress)
+			})
+		}
+	}
+}
+
+// BenchmarkRelayLatency is the round trip of a small message through a
+// forward
+func BenchmarkRelayLatency(b *testing.B) {
+	for _, compress := range []bool{false, true} {
+		name := "plain"
+		if compress {
+			name = "deflate"
+		}
+		b.Run(name, func(b *testing.B) {
+			conn := startBenchForward(b, compress)
+			ping := []byte("ping")
+			pong := make([]byte, len(ping))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := conn.Write(ping); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(conn, pong); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// dialRelay serves meshrelay.ashx with relay and returns the client side of
+// the websocket
+func dialRelay(t *testing.T, relay func(conn *websocket.Conn)) *websocket.Conn {
+	t.Helper()
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		relay(conn)
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+strings.TrimPrefix(server.URL, "http://")+"/meshrelay.ashx", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// stubLocal is the local side of a pump
+type stubLocal struct {
+	io.Reader
+	io.Writer
+}
+
+type failingIO struct {
+	err error
+}
+
+func (f failingIO) Read([]byte) (int, error)  { return 0, f.err }
+func (f failingIO) Write([]byte) (int, error) { return 0, f.err }
+
+// endlessReader returns data until it is closed
+type endlessReader struct {
+	closed atomic.Bool
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	if r.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	return len(p), nil
+}
+
+// blockingReader returns nothing until the test ends
+func blockingReader(t *testing.T) io.Reader {
+	reader, writer := io.Pipe()
+	t.Cleanup(func() { writer.Close() })
+	return reader
+}
+
+// readUntilClosed reads from the relay and returns the close code it got
+func readUntilClosed(conn *websocket.Conn) int {
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				return closeErr.Code
+			}
+			return -1
+		}
+	}
+}
+
+// sendMessages writes one binary message of each size, numbered by byte
+func sendMessages(conn *websocket.Conn, sizes []int) []byte {
+	var sent []byte
+	for _, size := range sizes {
+		message := make([]byte, size)
+		for i := range message {
+			message[i] = byte(len(sent) + i)
+		}
+		if conn.WriteMessage(websocket.BinaryMessage, message) != nil {
+			break
+		}
+		sent = append(sent, message...)
+	}
+	return sent
+}
+
+func TestPumpCloseReasons(t *testing.T) {
+	tests := []struct {
+		name  string
+		local func(t *testing.T) io.ReadWriter
+		relay func(conn *websocket.Conn)
+		want  string
+	}{
+		{
+			name:  "client eof",
+			local: func(t *testing.T) io.ReadWriter { return stubLocal{strings.NewReader("hello"), io.Discard} },
+			relay: func(conn *websocket.Conn) { readUntilClosed(conn) },
+			want:  "client closed",
+		},
+		{
+			name: "client read error",
+			local: func(t *testing.T) io.ReadWriter {
+				return stubLocal{failingIO{errors.New("connection reset")}, io.Discard}
+			},
+			relay: func(conn *websocket.Conn) { readUntilClosed(conn) },
+			want:  "client error: connection reset",
+		},
+		{
+			name: "client write error",
+			local: func(t *testing.T) io.ReadWriter {
+				return stubLocal{blockingReader(t), failingIO{errors.New("broken pipe")}}
+			},
+			relay: func(conn *websocket.Conn) {
+				sendMessages(conn, []int{10})
+				readUntilClosed(conn)
+			},
+			want: "client error: broken pipe",
+		},
+		{
+			name:  "remote normal closure",
+			local: func(t *testing.T) io.ReadWriter { return stubLocal{blockingReader(t), io.Discard} },
+			relay: func(conn *websocket.Conn) {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				readUntilClosed(conn)
+			},
+			want: "remote closed",
+		},
+		{
+			name:  "remote going away",
+			local: func(t *testing.T) io.ReadWriter { return stubLocal{blockingReader(t), io.Discard} },
+			relay: func(conn *websocket.Conn) {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+				readUntilClosed(conn)
+			},
+			want: "remote closed",
+		},
+		{
+			name:  "relay dropped",
+			local: func(t *testing.T) io.ReadWriter { return stubLocal{blockingReader(t), io.Discard} },
+			relay: func(conn *websocket.Conn) { conn.NetConn().Close() },
+			want:  "relay error: ",
+		},
+		{
+			name:  "relay protocol error",
+			local: func(t *testing.T) io.ReadWriter { return stubLocal{blockingReader(t), io.Discard} },
+			relay: func(conn *websocket.Conn) {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "agent gone"))
+				readUntilClosed(conn)
+			},
+			want: "relay error: websocket: close 1011 (internal server error): agent gone",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dialRelay(t, tt.relay)
+			if got := pump(conn, tt.local(t), nil); !strings.HasPrefix(got, tt.want) {
+				t.Errorf("pump() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPumpClientEOFClosesRelayNormally(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"no data", ""},
+		{"after data", "hello"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := make(chan []byte, 1)
+			codes := make(chan int, 1)
+			conn := dialRelay(t, func(conn *websocket.Conn) {
+				var data []byte
+				for {
+					_, message, err := conn.ReadMessage()
+					if err != nil {
+						received <- data
+						var closeErr *websocket.CloseError
+						if errors.As(err, &closeErr) {
+							codes <- closeErr.Code
+						} else {
+							codes <- -1
+						}
+						return
+					}
+					data = append(data, message...)
+				}
+			})
+
+			if got := pump(conn, stubLocal{strings.NewReader(tt.data), io.Discard}, nil); got != "client closed" {
+				t.Fatalf("pump() = %q, want %q", got, "client closed")
+			}
+			if data := <-received; string(data) != tt.data {
+				t.Errorf("relay got %q, want %q", data, tt.data)
+			}
+			if code := <-codes; code != websocket.CloseNormalClosure {
+				t.Errorf("relay close code = %d, want %d", code, websocket.CloseNormalClosure)
+			}
+		})
+	}
+}
+
+func TestPumpToLocalAcrossMessages(t *testing.T) {
+	tests := []struct {
+		name  string
+		sizes []int
+	}{
+		{"small messages", []int{1, 2, 3, 10}},
+		{"one buffer", []int{relayBufferSize}},
+		{"buffer boundary", []int{relayBufferSize - 1, 2, relayBufferSize + 1}},
+		{"larger than a frame", []int{relayFrameSize + 5, 7}},
+		{"many", []int{5000, 70000, 1, 32768, 32769, 100}},
+		{"empty message", []int{3, 0, 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := make(chan []byte, 1)
+			conn := dialRelay(t, func(conn *websocket.Conn) {
+				sent <- sendMessages(conn, tt.sizes)
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				readUntilClosed(conn)
+			})
+
+			var local bytes.Buffer
+			if got := pump(conn, stubLocal{blockingReader(t), &local}, nil); got != "remote closed" {
+				t.Fatalf("pump() = %q, want %q", got, "remote closed")
+			}
+			if want := <-sent; !bytes.Equal(local.Bytes(), want) {
+				t.Errorf("local got %d bytes, want %d bytes in order", local.Len(), len(want))
+			}
+		})
+	}
+}
+
+func TestPumpToRelayFrames(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"small", 10},
+		{"one buffer", relayBufferSize},
+		{"one frame", relayFrameSize},
+		{"several frames", 3*relayFrameSize + 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := benchPayload(tt.size)
+			received := make(chan []byte, 1)
+			largest := make(chan int, 1)
+			conn := dialRelay(t, func(conn *websocket.Conn) {
+				var data []byte
+				size := 0
+				for {
+					_, message, err := conn.ReadMessage()
+					if err != nil {
+						received <- data
+						largest <- size
+						return
+					}
+					data = append(data, message...)
+					size = max(size, len(message))
+				}
+			})
+
+			if got := pump(conn, stubLocal{bytes.NewReader(payload), io.Discard}, nil); got != "client closed" {
+				t.Fatalf("pump() = %q, want %q", got, "client closed")
+			}
+			if data := <-received; !bytes.Equal(data, payload) {
+				t.Errorf("relay got %d bytes, want %d bytes in order", len(data), len(payload))
+			}
+			if size := <-largest; size > relayFrameSize {
+				t.Errorf("largest message is %d bytes, want at most %d", size, relayFrameSize)
+			}
+		})
+	}
+}
+
+// countRelayBuffers makes relayBuffers count what it allocates, and returns
+// the count and a func that reports how many buffers are back in the pool
+func countRelayBuffers(t *testing.T) (*atomic.Int64, func() int64) {
+	// the pool must not drop buffers while they are counted
+	gc := debug.SetGCPercent(-1)
+	t.Cleanup(func() { debug.SetGCPercent(gc) })
+
+	var allocated atomic.Int64
+	var emptying atomic.Bool
+	newBuffer := relayBuffers.New
+	relayBuffers.New = func() any {
+		if emptying.Load() {
+			return nil
+		}
+		allocated.Add(1)
+		return newBuffer()
+	}
+	t.Cleanup(func() { relayBuffers.New = newBuffer })
+
+	pooled := func() int64 {
+		emptying.Store(true)
+		defer emptying.Store(false)
+		var bufs []any
+		for buf := relayBuffers.Get(); buf != nil; buf = relayBuffers.Get() {
+			bufs = append(bufs, buf)
+		}
+		for _, buf := range bufs {
+			relayBuffers.Put(buf)
+		}
+		return int64(len(bufs))
+	}
+
+	// start from an empty pool
+	emptying.Store(true)
+	for relayBuffers.Get() != nil {
+	}
+	emptying.Store(false)
+	return &allocated, pooled
+}
+
+func TestPumpReturnsBuffersOnError(t *testing.T) {
+	tests := []struct {
+		name  string
+		local func(t *testing.T) (io.ReadWriter, func())
+		relay func(conn *websocket.Conn)
+	}{
+		{
+			name: "client write error with messages queued",
+			local: func(t *testing.T) (io.ReadWriter, func()) {
+				reader, writer := io.Pipe()
+				return stubLocal{reader, failingIO{errors.New("broken pipe")}}, func() { writer.Close() }
+			},
+			relay: func(conn *websocket.Conn) {
+				sendMessages(conn, []int{relayFrameSize, relayFrameSize, relayFrameSize, relayFrameSize, relayFrameSize})
+				readUntilClosed(conn)
+			},
+		},
+		{
+			name: "relay error with reads queued",
+			local: func(t *testing.T) (io.ReadWriter, func()) {
+				reader := &endlessReader{}
+				return stubLocal{reader, io.Discard}, func() { reader.closed.Store(true) }
+			},
+			relay: func(conn *websocket.Conn) {
+				conn.ReadMessage()
+				conn.NetConn().Close()
+			},
+		},
+		{
+			name: "client read error after data",
+			local: func(t *testing.T) (io.ReadWriter, func()) {
+				reader := io.MultiReader(bytes.NewReader(benchPayload(relayFrameSize)), failingIO{errors.New("connection reset")})
+				return stubLocal{reader, io.Discard}, func() {}
+			},
+			relay: func(conn *websocket.Conn) { readUntilClosed(conn) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allocated, pooled := countRelayBuffers(t)
+			conn := dialRelay(t, tt.relay)
+			local, closeLocal := tt.local(t)
+
+			pump(conn, local, nil)
+			// what the caller of pump does, which stops the other direction
+			conn.Close()
+			closeLocal()
+
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				got, want := pooled(), allocated.Load()
+				if got == want {
+					return
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("%d of %d buffers returned to the pool", got, want)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package meshcentral
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimit caps the bandwidth of a forward or transfer, in bytes per second
+// in each direction. All connections share the limit unless PerConn is set.
+// The rate can be changed while it is in use, 0 means unlimited.
+type RateLimit struct {
+	PerConn bool
+
+	rate atomic.Int64
+	up   *bucket
+	down *bucket
+}
+
+func NewRateLimit(rate int64, perConn bool) *RateLimit {
+	l := &RateLimit{PerConn: perConn}
+	l.rate.Store(rate)
+	l.up = &bucket{rate: &l.rate}
+	l.down = &bucket{rate: &l.rate}
+	return l
+}
+
+func (l *RateLimit) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.rate.Load()
+}
+
+// SetRate changes the rate, open connections slow down or speed up from
+// their next write
+func (l *RateLimit) SetRate(rate int64) {
+	l.rate.Store(rate)
+}
+
+// buckets returns the buckets a new connection takes its bytes from, nil
+// when there is no limit
+func (l *RateLimit) buckets() (up *bucket, down *bucket) {
+	if l == nil {
+		return nil, nil
+	}
+	if l.PerConn {
+		return &bucket{rate: &l.rate}, &bucket{rate: &l.rate}
+	}
+	return l.up, l.down
+}
+
+// Reader limits what is read from r to the upload rate
+func (l *RateLimit) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	up, _ := l.buckets()
+	return &rateReader{r, up}
+}
+
+// Writer limits what is written to w to the download rate
+func (l *RateLimit) Writer(w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	_, down := l.buckets()
+	return &rateWriter{w, down}
+}
+
+// bucket is a token bucket refilled at rate bytes per second
+type bucket struct {
+	rate *atomic.Int64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// wait blocks until n more bytes fit the rate. Bytes are taken on credit, so
+// a large write waits once for all of it and the writes after it queue up
+// behind.
+func (b *bucket) wait(n int) {
+	if b == nil {
+		return
+	}
+	rate := float64(b.rate.Load())
+	if rate <= 0 {
+		return
+	}
+
+	// allow bursts of a tenth of a second, but at least one read
+	burst := max(rate/10, relayBufferSize)
+
+	b.mu.Lock()
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	debt := -b.tokens
+	b.mu.Unlock()
+
+	if debt > 0 {
+		time.Sleep(time.Duration(debt / rate * float64(time.Second)))
+	}
+}
+
+type rateReader struct {
+	r io.Reader
+	b *bucket
+}
+
+func (r *rateReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.b.wait(n)
+	return n, err
+}
+
+type rateWriter struct {
+	w io.Writer
+	b *bucket
+}
+
+func (w *rateWriter) Write(p []byte) (int, error) {
+	w.b.wait(len(p))
+	return w.w.Write(p)
+}
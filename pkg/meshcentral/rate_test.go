@@ -0,0 +1,109 @@
+package meshcentral
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// timed returns how long f took
+func timed(f func()) time.Duration {
+	start := time.Now()
+	f()
+	return time.Since(start)
+}
+
+func TestNilRateLimit(t *testing.T) {
+	var l *RateLimit
+	if l.Rate() != 0 {
+		t.Errorf("Rate() = %d", l.Rate())
+	}
+	if up, down := l.buckets(); up != nil || down != nil {
+		t.Error("a nil limit has buckets")
+	}
+
+	// without a limit readers and writers are used as they are
+	r := strings.NewReader("data")
+	var w bytes.Buffer
+	if l.Reader(r) != io.Reader(r) || l.Writer(&w) != io.Writer(&w) {
+		t.Error("a nil limit wraps readers or writers")
+	}
+
+	// and nil buckets never wait
+	var b *bucket
+	if took := timed(func() { b.wait(1 << 30) }); took > 100*time.Millisecond {
+		t.Errorf("nil bucket waited %v", took)
+	}
+}
+
+func TestBucketWait(t *testing.T) {
+	l := NewRateLimit(256<<10, false)
+	up, _ := l.buckets()
+
+	// the burst is a tenth of a second, but never less than one read
+	if took := timed(func() { up.wait(relayBufferSize) }); took > 100*time.Millisecond {
+		t.Errorf("the burst waited %v", took)
+	}
+	// 64K more at 256K/s is a quarter of a second
+	if took := timed(func() { up.wait(64 << 10) }); took < 200*time.Millisecond || took > 750*time.Millisecond {
+		t.Errorf("64K at 256K/s took %v, want 250ms", took)
+	}
+
+	// without a rate nothing waits, and setting one again applies at once
+	l.SetRate(0)
+	if took := timed(func() { up.wait(10 << 20) }); took > 100*time.Millisecond {
+		t.Errorf("unlimited wait took %v", took)
+	}
+	l.SetRate(1 << 20)
+	if l.Rate() != 1<<20 {
+		t.Errorf("Rate() = %d after SetRate", l.Rate())
+	}
+}
+
+func TestRateLimitSharing(t *testing.T) {
+	// two transfers of 256K after the burst, at 512K/s: half a second each on
+	// their own, a second together when they share the limit
+	transfer := func(l *RateLimit) time.Duration {
+		var wg sync.WaitGroup
+		return timed(func() {
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					up, _ := l.buckets()
+					up.wait(relayBufferSize + 256<<10)
+				}()
+			}
+			wg.Wait()
+		})
+	}
+
+	if took := transfer(NewRateLimit(512<<10, false)); took < 900*time.Millisecond {
+		t.Errorf("a shared limit let two transfers through in %v, want a second", took)
+	}
+	if took := transfer(NewRateLimit(512<<10, true)); took < 450*time.Millisecond || took > 800*time.Millisecond {
+		t.Errorf("per connection limits took %v, want 500ms", took)
+	}
+}
+
+func TestRateReaderWriter(t *testing.T) {
+	l := NewRateLimit(128<<10, false)
+	data := strings.Repeat("x", relayBufferSize+32<<10)
+
+	var copied bytes.Buffer
+	took := timed(func() { io.Copy(&copied, l.Reader(strings.NewReader(data))) })
+	if copied.String() != data || took < 200*time.Millisecond {
+		t.Errorf("read %d bytes in %v, want %d in 250ms", copied.Len(), took, len(data))
+	}
+
+	// the other direction has a bucket of its own, so it starts with a burst
+	var written bytes.Buffer
+	w := l.Writer(&written)
+	took = timed(func() { io.WriteString(w, data[:relayBufferSize]) })
+	if written.Len() != relayBufferSize || took > 100*time.Millisecond {
+		t.Errorf("wrote %d bytes in %v, want the burst at once", written.Len(), took)
+	}
+}
@@ -0,0 +1,402 @@
+package meshcentral
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RelayStats is a snapshot of the traffic through a forward or proxy. In is
+// what came back from the node, Out what was sent to it.
+type RelayStats struct {
+	Active   int64
+	Total    int64
+	BytesIn  int64
+	BytesOut int64
+	Started  time.Time
+}
+
+// relay tracks the listeners and live connections of a forward or proxy so
+// they can be counted and closed
+type relay struct {
+	mu        sync.Mutex
+	listeners []io.Closer
+	conns     map[*relayConn]struct{}
+	closed    bool
+	done      chan struct{}
+	started   time.Time
+	idle      chan struct{}
+
+	active   atomic.Int64
+	total    atomic.Int64
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+// Stats returns the current counters
+func (r *relay) Stats() RelayStats {
+	r.mu.Lock()
+	started := r.started
+	r.mu.Unlock()
+
+	return RelayStats{
+		Active:   r.active.Load(),
+		Total:    r.total.Load(),
+		BytesIn:  r.bytesIn.Load(),
+		BytesOut: r.bytesOut.Load(),
+		Started:  started,
+	}
+}
+
+// Close stops accepting and closes every live connection
+func (r *relay) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.markClosed()
+	for _, l := range r.listeners {
+		l.Close()
+	}
+	for conn := range r.conns {
+		conn.closeWith("shutdown")
+	}
+	return nil
+}
+
+// Shutdown stops accepting and gives live connections up to grace to finish
+// before closing them
+func (r *relay) Shutdown(grace time.Duration) {
+	r.mu.Lock()
+	r.markClosed()
+	for _, l := range r.listeners {
+		l.Close()
+	}
+	if len(r.conns) == 0 {
+		r.mu.Unlock()
+		return
+	}
+	if r.idle == nil {
+		r.idle = make(chan struct{})
+	}
+	idle := r.idle
+	r.mu.Unlock()
+
+	select {
+	case <-idle:
+	case <-time.After(grace):
+		r.Close()
+	}
+}
+
+// markClosed sets closed and wakes up whoever waits on closing, r.mu must be
+// held
+func (r *relay) markClosed() {
+	if r.closed {
+		return
+	}
+	r.closed = true
+	if r.done != nil {
+		close(r.done)
+	}
+}
+
+// closing returns a channel that is closed once the relay is
+func (r *relay) closing() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.done == nil {
+		r.done = make(chan struct{})
+		if r.closed {
+			close(r.done)
+		}
+	}
+	return r.done
+}
+
+func (r *relay) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+// addListener registers a listener, it is closed straight away when the
+// relay already is
+func (r *relay) addListener(l io.Closer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.started.IsZero() {
+		r.started = time.Now()
+	}
+	if r.closed {
+		l.Close()
+		return
+	}
+	r.listeners = append(r.listeners, l)
+}
+
+// open counts a new client connection, or refuses it when limits don't allow
+// it. The connection must be finished once it is done.
+func (r *relay) open(conn net.Conn, limits *Limits) (*relayConn, error) {
+	rc := &relayConn{
+		Conn:   conn,
+		relay:  r,
+		limits: limits,
+		done:   make(chan struct{}),
+		entry: AccessLogEntry{
+			Listener: conn.LocalAddr().String(),
+			Client:   conn.RemoteAddr().String(),
+			Start:    time.Now(),
+		},
+	}
+	rc.touch()
+
+	if !limits.permitsSource(conn.RemoteAddr()) {
+		rc.refuse("source not allowed")
+		return nil, errors.New("source not allowed")
+	}
+
+	r.mu.Lock()
+	if limits.MaxConns > 0 && len(r.conns) >= limits.MaxConns {
+		r.mu.Unlock()
+		rc.refuse("too many connections")
+		return nil, errors.New("too many connections")
+	}
+	if r.conns == nil {
+		r.conns = map[*relayConn]struct{}{}
+	}
+	r.conns[rc] = struct{}{}
+	r.mu.Unlock()
+
+	r.active.Add(1)
+	r.total.Add(1)
+
+	if limits.IdleTimeout > 0 || limits.MaxLifetime > 0 {
+		go rc.watch()
+	}
+	return rc, nil
+}
+
+// acceptFailed handles an error from Accept. It reports whether the accept
+// loop should stop, which is the case once the listener has been closed, and
+// otherwise backs off so a persistent error (like running out of file
+// descriptors) doesn't spin.
+func (r *relay) acceptFailed(c *Client, err error, delay *time.Duration) bool {
+	if errors.Is(err, net.ErrClosed) || r.isClosed() {
+		return true
+	}
+
+	*delay *= 2
+	if *delay == 0 {
+		*delay = 5 * time.Millisecond
+	}
+	if *delay > time.Second {
+		*delay = time.Second
+	}
+	c.logf("Error accepting connection: %v, retrying in %v", err, *delay)
+	time.Sleep(*delay)
+	return false
+}
+
+// Limits restrict the client connections of a forward or proxy, the zero
+// value allows everything
+type Limits struct {
+	// MaxConns is the number of concurrent connections, further clients are
+	// refused
+	MaxConns int
+	// IdleTimeout closes a connection without traffic in either direction
+	IdleTimeout time.Duration
+	// MaxLifetime closes a connection this long after it was accepted
+	MaxLifetime time.Duration
+	// Sources are the client networks allowed to connect. Loopback and unix
+	// socket clients are always allowed, an empty list allows everyone.
+	Sources []*net.IPNet
+	// AccessLog gets a JSON line for every connection once it is closed
+	AccessLog io.Writer
+	// Rate caps the bandwidth of the connections
+	Rate *RateLimit
+}
+
+func (l *Limits) permitsSource(addr net.Addr) bool {
+	if len(l.Sources) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || tcpAddr.IP.IsLoopback() {
+		return true
+	}
+	for _, n := range l.Sources {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// AccessLogEntry is a line of the access log. In is what came back from the
+// node, Out what the client sent.
+type AccessLogEntry struct {
+	Listener    string    `json:"listener"`
+	Client      string    `json:"client"`
+	Node        string    `json:"node,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	Reason      string    `json:"reason"`
+}
+
+// access log lines from all forwards go through one lock so they don't
+// interleave when they share a file
+var accessLogLock sync.Mutex
+
+func (l *Limits) log(entry AccessLogEntry) {
+	if l.AccessLog == nil {
+		return
+	}
+	accessLogLock.Lock()
+	defer accessLogLock.Unlock()
+	json.NewEncoder(l.AccessLog).Encode(entry)
+}
+
+// relayConn is a client connection of a relay. It counts its bytes, enforces
+// the idle timeout and lifetime, and writes the access log entry when it is
+// finished.
+type relayConn struct {
+	net.Conn
+	relay  *relay
+	limits *Limits
+
+	bytesIn    atomic.Int64
+	bytesOut   atomic.Int64
+	lastActive atomic.Int64
+
+	mu       sync.Mutex
+	entry    AccessLogEntry
+	reason   string
+	finished bool
+	done     chan struct{}
+}
+
+func (c *relayConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.bytesOut.Add(int64(n))
+		c.relay.bytesOut.Add(int64(n))
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *relayConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.bytesIn.Add(int64(n))
+		c.relay.bytesIn.Add(int64(n))
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *relayConn) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// target records where the connection is relayed to, for the access log
+func (c *relayConn) target(node string, destination string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entry.Node, c.entry.Destination = node, destination
+}
+
+// closeWith closes the connection, the first reason given is the one logged
+func (c *relayConn) closeWith(reason string) {
+	c.mu.Lock()
+	if c.reason == "" {
+		c.reason = reason
+	}
+	c.mu.Unlock()
+	c.Conn.Close()
+}
+
+// watch closes the connection once it has been idle or open for too long
+func (c *relayConn) watch() {
+	var lifetime <-chan time.Time
+	if c.limits.MaxLifetime > 0 {
+		timer := time.NewTimer(c.limits.MaxLifetime)
+		defer timer.Stop()
+		lifetime = timer.C
+	}
+
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if c.limits.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(c.limits.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-lifetime:
+			c.closeWith("max lifetime")
+			return
+		case <-idle:
+			since := time.Since(time.Unix(0, c.lastActive.Load()))
+			if since >= c.limits.IdleTimeout {
+				c.closeWith("idle timeout")
+				return
+			}
+			idleTimer.Reset(c.limits.IdleTimeout - since)
+		}
+	}
+}
+
+// finish closes the connection, stops counting it and writes its access log
+// entry. Only the first call does anything.
+func (c *relayConn) finish(reason string) {
+	c.closeWith(reason)
+
+	c.mu.Lock()
+	if c.finished {
+		c.mu.Unlock()
+		return
+	}
+	c.finished = true
+	close(c.done)
+	entry := c.entry
+	entry.Reason = c.reason
+	c.mu.Unlock()
+
+	r := c.relay
+	r.mu.Lock()
+	delete(r.conns, c)
+	if r.idle != nil && len(r.conns) == 0 {
+		close(r.idle)
+		r.idle = nil
+	}
+	r.mu.Unlock()
+	r.active.Add(-1)
+
+	entry.End = time.Now()
+	entry.BytesIn = c.bytesIn.Load()
+	entry.BytesOut = c.bytesOut.Load()
+	c.limits.log(entry)
+}
+
+// refuse closes a connection that was never counted and logs why
+func (c *relayConn) refuse(reason string) {
+	c.Conn.Close()
+	entry := c.entry
+	entry.End = time.Now()
+	entry.Reason = reason
+	c.limits.log(entry)
+}
@@ -0,0 +1,355 @@
+package meshcentral
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeListener counts how often it was closed
+type fakeListener struct{ closed atomic.Int32 }
+
+func (l *fakeListener) Close() error {
+	l.closed.Add(1)
+	return nil
+}
+
+// openPipe opens a relay connection and returns it with the client's end
+func openPipe(t *testing.T, r *relay, limits *Limits) (*relayConn, net.Conn) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	conn, err := r.open(server, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, client
+}
+
+// shutdownTime runs Shutdown and returns how long it took
+func shutdownTime(r *relay, grace time.Duration) time.Duration {
+	start := time.Now()
+	r.Shutdown(grace)
+	return time.Since(start)
+}
+
+func TestShutdownWithoutConnections(t *testing.T) {
+	var r relay
+	listener := &fakeListener{}
+	r.addListener(listener)
+	closing := r.closing()
+
+	if took := shutdownTime(&r, time.Hour); took > time.Second {
+		t.Errorf("Shutdown() without connections took %v", took)
+	}
+	if listener.closed.Load() != 1 {
+		t.Error("listener still open")
+	}
+	select {
+	case <-closing:
+	default:
+		t.Error("closing() not closed")
+	}
+
+	// listeners added later, like a fleet device showing up, close at once
+	late := &fakeListener{}
+	r.addListener(late)
+	if late.closed.Load() != 1 {
+		t.Error("listener added after Shutdown() still open")
+	}
+}
+
+func TestShutdownWaitsForConnections(t *testing.T) {
+	var r relay
+	var log syncBuffer
+	limits := &Limits{AccessLog: &log}
+	first, _ := openPipe(t, &r, limits)
+	second, _ := openPipe(t, &r, limits)
+
+	// the connections finish on their own well within the grace period
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		first.finish("client closed")
+		time.Sleep(20 * time.Millisecond)
+		second.finish("server closed")
+	}()
+
+	took := shutdownTime(&r, time.Hour)
+	if took < 40*time.Millisecond || took > time.Second {
+		t.Errorf("Shutdown() returned after %v, want once both connections were done", took)
+	}
+	if got := log.reasons(t); got != "client closed,server closed" {
+		t.Errorf("connections ended with %s", got)
+	}
+}
+
+func TestShutdownGraceRunsOut(t *testing.T) {
+	var r relay
+	var log syncBuffer
+	limits := &Limits{AccessLog: &log}
+	conn, client := openPipe(t, &r, limits)
+
+	// the relay finishes the connection once it is closed under it
+	go func() {
+		io.Copy(io.Discard, conn)
+		conn.finish("client closed")
+	}()
+
+	took := shutdownTime(&r, 50*time.Millisecond)
+	if took < 50*time.Millisecond || took > time.Second {
+		t.Errorf("Shutdown() returned after %v, want the 50ms grace", took)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("client read %v after the grace, want EOF", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for r.active.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	// the first reason given wins over the relay's own
+	if got := log.reasons(t); got != "shutdown" {
+		t.Errorf("connection ended with %s, want shutdown", got)
+	}
+}
+
+func TestShutdownTwice(t *testing.T) {
+	// ctrl-c while a daemon is already stopping the route
+	var r relay
+	conn, _ := openPipe(t, &r, &Limits{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Shutdown(time.Hour)
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	conn.finish("client closed")
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown() calls kept waiting after the last connection finished")
+	}
+}
+
+// syncBuffer collects an access log that is written from other goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// entries decodes the access log lines written so far
+func (b *syncBuffer) entries(t *testing.T) []AccessLogEntry {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var entries []AccessLogEntry
+	decoder := json.NewDecoder(bytes.NewReader(b.buf.Bytes()))
+	for decoder.More() {
+		var entry AccessLogEntry
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// reasons lists why the logged connections ended
+func (b *syncBuffer) reasons(t *testing.T) string {
+	t.Helper()
+	var reasons []string
+	for _, entry := range b.entries(t) {
+		reasons = append(reasons, entry.Reason)
+	}
+	return strings.Join(reasons, ",")
+}
+
+func TestPermitsSource(t *testing.T) {
+	office := &Limits{Sources: mustParseNetworks(t, "192.168.1.0/24", "fd00::/8")}
+	tcp := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 50000} }
+
+	for _, tt := range []struct {
+		limits *Limits
+		addr   net.Addr
+		want   bool
+	}{
+		{&Limits{}, tcp("203.0.113.9"), true},
+		{office, tcp("192.168.1.20"), true},
+		{office, tcp("192.168.2.20"), false},
+		{office, tcp("fd12::1"), true},
+		{office, tcp("2001:db8::1"), false},
+		{office, tcp("::ffff:192.168.1.20"), true},
+		// loopback and unix socket clients are the local user
+		{office, tcp("127.0.0.1"), true},
+		{office, tcp("127.8.0.1"), true},
+		{office, tcp("::1"), true},
+		{office, &net.UnixAddr{Name: "@", Net: "unix"}, true},
+	} {
+		if got := tt.limits.permitsSource(tt.addr); got != tt.want {
+			t.Errorf("permitsSource(%v) with %d networks = %v, want %v", tt.addr, len(tt.limits.Sources), got, tt.want)
+		}
+	}
+}
+
+// remoteConn is a pipe end claiming to come from remote
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestLimitsRefuse(t *testing.T) {
+	var r relay
+	var log syncBuffer
+	limits := &Limits{MaxConns: 1, Sources: mustParseNetworks(t, "10.0.0.0/8"), AccessLog: &log}
+
+	open := func(remote string) (*relayConn, error) {
+		client, server := net.Pipe()
+		t.Cleanup(func() { client.Close() })
+		return r.open(remoteConn{server, &net.TCPAddr{IP: net.ParseIP(remote), Port: 40000}}, limits)
+	}
+
+	if _, err := open("192.168.1.5"); err == nil || err.Error() != "source not allowed" {
+		t.Errorf("open() from another network = %v", err)
+	}
+	first, err := open("10.1.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := open("10.1.1.2"); err == nil || err.Error() != "too many connections" {
+		t.Errorf("open() beyond MaxConns = %v", err)
+	}
+	first.finish("client closed")
+	second, err := open("10.1.1.3")
+	if err != nil {
+		t.Errorf("open() after a connection finished = %v", err)
+	} else {
+		second.finish("client closed")
+	}
+
+	// refused connections are logged but never counted
+	if got := log.reasons(t); got != "source not allowed,too many connections,client closed,client closed" {
+		t.Errorf("access log reasons = %s", got)
+	}
+	if stats := r.Stats(); stats.Total != 2 || stats.Active != 0 {
+		t.Errorf("stats = %+v, want 2 connections, none active", stats)
+	}
+}
+
+func TestLimitsTimeouts(t *testing.T) {
+	// keep writing to conn every 10ms until stop is closed
+	chatter := func(client net.Conn, stop chan struct{}) {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			client.Write([]byte("x"))
+		}
+	}
+	// wait reads from conn like the relay until it is closed, then finishes
+	// it and returns how long it lasted
+	wait := func(conn *relayConn) time.Duration {
+		start := time.Now()
+		io.Copy(io.Discard, conn)
+		conn.finish("client closed")
+		return time.Since(start)
+	}
+
+	t.Run("idle", func(t *testing.T) {
+		var r relay
+		var log syncBuffer
+		conn, client := openPipe(t, &r, &Limits{IdleTimeout: 60 * time.Millisecond, AccessLog: &log})
+
+		stop := make(chan struct{})
+		go chatter(client, stop)
+		time.AfterFunc(150*time.Millisecond, func() { close(stop) })
+
+		// busy for 150ms, then idle for another 60ms
+		if lasted := wait(conn); lasted < 200*time.Millisecond {
+			t.Errorf("closed after %v, traffic should have kept it open", lasted)
+		}
+		if got := log.reasons(t); got != "idle timeout" {
+			t.Errorf("reason = %s", got)
+		}
+	})
+
+	t.Run("lifetime", func(t *testing.T) {
+		var r relay
+		var log syncBuffer
+		conn, client := openPipe(t, &r, &Limits{IdleTimeout: time.Hour, MaxLifetime: 80 * time.Millisecond, AccessLog: &log})
+
+		stop := make(chan struct{})
+		defer close(stop)
+		go chatter(client, stop)
+
+		if lasted := wait(conn); lasted < 80*time.Millisecond || lasted > time.Second {
+			t.Errorf("closed after %v, want the 80ms lifetime", lasted)
+		}
+		if got := log.reasons(t); got != "max lifetime" {
+			t.Errorf("reason = %s", got)
+		}
+	})
+}
+
+func TestAccessLogEntry(t *testing.T) {
+	var r relay
+	var log syncBuffer
+	conn, client := openPipe(t, &r, &Limits{AccessLog: &log})
+	conn.target("db01", "10.0.0.5:5432")
+
+	go func() {
+		client.Write([]byte("query"))
+		io.ReadFull(client, make([]byte, 11))
+		client.Close()
+	}()
+	io.ReadFull(conn, make([]byte, 5))
+	conn.Write([]byte("result rows"))
+	io.Copy(io.Discard, conn)
+	conn.finish("client closed")
+
+	entries := log.entries(t)
+	if len(entries) != 1 {
+		t.Fatalf("%d access log entries, want 1", len(entries))
+	}
+	e := entries[0]
+	if e.Node != "db01" || e.Destination != "10.0.0.5:5432" || e.Listener != "pipe" || e.Client != "pipe" {
+		t.Errorf("entry = %+v", e)
+	}
+	// In is what went back to the client, Out what it sent
+	if e.BytesIn != 11 || e.BytesOut != 5 || e.Reason != "client closed" {
+		t.Errorf("entry counted %d in, %d out, ended with %q", e.BytesIn, e.BytesOut, e.Reason)
+	}
+	if e.Start.IsZero() || e.End.Before(e.Start) {
+		t.Errorf("entry ran from %v to %v", e.Start, e.End)
+	}
+	if stats := r.Stats(); stats.BytesIn != 11 || stats.BytesOut != 5 {
+		t.Errorf("relay counted %d in, %d out", stats.BytesIn, stats.BytesOut)
+	}
+}
@@ -0,0 +1,348 @@
+package meshcentral
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// resolverRefresh is how old the device list may get before a name that isn't
+// in it makes the resolver ask the server again
+const resolverRefresh = 5 * time.Second
+
+// Resolver is a DNS server on Address that answers <device>.<Domain> with an
+// address of the device's own in Network. The first time a device is looked
+// up, Ports on its address are forwarded to the same ports on the device.
+// Names in subdomains (www.web01.mesh) resolve to the device too. Everything
+// outside of Domain is refused, the resolver is meant for a split DNS setup.
+// Devices are looked up and relayed through Client.
+type Resolver struct {
+	Client  *Client
+	Address string
+	Domain  string
+	Network *net.IPNet
+	Ports   []int
+	TTL     time.Duration
+	Limits  Limits
+	Retry   Retry
+
+	mu        sync.Mutex
+	conn      net.PacketConn
+	devices   []Device
+	refreshed time.Time
+	resolved  map[string]*resolvedDevice
+	next      int
+	closed    bool
+	quit      chan struct{}
+}
+
+// resolvedDevice is a device that has been looked up and its forwards
+type resolvedDevice struct {
+	device   Device
+	ip       net.IP
+	forwards []*Forward
+}
+
+// ResolvedName is a name the resolver has handed out
+type ResolvedName struct {
+	Name     string
+	Address  string
+	Device   Device
+	Forwards []*Forward
+}
+
+// Start listens for DNS queries, they are answered once the server is
+// authenticated
+func (r *Resolver) Start() error {
+	if r.Network == nil || r.Network.IP.To4() == nil {
+		return errors.New("the resolver needs an IPv4 network")
+	}
+	r.Network = &net.IPNet{IP: r.Network.IP.To4(), Mask: r.Network.Mask[len(r.Network.Mask)-net.IPv4len:]}
+	conn, err := net.ListenPacket("udp", r.Address)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %w", r.Address, err)
+	}
+
+	r.Domain = strings.ToLower(strings.Trim(r.Domain, "."))
+	r.conn = conn
+	r.resolved = map[string]*resolvedDevice{}
+	r.quit = make(chan struct{})
+
+	changes, stop := r.Client.WatchNodes()
+	go r.watch(changes, stop)
+	go r.serve()
+	return nil
+}
+
+// watch makes the next lookup of an unknown name fetch the devices again
+// after a node was added, changed or removed
+func (r *Resolver) watch(changes <-chan struct{}, stop func()) {
+	defer stop()
+	for {
+		select {
+		case <-r.quit:
+			return
+		case <-changes:
+			r.mu.Lock()
+			r.refreshed = time.Time{}
+			r.mu.Unlock()
+		}
+	}
+}
+
+func (r *Resolver) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			answer, err := r.answer(query)
+			if err != nil {
+				r.Client.debugf("Bad DNS query from %s: %v", addr, err)
+				return
+			}
+			r.conn.WriteTo(answer, addr)
+		}()
+	}
+}
+
+// answer builds the response to a query
+func (r *Resolver) answer(query []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	header.Response = true
+	header.RecursionAvailable = false
+	header.RCode = dnsmessage.RCodeSuccess
+
+	var ip net.IP
+	label, ok := r.label(question.Name.String())
+	switch {
+	case !ok:
+		header.RCode = dnsmessage.RCodeRefused
+	case question.Class != dnsmessage.ClassINET:
+		header.RCode = dnsmessage.RCodeNotImplemented
+	default:
+		header.Authoritative = true
+		resolved, err := r.resolve(label)
+		if err != nil {
+			r.Client.debugf("Unable to resolve %s: %v", question.Name, err)
+			header.RCode = dnsmessage.RCodeNameError
+		} else if question.Type == dnsmessage.TypeA {
+			ip = resolved.ip
+		}
+		// other types get an empty answer, so AAAA falls back to A
+	}
+
+	builder := dnsmessage.NewBuilder(make([]byte, 0, 512), header)
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(question); err != nil {
+		return nil, err
+	}
+	if ip != nil {
+		if err := builder.StartAnswers(); err != nil {
+			return nil, err
+		}
+		resource := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: uint32(r.TTL / time.Second)}
+		var a dnsmessage.AResource
+		copy(a.A[:], ip.To4())
+		if err := builder.AResource(resource, a); err != nil {
+			return nil, err
+		}
+	}
+	return builder.Finish()
+}
+
+// label returns the device part of a name in the domain, the label right in
+// front of it
+func (r *Resolver) label(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	rest, ok := strings.CutSuffix(name, "."+r.Domain)
+	if !ok || rest == "" {
+		return "", false
+	}
+	return rest[strings.LastIndex(rest, ".")+1:], true
+}
+
+// DeviceLabel turns a device name into a DNS label: lower case letters and
+// digits, with a dash for every run of anything else
+func DeviceLabel(name string) string {
+	var label strings.Builder
+	dash := false
+	for _, c := range strings.ToLower(name) {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' {
+			label.WriteRune(c)
+			dash = false
+		} else if !dash && label.Len() > 0 {
+			label.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(label.String(), "-")
+}
+
+// resolve returns the device with the label, starting its forwards the first
+// time it is asked for
+func (r *Resolver) resolve(label string) (*resolvedDevice, error) {
+	device, err := r.find(label)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, net.ErrClosed
+	}
+	if resolved, ok := r.resolved[device.Id]; ok {
+		return resolved, nil
+	}
+
+	ip, ok := networkAddress(r.Network, r.next)
+	if !ok {
+		return nil, errors.New("no free addresses left in " + r.Network.String())
+	}
+	r.next++
+	resolved := &resolvedDevice{device: device, ip: ip}
+	r.resolved[device.Id] = resolved
+
+	for _, port := range r.Ports {
+		fwd := &Forward{
+			NodeID:      device.Id,
+			NodeName:    device.Name,
+			BindAddress: ip.String(),
+			LocalPort:   port,
+			RemotePort:  port,
+			Limits:      r.Limits,
+			Retry:       r.Retry,
+		}
+		if err := r.Client.StartForwards([]*Forward{fwd}); err != nil {
+			r.Client.logf("Unable to forward port %d of %s: %v", port, device.Name, err)
+			continue
+		}
+		resolved.forwards = append(resolved.forwards, fwd)
+	}
+	r.Client.logf("%s.%s is %s", DeviceLabel(device.Name), r.Domain, ip)
+	return resolved, nil
+}
+
+// find looks the label up in the device list, asking the server for the
+// devices again when it isn't there and the list is old. Of several devices
+// with the same label, the ones that are online win.
+func (r *Resolver) find(label string) (Device, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		r.mu.Lock()
+		devices, refreshed := r.devices, r.refreshed
+		r.mu.Unlock()
+
+		var matches []Device
+		for _, device := range devices {
+			if DeviceLabel(device.Name) == label {
+				matches = append(matches, device)
+			}
+		}
+		if len(matches) > 0 {
+			sort.SliceStable(matches, func(i, j int) bool {
+				return r.Client.NodeOnline(matches[i].Id) && !r.Client.NodeOnline(matches[j].Id)
+			})
+			return matches[0], nil
+		}
+		if time.Since(refreshed) < resolverRefresh {
+			break
+		}
+
+		devices, err := r.Client.Devices()
+		if err != nil {
+			return Device{}, err
+		}
+		r.mu.Lock()
+		r.devices, r.refreshed = devices, time.Now()
+		r.mu.Unlock()
+	}
+	return Device{}, fmt.Errorf("%w %s", ErrDeviceNotFound, label)
+}
+
+// Names lists the names handed out so far, by address
+func (r *Resolver) Names() []ResolvedName {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var all []*resolvedDevice
+	for _, resolved := range r.resolved {
+		all = append(all, resolved)
+	}
+	sort.Slice(all, func(i, j int) bool { return bytes.Compare(all[i].ip, all[j].ip) < 0 })
+
+	var names []ResolvedName
+	for _, resolved := range all {
+		names = append(names, ResolvedName{
+			Name:     DeviceLabel(resolved.device.Name) + "." + r.Domain,
+			Address:  resolved.ip.String(),
+			Device:   resolved.device,
+			Forwards: resolved.forwards,
+		})
+	}
+	return names
+}
+
+// stop stops answering and returns the forwards that were started
+func (r *Resolver) stop() []*Forward {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.closed {
+		r.closed = true
+		close(r.quit)
+		r.conn.Close()
+	}
+	var forwards []*Forward
+	for _, resolved := range r.resolved {
+		forwards = append(forwards, resolved.forwards...)
+	}
+	return forwards
+}
+
+// Close stops the DNS server and closes every forward
+func (r *Resolver) Close() error {
+	for _, fwd := range r.stop() {
+		fwd.Close()
+	}
+	return nil
+}
+
+// Shutdown stops the DNS server and waits up to grace for the open
+// connections of the forwards to finish
+func (r *Resolver) Shutdown(grace time.Duration) {
+	var wg sync.WaitGroup
+	for _, fwd := range r.stop() {
+		wg.Add(1)
+		go func(fwd *Forward) {
+			defer wg.Done()
+			fwd.Shutdown(grace)
+		}(fwd)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,140 @@
+package meshcentral
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestResolverLabel(t *testing.T) {
+	r := &Resolver{Domain: "mesh"}
+
+	tests := []struct {
+		name   string
+		want   string
+		wantOK bool
+	}{
+		{"web01.mesh.", "web01", true},
+		{"web01.mesh", "web01", true},
+		{"WEB01.Mesh.", "web01", true},
+		{"www.web01.mesh.", "web01", true},
+		{"a.b.web01.mesh.", "web01", true},
+		{"mesh.", "", false},
+		{".mesh.", "", false},
+		{"web01.example.com.", "", false},
+		{"web01.notmesh.", "", false},
+		{"web01.mesh.example.com.", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := r.label(tt.name)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("label(%q) = %q, %v, want %q, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestResolverAnswer(t *testing.T) {
+	web01 := Device{Id: "node//web01", Name: "Web01"}
+	r := &Resolver{
+		Client:    &Client{nodeConn: map[string]int{}},
+		Domain:    "mesh",
+		TTL:       30 * time.Second,
+		devices:   []Device{web01},
+		refreshed: time.Now(),
+		// already looked up, so no forwards are started
+		resolved: map[string]*resolvedDevice{web01.Id: {device: web01, ip: net.IPv4(127, 77, 0, 1)}},
+	}
+
+	tests := []struct {
+		name     string
+		question string
+		qtype    dnsmessage.Type
+		class    dnsmessage.Class
+		rcode    dnsmessage.RCode
+		answer   string
+	}{
+		{"device", "web01.mesh.", dnsmessage.TypeA, dnsmessage.ClassINET, dnsmessage.RCodeSuccess, "127.77.0.1"},
+		{"upper case", "WEB01.MESH.", dnsmessage.TypeA, dnsmessage.ClassINET, dnsmessage.RCodeSuccess, "127.77.0.1"},
+		{"subdomain", "www.web01.mesh.", dnsmessage.TypeA, dnsmessage.ClassINET, dnsmessage.RCodeSuccess, "127.77.0.1"},
+		{"aaaa is empty", "web01.mesh.", dnsmessage.TypeAAAA, dnsmessage.ClassINET, dnsmessage.RCodeSuccess, ""},
+		{"unknown device", "db01.mesh.", dnsmessage.TypeA, dnsmessage.ClassINET, dnsmessage.RCodeNameError, ""},
+		{"outside the domain", "example.com.", dnsmessage.TypeA, dnsmessage.ClassINET, dnsmessage.RCodeRefused, ""},
+		{"the domain itself", "mesh.", dnsmessage.TypeA, dnsmessage.ClassINET, dnsmessage.RCodeRefused, ""},
+		{"other class", "web01.mesh.", dnsmessage.TypeA, dnsmessage.ClassCHAOS, dnsmessage.RCodeNotImplemented, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42, RecursionDesired: true})
+			builder.StartQuestions()
+			builder.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(tt.question), Type: tt.qtype, Class: tt.class})
+			query, err := builder.Finish()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response, err := r.answer(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(response); err != nil {
+				t.Fatal(err)
+			}
+
+			if msg.ID != 42 || !msg.Response {
+				t.Errorf("header = %+v, want a response to query 42", msg.Header)
+			}
+			if msg.RCode != tt.rcode {
+				t.Errorf("rcode = %v, want %v", msg.RCode, tt.rcode)
+			}
+			if len(msg.Questions) != 1 || msg.Questions[0].Name.String() != tt.question {
+				t.Errorf("questions = %v, want %s", msg.Questions, tt.question)
+			}
+
+			var answer string
+			if len(msg.Answers) > 0 {
+				a, ok := msg.Answers[0].Body.(*dnsmessage.AResource)
+				if !ok {
+					t.Fatalf("answer is %T, want an A record", msg.Answers[0].Body)
+				}
+				answer = net.IP(a.A[:]).String()
+				if msg.Answers[0].Header.TTL != 30 {
+					t.Errorf("ttl = %d, want 30", msg.Answers[0].Header.TTL)
+				}
+			}
+			if len(msg.Answers) > 1 || answer != tt.answer {
+				t.Errorf("answers = %v, want %q", msg.Answers, tt.answer)
+			}
+		})
+	}
+
+	t.Run("garbage", func(t *testing.T) {
+		if _, err := r.answer([]byte{1, 2, 3}); err == nil {
+			t.Error("answer of a truncated query succeeded")
+		}
+	})
+}
+
+func TestDeviceLabel(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"web01", "web01"},
+		{"Web 01", "web-01"},
+		{"Bob's  Laptop!", "bob-s-laptop"},
+		{"--edge--01--", "edge-01"},
+		{"Ünïcode box", "n-code-box"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := DeviceLabel(tt.name); got != tt.want {
+			t.Errorf("DeviceLabel(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package meshcentral
+
+import (
+	"compress/flate"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Forward relays connections accepted on BindAddress:LocalPort to RemotePort
+// on the node, or to RemoteTarget:RemotePort as seen from the node. An empty
+// BindAddress listens on all interfaces. When SocketPath is set the forward
+// listens on that unix socket instead of a TCP port. Limits apply to the TCP
+// connections of the forward. When the node is offline, new connections go
+// to the first Failover node that is online. Forwards are started with
+// Client.StartForwards.
+type Forward struct {
+	NodeID       string
+	NodeName     string
+	SocketPath   string
+	BindAddress  string
+	LocalPort    int
+	RemoteTarget string
+	RemotePort   int
+	Limits       Limits
+	Failover     []Device
+	Retry        Retry
+
+	client *Client
+	relay
+}
+
+// Retry is how often a relay that can't be opened is tried again before the
+// client connection is given up. The wait doubles after every round, up to
+// MaxBackoff.
+type Retry struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// StartForwards binds every forward and starts relaying them through the
+// client. Nothing is relayed if any of the ports can't be bound.
+func (c *Client) StartForwards(forwards []*Forward) error {
+	var listeners []net.Listener
+	for _, fwd := range forwards {
+		listener, err := fwd.listen()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("unable to bind to %s: %w", fwd.localName(), err)
+		}
+		listeners = append(listeners, listener)
+	}
+	for i, fwd := range forwards {
+		fwd.client = c
+		fwd.addListener(listeners[i])
+		go fwd.accept(listeners[i])
+	}
+	return nil
+}
+
+// listen binds the local port, a zero port is replaced by the one assigned
+func (fwd *Forward) listen() (net.Listener, error) {
+	if fwd.SocketPath != "" {
+		return fwd.listenUnix()
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(fwd.BindAddress, strconv.Itoa(fwd.LocalPort)))
+	if err != nil {
+		return nil, err
+	}
+	fwd.LocalPort = listener.Addr().(*net.TCPAddr).Port
+	return listener, nil
+}
+
+// listenUnix binds the unix socket, replacing a stale socket file left behind
+// by a previous run but never one that is still in use. Only the current user
+// may connect.
+func (fwd *Forward) listenUnix() (net.Listener, error) {
+	if info, err := os.Lstat(fwd.SocketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", fwd.SocketPath)
+		}
+		if conn, err := net.DialTimeout("unix", fwd.SocketPath, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", fwd.SocketPath)
+		}
+		if err := os.Remove(fwd.SocketPath); err != nil {
+			return nil, err
+		}
+	}
+
+	// keep the socket private from the moment it is created
+	mask := umask(0o177)
+	listener, err := net.Listen("unix", fwd.SocketPath)
+	umask(mask)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(fwd.SocketPath, 0o600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (fwd *Forward) localName() string {
+	if fwd.SocketPath != "" {
+		return fwd.SocketPath
+	}
+	return "local TCP port " + net.JoinHostPort(fwd.BindAddress, strconv.Itoa(fwd.LocalPort))
+}
+
+// destination is where the forward connects to as seen from the node
+func (fwd *Forward) destination() string {
+	target := fwd.RemoteTarget
+	if target == "" {
+		target = "127.0.0.1"
+	}
+	return net.JoinHostPort(target, strconv.Itoa(fwd.RemotePort))
+}
+
+func (fwd *Forward) accept(listener net.Listener) {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if fwd.acceptFailed(fwd.client, err, &delay) {
+				return
+			}
+			continue
+		}
+		delay = 0
+
+		go fwd.onTcpClientConnected(conn)
+	}
+}
+
+func (fwd *Forward) onTcpClientConnected(conn net.Conn) {
+	fwd.client.debugf("Client connected")
+	tracked, err := fwd.open(conn, &fwd.Limits)
+	if err != nil {
+		fwd.client.debugf("Refused %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	tracked.target(fwd.NodeName, fwd.destination())
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(30 * time.Second)
+	}
+
+	wsConn, node, err := fwd.dial()
+	if err != nil {
+		fwd.client.logf("Unable to connect to server: %v", err)
+		tracked.finish("relay failed: " + err.Error())
+		return
+	}
+	if node.Id != fwd.NodeID {
+		tracked.target(node.Name, fwd.destination())
+	}
+
+	fwd.client.onWebSocket(wsConn, tracked, tracked)
+}
+
+// failoverNodes returns the node and its failover nodes, the ones that are
+// online first
+func (c *Client) failoverNodes(nodeID string, nodeName string, failover []Device) []Device {
+	all := append([]Device{{Id: nodeID, Name: nodeName}}, failover...)
+
+	var online, offline []Device
+	for _, node := range all {
+		if c.NodeOnline(node.Id) {
+			online = append(online, node)
+		} else {
+			offline = append(offline, node)
+		}
+	}
+	return append(online, offline...)
+}
+
+// dial opens a relay through the node or one of its failover nodes
+func (fwd *Forward) dial() (*websocket.Conn, Device, error) {
+	return fwd.dialProtocol("tcp")
+}
+
+// dialProtocol opens a "tcp" or "udp" relay for the forward, with its retries
+// and failover nodes
+func (fwd *Forward) dialProtocol(protocol string) (*websocket.Conn, Device, error) {
+	nodes := func() []Device { return fwd.client.failoverNodes(fwd.NodeID, fwd.NodeName, fwd.Failover) }
+	return fwd.client.retryDial(fwd.Retry, nodes, protocol, fwd.RemoteTarget, fwd.RemotePort, fwd.closing())
+}
+
+// retryDial opens a protocol relay to target:port through the first of nodes
+// that takes it, going through them again after a backoff until the retries are
+// used up or closed is closed. nodes is called every round, as nodes come
+// online and go offline.
+func (c *Client) retryDial(retry Retry, nodes func() []Device, protocol string, target string, port int, closed <-chan struct{}) (*websocket.Conn, Device, error) {
+	delay := retry.Backoff
+	if delay <= 0 {
+		delay = 500 * time.Millisecond
+	}
+	maxDelay := retry.MaxBackoff
+	if maxDelay <= 0 {
+		maxDelay = 10 * time.Second
+	}
+
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		for _, node := range nodes() {
+			wsConn, err := c.dialProtocolRelay(context.Background(), node.Id, protocol, target, port)
+			if err == nil {
+				return wsConn, node, nil
+			}
+			c.debugf("Relay through %s failed: %v", node.Name, err)
+			lastErr = err
+		}
+		if attempt >= retry.Attempts {
+			return nil, Device{}, lastErr
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-closed:
+			return nil, Device{}, lastErr
+		}
+		delay = min(delay*2, maxDelay)
+	}
+}
+
+// dialProtocolRelay opens a "tcp" or "udp" relay websocket to port on the
+// node, or to target:port as seen from the node when target is set. The
+// server picks the relay type from the tcpport/udpport parameter. It gives up
+// when ctx is done.
+func (c *Client) dialProtocolRelay(ctx context.Context, nodeID string, protocol string, target string, port int) (*websocket.Conn, error) {
+	options, err := url.Parse(c.serverURL)
+	if err != nil {
+		return nil, err
+	}
+
+	aCookie, _ := c.cookies()
+	query := url.Values{}
+	query.Add("auth", aCookie)
+	query.Add("nodeid", nodeID)
+	query.Add(protocol+"port", fmt.Sprintf("%d", port))
+	if target != "" {
+		query.Add(protocol+"addr", target)
+	}
+	options.RawQuery = query.Encode()
+
+	headers := http.Header{}
+	dialer := websocket.Dialer{
+		TLSClientConfig:   c.opts.TLSConfig,
+		ReadBufferSize:    relayFrameSize,
+		WriteBufferSize:   relayFrameSize,
+		WriteBufferPool:   relayWriteBuffers,
+		EnableCompression: c.opts.Compress,
+	}
+
+	wsConn, _, err := dialer.DialContext(ctx, options.String(), headers)
+	if err != nil {
+		return nil, err
+	}
+	if c.opts.Compress {
+		// only has an effect when the server agreed to permessage-deflate
+		wsConn.EnableWriteCompression(true)
+		wsConn.SetCompressionLevel(flate.BestSpeed)
+	}
+	return wsConn, nil
+}
+
+// onWebSocket pumps data between the relay and the client until either side
+// closes, then finishes conn with the reason. tcpConn reads and writes
+// through conn.
+func (c *Client) onWebSocket(wsConn *websocket.Conn, tcpConn net.Conn, conn *relayConn) {
+	c.debugf("Websocket connected")
+	defer wsConn.Close()
+
+	reason := pump(wsConn, tcpConn, conn.limits.Rate)
+	c.debugf("Relay for %s closed: %s", conn.RemoteAddr(), reason)
+	conn.finish(reason)
+}
@@ -0,0 +1,249 @@
+package meshcentral
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestUnixSocketForward(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets")
+	}
+	client := startFakeServer(t, relayTarget)
+	dir := t.TempDir()
+
+	start := func(path string) (*Forward, error) {
+		fwd := &Forward{NodeID: "node//db01", NodeName: "db01", SocketPath: path, RemoteTarget: "10.0.0.5", RemotePort: 5432}
+		if err := client.StartForwards([]*Forward{fwd}); err != nil {
+			return nil, err
+		}
+		return fwd, nil
+	}
+
+	t.Run("relays", func(t *testing.T) {
+		path := filepath.Join(dir, "db.sock")
+		fwd, err := start(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fwd.Close()
+
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+			t.Errorf("socket mode = %v, %v, want 0600", info.Mode().Perm(), err)
+		}
+
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if greeting, _ := bufio.NewReader(conn).ReadString('\n'); greeting != "10.0.0.5:5432 via node//db01\n" {
+			t.Errorf("relay opened for %q", greeting)
+		}
+	})
+
+	t.Run("stale socket", func(t *testing.T) {
+		path := filepath.Join(dir, "stale.sock")
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// left behind like by a killed process
+		listener.(*net.UnixListener).SetUnlinkOnClose(false)
+		listener.Close()
+
+		fwd, err := start(path)
+		if err != nil {
+			t.Fatalf("a stale socket wasn't replaced: %v", err)
+		}
+		fwd.Close()
+	})
+
+	t.Run("in use", func(t *testing.T) {
+		path := filepath.Join(dir, "busy.sock")
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+
+		if _, err := start(path); err == nil || !strings.Contains(err.Error(), "is in use") {
+			t.Errorf("StartForwards() on a socket in use = %v", err)
+		}
+	})
+
+	t.Run("not a socket", func(t *testing.T) {
+		path := filepath.Join(dir, "notes.txt")
+		os.WriteFile(path, []byte("keep me"), 0o644)
+
+		if _, err := start(path); err == nil || !strings.Contains(err.Error(), "exists and is not a socket") {
+			t.Errorf("StartForwards() on a file = %v", err)
+		}
+		if data, _ := os.ReadFile(path); string(data) != "keep me" {
+			t.Error("the file was replaced")
+		}
+	})
+}
+
+func TestFailoverNodes(t *testing.T) {
+	c := &Client{nodeConn: map[string]int{}}
+	failover := []Device{{Id: "node//gw2", Name: "gw2"}, {Id: "node//gw3", Name: "gw3"}}
+
+	for _, tt := range []struct {
+		offline []string
+		want    string
+	}{
+		{nil, "gw1 gw2 gw3"},
+		{[]string{"node//gw1"}, "gw2 gw3 gw1"},
+		{[]string{"node//gw1", "node//gw2"}, "gw3 gw1 gw2"},
+		// with every node offline they are still all tried, in order
+		{[]string{"node//gw1", "node//gw2", "node//gw3"}, "gw1 gw2 gw3"},
+		{[]string{"node//gw2"}, "gw1 gw3 gw2"},
+	} {
+		for _, id := range []string{"node//gw1", "node//gw2", "node//gw3"} {
+			c.setNodeConn(id, connAgent)
+		}
+		for _, id := range tt.offline {
+			c.setNodeConn(id, 0)
+		}
+
+		var names []string
+		for _, node := range c.failoverNodes("node//gw1", "gw1", failover) {
+			names = append(names, node.Name)
+		}
+		if got := strings.Join(names, " "); got != tt.want {
+			t.Errorf("offline %v: tried %s, want %s", tt.offline, got, tt.want)
+		}
+	}
+}
+
+// flakyRelay refuses relays through the nodes in down, and the first fail
+// relays through any other node. It notes when each relay was asked for.
+type flakyRelay struct {
+	mu    sync.Mutex
+	fail  int
+	down  map[string]bool
+	times []time.Time
+	nodes []string
+}
+
+func (f *flakyRelay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	node := r.URL.Query().Get("nodeid")
+	f.mu.Lock()
+	f.times = append(f.times, time.Now())
+	f.nodes = append(f.nodes, node)
+	refuse := f.down[node] || f.fail > 0
+	if !f.down[node] {
+		f.fail--
+	}
+	f.mu.Unlock()
+
+	if refuse {
+		http.Error(w, "agent not connected", http.StatusServiceUnavailable)
+		return
+	}
+	upgrader := websocket.Upgrader{}
+	if conn, err := upgrader.Upgrade(w, r, nil); err == nil {
+		conn.Close()
+	}
+}
+
+// gaps returns the waits between the requests that started a round, a round
+// being one request per node
+func (f *flakyRelay) gaps(perRound int) []time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var gaps []time.Duration
+	for i := perRound; i < len(f.times); i += perRound {
+		gaps = append(gaps, f.times[i].Sub(f.times[i-1]))
+	}
+	return gaps
+}
+
+func TestRetryDial(t *testing.T) {
+	dial := func(relay *flakyRelay, retry Retry, nodes []Device, closed <-chan struct{}) (Device, error) {
+		server := httptest.NewServer(relay)
+		defer server.Close()
+		c := &Client{serverURL: "ws://" + strings.TrimPrefix(server.URL, "http://") + "/meshrelay.ashx"}
+
+		conn, node, err := c.retryDial(retry, func() []Device { return nodes }, "tcp", "", 22, closed)
+		if err == nil {
+			conn.Close()
+		}
+		return node, err
+	}
+	gw1 := []Device{{Id: "node//gw1", Name: "gw1"}}
+	backoff := 20 * time.Millisecond
+
+	t.Run("succeeds after retries", func(t *testing.T) {
+		relay := &flakyRelay{fail: 2}
+		node, err := dial(relay, Retry{Attempts: 2, Backoff: backoff}, gw1, nil)
+		if err != nil || node.Name != "gw1" {
+			t.Fatalf("retryDial() = %v, %v", node, err)
+		}
+		// the backoff doubles after each round
+		gaps := relay.gaps(1)
+		if len(gaps) != 2 || gaps[0] < backoff || gaps[1] < 2*backoff {
+			t.Errorf("waited %v between attempts, want %v then %v", gaps, backoff, 2*backoff)
+		}
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		relay := &flakyRelay{fail: 10}
+		if _, err := dial(relay, Retry{Attempts: 1, Backoff: backoff}, gw1, nil); err == nil {
+			t.Fatal("retryDial() succeeded")
+		}
+		if n := len(relay.nodes); n != 2 {
+			t.Errorf("%d attempts, want the first and one retry", n)
+		}
+	})
+
+	t.Run("no retries", func(t *testing.T) {
+		relay := &flakyRelay{fail: 1}
+		if _, err := dial(relay, Retry{}, gw1, nil); err == nil || len(relay.nodes) != 1 {
+			t.Errorf("retryDial() without retries = %v after %d attempts", err, len(relay.nodes))
+		}
+	})
+
+	t.Run("next node in the same round", func(t *testing.T) {
+		relay := &flakyRelay{down: map[string]bool{"node//gw1": true}}
+		nodes := append(gw1, Device{Id: "node//gw2", Name: "gw2"})
+		node, err := dial(relay, Retry{Attempts: 3, Backoff: time.Hour}, nodes, nil)
+		if err != nil || node.Name != "gw2" {
+			t.Errorf("retryDial() = %v, %v, want gw2 without waiting", node, err)
+		}
+	})
+
+	t.Run("backoff is capped", func(t *testing.T) {
+		relay := &flakyRelay{fail: 10}
+		dial(relay, Retry{Attempts: 3, Backoff: backoff, MaxBackoff: 30 * time.Millisecond}, gw1, nil)
+		gaps := relay.gaps(1)
+		if len(gaps) != 3 || gaps[1] < 30*time.Millisecond || gaps[2] > 200*time.Millisecond {
+			t.Errorf("waited %v between attempts, want 20ms, 30ms, 30ms", gaps)
+		}
+	})
+
+	t.Run("closed while waiting", func(t *testing.T) {
+		relay := &flakyRelay{fail: 10}
+		closed := make(chan struct{})
+		time.AfterFunc(50*time.Millisecond, func() { close(closed) })
+
+		start := time.Now()
+		_, err := dial(relay, Retry{Attempts: 5, Backoff: time.Hour}, gw1, closed)
+		if err == nil || time.Since(start) > 2*time.Second {
+			t.Errorf("retryDial() = %v after %v, want the last error once closed", err, time.Since(start))
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package meshcentral
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Selector picks devices by their properties, e.g. "group=edge,os=*linux*".
+// Every term must match. Values are shell patterns compared without case, !=
+// excludes the devices that match. An empty selector matches every device.
+type Selector []selectorTerm
+
+type selectorTerm struct {
+	key    string
+	value  string
+	negate bool
+}
+
+// selectorKeys are the device properties a selector can use
+var selectorKeys = map[string]func(Device) []string{
+	"id":    func(d Device) []string { return []string{d.Id} },
+	"name":  func(d Device) []string { return []string{d.Name} },
+	"group": func(d Device) []string { return []string{d.Group} },
+	"os":    func(d Device) []string { return []string{d.OS} },
+	"ip":    func(d Device) []string { return []string{d.IP} },
+	"tag":   func(d Device) []string { return d.Tags },
+}
+
+// ParseSelector reads comma separated key=value and key!=value terms, the
+// keys are id, name, group, os, ip and tag
+func ParseSelector(s string) (Selector, error) {
+	var selector Selector
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(term, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid selector term %q: expected key=value", term)
+		}
+		negate := strings.HasSuffix(key, "!")
+		key = strings.ToLower(strings.TrimSpace(strings.TrimSuffix(key, "!")))
+		if _, ok := selectorKeys[key]; !ok {
+			return nil, fmt.Errorf("invalid selector term %q: unknown key %s", term, key)
+		}
+		value = strings.ToLower(strings.TrimSpace(value))
+		if _, err := path.Match(value, ""); err != nil {
+			return nil, fmt.Errorf("invalid selector term %q: %w", term, err)
+		}
+		selector = append(selector, selectorTerm{key, value, negate})
+	}
+	return selector, nil
+}
+
+// Matches reports whether the device has every property of the selector
+func (s Selector) Matches(device Device) bool {
+	for _, term := range s {
+		if term.matches(device) == term.negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (t selectorTerm) matches(device Device) bool {
+	for _, v := range selectorKeys[t.key](device) {
+		if ok, _ := path.Match(t.value, strings.ToLower(v)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Selector) String() string {
+	var terms []string
+	for _, t := range s {
+		op := "="
+		if t.negate {
+			op = "!="
+		}
+		terms = append(terms, t.key+op+t.value)
+	}
+	return strings.Join(terms, ",")
+}
@@ -0,0 +1,93 @@
+package meshcentral
+
+import "testing"
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     string
+		wantErr  bool
+	}{
+		{"", "", false},
+		{"group=edge", "group=edge", false},
+		{" Group = Edge , os=*Linux* ", "group=edge,os=*linux*", false},
+		{"tag!=retired", "tag!=retired", false},
+		{"name=web*,,", "name=web*", false},
+		{"edge", "", true},
+		{"owner=bob", "", true},
+		{"name=[web", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			got, err := ParseSelector(tt.selector)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSelector(%q) error = %v, want error %v", tt.selector, err, tt.wantErr)
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("ParseSelector(%q) = %q, want %q", tt.selector, got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	device := Device{
+		Id:    "node//abc123",
+		Name:  "Web01",
+		OS:    "Ubuntu Linux 22.04",
+		IP:    "10.0.0.5",
+		Group: "edge",
+		Tags:  []string{"prod", "eu-west"},
+	}
+
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{"", true},
+		{"name=web01", true},
+		{"name=web02", false},
+		{"name=web*", true},
+		{"name=web?1", true},
+		{"os=*linux*", true},
+		{"os=linux", false},
+		{"ip=10.0.0.*", true},
+		{"id=node//abc123", true},
+		{"group!=edge", false},
+		{"group!=core", true},
+		{"tag=prod", true},
+		{"tag=eu-*", true},
+		{"tag=staging", false},
+		{"tag!=prod", false},
+		{"tag!=staging", true},
+		{"group=edge,tag=prod", true},
+		{"group=edge,tag=staging", false},
+		{"group=edge,name!=web*", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			selector, err := ParseSelector(tt.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := selector.Matches(device); got != tt.want {
+				t.Errorf("%q matches = %v, want %v", tt.selector, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("no tags", func(t *testing.T) {
+		untagged := Device{Name: "db01"}
+		for selector, want := range map[string]bool{"tag=*": false, "tag!=prod": true} {
+			s, err := ParseSelector(selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Matches(untagged); got != want {
+				t.Errorf("%q matches untagged = %v, want %v", selector, got, want)
+			}
+		}
+	})
+}
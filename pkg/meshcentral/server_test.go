@@ -0,0 +1,49 @@
+package meshcentral
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// startFakeServer stands in for a MeshCentral server and returns a client
+// logged in to it. Messages on the control connection are dropped, every
+// tunnel or relay goes to agent, which plays the node.
+func startFakeServer(t *testing.T, agent func(conn *websocket.Conn, r *http.Request)) *Client {
+	t.Helper()
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if r.URL.Path == "/control.ashx" {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}
+		agent(conn, r)
+	}))
+	t.Cleanup(server.Close)
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	control, _, err := websocket.DefaultDialer.Dial("ws://"+host+"/control.ashx", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { control.Close() })
+
+	return &Client{
+		serverURL: "ws://" + host + "/meshrelay.ashx",
+		conn:      control,
+		done:      make(chan struct{}),
+		nodeConn:  map[string]int{},
+	}
+}
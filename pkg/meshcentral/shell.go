@@ -0,0 +1,209 @@
+package meshcentral
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func randomHex() (string, error) {
+	bytes := make([]byte, 5) // n bytes = 2n hex characters
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// openTunnel asks the agent to open a relay session of type p (1 terminal,
+// 5 files) and connects to the browser side of it
+func (c *Client) openTunnel(nodeID string, p int) (*websocket.Conn, error) {
+	id, err := randomHex()
+	if err != nil {
+		return nil, err
+	}
+
+	aCookie, rCookie := c.cookies()
+	c.sendControl([]byte(fmt.Sprintf(
+		`{"action":"msg","nodeid":"%s","type":"tunnel","usage":1,"value":"*/meshrelay.ashx?p=%d&nodeid=%s&id=%s&rauth=%s","responseid":"meshctrl"}`,
+		nodeID, p, nodeID, id, rCookie)))
+
+	// build url
+	wsUrl, err := url.Parse(fmt.Sprintf("%s?browser=1&p=%d&nodeid=%s&id=%s&auth=%s",
+		c.serverURL, p, nodeID, id, aCookie))
+	if err != nil {
+		return nil, err
+	}
+
+	// set up headers
+	headers := http.Header{}
+
+	// set up websocket dialer
+	dialer := websocket.Dialer{TLSClientConfig: c.opts.TLSConfig}
+
+	// connect to websocket
+	wsConn, _, err := dialer.Dial(wsUrl.String(), headers)
+	if err != nil {
+		return nil, err
+	}
+
+	return wsConn, nil
+}
+
+// ShellOptions are the terminal of Client.OpenShell. PowerShell starts
+// powershell instead of the default shell (windows agents only). Cols and
+// Rows default to 80x24.
+type ShellOptions struct {
+	PowerShell bool
+	Cols       int
+	Rows       int
+}
+
+// ShellSession is an interactive terminal on a node. Read returns what the
+// terminal prints, Write types into it.
+type ShellSession struct {
+	client   *Client
+	conn     *websocket.Conn
+	protocol int
+
+	wmu    sync.Mutex
+	rmu    sync.Mutex
+	reader io.Reader
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// OpenShell opens a terminal on the node and waits for the agent to accept it
+func (c *Client) OpenShell(nodeID string, opts ShellOptions) (*ShellSession, error) {
+	protocol := 1
+	if opts.PowerShell {
+		protocol = 6
+	}
+	cols, rows := opts.Cols, opts.Rows
+	if cols <= 0 || rows <= 0 {
+		cols, rows = 80, 24
+	}
+
+	wsConn, err := c.openTunnel(nodeID, 1)
+	if err != nil {
+		return nil, err
+	}
+	s := &ShellSession{client: c, conn: wsConn, protocol: protocol, stop: make(chan struct{})}
+
+	// the relay signals that the agent joined with a single 'c'
+	wsConn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	for {
+		msgType, msg, err := wsConn.ReadMessage()
+		if err != nil {
+			wsConn.Close()
+			return nil, fmt.Errorf("agent did not accept the terminal: %w", err)
+		}
+		if msgType != websocket.BinaryMessage && string(msg) == "c" {
+			break
+		}
+	}
+	wsConn.SetReadDeadline(time.Time{})
+	c.debugf("Received 'c' message")
+
+	if err := s.Resize(cols, rows); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := s.write(websocket.TextMessage, []byte(strconv.Itoa(protocol))); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	go s.keepAlive()
+	return s, nil
+}
+
+func (s *ShellSession) write(messageType int, data []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return s.conn.WriteMessage(messageType, data)
+}
+
+// keepAlive sends the rtt messages the web UI sends, every 5 seconds
+func (s *ShellSession) keepAlive() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		epoch := time.Now().UnixNano() / int64(time.Millisecond)
+		if err := s.write(websocket.TextMessage, []byte(fmt.Sprintf(`{"ctrlChannel":102938,"type":"rtt","time":%d}`, epoch))); err != nil {
+			return
+		}
+	}
+}
+
+// Read returns terminal output, io.EOF once the terminal is closed
+func (s *ShellSession) Read(p []byte) (int, error) {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+
+	for {
+		if s.reader != nil {
+			n, err := s.reader.Read(p)
+			if err == io.EOF {
+				s.reader = nil
+				if n == 0 {
+					continue
+				}
+				err = nil
+			}
+			return n, err
+		}
+
+		msgType, reader, err := s.conn.NextReader()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) || errors.Is(err, net.ErrClosed) {
+				s.client.debugf("Server closed connection")
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		// text messages are rtt answers and the like
+		if msgType == websocket.BinaryMessage {
+			s.reader = reader
+		}
+	}
+}
+
+// Write sends p to the terminal as typed input
+func (s *ShellSession) Write(p []byte) (int, error) {
+	if err := s.write(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Resize tells the agent the size of the terminal
+func (s *ShellSession) Resize(cols int, rows int) error {
+	return s.write(websocket.TextMessage, []byte(fmt.Sprintf(`{"protocol":%d,"cols":%d,"rows":%d,"xterm":true,"type":"options"}`, s.protocol, cols, rows)))
+}
+
+// Close ends the terminal
+func (s *ShellSession) Close() error {
+	err := net.ErrClosed
+	s.once.Do(func() {
+		close(s.stop)
+		s.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, `{"ctrlChannel":"102938","type":"close"}`))
+		err = s.conn.Close()
+	})
+	return err
+}
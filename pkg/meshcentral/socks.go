@@ -0,0 +1,267 @@
+package meshcentral
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants (RFC 1928, RFC 1929)
+const (
+	socksVersion = 0x05
+
+	socksMethodNone     = 0x00
+	socksMethodPassword = 0x02
+	socksMethodNoAccept = 0xFF
+
+	socksCmdConnect = 0x01
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksReplySucceeded       = 0x00
+	socksReplyFailure         = 0x01
+	socksReplyNotAllowed      = 0x02
+	socksReplyHostUnreachable = 0x04
+	socksReplyCmdNotSupported = 0x07
+	socksReplyAtypUnsupported = 0x08
+)
+
+// SocksProxy is a local SOCKS5 server that opens a relay through the node for
+// every CONNECT request, so anything the node can reach is reachable locally.
+// The relays are opened with Client, through the Failover nodes while the
+// node is offline and with Retry when they can't be opened.
+type SocksProxy struct {
+	Client   *Client
+	NodeID   string
+	NodeName string
+	Failover []Device
+	Retry    Retry
+	Address  string
+	Username string
+	Password string
+	Policy   *NetworkPolicy
+	Limits   Limits
+
+	relay
+}
+
+// Start binds the SOCKS listener and serves it in the background
+func (s *SocksProxy) Start() error {
+	listener, err := net.Listen("tcp", s.Address)
+	if err != nil {
+		return fmt.Errorf("unable to bind SOCKS proxy to %s: %w", s.Address, err)
+	}
+	s.Address = listener.Addr().String()
+	s.addListener(listener)
+
+	go func() {
+		var delay time.Duration
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if s.acceptFailed(s.Client, err, &delay) {
+					return
+				}
+				continue
+			}
+			delay = 0
+			go s.serve(conn)
+		}
+	}()
+	return nil
+}
+
+func (s *SocksProxy) serve(raw net.Conn) {
+	conn, err := s.open(raw, &s.Limits)
+	if err != nil {
+		s.Client.debugf("Refused %s: %v", raw.RemoteAddr(), err)
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	host, port, err := s.handshake(reader, conn)
+	if err != nil {
+		s.Client.debugf("SOCKS handshake failed: %v", err)
+		conn.finish("handshake failed: " + err.Error())
+		return
+	}
+
+	conn.target(s.NodeName, net.JoinHostPort(host, strconv.Itoa(port)))
+
+	if !s.Policy.Permits(host) {
+		s.Client.debugf("SOCKS refused %s", net.JoinHostPort(host, strconv.Itoa(port)))
+		socksReply(conn, socksReplyNotAllowed)
+		conn.finish("destination not allowed")
+		return
+	}
+
+	s.Client.debugf("SOCKS connect to %s via %s", net.JoinHostPort(host, strconv.Itoa(port)), s.NodeName)
+
+	nodes := func() []Device { return s.Client.failoverNodes(s.NodeID, s.NodeName, s.Failover) }
+	wsConn, node, err := s.Client.retryDial(s.Retry, nodes, "tcp", host, port, s.closing())
+	if err != nil {
+		s.Client.logf("Unable to connect to server: %v", err)
+		socksReply(conn, socksReplyHostUnreachable)
+		conn.finish("relay failed: " + err.Error())
+		return
+	}
+	if node.Id != s.NodeID {
+		conn.target(node.Name, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+
+	if err := socksReply(conn, socksReplySucceeded); err != nil {
+		wsConn.Close()
+		conn.finish("client error: " + err.Error())
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// the client may already have sent data behind its request
+	s.Client.onWebSocket(wsConn, &bufferedConn{Conn: conn, reader: reader}, conn)
+}
+
+// handshake negotiates authentication and reads the CONNECT request
+func (s *SocksProxy) handshake(r *bufio.Reader, w io.Writer) (string, int, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", 0, err
+	}
+	if header[0] != socksVersion {
+		return "", 0, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", 0, err
+	}
+
+	want := byte(socksMethodNone)
+	if s.Username != "" {
+		want = socksMethodPassword
+	}
+	offered := false
+	for _, m := range methods {
+		if m == want {
+			offered = true
+		}
+	}
+	if !offered {
+		w.Write([]byte{socksVersion, socksMethodNoAccept})
+		return "", 0, errors.New("client did not offer an acceptable authentication method")
+	}
+	if _, err := w.Write([]byte{socksVersion, want}); err != nil {
+		return "", 0, err
+	}
+
+	if want == socksMethodPassword {
+		if err := s.authenticate(r, w); err != nil {
+			return "", 0, err
+		}
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(r, request); err != nil {
+		return "", 0, err
+	}
+	if request[1] != socksCmdConnect {
+		socksReply(w, socksReplyCmdNotSupported)
+		return "", 0, fmt.Errorf("unsupported SOCKS command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		size := net.IPv4len
+		if request[3] == socksAtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		size, err := r.ReadByte()
+		if err != nil {
+			return "", 0, err
+		}
+		name := make([]byte, size)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", 0, err
+		}
+		host = string(name)
+	default:
+		socksReply(w, socksReplyAtypUnsupported)
+		return "", 0, fmt.Errorf("unsupported SOCKS address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(port)), nil
+}
+
+// authenticate runs the username/password sub negotiation
+func (s *SocksProxy) authenticate(r *bufio.Reader, w io.Writer) error {
+	version, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != 0x01 {
+		return fmt.Errorf("unsupported SOCKS auth version %d", version)
+	}
+
+	readField := func() ([]byte, error) {
+		size, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		field := make([]byte, size)
+		_, err = io.ReadFull(r, field)
+		return field, err
+	}
+	username, err := readField()
+	if err != nil {
+		return err
+	}
+	password, err := readField()
+	if err != nil {
+		return err
+	}
+
+	userOK := subtle.ConstantTimeCompare(username, []byte(s.Username)) == 1
+	passOK := subtle.ConstantTimeCompare(password, []byte(s.Password)) == 1
+	if !userOK || !passOK {
+		w.Write([]byte{0x01, socksReplyFailure})
+		return errors.New("invalid SOCKS credentials")
+	}
+	_, err = w.Write([]byte{0x01, socksReplySucceeded})
+	return err
+}
+
+// socksReply answers a request, the bound address is not meaningful for a
+// relayed connection so it is always 0.0.0.0:0
+func socksReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socksVersion, code, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// bufferedConn reads through a bufio.Reader that may already hold data
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
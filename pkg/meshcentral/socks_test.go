@@ -0,0 +1,182 @@
+package meshcentral
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/proxy"
+)
+
+// socksStep is something the SOCKS client sends and the answer it expects
+type socksStep struct {
+	send   []byte
+	expect []byte
+}
+
+func TestSocksHandshake(t *testing.T) {
+	var (
+		noAuth    = socksStep{[]byte{5, 1, 0}, []byte{5, 0}}
+		wantsAuth = socksStep{[]byte{5, 2, 0, 2}, []byte{5, 2}}
+		login     = socksStep{append(append([]byte{1, 3}, "bob"...), append([]byte{6}, "secret"...)...), []byte{1, 0}}
+		connectV4 = socksStep{[]byte{5, 1, 0, 1, 10, 0, 0, 5, 0x15, 0x38}, nil}
+		succeeded = []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	)
+	reply := func(code byte) []byte { return []byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0} }
+
+	tests := []struct {
+		name     string
+		username string
+		steps    []socksStep
+		host     string
+		port     int
+		err      string
+	}{
+		{"ipv4", "", []socksStep{noAuth, connectV4}, "10.0.0.5", 5432, ""},
+		{"ipv6", "", []socksStep{noAuth, {[]byte{5, 1, 0, 4, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 22}, nil}}, "fd00::1", 22, ""},
+		{"domain", "", []socksStep{noAuth, {append(append([]byte{5, 1, 0, 3, 12}, "intranet.lan"...), 1, 187), nil}}, "intranet.lan", 443, ""},
+		{"login", "bob", []socksStep{wantsAuth, login, connectV4}, "10.0.0.5", 5432, ""},
+		{"wrong password", "bob", []socksStep{wantsAuth, {append(append([]byte{1, 3}, "bob"...), append([]byte{5}, "guess"...)...), []byte{1, 1}}}, "", 0, "invalid SOCKS credentials"},
+		{"wrong user", "bob", []socksStep{wantsAuth, {append(append([]byte{1, 5}, "alice"...), append([]byte{6}, "secret"...)...), []byte{1, 1}}}, "", 0, "invalid SOCKS credentials"},
+		{"auth version", "bob", []socksStep{wantsAuth, {[]byte{2}, nil}}, "", 0, "unsupported SOCKS auth version 2"},
+		{"login not offered", "bob", []socksStep{{[]byte{5, 1, 0}, []byte{5, 0xff}}}, "", 0, "client did not offer an acceptable authentication method"},
+		{"no methods", "", []socksStep{{[]byte{5, 0}, []byte{5, 0xff}}}, "", 0, "client did not offer an acceptable authentication method"},
+		{"socks4", "", []socksStep{{[]byte{4, 1}, nil}}, "", 0, "unsupported SOCKS version 4"},
+		{"bind", "", []socksStep{noAuth, {[]byte{5, 2, 0, 1}, reply(socksReplyCmdNotSupported)}}, "", 0, "unsupported SOCKS command 2"},
+		{"address type", "", []socksStep{noAuth, {[]byte{5, 1, 0, 9}, reply(socksReplyAtypUnsupported)}}, "", 0, "unsupported SOCKS address type 9"},
+		{"cut short", "", []socksStep{noAuth, {[]byte{5, 1, 0, 1, 10, 0}, nil}}, "", 0, io.ErrUnexpectedEOF.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+
+			type result struct {
+				host string
+				port int
+				err  error
+			}
+			done := make(chan result, 1)
+			go func() {
+				defer server.Close()
+				s := &SocksProxy{Username: tt.username, Password: "secret"}
+				host, port, err := s.handshake(bufio.NewReader(server), server)
+				if err == nil {
+					err = socksReply(server, socksReplySucceeded)
+				}
+				done <- result{host, port, err}
+			}()
+
+			for _, step := range tt.steps {
+				if _, err := client.Write(step.send); err != nil {
+					t.Fatalf("sending %v: %v", step.send, err)
+				}
+				if step.expect == nil {
+					continue
+				}
+				got := make([]byte, len(step.expect))
+				if _, err := io.ReadFull(client, got); err != nil {
+					t.Fatalf("waiting for %v: %v", step.expect, err)
+				}
+				if !bytes.Equal(got, step.expect) {
+					t.Fatalf("after %v got %v, want %v", step.send, got, step.expect)
+				}
+			}
+			if tt.err == "" {
+				got := make([]byte, len(succeeded))
+				io.ReadFull(client, got)
+				if !bytes.Equal(got, succeeded) {
+					t.Errorf("reply = %v, want %v", got, succeeded)
+				}
+			}
+			client.Close()
+
+			r := <-done
+			switch {
+			case tt.err != "" && (r.err == nil || r.err.Error() != tt.err):
+				t.Errorf("handshake() error = %v, want %s", r.err, tt.err)
+			case tt.err == "" && r.err != nil:
+				t.Errorf("handshake() error = %v", r.err)
+			case r.host != tt.host || r.port != tt.port:
+				t.Errorf("handshake() = %s %d, want %s %d", r.host, r.port, tt.host, tt.port)
+			}
+		})
+	}
+}
+
+// relayTarget plays an agent that greets every relay with the target it was
+// asked for and echoes whatever comes next
+func relayTarget(conn *websocket.Conn, r *http.Request) {
+	query := r.URL.Query()
+	greeting := fmt.Sprintf("%s:%s via %s\n", query.Get("tcpaddr"), query.Get("tcpport"), query.Get("nodeid"))
+	if conn.WriteMessage(websocket.BinaryMessage, []byte(greeting)) != nil {
+		return
+	}
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if conn.WriteMessage(messageType, message) != nil {
+			return
+		}
+	}
+}
+
+func TestSocksProxyConnect(t *testing.T) {
+	client := startFakeServer(t, relayTarget)
+	policy := &NetworkPolicy{Deny: mustParseNetworks(t, "169.254.0.0/16")}
+	s := &SocksProxy{Client: client, NodeID: "node//gw", NodeName: "gw", Address: "127.0.0.1:0", Username: "bob", Password: "secret", Policy: policy}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	dialer, err := proxy.SOCKS5("tcp", s.Address, &proxy.Auth{User: "bob", Password: "secret"}, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dialer.Dial("tcp", "10.0.0.5:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	if greeting, _ := reader.ReadString('\n'); greeting != "10.0.0.5:5432 via node//gw\n" {
+		t.Errorf("relay opened for %q", greeting)
+	}
+	io.WriteString(conn, "ping\n")
+	if echo, _ := reader.ReadString('\n'); echo != "ping\n" {
+		t.Errorf("echo = %q", echo)
+	}
+
+	if _, err := dialer.Dial("tcp", "169.254.169.254:80"); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("dial to a denied network: %v", err)
+	}
+
+	wrong, _ := proxy.SOCKS5("tcp", s.Address, &proxy.Auth{User: "bob", Password: "guess"}, proxy.Direct)
+	if _, err := wrong.Dial("tcp", "10.0.0.5:5432"); err == nil {
+		t.Error("dial with a wrong password succeeded")
+	}
+}
+
+func mustParseNetworks(t *testing.T, values ...string) []*net.IPNet {
+	t.Helper()
+	networks, err := ParseNetworks(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return networks
+}
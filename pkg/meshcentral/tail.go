@@ -0,0 +1,117 @@
+package meshcentral
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"time"
+)
+
+// TailOptions controls TailFile
+type TailOptions struct {
+	Lines    int
+	Follow   bool
+	Interval time.Duration
+}
+
+// TailFile writes the last lines of a remote file to w over the files tunnel.
+// The agent can only send whole files, so following polls the size and
+// downloads the file again when it grows, skipping what was already written.
+func TailFile(files *FileSession, remotePath string, opts TailOptions, w io.Writer, stop <-chan struct{}) error {
+	var buf bytes.Buffer
+	if err := files.Download(remotePath, &buf, nil); err != nil {
+		return err
+	}
+	w.Write(lastLines(buf.Bytes(), opts.Lines))
+	offset := int64(buf.Len())
+
+	if !opts.Follow {
+		return nil
+	}
+
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-files.Done():
+			return ErrFilesClosed
+		case <-ticker.C:
+		}
+
+		entry, err := files.Stat(remotePath)
+		if os.IsNotExist(err) {
+			// rotated away, wait for it to come back
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if entry.Size < offset {
+			files.client.debugf("%s: file truncated", remotePath)
+			offset = 0
+		}
+		if entry.Size == offset {
+			continue
+		}
+
+		sw := &skipWriter{w: w, skip: offset}
+		if err := files.Download(remotePath, sw, nil); err != nil {
+			return err
+		}
+		offset += sw.written
+	}
+}
+
+// lastLines returns the final n lines of data
+func lastLines(data []byte, n int) []byte {
+	if n <= 0 {
+		return nil
+	}
+
+	end := len(data)
+	if end > 0 && data[end-1] == '\n' {
+		end--
+	}
+	for i := end - 1; i >= 0; i-- {
+		if data[i] == '\n' {
+			n--
+			if n == 0 {
+				return data[i+1:]
+			}
+		}
+	}
+	return data
+}
+
+// skipWriter drops the first skip bytes written to it
+type skipWriter struct {
+	w       io.Writer
+	skip    int64
+	written int64
+}
+
+func (s *skipWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if s.skip > 0 {
+		if int64(len(p)) <= s.skip {
+			s.skip -= int64(len(p))
+			return n, nil
+		}
+		p = p[s.skip:]
+		s.skip = 0
+	}
+	written, err := s.w.Write(p)
+	s.written += int64(written)
+	if err != nil {
+		return n, err
+	}
+	return n, nil
+}
@@ -0,0 +1,145 @@
+package meshcentral
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLastLines(t *testing.T) {
+	tests := []struct {
+		data string
+		n    int
+		want string
+	}{
+		{"a\nb\nc\n", 2, "b\nc\n"},
+		{"a\nb\nc", 2, "b\nc"},
+		{"a\nb\nc\n", 3, "a\nb\nc\n"},
+		{"a\nb\nc\n", 10, "a\nb\nc\n"},
+		{"a\nb\nc\n", 0, ""},
+		{"a\n\n\n", 2, "\n\n"},
+		{"", 5, ""},
+		{"no newline", 1, "no newline"},
+	}
+
+	for _, tt := range tests {
+		if got := string(lastLines([]byte(tt.data), tt.n)); got != tt.want {
+			t.Errorf("lastLines(%q, %d) = %q, want %q", tt.data, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestSkipWriter(t *testing.T) {
+	const data = "0123456789"
+
+	// wherever the download is split into writes, the same bytes come out
+	for skip := 0; skip <= len(data)+1; skip++ {
+		for split := 0; split <= len(data); split++ {
+			var out bytes.Buffer
+			w := &skipWriter{w: &out, skip: int64(skip)}
+			n1, _ := w.Write([]byte(data[:split]))
+			n2, _ := w.Write([]byte(data[split:]))
+
+			want := data[min(skip, len(data)):]
+			if out.String() != want || w.written != int64(len(want)) {
+				t.Errorf("skip %d split %d: wrote %q (%d), want %q", skip, split, out.String(), w.written, want)
+			}
+			if n1+n2 != len(data) {
+				t.Errorf("skip %d split %d: writes returned %d, want every byte", skip, split, n1+n2)
+			}
+		}
+	}
+}
+
+// chanWriter passes every write on to the test
+type chanWriter chan string
+
+func (c chanWriter) Write(p []byte) (int, error) {
+	c <- string(p)
+	return len(p), nil
+}
+
+// expect reads from the writer until it has seen want
+func (c chanWriter) expect(t *testing.T, want string) {
+	t.Helper()
+	var got strings.Builder
+	timeout := time.After(2 * time.Second)
+	for got.Len() < len(want) {
+		select {
+		case s := <-c:
+			got.WriteString(s)
+		case <-timeout:
+			t.Fatalf("got %q, want %q", got.String(), want)
+		}
+	}
+	if got.String() != want {
+		t.Fatalf("got %q, want %q", got.String(), want)
+	}
+}
+
+func TestTailFileFollow(t *testing.T) {
+	fs := newFakeFiles(map[string]string{"/var/log/app.log": "one\ntwo\nthree\n"})
+	files := openFakeFiles(t, fs)
+
+	out := make(chanWriter, 16)
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- TailFile(files, "/var/log/app.log", TailOptions{Lines: 2, Follow: true, Interval: 5 * time.Millisecond}, out, stop)
+	}()
+
+	out.expect(t, "two\nthree\n")
+
+	fs.write("/var/log/app.log", "one\ntwo\nthree\nfour\n")
+	out.expect(t, "four\n")
+
+	// a partial line is written as it arrives
+	fs.write("/var/log/app.log", "one\ntwo\nthree\nfour\nfi")
+	out.expect(t, "fi")
+	fs.write("/var/log/app.log", "one\ntwo\nthree\nfour\nfive\n")
+	out.expect(t, "ve\n")
+
+	// truncated, it starts over from the top
+	fs.write("/var/log/app.log", "new\n")
+	out.expect(t, "new\n")
+
+	// rotated away and back
+	fs.mu.Lock()
+	delete(fs.files, "/var/log/app.log")
+	fs.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	fs.write("/var/log/app.log", "new\nrotated\n")
+	out.expect(t, "rotated\n")
+
+	close(stop)
+	if err := <-done; err != nil {
+		t.Errorf("TailFile() after stop = %v", err)
+	}
+}
+
+func TestTailFileSessionCloses(t *testing.T) {
+	fs := newFakeFiles(map[string]string{"/var/log/app.log": "one\n"})
+	files := openFakeFiles(t, fs)
+
+	var out bytes.Buffer
+	if err := TailFile(files, "/var/log/app.log", TailOptions{Lines: 10}, &out, nil); err != nil || out.String() != "one\n" {
+		t.Fatalf("TailFile() without follow = %q, %v", out.String(), err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- TailFile(files, "/var/log/app.log", TailOptions{Lines: 10, Follow: true, Interval: time.Hour}, &bytes.Buffer{}, nil)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	files.Close()
+
+	select {
+	case err := <-done:
+		if err != ErrFilesClosed {
+			t.Errorf("TailFile() = %v, want ErrFilesClosed", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("TailFile() kept following a closed session")
+	}
+}
@@ -0,0 +1,234 @@
+package meshcentral
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// datagrams queued for a flow while its relay is still being opened
+const udpFlowQueue = 64
+
+// udpFlow is the relay for a single local client address. Every datagram
+// travels as one binary websocket message in either direction.
+type udpFlow struct {
+	addr    *net.UDPAddr
+	packets chan []byte
+	mu      sync.Mutex
+	active  time.Time
+	closed  bool
+	wsConn  *websocket.Conn
+}
+
+func (f *udpFlow) touch() {
+	f.mu.Lock()
+	f.active = time.Now()
+	f.mu.Unlock()
+}
+
+func (f *udpFlow) idle() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return time.Since(f.active)
+}
+
+func (f *udpFlow) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	f.closed = true
+	close(f.packets)
+	if f.wsConn != nil {
+		f.wsConn.Close()
+	}
+}
+
+// StartUdpForwards binds a UDP socket for every forward and relays each client
+// address over its own websocket until it has been idle for idleTimeout.
+// Nothing is relayed if any of the ports can't be bound. The relays are opened
+// with the Retry and Failover of the forward and shaped by its Limits.Rate,
+// the other Limits only apply to TCP.
+func (c *Client) StartUdpForwards(forwards []*Forward, idleTimeout time.Duration) error {
+	if idleTimeout <= 0 {
+		idleTimeout = time.Minute
+	}
+
+	var sockets []*net.UDPConn
+	for _, fwd := range forwards {
+		address := net.JoinHostPort(fwd.BindAddress, strconv.Itoa(fwd.LocalPort))
+		local, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			for _, s := range sockets {
+				s.Close()
+			}
+			return fmt.Errorf("invalid local UDP address %s: %w", address, err)
+		}
+		socket, err := net.ListenUDP("udp", local)
+		if err != nil {
+			for _, s := range sockets {
+				s.Close()
+			}
+			return fmt.Errorf("unable to bind to local UDP port %s: %w", address, err)
+		}
+		fwd.LocalPort = socket.LocalAddr().(*net.UDPAddr).Port
+		sockets = append(sockets, socket)
+	}
+
+	for i, fwd := range forwards {
+		fwd.client = c
+		fwd.addListener(sockets[i])
+		go fwd.serveUdp(sockets[i], idleTimeout)
+	}
+	return nil
+}
+
+func (fwd *Forward) serveUdp(socket *net.UDPConn, idleTimeout time.Duration) {
+	var mu sync.Mutex
+	flows := map[string]*udpFlow{}
+
+	remove := func(f *udpFlow) {
+		mu.Lock()
+		if flows[f.addr.String()] == f {
+			delete(flows, f.addr.String())
+			fwd.active.Add(-1)
+		}
+		mu.Unlock()
+		f.close()
+	}
+
+	stop := make(chan struct{})
+	defer func() {
+		close(stop)
+		mu.Lock()
+		var open []*udpFlow
+		for _, f := range flows {
+			open = append(open, f)
+		}
+		mu.Unlock()
+		for _, f := range open {
+			remove(f)
+		}
+	}()
+
+	// close flows nobody has used for a while
+	go func() {
+		ticker := time.NewTicker(idleTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			mu.Lock()
+			var expired []*udpFlow
+			for _, f := range flows {
+				if f.idle() > idleTimeout {
+					expired = append(expired, f)
+				}
+			}
+			mu.Unlock()
+			for _, f := range expired {
+				fwd.client.debugf("UDP flow from %s idle, closing", f.addr)
+				remove(f)
+			}
+		}
+	}()
+
+	var delay time.Duration
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := socket.ReadFromUDP(buf)
+		if err != nil {
+			if fwd.acceptFailed(fwd.client, err, &delay) {
+				return
+			}
+			continue
+		}
+		delay = 0
+
+		mu.Lock()
+		f, ok := flows[addr.String()]
+		if !ok {
+			f = &udpFlow{addr: addr, packets: make(chan []byte, udpFlowQueue), active: time.Now()}
+			flows[addr.String()] = f
+			fwd.active.Add(1)
+			fwd.total.Add(1)
+			go fwd.relayUdpFlow(socket, f, remove)
+		}
+		mu.Unlock()
+
+		packet := append([]byte(nil), buf[:n]...)
+		f.touch()
+		f.mu.Lock()
+		if !f.closed {
+			select {
+			case f.packets <- packet:
+				fwd.bytesOut.Add(int64(n))
+			default:
+				// like the network, drop what can't be delivered in time
+				fwd.client.debugf("UDP flow from %s congested, dropping datagram", addr)
+			}
+		}
+		f.mu.Unlock()
+	}
+}
+
+func (fwd *Forward) relayUdpFlow(socket *net.UDPConn, f *udpFlow, remove func(*udpFlow)) {
+	defer remove(f)
+
+	fwd.client.debugf("UDP flow from %s to %s", f.addr, fwd.NodeName)
+
+	wsConn, node, err := fwd.dialProtocol("udp")
+	if err != nil {
+		fwd.client.logf("Unable to connect to server: %v", err)
+		return
+	}
+	if node.Id != fwd.NodeID {
+		fwd.client.debugf("UDP flow from %s failed over to %s", f.addr, node.Name)
+	}
+	up, down := fwd.Limits.Rate.buckets()
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		wsConn.Close()
+		return
+	}
+	f.wsConn = wsConn
+	f.mu.Unlock()
+
+	// replies go back to the address that opened the flow
+	go func() {
+		defer remove(f)
+		for {
+			messageType, message, err := wsConn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if messageType != websocket.BinaryMessage || len(message) == 0 {
+				continue
+			}
+			f.touch()
+			down.wait(len(message))
+			fwd.bytesIn.Add(int64(len(message)))
+			if _, err := socket.WriteToUDP(message, f.addr); err != nil {
+				fwd.client.logf("UDP write error: %v", err)
+				return
+			}
+		}
+	}()
+
+	for packet := range f.packets {
+		up.wait(len(packet))
+		if err := wsConn.WriteMessage(websocket.BinaryMessage, packet); err != nil {
+			fwd.client.debugf("WebSocket write error: %v", err)
+			return
+		}
+	}
+}
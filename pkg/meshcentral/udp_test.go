@@ -0,0 +1,204 @@
+package meshcentral
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// udpRelay stands in for the server's UDP relays. The first fail requests
+// are answered with an error, the relays after that echo every datagram.
+type udpRelay struct {
+	mu    sync.Mutex
+	fail  int
+	nodes []string
+}
+
+func (u *udpRelay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	u.nodes = append(u.nodes, r.URL.Query().Get("nodeid"))
+	failing := u.fail > 0
+	u.fail--
+	u.mu.Unlock()
+
+	if failing || r.URL.Query().Get("udpport") == "" {
+		http.Error(w, "agent not connected", http.StatusServiceUnavailable)
+		return
+	}
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if conn.WriteMessage(messageType, message) != nil {
+			return
+		}
+	}
+}
+
+// requests lists the nodes the relays were requested for
+func (u *udpRelay) requests() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.nodes...)
+}
+
+// startUdpForward starts fwd through relay and returns a socket connected to
+// it. Flows close after a minute without traffic.
+func startUdpForward(t *testing.T, relay *udpRelay, offline []string, fwd *Forward) *net.UDPConn {
+	return startIdleUdpForward(t, relay, offline, fwd, time.Minute)
+}
+
+func startIdleUdpForward(t *testing.T, relay *udpRelay, offline []string, fwd *Forward, idleTimeout time.Duration) *net.UDPConn {
+	t.Helper()
+	server := httptest.NewServer(relay)
+	t.Cleanup(server.Close)
+
+	client := &Client{
+		serverURL: "ws://" + strings.TrimPrefix(server.URL, "http://") + "/meshrelay.ashx",
+		done:      make(chan struct{}),
+		nodeConn:  map[string]int{},
+	}
+	for _, node := range offline {
+		client.nodeConn[node] = 0
+	}
+
+	fwd.BindAddress, fwd.RemotePort = "127.0.0.1", 53
+	if err := client.StartUdpForwards([]*Forward{fwd}, idleTimeout); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fwd.Close() })
+
+	return dialUdpForward(t, fwd)
+}
+
+// dialUdpForward returns a new socket connected to fwd, a flow of its own
+func dialUdpForward(t *testing.T, fwd *Forward) *net.UDPConn {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: fwd.LocalPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// echo sends the datagrams and reads them back
+func echo(t *testing.T, conn *net.UDPConn, datagrams ...[]byte) {
+	t.Helper()
+	for _, d := range datagrams {
+		if _, err := conn.Write(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 65535)
+	for _, d := range datagrams {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], d) {
+			t.Fatalf("got a %d byte datagram back, want %d bytes", n, len(d))
+		}
+	}
+}
+
+func TestUdpForwardRetries(t *testing.T) {
+	relay := &udpRelay{fail: 2}
+	fwd := &Forward{NodeID: "node//dns01", NodeName: "dns01", Retry: Retry{Attempts: 2, Backoff: 10 * time.Millisecond}}
+	conn := startUdpForward(t, relay, nil, fwd)
+
+	echo(t, conn, []byte("query"))
+	if nodes := relay.requests(); len(nodes) != 3 {
+		t.Errorf("relay was requested %d times, want 3", len(nodes))
+	}
+}
+
+func TestUdpForwardGivesUp(t *testing.T) {
+	relay := &udpRelay{fail: 3}
+	fwd := &Forward{NodeID: "node//dns01", NodeName: "dns01", Retry: Retry{Attempts: 1, Backoff: 10 * time.Millisecond}}
+	conn := startUdpForward(t, relay, nil, fwd)
+
+	conn.Write([]byte("query"))
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 16)); err == nil {
+		t.Error("got a reply through a relay that never opened")
+	}
+	if nodes := relay.requests(); len(nodes) != 2 {
+		t.Errorf("relay was requested %d times, want 2", len(nodes))
+	}
+}
+
+func TestUdpForwardFailover(t *testing.T) {
+	relay := &udpRelay{}
+	fwd := &Forward{
+		NodeID:   "node//dns01",
+		NodeName: "dns01",
+		Failover: []Device{{Id: "node//dns02", Name: "dns02"}},
+	}
+	conn := startUdpForward(t, relay, []string{"node//dns01"}, fwd)
+
+	echo(t, conn, []byte("query"))
+	if nodes := relay.requests(); len(nodes) != 1 || nodes[0] != "node//dns02" {
+		t.Errorf("relays were opened through %v, want node//dns02", nodes)
+	}
+}
+
+func TestUdpForwardRate(t *testing.T) {
+	// the first 32K of either direction are a burst, the rest is shaped
+	fwd := &Forward{NodeID: "node//dns01", NodeName: "dns01", Limits: Limits{Rate: NewRateLimit(64<<10, false)}}
+	conn := startUdpForward(t, &udpRelay{}, nil, fwd)
+
+	datagram := bytes.Repeat([]byte{'x'}, 16<<10)
+	start := time.Now()
+	echo(t, conn, datagram, datagram, datagram, datagram)
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("64K went through a 64K/s limit in %v, want about half a second", elapsed)
+	}
+}
+
+func TestUdpForwardFlows(t *testing.T) {
+	relay := &udpRelay{}
+	fwd := &Forward{NodeID: "node//dns01", NodeName: "dns01"}
+	first := startIdleUdpForward(t, relay, nil, fwd, 100*time.Millisecond)
+	second := dialUdpForward(t, fwd)
+
+	// every source address gets a relay of its own, which carries all of its
+	// datagrams
+	echo(t, first, []byte("one"), []byte("two"))
+	echo(t, second, []byte("three"))
+	echo(t, first, []byte("four"))
+	if n := len(relay.requests()); n != 2 {
+		t.Errorf("%d relays for two sources, want 2", n)
+	}
+	if active, total := fwd.active.Load(), fwd.total.Load(); active != 2 || total != 2 {
+		t.Errorf("%d active of %d flows, want 2 of 2", active, total)
+	}
+
+	// idle flows are closed and the next datagram opens a new one
+	deadline := time.Now().Add(2 * time.Second)
+	for fwd.active.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if active := fwd.active.Load(); active != 0 {
+		t.Fatalf("%d flows still open after the idle timeout", active)
+	}
+	echo(t, first, []byte("five"))
+	if n := len(relay.requests()); n != 3 {
+		t.Errorf("%d relays after the flow was reopened, want 3", n)
+	}
+}
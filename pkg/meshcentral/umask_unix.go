@@ -0,0 +1,9 @@
+//go:build !windows
+
+package meshcentral
+
+import "syscall"
+
+func umask(mask int) int {
+	return syscall.Umask(mask)
+}
@@ -0,0 +1,450 @@
+package meshcentral
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// how long directory listings are reused before asking the agent again
+const webdavListTTL = 2 * time.Second
+
+// NewWebDAVHandler serves the filesystem of the node below root over WebDAV.
+// An empty root on a windows agent exposes the drives as top level folders.
+// The files session is reopened if the agent drops it.
+//
+// The handler has no authentication. address is where it listens, requests
+// must name it in their Host header, an IP address or localhost with its
+// port will do too, which keeps DNS rebinding out. sources are the client
+// networks allowed besides loopback, an empty list allows everyone.
+func NewWebDAVHandler(c *Client, nodeID string, root string, address string, sources []*net.IPNet) (http.Handler, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	files, err := c.OpenFiles(nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webdavGuard{
+		client:  c,
+		host:    host,
+		port:    port,
+		sources: sources,
+		handler: &webdav.Handler{
+			FileSystem: &remoteFS{client: c, nodeID: nodeID, files: files, root: root, lists: map[string]cachedList{}},
+			LockSystem: webdav.NewMemLS(),
+			Logger: func(r *http.Request, err error) {
+				c.debugf("WebDAV %s %s %v", r.Method, r.URL.Path, err)
+			},
+		},
+	}, nil
+}
+
+// webdavGuard refuses the requests that aren't meant for the WebDAV server
+type webdavGuard struct {
+	client  *Client
+	host    string
+	port    string
+	sources []*net.IPNet
+	handler http.Handler
+}
+
+func (g *webdavGuard) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr)
+	limits := Limits{Sources: g.sources}
+	if err != nil || !limits.permitsSource(addr) {
+		g.client.debugf("WebDAV refused %s", req.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if !g.permitsHost(req.Host) {
+		g.client.debugf("WebDAV refused host %q from %s", req.Host, req.RemoteAddr)
+		http.Error(w, "forbidden host", http.StatusForbidden)
+		return
+	}
+	g.handler.ServeHTTP(w, req)
+}
+
+// permitsHost checks the Host header of a request against the listen address
+func (g *webdavGuard) permitsHost(hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, "80"
+	}
+	if port != g.port {
+		return false
+	}
+	return strings.EqualFold(host, g.host) || strings.EqualFold(host, "localhost") || net.ParseIP(host) != nil
+}
+
+type cachedList struct {
+	entries []FileEntry
+	at      time.Time
+}
+
+// remoteFS implements webdav.FileSystem on top of a files session
+type remoteFS struct {
+	client *Client
+	nodeID string
+	root   string
+
+	mu    sync.Mutex
+	files *FileSession
+	lists map[string]cachedList
+}
+
+// session returns the files session, reconnecting when it was closed
+func (r *remoteFS) session() (*FileSession, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	select {
+	case <-r.files.Done():
+		r.client.debugf("Files session closed, reconnecting")
+		files, err := r.client.OpenFiles(r.nodeID)
+		if err != nil {
+			return nil, err
+		}
+		r.files = files
+		r.lists = map[string]cachedList{}
+	default:
+	}
+	return r.files, nil
+}
+
+// remotePath maps a slash separated WebDAV name onto the agent's filesystem
+func (r *remoteFS) remotePath(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if r.root == "" {
+		return name
+	}
+	if name == "" {
+		return r.root
+	}
+	if strings.Contains(r.root, `\`) {
+		name = strings.ReplaceAll(name, "/", `\`)
+	}
+	return JoinRemotePath(r.root, name)
+}
+
+func (r *remoteFS) list(dir string) ([]FileEntry, error) {
+	r.mu.Lock()
+	cached, ok := r.lists[dir]
+	r.mu.Unlock()
+	if ok && time.Since(cached.at) < webdavListTTL {
+		return cached.entries, nil
+	}
+
+	files, err := r.session()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := files.List(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.lists[dir] = cachedList{entries: entries, at: time.Now()}
+	r.mu.Unlock()
+	return entries, nil
+}
+
+// forget drops the cached listing of the directory holding p
+func (r *remoteFS) forget(p string) {
+	dir, _ := SplitRemotePath(p)
+	r.mu.Lock()
+	delete(r.lists, dir)
+	delete(r.lists, p)
+	r.mu.Unlock()
+}
+
+func (r *remoteFS) stat(p string) (*FileEntry, error) {
+	dir, name := SplitRemotePath(p)
+	if name == "" || p == r.root {
+		return &FileEntry{Name: "/", Type: FileTypeDir}, nil
+	}
+
+	entries, err := r.list(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Name == name || (isWindowsPath(p) && strings.EqualFold(e.Name, name)) {
+			return &e, nil
+		}
+	}
+	return nil, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+}
+
+func (r *remoteFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	files, err := r.session()
+	if err != nil {
+		return err
+	}
+
+	p := r.remotePath(name)
+	defer r.forget(p)
+	return files.Mkdir(p)
+}
+
+func (r *remoteFS) RemoveAll(ctx context.Context, name string) error {
+	files, err := r.session()
+	if err != nil {
+		return err
+	}
+
+	p := r.remotePath(name)
+	defer r.forget(p)
+
+	dir, base := SplitRemotePath(p)
+	return files.Remove(dir, []string{base}, true)
+}
+
+func (r *remoteFS) Rename(ctx context.Context, oldName string, newName string) error {
+	files, err := r.session()
+	if err != nil {
+		return err
+	}
+
+	oldPath, newPath := r.remotePath(oldName), r.remotePath(newName)
+	defer r.forget(oldPath)
+	defer r.forget(newPath)
+
+	oldDir, oldBase := SplitRemotePath(oldPath)
+	newDir, newBase := SplitRemotePath(newPath)
+
+	if oldDir != newDir {
+		if err := files.Move(oldDir, newDir, []string{oldBase}); err != nil {
+			return err
+		}
+	}
+	if oldBase != newBase {
+		return files.Rename(newDir, oldBase, newBase)
+	}
+	return nil
+}
+
+func (r *remoteFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	entry, err := r.stat(r.remotePath(name))
+	if err != nil {
+		return nil, err
+	}
+	return remoteFileInfo{*entry}, nil
+}
+
+func (r *remoteFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	p := r.remotePath(name)
+
+	entry, err := r.stat(p)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if entry == nil && flag&os.O_CREATE == 0 {
+		return nil, err
+	}
+	if entry != nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrExist}
+	}
+
+	f := &remoteFile{fs: r, path: p, entry: entry, flag: flag}
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		f.dirty = true
+	}
+	if entry == nil {
+		_, base := SplitRemotePath(p)
+		f.entry = &FileEntry{Name: base, Type: FileTypeFile, Date: time.Now().UTC().Format(time.RFC3339)}
+		f.dirty = true
+	}
+	return f, nil
+}
+
+// remoteFile buffers file contents in a local temporary file. Reads download
+// the file on first use, writes are uploaded again when the file is closed.
+type remoteFile struct {
+	fs    *remoteFS
+	path  string
+	entry *FileEntry
+	flag  int
+
+	tmp   *os.File
+	dirty bool
+
+	entries []FileEntry
+	listed  bool
+}
+
+// load makes sure the temporary copy exists, downloading it unless the file
+// is new or being truncated
+func (f *remoteFile) load() error {
+	if f.tmp != nil {
+		return nil
+	}
+	if f.entry.IsDir() {
+		return &os.PathError{Op: "read", Path: f.path, Err: fs.ErrInvalid}
+	}
+
+	tmp, err := os.CreateTemp("", "mcc-webdav-*")
+	if err != nil {
+		return err
+	}
+	os.Remove(tmp.Name())
+	f.tmp = tmp
+
+	if f.dirty || f.flag&os.O_TRUNC != 0 {
+		f.dirty = true
+		return nil
+	}
+
+	files, err := f.fs.session()
+	if err != nil {
+		return err
+	}
+	if err := files.Download(f.path, tmp, nil); err != nil {
+		return err
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	return err
+}
+
+func (f *remoteFile) Read(p []byte) (int, error) {
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	return f.tmp.Read(p)
+}
+
+func (f *remoteFile) Seek(offset int64, whence int) (int64, error) {
+	// seeking to the end only needs the size, which keeps directory
+	// listings and HEAD requests from downloading anything
+	if f.tmp == nil && whence == io.SeekEnd && offset == 0 {
+		return f.entry.Size, nil
+	}
+	if f.tmp == nil && whence == io.SeekStart && offset == 0 {
+		return 0, nil
+	}
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	return f.tmp.Seek(offset, whence)
+}
+
+func (f *remoteFile) Write(p []byte) (int, error) {
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: f.path, Err: fs.ErrPermission}
+	}
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	f.dirty = true
+	return f.tmp.Write(p)
+}
+
+func (f *remoteFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if !f.entry.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: f.path, Err: fs.ErrInvalid}
+	}
+	if !f.listed {
+		entries, err := f.fs.list(f.path)
+		if err != nil {
+			return nil, err
+		}
+		f.entries = entries
+		f.listed = true
+	}
+
+	n := len(f.entries)
+	if count > 0 && count < n {
+		n = count
+	}
+	if count > 0 && n == 0 {
+		return nil, io.EOF
+	}
+
+	infos := make([]fs.FileInfo, 0, n)
+	for _, e := range f.entries[:n] {
+		infos = append(infos, remoteFileInfo{e})
+	}
+	f.entries = f.entries[n:]
+	return infos, nil
+}
+
+func (f *remoteFile) Stat() (fs.FileInfo, error) {
+	entry := *f.entry
+	if f.tmp != nil {
+		if st, err := f.tmp.Stat(); err == nil {
+			entry.Size = st.Size()
+		}
+	}
+	return remoteFileInfo{entry}, nil
+}
+
+func (f *remoteFile) Close() error {
+	if f.tmp == nil && f.dirty {
+		// a new empty file still has to be created on the agent
+		if err := f.load(); err != nil {
+			return err
+		}
+	}
+	if f.tmp == nil {
+		return nil
+	}
+	defer f.tmp.Close()
+
+	if !f.dirty {
+		return nil
+	}
+	defer f.fs.forget(f.path)
+
+	if _, err := f.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	files, err := f.fs.session()
+	if err != nil {
+		return err
+	}
+	dir, name := SplitRemotePath(f.path)
+	return files.Upload(f.tmp, dir, name, nil)
+}
+
+// remoteFileInfo adapts a FileEntry to fs.FileInfo
+type remoteFileInfo struct {
+	entry FileEntry
+}
+
+func (i remoteFileInfo) Name() string       { return i.entry.Name }
+func (i remoteFileInfo) Size() int64        { return i.entry.Size }
+func (i remoteFileInfo) ModTime() time.Time { return i.entry.ModTime() }
+func (i remoteFileInfo) IsDir() bool        { return i.entry.IsDir() }
+func (i remoteFileInfo) Sys() interface{}   { return nil }
+
+func (i remoteFileInfo) Mode() fs.FileMode {
+	if i.IsDir() {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ContentType is picked up by the webdav package so it does not download
+// every file in a listing to sniff its type
+func (i remoteFileInfo) ContentType(ctx context.Context) (string, error) {
+	if i.IsDir() {
+		return "", webdav.ErrNotImplemented
+	}
+	if t := mime.TypeByExtension(path.Ext(i.entry.Name)); t != "" {
+		return t, nil
+	}
+	return "application/octet-stream", nil
+}
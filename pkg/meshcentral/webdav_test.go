@@ -0,0 +1,153 @@
+package meshcentral
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebDAVGuard(t *testing.T) {
+	office, err := ParseNetworks([]string{"192.168.1.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMultiStatus)
+	})
+
+	loopback := &webdavGuard{client: &Client{}, host: "127.0.0.1", port: "8081", handler: served}
+	lan := &webdavGuard{client: &Client{}, host: "0.0.0.0", port: "8081", sources: office, handler: served}
+
+	tests := []struct {
+		name   string
+		guard  *webdavGuard
+		remote string
+		host   string
+		want   int
+	}{
+		{"listen address", loopback, "127.0.0.1:50000", "127.0.0.1:8081", http.StatusMultiStatus},
+		{"localhost", loopback, "127.0.0.1:50000", "localhost:8081", http.StatusMultiStatus},
+		{"localhost upper case", loopback, "127.0.0.1:50000", "LOCALHOST:8081", http.StatusMultiStatus},
+		{"ipv6 loopback", loopback, "[::1]:50000", "[::1]:8081", http.StatusMultiStatus},
+		{"rebound name", loopback, "127.0.0.1:50000", "attacker.example.com:8081", http.StatusForbidden},
+		{"other port", loopback, "127.0.0.1:50000", "127.0.0.1:80", http.StatusForbidden},
+		{"no port", loopback, "127.0.0.1:50000", "127.0.0.1", http.StatusForbidden},
+		{"allowed network", lan, "192.168.1.20:50000", "192.168.1.5:8081", http.StatusMultiStatus},
+		{"other network", lan, "10.9.9.9:50000", "192.168.1.5:8081", http.StatusForbidden},
+		{"allowed network rebound name", lan, "192.168.1.20:50000", "files.example.com:8081", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("PROPFIND", "/", nil)
+			req.RemoteAddr, req.Host = tt.remote, tt.host
+			rec := httptest.NewRecorder()
+			tt.guard.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemotePath(t *testing.T) {
+	tests := []struct {
+		root, name, want string
+	}{
+		{"/", "/", "/"},
+		{"/", "/etc/hosts", "/etc/hosts"},
+		{"/srv/www", "/", "/srv/www"},
+		{"/srv/www", "/index.html", "/srv/www/index.html"},
+		{"/srv/www", "/css/", "/srv/www/css"},
+		// names can't climb out of the root
+		{"/srv/www", "/../../etc/passwd", "/srv/www/etc/passwd"},
+		{"/srv/www", "a/./b/../c", "/srv/www/a/c"},
+		{`C:\Users`, "/admin/notes.txt", `C:\Users\admin\notes.txt`},
+		// without a root a windows agent's drives are the top folders
+		{"", "/", ""},
+		{"", "/C:", "C:"},
+		{"", "/C:/Users", "C:/Users"},
+	}
+
+	for _, tt := range tests {
+		r := &remoteFS{root: tt.root}
+		if got := r.remotePath(tt.name); got != tt.want {
+			t.Errorf("root %q: remotePath(%q) = %q, want %q", tt.root, tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestWebDAVServer drives the handler with plain HTTP requests like a WebDAV
+// client would, against the in-memory files agent
+func TestWebDAVServer(t *testing.T) {
+	fs := newFakeFiles(map[string]string{
+		"/srv/www/index.html": "<h1>hi</h1>",
+		"/etc/passwd":         "root:x:0:0\n",
+	})
+	client := startFakeServer(t, fs.serve)
+
+	server := httptest.NewUnstartedServer(nil)
+	handler, err := NewWebDAVHandler(client, "node//web01", "/srv/www", server.Listener.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Config.Handler = handler
+	server.Start()
+	defer server.Close()
+
+	do := func(method string, name string, body string, header ...string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+name, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	if code, body := do("GET", "/index.html", ""); code != http.StatusOK || body != "<h1>hi</h1>" {
+		t.Errorf("GET /index.html = %d %q", code, body)
+	}
+	if code, _ := do("GET", "/../../etc/passwd", ""); code != http.StatusNotFound {
+		t.Errorf("GET outside the root = %d, want 404", code)
+	}
+
+	if code, _ := do("MKCOL", "/css", ""); code != http.StatusCreated {
+		t.Errorf("MKCOL /css = %d", code)
+	}
+	if code, _ := do("PUT", "/css/site.css", "body { color: red }"); code != http.StatusCreated {
+		t.Errorf("PUT /css/site.css = %d", code)
+	}
+	if got, _ := fs.content("/srv/www/css/site.css"); got != "body { color: red }" {
+		t.Errorf("agent has %q after PUT", got)
+	}
+
+	code, body := do("PROPFIND", "/css/", "", "Depth", "1")
+	if code != http.StatusMultiStatus || !strings.Contains(body, "/css/site.css") {
+		t.Errorf("PROPFIND /css/ = %d %s", code, body)
+	}
+
+	if code, _ := do("MOVE", "/css/site.css", "", "Destination", server.URL+"/style.css"); code != http.StatusCreated {
+		t.Errorf("MOVE = %d", code)
+	}
+	if got, ok := fs.content("/srv/www/style.css"); !ok || got != "body { color: red }" {
+		t.Errorf("agent has %q after MOVE", got)
+	}
+
+	if code, _ := do("DELETE", "/css", ""); code != http.StatusNoContent {
+		t.Errorf("DELETE /css = %d", code)
+	}
+	if code, _ := do("GET", "/css/site.css", ""); code != http.StatusNotFound {
+		t.Errorf("GET of a deleted file = %d", code)
+	}
+}